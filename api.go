@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/webrtc/v4"
+)
+
+// Shared WebRTC API, built in main once the configuration is known
+var webrtcAPI *webrtc.API
+
+// codecSpec is one entry of the codecs the server negotiates, mirroring pion's
+// defaults plus H.265. Video codecs are paired with an RTX stream on rtxPayloadType.
+type codecSpec struct {
+	kind           webrtc.RTPCodecType
+	mimeType       string
+	clockRate      uint32
+	channels       uint16
+	fmtp           string
+	payloadType    webrtc.PayloadType
+	rtxPayloadType webrtc.PayloadType
+}
+
+var supportedCodecs = []codecSpec{
+	{webrtc.RTPCodecTypeAudio, webrtc.MimeTypeOpus, 48000, 2, "minptime=10;useinbandfec=1", 111, 0},
+	{webrtc.RTPCodecTypeAudio, webrtc.MimeTypeG722, 8000, 0, "", 9, 0},
+	{webrtc.RTPCodecTypeAudio, webrtc.MimeTypePCMU, 8000, 0, "", 0, 0},
+	{webrtc.RTPCodecTypeAudio, webrtc.MimeTypePCMA, 8000, 0, "", 8, 0},
+
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeVP8, 90000, 0, "", 96, 97},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", 102, 103},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", 104, 105},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", 106, 107},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", 108, 109},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f", 127, 125},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f", 39, 40},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeAV1, 90000, 0, "", 45, 46},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeVP9, 90000, 0, "profile-id=0", 98, 99},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeVP9, 90000, 0, "profile-id=2", 100, 101},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f", 112, 113},
+	{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH265, 90000, 0, "", 116, 117},
+}
+
+// canonicalCodec maps a MIME type such as "video/vp8", or a bare name such as
+// "vp8", to the form pion uses, reporting whether the server supports it
+func canonicalCodec(name string) (string, bool) {
+	for _, codec := range supportedCodecs {
+		_, subtype, _ := strings.Cut(codec.mimeType, "/")
+		if strings.EqualFold(name, codec.mimeType) || strings.EqualFold(name, subtype) {
+			return codec.mimeType, true
+		}
+	}
+	return "", false
+}
+
+// codecAllowed reports whether mimeType may be negotiated; an empty allow list permits every codec
+func codecAllowed(allowed []string, mimeType string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, codec := range allowed {
+		if strings.EqualFold(codec, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerCodecs registers the supported codecs that are allowed, with the
+// same feedback as pion's defaults less NACK when -nack is off
+func registerCodecs(mediaEngine *webrtc.MediaEngine, allowed []string) error {
+	videoRTCPFeedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}}
+	if config.NACK {
+		videoRTCPFeedback = append(videoRTCPFeedback, webrtc.RTCPFeedback{Type: "nack"})
+	}
+	videoRTCPFeedback = append(videoRTCPFeedback, webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"})
+	for _, codec := range supportedCodecs {
+		if !codecAllowed(allowed, codec.mimeType) {
+			continue
+		}
+		params := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    codec.mimeType,
+				ClockRate:   codec.clockRate,
+				Channels:    codec.channels,
+				SDPFmtpLine: codec.fmtp,
+			},
+			PayloadType: codec.payloadType,
+		}
+		if codec.kind == webrtc.RTPCodecTypeVideo {
+			params.RTCPFeedback = videoRTCPFeedback
+		}
+		if err := mediaEngine.RegisterCodec(params, codec.kind); err != nil {
+			return err
+		}
+
+		if codec.rtxPayloadType == 0 {
+			continue
+		}
+		rtx := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeRTX,
+				ClockRate:   codec.clockRate,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", codec.payloadType),
+			},
+			PayloadType: codec.rtxPayloadType,
+		}
+		if err := mediaEngine.RegisterCodec(rtx, codec.kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newAPI mirrors pion's default setup except for the NACK generator: recorded
+// tracks run their own (see nackGenerator), so only the responder is kept for
+// WHEP viewers. -nack, -twcc and -rtcp-reports leave out the interceptors
+// they switch off. The stats interceptor backs /stats (see newPeerConnection).
+func newAPI() (*webrtc.API, error) {
+	return newKeyLogAPI(nil)
+}
+
+// configureInterceptors adds the NACK responder, the RTCP report and the
+// TWCC interceptors to registry, each unless switched off by its flag. The
+// NACK and PLI feedback of the video codecs is registered by registerCodecs.
+func configureInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	if config.NACK {
+		responder, err := nack.NewResponderInterceptor()
+		if err != nil {
+			return err
+		}
+		registry.Add(responder)
+	}
+
+	if config.RTCPReports {
+		if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+			return err
+		}
+	}
+	if config.TWCC {
+		if err := webrtc.ConfigureTWCCSender(mediaEngine, registry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newKeyLogAPI is newAPI writing the keys of every DTLS handshake to keyLog,
+// if set, for -export-keys
+func newKeyLogAPI(keyLog io.Writer) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, config.Codecs); err != nil {
+		return nil, err
+	}
+	if err := registerHeaderExtensions(mediaEngine); err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if err := configureInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return nil, err
+	}
+	if err := configureStats(registry); err != nil {
+		return nil, err
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetReceiveMTU(uint(config.RTPBufferSize))
+	if role := dtlsRoles[config.DTLSRole]; role != webrtc.DTLSRoleAuto {
+		if err := settingEngine.SetAnsweringDTLSRole(role); err != nil {
+			return nil, err
+		}
+	}
+	if keyLog != nil {
+		settingEngine.SetDTLSKeyLogWriter(keyLog)
+	}
+	if err := configureICE(&settingEngine); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settingEngine),
+	), nil
+}
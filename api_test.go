@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCanonicalCodec(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{name: "video/VP8", want: webrtc.MimeTypeVP8, wantOK: true},
+		{name: "video/vp8", want: webrtc.MimeTypeVP8, wantOK: true},
+		{name: "h264", want: webrtc.MimeTypeH264, wantOK: true},
+		{name: "OPUS", want: webrtc.MimeTypeOpus, wantOK: true},
+		{name: "audio/PCMU", want: webrtc.MimeTypePCMU, wantOK: true},
+		{name: "video/theora"},
+		{name: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := canonicalCodec(tt.name)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("canonicalCodec(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCodecAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		mimeType string
+		want     bool
+	}{
+		{name: "no list", mimeType: webrtc.MimeTypeH264, want: true},
+		{name: "listed", allowed: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, mimeType: webrtc.MimeTypeOpus, want: true},
+		{name: "other case", allowed: []string{webrtc.MimeTypeVP8}, mimeType: "video/vp8", want: true},
+		{name: "not listed", allowed: []string{webrtc.MimeTypeVP8}, mimeType: webrtc.MimeTypeH264},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codecAllowed(tt.allowed, tt.mimeType); got != tt.want {
+				t.Errorf("codecAllowed(%v, %q) = %v, want %v", tt.allowed, tt.mimeType, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCodecRestriction publishes to a server limited by -codecs, from a
+// client offering only the codecs it publishes, and checks which tracks were
+// recorded
+func TestCodecRestriction(t *testing.T) {
+	tests := []struct {
+		name       string
+		codecs     []string
+		publish    []string
+		wantStatus int
+		// want are the extensions of the recorded files, in name order
+		want []string
+	}{
+		{
+			name:       "only an excluded codec",
+			codecs:     []string{webrtc.MimeTypeVP8},
+			publish:    []string{webrtc.MimeTypeH264},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "allowed codec",
+			codecs:     []string{webrtc.MimeTypeVP8},
+			publish:    []string{webrtc.MimeTypeVP8},
+			wantStatus: http.StatusCreated,
+			want:       []string{".webm"},
+		},
+		{
+			name:       "one of the allowed codecs",
+			codecs:     []string{webrtc.MimeTypeVP8, webrtc.MimeTypeH264},
+			publish:    []string{webrtc.MimeTypeH264},
+			wantStatus: http.StatusCreated,
+			want:       []string{".mp4"},
+		},
+		{
+			name:       "no restriction",
+			publish:    []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus},
+			wantStatus: http.StatusCreated,
+			want:       []string{".mp4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.Codecs = tt.codecs })
+			saved := webrtcAPI
+			t.Cleanup(func() { webrtcAPI = saved })
+			var err error
+			if webrtcAPI, err = newAPI(); err != nil {
+				t.Fatal(err)
+			}
+			base := startServer(t)
+			p := newCodecPublisher(t, tt.publish...)
+			resp, body := postOffer(t, base+"/whip/cam", p.pc, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("publish answered %d: %s, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if resp.StatusCode == http.StatusCreated {
+				p.location = resp.Header.Get("Location")
+				waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+				p.play(t, 500*time.Millisecond)
+				p.stop(t, base)
+			}
+
+			var got []string
+			paths, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range paths {
+				if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+					got = append(got, filepath.Ext(path))
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recorded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// publishTWCC is publishRTP from a publisher stamping its packets with the
+// transport-wide sequence numbers TWCC feedback is about, as browsers do
+func publishTWCC(t *testing.T, url string) (*webrtc.TrackLocalStaticRTP, *webrtc.RTPSender) {
+	t.Helper()
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		t.Fatal(err)
+	}
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	track, err := webrtc.NewTrackLocalStaticRTP(trackCapability(webrtc.MimeTypeVP8), "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := postOffer(t, url, pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	waitFor(t, "the publisher to connect", func() bool { return pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	return track, sender
+}
+
+// TestInterceptorFlags publishes a video track with a sequence gap to a
+// server with some of its interceptors switched off, and checks which kinds
+// of RTCP feedback the publisher gets over longer than a report interval
+func TestInterceptorFlags(t *testing.T) {
+	const window = 1500 * time.Millisecond
+	tests := []struct {
+		name                        string
+		nack, twcc, reports         bool
+		wantNACK, wantTWCC, wantRRs bool
+	}{
+		{name: "all", nack: true, twcc: true, reports: true, wantNACK: true, wantTWCC: true, wantRRs: true},
+		{name: "no NACK", twcc: true, reports: true, wantTWCC: true, wantRRs: true},
+		{name: "no TWCC", nack: true, reports: true, wantNACK: true, wantRRs: true},
+		{name: "no reports", nack: true, twcc: true, wantNACK: true, wantTWCC: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.NACK, c.TWCC, c.RTCPReports = tt.nack, tt.twcc, tt.reports })
+			saved := webrtcAPI
+			t.Cleanup(func() { webrtcAPI = saved })
+			var err error
+			if webrtcAPI, err = newAPI(); err != nil {
+				t.Fatal(err)
+			}
+			base := startServer(t)
+			track, sender := publishTWCC(t, base+"/whip/cam")
+
+			var (
+				mu                       sync.Mutex
+				gotNACK, gotTWCC, gotRRs bool
+			)
+			go func() {
+				for {
+					packets, _, err := sender.ReadRTCP()
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					for _, packet := range packets {
+						switch packet.(type) {
+						case *rtcp.TransportLayerNack:
+							gotNACK = true
+						case *rtcp.TransportLayerCC:
+							gotTWCC = true
+						case *rtcp.ReceiverReport:
+							gotRRs = true
+						}
+					}
+					mu.Unlock()
+				}
+			}()
+
+			// Packets 3 and 4 are lost
+			for seq, start := uint16(1), time.Now(); time.Since(start) < window; seq++ {
+				if seq != 3 && seq != 4 {
+					packet := &rtp.Packet{
+						Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+						Payload: append([]byte{0x10}, testVP8Interframe...),
+					}
+					if err := track.WriteRTP(packet); err != nil {
+						t.Fatal(err)
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if gotNACK != tt.wantNACK || gotTWCC != tt.wantTWCC || gotRRs != tt.wantRRs {
+				t.Errorf("got NACK %v, TWCC %v, receiver reports %v, want %v, %v, %v",
+					gotNACK, gotTWCC, gotRRs, tt.wantNACK, tt.wantTWCC, tt.wantRRs)
+			}
+		})
+	}
+}
+
+// TestRTCPFeedback checks an offer of the server's API lists each kind of
+// RTCP feedback of the video codecs once, NACK only with -nack
+func TestRTCPFeedback(t *testing.T) {
+	for _, nack := range []bool{true, false} {
+		t.Run(fmt.Sprintf("nack %v", nack), func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.NACK = nack })
+			api, err := newAPI()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+				t.Fatal(err)
+			}
+			offer, err := pc.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			feedback := map[string]int{}
+			for _, line := range strings.Split(offer.SDP, "\r\n") {
+				if value, ok := strings.CutPrefix(line, "a=rtcp-fb:"); ok {
+					feedback[strings.TrimSpace(value)]++
+				}
+			}
+			var gotNACK, gotPLI bool
+			for value, n := range feedback {
+				if n != 1 {
+					t.Errorf("offer lists a=rtcp-fb:%s %d times, want once", value, n)
+				}
+				_, fb, _ := strings.Cut(value, " ")
+				gotNACK = gotNACK || fb == "nack"
+				gotPLI = gotPLI || fb == "nack pli"
+			}
+			if gotNACK != nack || !gotPLI {
+				t.Errorf("offer has NACK %v and PLI %v, want %v and true\n%s", gotNACK, gotPLI, nack, offer.SDP)
+			}
+		})
+	}
+}
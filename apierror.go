@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// errorWriter answers a request with an error message and status, as
+// http.Error does in plain text for the WHIP and WHEP endpoints
+type errorWriter func(w http.ResponseWriter, message string, status int)
+
+// apiError is the JSON envelope of the errors answered by the admin
+// endpoints: /sessions, /stats and /ingest
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	// Code names the status in snake case, such as "not_found"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// allowMethods reports whether the request uses one of methods, answering
+// it 405 with an Allow header listing them otherwise
+func allowMethods(w http.ResponseWriter, r *http.Request, writeError errorWriter, methods ...string) bool {
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, "Invalid method", http.StatusMethodNotAllowed)
+	return false
+}
+
+// writeJSONError is the errorWriter of the admin endpoints
+func writeJSONError(w http.ResponseWriter, message string, status int) {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	if code == "" {
+		code = "error"
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(apiError{Error: apiErrorBody{Code: code, Message: message}})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestAdminErrors checks the admin endpoints answer errors with the JSON
+// envelope, and the SDP endpoints still in plain text
+func TestAdminErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		token       string
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{name: "unknown session stats", method: http.MethodGet, path: "/stats/missing", wantStatus: http.StatusNotFound, wantCode: "not_found", wantMessage: "Session not found"},
+		{name: "invalid ingest", method: http.MethodPost, path: "/ingest", body: `{"url": "ftp://example.com"}`, token: "secret", wantStatus: http.StatusBadRequest, wantCode: "bad_request", wantMessage: "Expected the http or https URL of a WHEP endpoint"},
+		{name: "sessions method", method: http.MethodDelete, path: "/sessions", wantStatus: http.StatusMethodNotAllowed, wantCode: "method_not_allowed", wantMessage: "Invalid method"},
+		{name: "unauthorized", method: http.MethodGet, path: "/sessions", token: "guess", wantStatus: http.StatusUnauthorized, wantCode: "unauthorized", wantMessage: "Unauthorized"},
+		{name: "WHIP stays plain text", method: http.MethodGet, path: "/whip", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.token != "" {
+				setConfig(t, func(c *Config) { c.Tokens = []string{"secret"} })
+			}
+			base := startServer(t)
+			req, err := http.NewRequest(tt.method, base+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("%s %s answered %d: %s, want %d", tt.method, tt.path, resp.StatusCode, data, tt.wantStatus)
+			}
+			if tt.wantCode == "" {
+				if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+					t.Errorf("Content-Type %q, want text/plain", contentType)
+				}
+				return
+			}
+
+			if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", contentType)
+			}
+			var got map[string]map[string]string
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("body %q isn't a JSON error: %v", data, err)
+			}
+			want := map[string]string{"code": tt.wantCode, "message": tt.wantMessage}
+			if len(got) != 1 || len(got["error"]) != 2 || got["error"]["code"] != want["code"] || got["error"]["message"] != want["message"] {
+				t.Errorf("body %s, want {\"error\": %v}", data, want)
+			}
+		})
+	}
+}
+
+// TestRouting checks unknown paths get 404, and methods a route doesn't take
+// 405 with the ones it does in the Allow header
+func TestRouting(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{name: "unknown path", method: http.MethodGet, path: "/unknown", wantStatus: http.StatusNotFound},
+		{name: "under no route", method: http.MethodPost, path: "/whipx/cam", wantStatus: http.StatusNotFound},
+		{name: "WHIP", method: http.MethodGet, path: "/whip", wantStatus: http.StatusMethodNotAllowed, wantAllow: "OPTIONS, POST"},
+		{name: "WHIP stream or resource", method: http.MethodPut, path: "/whip/cam", wantStatus: http.StatusMethodNotAllowed, wantAllow: "OPTIONS, POST, DELETE, PATCH"},
+		{name: "WHEP", method: http.MethodGet, path: "/whep/cam", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST, DELETE"},
+		{name: "ingest", method: http.MethodGet, path: "/ingest", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "sessions", method: http.MethodPost, path: "/sessions", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET"},
+		{name: "stats", method: http.MethodDelete, path: "/stats/0000", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET"},
+		{name: "snapshot", method: http.MethodPost, path: "/snapshot/cam", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET"},
+		{name: "HLS", method: http.MethodPost, path: "/hls/cam/playlist.m3u8", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "health", method: http.MethodDelete, path: "/healthz", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "allowed", method: http.MethodGet, path: "/healthz", wantStatus: http.StatusOK},
+	}
+	base := startServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, base+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("%s %s answered %d, want %d", tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if allow := resp.Header.Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("Allow %q, want %q", allow, tt.wantAllow)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// registerHeaderExtensions negotiates the client-to-mixer audio level
+// (RFC 6464) on audio tracks and the absolute send time on video tracks
+func registerHeaderExtensions(mediaEngine *webrtc.MediaEngine) error {
+	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return err
+	}
+	return mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.ABSSendTimeURI}, webrtc.RTPCodecTypeVideo)
+}
+
+// headerExtensionID returns the id negotiated for the header extension uri on
+// the track of receiver, or 0 if the publisher didn't accept it
+func headerExtensionID(receiver *webrtc.RTPReceiver, uri string) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// parseAudioLevel returns the level of the audio in packet, in dBov from -127
+// to 0, and whether the publisher detected voice in it. ok is false if the
+// packet doesn't carry the extension id.
+func parseAudioLevel(packet *rtp.Packet, id uint8) (level int, voice, ok bool) {
+	payload := packet.GetExtension(id)
+	if payload == nil {
+		return 0, false, false
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(payload); err != nil {
+		return 0, false, false
+	}
+	return -int(ext.Level), ext.Voice, true
+}
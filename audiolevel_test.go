@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseAudioLevel(t *testing.T) {
+	const id = 1
+	tests := []struct {
+		name      string
+		ext       []byte
+		wantLevel int
+		wantVoice bool
+		wantOK    bool
+	}{
+		{"silence", []byte{127}, -127, false, true},
+		{"voice", []byte{0x80 | 30}, -30, true, true},
+		{"full scale", []byte{0x80}, 0, true, true},
+		{"no extension", nil, 0, false, false},
+		{"empty extension", []byte{}, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := &rtp.Packet{Header: rtp.Header{Version: 2}}
+			if tt.ext != nil {
+				if err := packet.SetExtension(id, tt.ext); err != nil {
+					t.Fatal(err)
+				}
+			}
+			level, voice, ok := parseAudioLevel(packet, id)
+			if level != tt.wantLevel || voice != tt.wantVoice || ok != tt.wantOK {
+				t.Errorf("parseAudioLevel = %d dBov, voice %v, ok %v, want %d dBov, voice %v, ok %v",
+					level, voice, ok, tt.wantLevel, tt.wantVoice, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestSessionAudioLevel publishes Opus packets carrying the audio level
+// extension and checks /sessions reports the last level
+func TestSessionAudioLevel(t *testing.T) {
+	base := startServer(t)
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, []string{webrtc.MimeTypeOpus}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerHeaderExtensions(mediaEngine); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	track, err := webrtc.NewTrackLocalStaticRTP(trackCapability(webrtc.MimeTypeOpus), "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+	resp, body := postOffer(t, base+"/whip/mic", pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Fatal("publisher did not connect")
+	}
+
+	var id uint8
+	for _, ext := range sender.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			id = uint8(ext.ID)
+		}
+	}
+	if id == 0 {
+		t.Fatal("audio level extension was not negotiated")
+	}
+
+	list := func() []sessionInfo {
+		resp, err := http.Get(base + "/sessions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list []sessionInfo
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	if got := list(); len(got) != 1 || got[0].AudioLevel != nil {
+		t.Fatalf("sessions %+v before any audio, want one without a level", got)
+	}
+
+	level := rtp.AudioLevelExtension{Level: 42, Voice: true}
+	payload, err := level.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq uint16
+	waitFor(t, "the audio level", func() bool {
+		seq++
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+			Payload: sample(webrtc.MimeTypeOpus, int(seq)).Data,
+		}
+		if err := packet.SetExtension(id, payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+		got := list()
+		return len(got) == 1 && got[0].AudioLevel != nil
+	})
+	if got := list()[0]; *got.AudioLevel != -42 || !got.Voice {
+		t.Errorf("audio level %d dBov, voice %v, want -42 dBov with voice", *got.AudioLevel, got.Voice)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// streamRight is what a request does with a stream
+type streamRight int
+
+const (
+	rightPublish streamRight = iota
+	rightPlay
+)
+
+// aclEntry grants a bearer token rights on some streams, as an item of the
+// acl list of a -config file:
+//
+//	acl:
+//	  - token: studio-secret
+//	    streams: [studio-a, studio-b]
+//	    publish: true
+//	  - token: player-secret
+//	    streams: ["*"]
+//	    play: true
+type aclEntry struct {
+	Token string `yaml:"token"`
+	// Streams are the stream keys granted; "*" grants every stream
+	Streams []string `yaml:"streams"`
+	Publish bool     `yaml:"publish"`
+	Play    bool     `yaml:"play"`
+}
+
+// allows reports whether the entry grants right on streamKey
+func (e *aclEntry) allows(streamKey string, right streamRight) bool {
+	if right == rightPublish && !e.Publish || right == rightPlay && !e.Play {
+		return false
+	}
+	return slices.Contains(e.Streams, "*") || slices.Contains(e.Streams, streamKey)
+}
+
+// validate reports why the entry can't be used
+func (e *aclEntry) validate() error {
+	if e.Token == "" {
+		return errors.New("token is empty")
+	}
+	if len(e.Streams) == 0 {
+		return errors.New("no streams")
+	}
+	for _, key := range e.Streams {
+		if key != "*" && !streamKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid stream key %q", key)
+		}
+	}
+	if !e.Publish && !e.Play {
+		return errors.New("grants neither publish nor play")
+	}
+	return nil
+}
+
+// validateACL checks every entry, and that no two share a token
+func validateACL(acl []aclEntry) error {
+	tokens := make(map[string]bool, len(acl))
+	for i, entry := range acl {
+		if err := entry.validate(); err != nil {
+			return fmt.Errorf("invalid acl entry %d: %w", i+1, err)
+		}
+		if tokens[entry.Token] {
+			return fmt.Errorf("invalid acl entry %d: token of an earlier entry", i+1)
+		}
+		tokens[entry.Token] = true
+	}
+	return nil
+}
+
+// authorized reports whether the request carries one of the configured bearer
+// tokens. Every request is allowed when no tokens are configured.
+func authorized(r *http.Request) bool {
+	if len(config.Tokens) == 0 || r.Method == http.MethodOptions {
+		return true
+	}
+	return hasValidToken(r)
+}
+
+// bearerToken returns the token of the request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+// hasValidToken reports whether the request carries one of the configured
+// bearer tokens, whatever its method
+func hasValidToken(r *http.Request) bool {
+	token, _ := bearerToken(r)
+	return validToken(token)
+}
+
+// validToken reports whether token is one of the configured bearer tokens
+func validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, valid := range config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(valid), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// aclEntryFor returns the ACL entry of the request's bearer token, or nil
+func aclEntryFor(r *http.Request) *aclEntry {
+	token, _ := bearerToken(r)
+	return aclEntryOf(token)
+}
+
+// aclEntryOf returns the ACL entry of token, or nil
+func aclEntryOf(token string) *aclEntry {
+	if token == "" {
+		return nil
+	}
+	for i := range config.ACL {
+		if subtle.ConstantTimeCompare([]byte(config.ACL[i].Token), []byte(token)) == 1 {
+			return &config.ACL[i]
+		}
+	}
+	return nil
+}
+
+// streamAuthRequired reports whether right takes a token: publishing once
+// -token or an ACL is configured, playing only once there is an ACL
+func streamAuthRequired(right streamRight) bool {
+	return len(config.ACL) > 0 || right == rightPublish && len(config.Tokens) > 0
+}
+
+// requireAuth rejects unauthorized requests with 401 and reports whether the handler may continue
+func requireAuth(w http.ResponseWriter, r *http.Request) bool {
+	return checkAuth(w, r, http.Error)
+}
+
+// requireAdminAuth is requireAuth for the admin endpoints, answering with a
+// JSON error. Only the -token tokens grant them, never those of the ACL.
+func requireAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	return checkAuth(w, r, writeJSONError)
+}
+
+// requireAdminToken is requireAdminAuth for the admin endpoints too
+// dangerous to leave open, refused with 403 unless a -token is configured
+func requireAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if len(config.Tokens) == 0 && r.Method != http.MethodOptions {
+		writeJSONError(w, "Needs a -token to be configured", http.StatusForbidden)
+		return false
+	}
+	return requireAdminAuth(w, r)
+}
+
+func checkAuth(w http.ResponseWriter, r *http.Request, writeError errorWriter) bool {
+	if authorized(r) {
+		return true
+	}
+	unauthorized(w, writeError)
+	return false
+}
+
+// requireStreamAuth authorizes a request to publish or play streamKey,
+// answering 401 without a known token and 403 if the token's ACL entry
+// doesn't grant right on the stream. The -token tokens grant every right on
+// every stream. Publishing takes a token once either is configured, playing
+// only once there is an ACL.
+func requireStreamAuth(w http.ResponseWriter, r *http.Request, streamKey string, right streamRight) bool {
+	if r.Method == http.MethodOptions {
+		return true
+	}
+	token, _ := bearerToken(r)
+	switch streamAccess(token, streamKey, right) {
+	case http.StatusUnauthorized:
+		unauthorized(w, http.Error)
+		return false
+	case http.StatusForbidden:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// streamAccess returns the status of a request carrying token, empty if
+// none, for right on streamKey: 200 if it may go on, else 401 or 403 as
+// requireStreamAuth answers
+func streamAccess(token, streamKey string, right streamRight) int {
+	if !streamAuthRequired(right) || validToken(token) {
+		return http.StatusOK
+	}
+	entry := aclEntryOf(token)
+	if entry == nil {
+		return http.StatusUnauthorized
+	}
+	if !entry.allows(streamKey, right) {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// requireResourceToken is requireAuth for the resources of publishes or
+// viewers whose stream is unknown, taking a token whenever right does and
+// also accepting the tokens of the ACL
+func requireResourceToken(w http.ResponseWriter, r *http.Request, right streamRight) bool {
+	if !streamAuthRequired(right) || hasValidToken(r) || aclEntryFor(r) != nil {
+		return true
+	}
+	unauthorized(w, http.Error)
+	return false
+}
+
+func unauthorized(w http.ResponseWriter, writeError errorWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="mediaserver"`)
+	writeError(w, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWHIPAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "missing header", status: http.StatusUnauthorized},
+		{name: "wrong token", token: "wrong", status: http.StatusUnauthorized},
+		{name: "valid token", token: "secret", status: http.StatusCreated},
+		{name: "second token", token: "other", status: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.Tokens = []string{"secret", "other"} })
+			base := startServer(t)
+			header := http.Header{}
+			if tt.token != "" {
+				header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			pc := newTestPeerConnection(t)
+			track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := pc.AddTrack(track); err != nil {
+				t.Fatal(err)
+			}
+			resp, _ := postOffer(t, base+"/whip", pc, header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if started := resp.Header.Get("Location") != ""; started != (tt.status == http.StatusCreated) {
+				t.Errorf("session started = %v", started)
+			}
+		})
+	}
+}
+
+func TestTokenConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want []string
+	}{
+		{name: "none"},
+		{name: "env", env: "a, b,,c", want: []string{"a", "b", "c"}},
+		{name: "flag", args: []string{"-token", "a,b"}, want: []string{"a", "b"}},
+		{name: "repeated flag", args: []string{"-token", "a", "-token", "b"}, want: []string{"a", "b"}},
+		{name: "flag replaces env", env: "a", args: []string{"-token", "b"}, want: []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MEDIASERVER_TOKENS", tt.env)
+			if cfg := parseFlags(t, tt.args...); !slices.Equal(cfg.Tokens, tt.want) {
+				t.Errorf("Tokens = %q, want %q", cfg.Tokens, tt.want)
+			}
+		})
+	}
+}
+
+// testACL grants a publisher and a viewer of cam, and a token everything
+var testACL = []aclEntry{
+	{Token: "cam-publisher", Streams: []string{"cam"}, Publish: true},
+	{Token: "cam-viewer", Streams: []string{"cam"}, Play: true},
+	{Token: "anything", Streams: []string{"*"}, Publish: true, Play: true},
+}
+
+// TestACL publishes and plays with the tokens of testACL and a -token,
+// viewers of streams without a publisher playing the -test-source
+func TestACL(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "publish granted", path: "/whip/cam", token: "cam-publisher", status: http.StatusCreated},
+		{name: "publish to another stream", path: "/whip/other", token: "cam-publisher", status: http.StatusForbidden},
+		{name: "publish with play rights", path: "/whip/cam", token: "cam-viewer", status: http.StatusForbidden},
+		{name: "publish any stream", path: "/whip/other", token: "anything", status: http.StatusCreated},
+		{name: "publish with -token", path: "/whip/other", token: "admin", status: http.StatusCreated},
+		{name: "publish without a token", path: "/whip/cam", status: http.StatusUnauthorized},
+		{name: "publish with an unknown token", path: "/whip/cam", token: "wrong", status: http.StatusUnauthorized},
+		{name: "play granted", path: "/whep/cam", token: "cam-viewer", status: http.StatusCreated},
+		{name: "play another stream", path: "/whep/other", token: "cam-viewer", status: http.StatusForbidden},
+		{name: "play with publish rights", path: "/whep/cam", token: "cam-publisher", status: http.StatusForbidden},
+		{name: "play any stream", path: "/whep/other", token: "anything", status: http.StatusCreated},
+		{name: "play with -token", path: "/whep/cam", token: "admin", status: http.StatusCreated},
+		{name: "play without a token", path: "/whep/cam", status: http.StatusUnauthorized},
+		{name: "publish to an invalid stream key", path: "/whip/.cam", status: http.StatusBadRequest},
+		{name: "play an invalid stream key", path: "/whep/.cam", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			setConfig(t, func(c *Config) {
+				c.Tokens = []string{"admin"}
+				c.ACL = testACL
+				c.TestSource = writeTestIVF(t, "VP80", 10)
+			})
+			header := http.Header{}
+			if tt.token != "" {
+				header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			pc := newTestPeerConnection(t)
+			if strings.HasPrefix(tt.path, "/whip/") {
+				track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := pc.AddTrack(track); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+				t.Fatal(err)
+			}
+			resp, body := postOffer(t, base+tt.path, pc, header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("POST %s answered %d: %s, want %d", tt.path, resp.StatusCode, body, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+// TestACLSessionResource checks only tokens granted publishing its stream
+// may end a session
+func TestACLSessionResource(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) { c.ACL = testACL })
+	header := http.Header{"Authorization": {"Bearer cam-publisher"}}
+	pc := newTestPeerConnection(t)
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := postOffer(t, base+"/whip/cam", pc, header)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	location := resp.Header.Get("Location")
+
+	for _, tt := range []struct {
+		token  string
+		status int
+	}{
+		{"cam-viewer", http.StatusForbidden},
+		{"cam-publisher", http.StatusOK},
+		{"anything", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("DELETE with %s answered %d, want %d", tt.token, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// TestACLViewerResource checks only tokens granted playing its stream may
+// end a viewer's playback
+func TestACLViewerResource(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) {
+		c.ACL = testACL
+		c.TestSource = writeTestIVF(t, "VP80", 10)
+	})
+	pc := newTestPeerConnection(t)
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := postOffer(t, base+"/whep/cam", pc, http.Header{"Authorization": {"Bearer cam-viewer"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("play answered %d: %s", resp.StatusCode, body)
+	}
+	location := resp.Header.Get("Location")
+
+	for _, tt := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"cam-publisher", http.StatusForbidden},
+		{"cam-viewer", http.StatusOK},
+		{"anything", http.StatusNotFound},
+		{"", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("DELETE with %q answered %d, want %d", tt.token, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// TestACLAdmin checks the tokens of the ACL grant none of the admin
+// endpoints, only -token does
+func TestACLAdmin(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) {
+		c.Tokens = []string{"admin"}
+		c.ACL = testACL
+	})
+	for _, tt := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodGet, "/sessions", "", http.StatusUnauthorized},
+		{http.MethodGet, "/sessions", "anything", http.StatusUnauthorized},
+		{http.MethodGet, "/sessions", "admin", http.StatusOK},
+		{http.MethodPost, "/ingest", "anything", http.StatusUnauthorized},
+		{http.MethodPost, "/drain", "cam-publisher", http.StatusUnauthorized},
+		{http.MethodGet, "/stats/cam", "anything", http.StatusUnauthorized},
+		{http.MethodGet, "/snapshot/cam", "cam-viewer", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(tt.method, base+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s with %q answered %d, want %d", tt.method, tt.path, tt.token, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+// TestACLConfig loads the ACL from a -config file and rejects invalid entries
+func TestACLConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    []aclEntry
+		wantErr string
+	}{
+		{
+			name: "entries",
+			file: `
+token: [admin]
+acl:
+  - token: studio
+    streams: [studio-a, studio-b]
+    publish: true
+  - token: player
+    streams: ["*"]
+    play: true
+`,
+			want: []aclEntry{
+				{Token: "studio", Streams: []string{"studio-a", "studio-b"}, Publish: true},
+				{Token: "player", Streams: []string{"*"}, Play: true},
+			},
+		},
+		{name: "no token", file: "acl: [{streams: [cam], publish: true}]\n", wantErr: "acl entry 1: token is empty"},
+		{name: "no streams", file: "acl: [{token: a, publish: true}]\n", wantErr: "no streams"},
+		{name: "invalid stream key", file: "acl: [{token: a, streams: [../cam], publish: true}]\n", wantErr: "invalid stream key"},
+		{name: "no rights", file: "acl: [{token: a, streams: [cam]}]\n", wantErr: "neither publish nor play"},
+		{name: "shared token", file: "acl: [{token: a, streams: [cam], play: true}, {token: a, streams: [cam], publish: true}]\n", wantErr: "acl entry 2: token of an earlier entry"},
+		{name: "unknown field", file: "acl: [{token: a, streams: [cam], record: true}]\n", wantErr: "field record not found"},
+		{name: "no -token", file: "acl: [{token: a, streams: [cam], play: true}]\n", wantErr: "needs a -token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mediaserver.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			fs := flag.NewFlagSet("", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg, err := loadConfig(fs, []string{"-config", path, "-output-dir", t.TempDir()})
+			if err == nil {
+				err = cfg.validate()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loading the config failed with %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.ACL, tt.want) {
+				t.Errorf("ACL = %+v, want %+v", cfg.ACL, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/av1/obu"
+)
+
+// AV1 aggregation header bits: Z, the first OBU element continues one of
+// the previous packet, and Y, the last one continues in the next packet
+const (
+	av1ContinuedBit = 0x80
+	av1ContinuesBit = 0x40
+)
+
+// av1Depacketizer wraps codecs.AV1Depacketizer so that an OBU fragmented
+// over packets can't be buffered past -max-frame-size
+type av1Depacketizer struct {
+	codecs.AV1Depacketizer
+	// fragment counts the bytes of the packets since the one starting the
+	// OBU buffered, 0 when none is
+	fragment int
+}
+
+func (d *av1Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) > 1 {
+		// Continuations of nothing buffered are dropped by AV1Depacketizer
+		switch {
+		case payload[0]&av1ContinuedBit == 0:
+			d.fragment = len(payload) - 1
+		case d.fragment > 0:
+			d.fragment += len(payload) - 1
+		}
+		if config.MaxFrameSize > 0 && d.fragment > config.MaxFrameSize {
+			d.AV1Depacketizer = codecs.AV1Depacketizer{}
+			d.fragment = 0
+			return nil, errFrameTooLarge
+		}
+	}
+	frame, err := d.AV1Depacketizer.Unmarshal(payload)
+	if err != nil || len(payload) > 1 && payload[0]&av1ContinuesBit == 0 {
+		d.fragment = 0
+	}
+	return frame, err
+}
+
+// av1TemporalDelimiter starts every IVF frame; RTP senders strip it
+var av1TemporalDelimiter = []byte{0x12, 0x00}
+
+// av1OBUs calls fn with the type and payload of each OBU in a low overhead
+// bitstream temporal unit, as produced by codecs.AV1Depacketizer
+func av1OBUs(frame []byte, fn func(obuType obu.Type, payload []byte) bool) {
+	for len(frame) > 0 {
+		header, err := obu.ParseOBUHeader(frame)
+		if err != nil || !header.HasSizeField {
+			return
+		}
+		size, n, err := obu.ReadLeb128(frame[header.Size():])
+		if err != nil {
+			return
+		}
+		start := header.Size() + int(n)
+		end := start + int(size)
+		if end > len(frame) {
+			return
+		}
+		if !fn(header.Type, frame[start:end]) {
+			return
+		}
+		frame = frame[end:]
+	}
+}
+
+// av1IsKeyframe reports whether a temporal unit opens with a sequence header,
+// which encoders send with every key frame
+func av1IsKeyframe(frame []byte) bool {
+	found := false
+	av1OBUs(frame, func(obuType obu.Type, _ []byte) bool {
+		found = obuType == obu.OBUSequenceHeader
+		return !found
+	})
+	return found
+}
+
+// av1FrameSize returns the maximum frame dimensions from the sequence header, or zero if there is none
+func av1FrameSize(frame []byte) (width, height uint16) {
+	av1OBUs(frame, func(obuType obu.Type, payload []byte) bool {
+		if obuType != obu.OBUSequenceHeader {
+			return true
+		}
+		width, height = parseAV1SequenceHeaderSize(payload)
+		return false
+	})
+	return width, height
+}
+
+// parseAV1SequenceHeaderSize walks sequence_header_obu() up to
+// max_frame_width_minus_1 and max_frame_height_minus_1 (AV1 spec 5.5)
+func parseAV1SequenceHeaderSize(payload []byte) (width, height uint16) {
+	r := &bitReader{data: payload}
+	r.read(3) // seq_profile
+	r.read(1) // still_picture
+	reduced, _ := r.read(1)
+	if reduced == 1 {
+		r.read(5) // seq_level_idx[0]
+	} else {
+		var decoderModelInfo bool
+		var bufferDelayLength int
+		if timingInfo, _ := r.read(1); timingInfo == 1 {
+			r.read(32) // num_units_in_display_tick
+			r.read(32) // time_scale
+			if equalPictureInterval, _ := r.read(1); equalPictureInterval == 1 {
+				readUVLC(r) // num_ticks_per_picture_minus_1
+			}
+			if present, _ := r.read(1); present == 1 {
+				decoderModelInfo = true
+				length, _ := r.read(5)
+				bufferDelayLength = int(length) + 1
+				r.read(32) // num_units_in_decoding_tick
+				r.read(5)  // buffer_removal_time_length_minus_1
+				r.read(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay, _ := r.read(1)
+		operatingPoints, _ := r.read(5)
+		for i := uint32(0); i <= operatingPoints; i++ {
+			r.read(12) // operating_point_idc
+			if level, _ := r.read(5); level > 7 {
+				r.read(1) // seq_tier
+			}
+			if decoderModelInfo {
+				if present, _ := r.read(1); present == 1 {
+					r.read(bufferDelayLength) // decoder_buffer_delay
+					r.read(bufferDelayLength) // encoder_buffer_delay
+					r.read(1)                 // low_delay_mode_flag
+				}
+			}
+			if initialDisplayDelay == 1 {
+				if present, _ := r.read(1); present == 1 {
+					r.read(4) // initial_display_delay_minus_1
+				}
+			}
+		}
+	}
+
+	widthBits, _ := r.read(4)
+	heightBits, _ := r.read(4)
+	w, ok := r.read(int(widthBits) + 1)
+	if !ok {
+		return 0, 0
+	}
+	h, ok := r.read(int(heightBits) + 1)
+	if !ok {
+		return 0, 0
+	}
+	return uint16(w + 1), uint16(h + 1)
+}
+
+// readUVLC reads a variable length unsigned integer (AV1 spec 4.10.3)
+func readUVLC(r *bitReader) uint32 {
+	leadingZeros := 0
+	for {
+		bit, ok := r.read(1)
+		if !ok || bit == 1 {
+			break
+		}
+		leadingZeros++
+	}
+	if leadingZeros >= 32 {
+		return 1<<32 - 1
+	}
+	value, _ := r.read(leadingZeros)
+	return value + (1 << leadingZeros) - 1
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp/codecs/av1/obu"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	// The payload of a reduced still picture sequence header of 640x480
+	testAV1SequenceHeader = []byte{0x0a, 0x26, 0x27, 0xfe, 0xf8, 0x10}
+	testAV1FrameData      = bytes.Repeat([]byte{0xab}, 300)
+)
+
+// AV1 aggregation header bits (AV1 RTP spec 4.4)
+const (
+	av1AggZ = 0x80
+	av1AggY = 0x40
+	av1AggN = 0x08
+)
+
+// av1OBU returns an OBU of obuType, with a size field when sized, as RTP
+// carries them without
+func av1OBU(obuType obu.Type, payload []byte, sized bool) []byte {
+	header := obu.Header{Type: obuType, HasSizeField: sized}
+	b := header.Marshal()
+	if sized {
+		b = append(b, obu.WriteToLeb128(uint(len(payload)))...)
+	}
+	return append(b, payload...)
+}
+
+// av1Payload builds an RTP payload of OBU elements: the last with no length
+func TestAV1Depacketizer(t *testing.T) {
+	frame := av1OBU(obu.OBUFrame, testAV1FrameData, false)
+	small := av1OBU(obu.OBUFrame, testAV1FrameData[:50], false)
+	fragments := [][]byte{
+		av1Payload(av1AggY|av1AggN, 1, frame[:150]),
+		av1Payload(av1AggZ, 1, frame[150:]),
+	}
+	tests := []struct {
+		name     string
+		maxSize  int
+		payloads [][]byte
+		want     []byte
+		wantErr  error
+	}{
+		{name: "fragmented OBU", payloads: fragments, want: av1OBU(obu.OBUFrame, testAV1FrameData, true)},
+		{
+			name:     "fragments over the maximum frame size",
+			maxSize:  200,
+			payloads: append(slices.Clone(fragments), av1Payload(0, 1, small)),
+			want:     av1OBU(obu.OBUFrame, testAV1FrameData[:50], true),
+			wantErr:  errFrameTooLarge,
+		},
+		{
+			name:     "continuation after the dropped fragments",
+			maxSize:  200,
+			payloads: [][]byte{fragments[0], fragments[1], av1Payload(av1AggZ, 1, small), av1Payload(0, 1, small)},
+			want:     av1OBU(obu.OBUFrame, testAV1FrameData[:50], true),
+			wantErr:  errFrameTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxFrameSize = tt.maxSize })
+			var d av1Depacketizer
+			var got []byte
+			var gotErr error
+			for _, payload := range tt.payloads {
+				out, err := d.Unmarshal(payload)
+				if err != nil {
+					if gotErr == nil {
+						gotErr = err
+					}
+					continue
+				}
+				got = append(got, out...)
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("error = %v, want %v", gotErr, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Unmarshal = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// field when count is set, as W then gives their number
+func av1Payload(flags byte, count int, elements ...[]byte) []byte {
+	payload := []byte{flags | byte(count)<<4}
+	for i, element := range elements {
+		if count == 0 || i < len(elements)-1 {
+			payload = append(payload, obu.WriteToLeb128(uint(len(element)))...)
+		}
+		payload = append(payload, element...)
+	}
+	return payload
+}
+
+func TestAV1Recording(t *testing.T) {
+	sequenceHeader := av1OBU(obu.OBUSequenceHeader, testAV1SequenceHeader, false)
+	frame := av1OBU(obu.OBUFrame, testAV1FrameData, false)
+	// The temporal unit of a keyframe and of a frame as written to IVF
+	keyframeUnit := slices.Concat(av1TemporalDelimiter, av1OBU(obu.OBUSequenceHeader, testAV1SequenceHeader, true), av1OBU(obu.OBUFrame, testAV1FrameData, true))
+	frameUnit := slices.Concat(av1TemporalDelimiter, av1OBU(obu.OBUFrame, testAV1FrameData, true))
+
+	tests := []struct {
+		name    string
+		packets []testPacket
+		want    [][]byte
+	}{
+		{
+			name: "aggregated OBUs counted by W",
+			packets: []testPacket{
+				{0, true, av1Payload(av1AggN, 2, sequenceHeader, frame)},
+				{3000, true, av1Payload(0, 1, frame)},
+			},
+			want: [][]byte{keyframeUnit, frameUnit},
+		},
+		{
+			name: "aggregated OBUs with length fields",
+			packets: []testPacket{
+				{0, true, av1Payload(av1AggN, 0, sequenceHeader, frame)},
+			},
+			want: [][]byte{keyframeUnit},
+		},
+		{
+			name: "OBU fragmented across packets",
+			packets: []testPacket{
+				{0, false, av1Payload(av1AggN|av1AggY, 2, sequenceHeader, frame[:100])},
+				{0, false, av1Payload(av1AggZ|av1AggY, 1, frame[100:200])},
+				{0, true, av1Payload(av1AggZ, 1, frame[200:])},
+				{3000, false, av1Payload(av1AggY, 1, frame[:150])},
+				{3000, true, av1Payload(av1AggZ, 1, frame[150:])},
+			},
+			want: [][]byte{keyframeUnit, frameUnit},
+		},
+		{
+			name: "first fragment lost",
+			packets: []testPacket{
+				{0, false, av1Payload(av1AggZ|av1AggY, 1, frame[100:200])},
+				{0, true, av1Payload(av1AggZ, 1, frame[200:])},
+				{3000, true, av1Payload(0, 1, frame)},
+			},
+			want: [][]byte{frameUnit},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fourcc, width, height, _, recorded := readIVF(t, recordPackets(t, webrtc.MimeTypeAV1, tt.packets))
+			if fourcc != "AV01" {
+				t.Errorf("FourCC = %q, want AV01", fourcc)
+			}
+			if len(recorded) != len(tt.want) {
+				t.Fatalf("recorded %d frames, want %d", len(recorded), len(tt.want))
+			}
+			for i := range recorded {
+				if !bytes.Equal(recorded[i].data, tt.want[i]) {
+					t.Errorf("frame %d = % x\nwant % x", i, recorded[i].data, tt.want[i])
+				}
+			}
+			if av1IsKeyframe(tt.want[0][len(av1TemporalDelimiter):]) && (width != 640 || height != 480) {
+				t.Errorf("size = %dx%d, want 640x480", width, height)
+			}
+		})
+	}
+}
+
+func TestAV1Keyframe(t *testing.T) {
+	sequenceHeader := av1OBU(obu.OBUSequenceHeader, testAV1SequenceHeader, true)
+	frame := av1OBU(obu.OBUFrame, testAV1FrameData, true)
+	tests := []struct {
+		name          string
+		unit          []byte
+		keyframe      bool
+		width, height uint16
+	}{
+		{name: "sequence header first", unit: slices.Concat(sequenceHeader, frame), keyframe: true, width: 640, height: 480},
+		{name: "sequence header after metadata", unit: slices.Concat(av1OBU(obu.OBUMetadata, []byte{1, 2}, true), sequenceHeader, frame), keyframe: true, width: 640, height: 480},
+		{name: "frame only", unit: frame},
+		{name: "OBU without size field", unit: av1OBU(obu.OBUSequenceHeader, testAV1SequenceHeader, false)},
+		{name: "truncated OBU", unit: sequenceHeader[:4]},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := av1IsKeyframe(tt.unit); got != tt.keyframe {
+				t.Errorf("av1IsKeyframe = %v, want %v", got, tt.keyframe)
+			}
+			if width, height := av1FrameSize(tt.unit); width != tt.width || height != tt.height {
+				t.Errorf("av1FrameSize = %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestReadUVLC(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		{name: "0", data: []byte{0x80}, want: 0},
+		{name: "1", data: []byte{0x40}, want: 1},
+		{name: "2", data: []byte{0x60}, want: 2},
+		{name: "39", data: []byte{0x05, 0x00}, want: 39},
+		{name: "all zeros", data: make([]byte, 5), want: 1<<32 - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readUVLC(&bitReader{data: tt.data}); got != tt.want {
+				t.Errorf("readUVLC(% x) = %d, want %d", tt.data, got, tt.want)
+			}
+		})
+	}
+}
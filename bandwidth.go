@@ -0,0 +1,57 @@
+package main
+
+import "github.com/pion/sdp/v3"
+
+// The bounds of -answer-bandwidth in kbps: video can't be sent under less,
+// and no link carries more
+const (
+	minAnswerBandwidth = 16
+	maxAnswerBandwidth = 10_000_000
+)
+
+// capAnswerBandwidth sets b=AS to kbps on the video sections the answer
+// accepts, replacing any b=AS they carry. Publishers keep the bitrate they
+// send each section under its b=AS, whether or not they act on REMB.
+func capAnswerBandwidth(answer string, kbps int) (string, error) {
+	var description sdp.SessionDescription
+	if err := description.UnmarshalString(answer); err != nil {
+		return "", err
+	}
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		bandwidth := media.Bandwidth[:0]
+		for _, b := range media.Bandwidth {
+			if b.Type != "AS" {
+				bandwidth = append(bandwidth, b)
+			}
+		}
+		media.Bandwidth = append(bandwidth, sdp.Bandwidth{Type: "AS", Bandwidth: uint64(kbps)})
+	}
+	munged, err := description.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(munged), nil
+}
+
+// publishAnswer returns the answer sent to the publisher of sess: its local
+// description, with the video capped to -answer-bandwidth. The cap cannot be
+// applied before SetLocalDescription: pion fails an answer whose SDP differs
+// from the one CreateAnswer returned ("new sdp does not match previous
+// answer"). b=AS only tells the publisher what to send, so the local
+// description does not need it. If the answer cannot be rewritten it is sent
+// uncapped.
+func publishAnswer(sess *session) string {
+	answer := sess.peerConnection.LocalDescription().SDP
+	if config.AnswerBandwidth == 0 {
+		return answer
+	}
+	capped, err := capAnswerBandwidth(answer, config.AnswerBandwidth)
+	if err != nil {
+		sess.log.Warn("Failed to cap the answer's bandwidth", "error", err)
+		return answer
+	}
+	return capped
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// sectionBandwidths returns the b=AS of each media section of the SDP, by
+// its media, 0 for none
+func sectionBandwidths(t *testing.T, text string) map[string]uint64 {
+	t.Helper()
+	var description sdp.SessionDescription
+	if err := description.UnmarshalString(text); err != nil {
+		t.Fatalf("unparseable SDP: %v\n%s", err, text)
+	}
+	bandwidths := make(map[string]uint64)
+	for _, media := range description.MediaDescriptions {
+		bandwidths[media.MediaName.Media] = 0
+		for _, b := range media.Bandwidth {
+			if b.Type == "AS" {
+				bandwidths[media.MediaName.Media] = b.Bandwidth
+			}
+		}
+	}
+	return bandwidths
+}
+
+func TestCapAnswerBandwidth(t *testing.T) {
+	const answer = "v=0\r\no=- 1 2 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\nc=IN IP4 0.0.0.0\r\n%sa=mid:0\r\na=rtpmap:96 VP8/90000\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nc=IN IP4 0.0.0.0\r\na=mid:1\r\na=rtpmap:111 opus/48000/2\r\n"
+	tests := []struct {
+		name      string
+		bandwidth string
+	}{
+		{name: "inserted"},
+		{name: "overridden", bandwidth: "b=AS:5000\r\n"},
+		{name: "other types kept", bandwidth: "b=TIAS:5000000\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			munged, err := capAnswerBandwidth(fmt.Sprintf(answer, tt.bandwidth), 800)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := sectionBandwidths(t, munged)
+			if got["video"] != 800 || got["audio"] != 0 {
+				t.Errorf("b=AS of the sections = %v, want 800 on the video only\n%s", got, munged)
+			}
+			if strings.Count(munged, "b=AS:") != 1 {
+				t.Errorf("b=AS set %d times\n%s", strings.Count(munged, "b=AS:"), munged)
+			}
+			if tt.bandwidth == "b=TIAS:5000000\r\n" && !strings.Contains(munged, tt.bandwidth) {
+				t.Errorf("b=TIAS dropped\n%s", munged)
+			}
+		})
+	}
+	if _, err := capAnswerBandwidth("not an SDP", 800); err == nil {
+		t.Error("an unparseable answer was munged")
+	}
+}
+
+func TestAnswerBandwidth(t *testing.T) {
+	tests := []struct {
+		name      string
+		bandwidth int
+		want      uint64
+	}{
+		{name: "capped", bandwidth: 1500, want: 1500},
+		{name: "uncapped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.AnswerBandwidth = tt.bandwidth })
+			base := startServer(t)
+			// The publisher connects with the answer, so pion took it
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+			got := sectionBandwidths(t, p.answer)
+			if got["video"] != tt.want || got["audio"] != 0 {
+				t.Errorf("b=AS of the answer's sections = %v, want %d on the video\n%s", got, tt.want, p.answer)
+			}
+		})
+	}
+}
+
+// TestAnswerBandwidthLocalDescription pins the reason publishAnswer caps the
+// answer as it is sent: pion fails a local answer that differs from the one
+// it created. If this starts passing, the cap can move before
+// SetLocalDescription.
+func TestAnswerBandwidthLocalDescription(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offerer.Close()
+	if _, err := offerer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+	if err := answerer.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.SDP, err = capAnswerBandwidth(answer.SDP, 1500); err != nil {
+		t.Fatal(err)
+	}
+	if err := answerer.SetLocalDescription(answer); err == nil {
+		t.Error("SetLocalDescription accepted a capped answer")
+	}
+}
+
+func TestAnswerBandwidthFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "set", args: []string{"-answer-bandwidth", "2500"}},
+		{name: "negative", args: []string{"-answer-bandwidth", "-1"}, wantErr: true},
+		{name: "too low", args: []string{"-answer-bandwidth", "8"}, wantErr: true},
+		{name: "too high", args: []string{"-answer-bandwidth", "20000000"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
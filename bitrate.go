@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// The bitrate is averaged over the packets of the last bitrateWindow,
+	// counted in bitrateBuckets slices of it
+	bitrateWindow  = 2 * time.Second
+	bitrateBuckets = 20
+	bitrateBucket  = bitrateWindow / bitrateBuckets
+)
+
+// bitrateMeter estimates the incoming bitrate of a track from the size of
+// the RTP packets read over a sliding window
+type bitrateMeter struct {
+	mu      sync.Mutex
+	start   time.Time
+	buckets [bitrateBuckets]int64
+	current int64
+}
+
+// add counts a packet of n bytes received at now
+func (m *bitrateMeter) add(n int, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.advance(now)
+	m.buckets[m.current%bitrateBuckets] += int64(n)
+}
+
+// bitrate returns the estimate in bits per second at now
+func (m *bitrateMeter) bitrate(now time.Time) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.start.IsZero() {
+		return 0
+	}
+	m.advance(now)
+
+	var bytes int64
+	for _, n := range m.buckets {
+		bytes += n
+	}
+	// The buckets span the window up to the start of the current one, plus
+	// the part of the current one elapsed; less before a window has passed
+	since := now.Sub(m.start)
+	elapsed := min(since, bitrateWindow-bitrateBucket+since%bitrateBucket)
+	elapsed = max(elapsed, bitrateBucket)
+	return bytes * 8 * int64(time.Second) / int64(elapsed)
+}
+
+// advance moves to the bucket holding now, emptying those skipped on the way
+func (m *bitrateMeter) advance(now time.Time) {
+	slot := int64(now.Sub(m.start) / bitrateBucket)
+	if slot <= m.current {
+		return
+	}
+	for i := m.current + 1; i <= slot && i <= m.current+bitrateBuckets; i++ {
+		m.buckets[i%bitrateBuckets] = 0
+	}
+	m.current = slot
+}
+
+// logBitrate logs the meter's estimate every interval, if positive, until ctx is cancelled
+func logBitrate(ctx context.Context, logger *slog.Logger, meter *bitrateMeter, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			logger.Info("Bitrate", "bps", meter.bitrate(now))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// bitrateFeed is a constant stream of packets of size bytes, one every interval
+type bitrateFeed struct {
+	size     int
+	interval time.Duration
+	duration time.Duration
+}
+
+func TestBitrateMeter(t *testing.T) {
+	tests := []struct {
+		name  string
+		feeds []bitrateFeed
+		// after is how long after the last packet the estimate is read
+		after time.Duration
+		want  int64
+	}{
+		{name: "no packets"},
+		{name: "steady", feeds: []bitrateFeed{{1000, 10 * time.Millisecond, 5 * time.Second}}, want: 800_000},
+		{name: "shorter than the window", feeds: []bitrateFeed{{1000, 10 * time.Millisecond, time.Second}}, want: 800_000},
+		{name: "large packets", feeds: []bitrateFeed{{1200, time.Millisecond, 3 * time.Second}}, want: 9_600_000},
+		{name: "rate drop", feeds: []bitrateFeed{{1000, 10 * time.Millisecond, 3 * time.Second}, {500, 10 * time.Millisecond, 3 * time.Second}}, want: 400_000},
+		{name: "stopped", feeds: []bitrateFeed{{1000, 10 * time.Millisecond, 3 * time.Second}}, after: 3 * time.Second, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meter := &bitrateMeter{}
+			now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			for _, feed := range tt.feeds {
+				for end := now.Add(feed.duration); now.Before(end); now = now.Add(feed.interval) {
+					meter.add(feed.size, now)
+				}
+			}
+			got := meter.bitrate(now.Add(tt.after))
+			// Within 5%, for the packets at the edges of the window
+			if diff := got - tt.want; diff < -tt.want/20 || diff > tt.want/20 {
+				t.Errorf("bitrate = %d bps, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSessionBitrate checks /sessions reports the bitrate of a session while
+// it is publishing
+func TestSessionBitrate(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(time.Second)
+
+	resp, err := http.Get(base + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []sessionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("listed %d sessions, want 1", len(list))
+	}
+	// The sample media is a keyframe, then small interframes and Opus silence
+	if bitrate := list[0].Bitrate; bitrate <= 0 || bitrate > 1_000_000 {
+		t.Errorf("bitrate = %d bps, want a positive estimate below 1 Mbps", bitrate)
+	}
+}
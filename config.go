@@ -0,0 +1,688 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server options. Its fields are named in a -config file
+// after the flags that set them.
+type Config struct {
+	// ConfigFile is the YAML or JSON file read before the flags are applied
+	ConfigFile string `yaml:"-"`
+
+	// Addr is the HTTP listen address, host:port
+	Addr string `yaml:"addr"`
+
+	// RTSPAddr is the RTSP listen address, host:port; empty disables RTSP
+	RTSPAddr string `yaml:"rtsp-addr"`
+	// PprofAddr is the listen address of the pprof profiles, host:port;
+	// empty, the default, disables them
+	PprofAddr string `yaml:"pprof-addr"`
+
+	// CertFile and KeyFile enable HTTPS when both are set
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+
+	// DTLSCertFile and DTLSKeyFile are the DTLS certificate shared by every
+	// PeerConnection, so clients can pin its fingerprint; unset, each
+	// PeerConnection generates its own. DTLSRole is the role taken when
+	// answering, one of dtlsRoles.
+	DTLSCertFile string `yaml:"dtls-cert"`
+	DTLSKeyFile  string `yaml:"dtls-key"`
+	DTLSRole     string `yaml:"dtls-role"`
+
+	// CORSOrigins are the origins browsers may call the API from; "*" allows any
+	CORSOrigins []string `yaml:"cors-origins"`
+
+	// Tokens are the accepted WHIP bearer tokens; empty disables authentication
+	Tokens []string `yaml:"token"`
+	// ACL grants further tokens publish and play rights on some streams; it
+	// is only read from a -config file. With an ACL, playing takes a token.
+	ACL []aclEntry `yaml:"acl"`
+
+	// MaxSessions caps the concurrent WHIP sessions; further publishes get 503
+	MaxSessions int `yaml:"max-sessions"`
+
+	// IdleTimeout closes a session once no RTP has arrived on any of its
+	// tracks for this long; 0 disables it
+	IdleTimeout time.Duration `yaml:"idle-timeout"`
+
+	// SessionTTL closes a session once neither RTP nor a request on its
+	// resource has arrived for this long; ConnectTimeout closes one whose
+	// PeerConnection has been out of the connected state for this long.
+	// 0 disables either.
+	SessionTTL     time.Duration `yaml:"session-ttl"`
+	ConnectTimeout time.Duration `yaml:"connect-timeout"`
+
+	// IngestReconnects is how many times in a row an ingest whose
+	// connection failed is tried again, 0 disabling it; the first attempt
+	// waits IngestBackoff, each next one twice as long up to maxIngestBackoff
+	IngestReconnects int           `yaml:"ingest-reconnects"`
+	IngestBackoff    time.Duration `yaml:"ingest-backoff"`
+
+	// MaxSessionDuration stops a session and finalizes its recording once
+	// it has run this long; 0 disables it
+	MaxSessionDuration time.Duration `yaml:"max-session-duration"`
+
+	// ShutdownTimeout bounds how long in-flight requests may take on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+
+	// DrainTimeout is how long the sessions of a draining server may go on
+	// before they are closed
+	DrainTimeout time.Duration `yaml:"drain-timeout"`
+
+	// ReadTimeout bounds reading the headers of a request, and the body of
+	// those handing the server an SDP or JSON document
+	ReadTimeout time.Duration `yaml:"read-timeout"`
+
+	// PLIInterval and PLIMaxRetries control the keyframe requests sent when a
+	// video track starts, until its first keyframe arrives
+	PLIInterval   time.Duration `yaml:"pli-interval"`
+	PLIMaxRetries int           `yaml:"pli-max-retries"`
+
+	// RTPBufferSize is the largest RTP packet read from a track; it also sets
+	// the receive MTU so larger datagrams aren't cut short by the transport
+	RTPBufferSize int `yaml:"rtp-buffer-size"`
+
+	// MaxFrameSize caps the video frames reassembled from RTP; larger ones
+	// are dropped and a keyframe requested in their place
+	MaxFrameSize int `yaml:"max-frame-size"`
+
+	// NACKHistorySize is how many recent sequence numbers are tracked per
+	// video track; NACKTimeout is how long a lost packet keeps being requested
+	NACKHistorySize int           `yaml:"nack-history"`
+	NACKTimeout     time.Duration `yaml:"nack-timeout"`
+
+	// NACK, TWCC and RTCPReports switch the interceptors behind loss
+	// recovery, transport-wide congestion feedback and RTCP sender and
+	// receiver reports, trading resilience for overhead
+	NACK        bool `yaml:"nack"`
+	TWCC        bool `yaml:"twcc"`
+	RTCPReports bool `yaml:"rtcp-reports"`
+
+	// JitterBuffer is how many packets past a gap each track waits for the
+	// missing one before depacketizing without it; 0 disables reordering
+	JitterBuffer int `yaml:"jitter-buffer"`
+
+	// BitrateLogInterval is how often each track logs its incoming bitrate; 0 disables it
+	BitrateLogInterval time.Duration `yaml:"bitrate-log-interval"`
+
+	// MaxBitrate is the upstream bitrate in bits per second publishers are
+	// asked to stay under with REMB; 0 disables it
+	MaxBitrate int64 `yaml:"max-bitrate"`
+
+	// AnswerBandwidth is the b=AS in kbps set on the video sections of the
+	// answers to publishers, capping their video in the SDP; 0 disables it
+	AnswerBandwidth int `yaml:"answer-bandwidth"`
+
+	// ICEServers are the STUN/TURN servers handed to every PeerConnection
+	ICEServers []webrtc.ICEServer `yaml:"ice-server"`
+
+	// TURNSecret is the secret shared with TURN servers using the TURN REST
+	// API, such as coturn with use-auth-secret. The TURN servers given
+	// without credentials get ones generated per PeerConnection, valid for
+	// TURNCredentialTTL.
+	TURNSecret        string        `yaml:"turn-secret"`
+	TURNCredentialTTL time.Duration `yaml:"turn-credential-ttl"`
+
+	// ICELite answers as an ICE-Lite agent, for servers reachable on a public
+	// IP; PublicIPs are announced as the host candidates, as behind 1:1 NAT
+	ICELite   bool     `yaml:"ice-lite"`
+	PublicIPs []string `yaml:"public-ip"`
+
+	// ICEPortMin and ICEPortMax bound the UDP ports of the ICE candidates;
+	// both 0 leaves the ports ephemeral
+	ICEPortMin int `yaml:"ice-port-min"`
+	ICEPortMax int `yaml:"ice-port-max"`
+
+	// UDPReceiveBuffer is the receive buffer in bytes of the ICE UDP sockets,
+	// up to the OS limit (see udpBufferNet); 0 leaves the OS default
+	UDPReceiveBuffer int `yaml:"udp-receive-buffer"`
+
+	// Codecs restricts the negotiated codecs to these MIME types; empty allows all
+	Codecs []string `yaml:"codecs"`
+
+	// TestSource is a VP8 IVF file looped to WHEP viewers of streams with no
+	// publisher; empty answers them 404
+	TestSource string `yaml:"test-source"`
+
+	// SimulateLoss is the percentage of incoming RTP packets dropped on
+	// purpose, to exercise NACK and PLI. It is a debugging aid, never to be
+	// set in production.
+	SimulateLoss float64 `yaml:"simulate-loss"`
+
+	// ExportKeys writes the DTLS key log of every session next to its
+	// recordings, so captured packets can be decrypted offline. The files
+	// are as sensitive as the media itself.
+	ExportKeys bool `yaml:"export-keys"`
+
+	// DumpSDP logs the offer and answer of every WHIP session at debug
+	// level, their ICE credentials redacted unless DumpSDPCredentials
+	DumpSDP            bool `yaml:"dump-sdp"`
+	DumpSDPCredentials bool `yaml:"dump-sdp-credentials"`
+
+	// SelfTest publishes a sample to the server's own routes on startup and
+	// checks its recordings, then exits instead of serving (see runSelfTest)
+	SelfTest bool `yaml:"selftest"`
+
+	// SenderReports records the RTCP sender reports of the recorded tracks
+	// in each session directory, for post-processing to line them up
+	SenderReports bool `yaml:"sender-reports"`
+
+	// RecordAllLayers writes every simulcast layer to a file of its own, the
+	// highest still recorded with the session as well. LayerKeyframeInterval
+	// is how often each layer is then asked for a keyframe, so the files
+	// have switch points in common; 0 disables it.
+	RecordAllLayers       bool          `yaml:"record-all-layers"`
+	LayerKeyframeInterval time.Duration `yaml:"layer-keyframe-interval"`
+
+	// FilenameTemplate is a text/template of the path, under the output
+	// directory, of the files of a track recorded on its own; empty keeps
+	// them in the session directory (see trackFileName)
+	FilenameTemplate string `yaml:"filename-template"`
+
+	// WAVSampleRate and WAVChannels are the format of the WAV files G.711
+	// is recorded to, converted from 8 kHz mono; 0 keeps the source's
+	WAVSampleRate int `yaml:"wav-sample-rate"`
+	WAVChannels   int `yaml:"wav-channels"`
+
+	// RecordingFormat is the container of sessions whose publish names none
+	// with ?format, one of recordingFormats
+	RecordingFormat string `yaml:"recording-format"`
+
+	// MaxFileDuration and MaxFileSize split recordings into numbered segment
+	// files once either is reached; 0 leaves that limit off
+	MaxFileDuration time.Duration `yaml:"max-file-duration"`
+	MaxFileSize     int64         `yaml:"max-file-size"`
+
+	// HLSSegmentDuration is the least media in an HLS segment, which starts
+	// on a keyframe; HLSPlaylistSize is how many of the latest segments the
+	// playlist lists, 0 listing them all
+	HLSSegmentDuration time.Duration `yaml:"hls-segment-duration"`
+	HLSPlaylistSize    int           `yaml:"hls-playlist-size"`
+
+	// OutputDir is the root under which each session's recordings are written
+	OutputDir string `yaml:"output-dir"`
+
+	// WebhookURL is sent a recordingEvent once each session's recording is
+	// complete; empty disables it. With WebhookSecret, the events are
+	// signed with HMAC-SHA256.
+	WebhookURL    string `yaml:"webhook-url"`
+	WebhookSecret string `yaml:"webhook-secret"`
+
+	// LogLevel is the minimum level logged: debug, info, warn or error
+	LogLevel string `yaml:"log-level"`
+
+	// RequestLogExclude are the paths whose requests aren't logged
+	RequestLogExclude []string `yaml:"request-log-exclude"`
+}
+
+// Active configuration, populated in main before the server starts
+var config = defaultConfig()
+
+// defaultConfig returns the built-in defaults, overridden by MEDIASERVER_* environment variables
+func defaultConfig() Config {
+	return Config{
+		ConfigFile: os.Getenv("MEDIASERVER_CONFIG"),
+
+		Addr:      envOr("MEDIASERVER_ADDR", ":8080"),
+		RTSPAddr:  os.Getenv("MEDIASERVER_RTSP_ADDR"),
+		PprofAddr: envOr("MEDIASERVER_PPROF_ADDR", ""),
+		CertFile:  os.Getenv("MEDIASERVER_CERT"),
+		KeyFile:   os.Getenv("MEDIASERVER_KEY"),
+
+		DTLSCertFile: os.Getenv("MEDIASERVER_DTLS_CERT"),
+		DTLSKeyFile:  os.Getenv("MEDIASERVER_DTLS_KEY"),
+		DTLSRole:     envOr("MEDIASERVER_DTLS_ROLE", "auto"),
+		Tokens:       splitList(os.Getenv("MEDIASERVER_TOKENS")),
+
+		CORSOrigins: splitList(envOr("MEDIASERVER_CORS_ORIGINS", "*")),
+
+		MaxSessions:           100,
+		IdleTimeout:           30 * time.Second,
+		SessionTTL:            10 * time.Minute,
+		ConnectTimeout:        time.Minute,
+		IngestReconnects:      5,
+		IngestBackoff:         time.Second,
+		ShutdownTimeout:       10 * time.Second,
+		DrainTimeout:          10 * time.Minute,
+		ReadTimeout:           10 * time.Second,
+		PLIInterval:           time.Second,
+		PLIMaxRetries:         10,
+		LayerKeyframeInterval: 5 * time.Second,
+		RTPBufferSize:         1500,
+		MaxFrameSize:          8 << 20,
+		NACKHistorySize:       512,
+		NACKTimeout:           time.Second,
+		NACK:                  true,
+		TWCC:                  true,
+		RTCPReports:           true,
+		JitterBuffer:          16,
+		BitrateLogInterval:    10 * time.Second,
+		TURNSecret:            os.Getenv("MEDIASERVER_TURN_SECRET"),
+		WebhookURL:            os.Getenv("MEDIASERVER_WEBHOOK_URL"),
+		WebhookSecret:         os.Getenv("MEDIASERVER_WEBHOOK_SECRET"),
+		TURNCredentialTTL:     24 * time.Hour,
+		ICELite:               os.Getenv("MEDIASERVER_ICE_LITE") == "true",
+		PublicIPs:             splitList(os.Getenv("MEDIASERVER_PUBLIC_IPS")),
+		Codecs:                splitList(os.Getenv("MEDIASERVER_CODECS")),
+		RecordAllLayers:       os.Getenv("MEDIASERVER_RECORD_ALL_LAYERS") == "true",
+		RecordingFormat:       envOr("MEDIASERVER_RECORDING_FORMAT", "auto"),
+		HLSSegmentDuration:    2 * time.Second,
+		HLSPlaylistSize:       6,
+		OutputDir:             envOr("MEDIASERVER_OUTPUT_DIR", "./recordings"),
+		LogLevel:              envOr("MEDIASERVER_LOG_LEVEL", "info"),
+		RequestLogExclude:     []string{"/healthz", "/metrics"},
+	}
+}
+
+// registerFlags binds the command-line flags to cfg, using its current values as defaults
+func registerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile, "YAML or JSON file of options named after their flags, which override it (env MEDIASERVER_CONFIG)")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "HTTP listen address (env MEDIASERVER_ADDR)")
+	fs.StringVar(&cfg.RTSPAddr, "rtsp-addr", cfg.RTSPAddr, "RTSP listen address for playing streams, such as :8554; empty, the default, disables it (env MEDIASERVER_RTSP_ADDR)")
+	fs.StringVar(&cfg.PprofAddr, "pprof-addr", cfg.PprofAddr, "Listen address serving the pprof profiles under /debug/pprof/, empty disables it (env MEDIASERVER_PPROF_ADDR)")
+	fs.StringVar(&cfg.CertFile, "cert", cfg.CertFile, "TLS certificate PEM file, requires -key (env MEDIASERVER_CERT)")
+	fs.StringVar(&cfg.KeyFile, "key", cfg.KeyFile, "TLS private key PEM file, requires -cert (env MEDIASERVER_KEY)")
+	fs.StringVar(&cfg.DTLSCertFile, "dtls-cert", cfg.DTLSCertFile, "DTLS certificate PEM file shared by every session, for fingerprint pinning; requires -dtls-key (env MEDIASERVER_DTLS_CERT)")
+	fs.StringVar(&cfg.DTLSKeyFile, "dtls-key", cfg.DTLSKeyFile, "ECDSA or RSA private key PEM file of -dtls-cert (env MEDIASERVER_DTLS_KEY)")
+	fs.StringVar(&cfg.DTLSRole, "dtls-role", cfg.DTLSRole, "DTLS role taken when answering: auto, client or server (env MEDIASERVER_DTLS_ROLE)")
+	fs.IntVar(&cfg.MaxSessions, "max-sessions", cfg.MaxSessions, "maximum concurrent WHIP sessions")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "close a session when no RTP arrives for this long, 0 disables it")
+	fs.DurationVar(&cfg.SessionTTL, "session-ttl", cfg.SessionTTL, "close a session when neither RTP nor a request on it arrives for this long, 0 disables it")
+	fs.DurationVar(&cfg.ConnectTimeout, "connect-timeout", cfg.ConnectTimeout, "close a session whose publisher isn't connected for this long, 0 disables it")
+	fs.IntVar(&cfg.IngestReconnects, "ingest-reconnects", cfg.IngestReconnects, "times in a row an ingest whose connection failed is tried again, 0 disables reconnecting")
+	fs.DurationVar(&cfg.IngestBackoff, "ingest-backoff", cfg.IngestBackoff, "wait before the first reconnection attempt of an ingest, doubled for each next one up to 30s")
+	fs.DurationVar(&cfg.MaxSessionDuration, "max-session-duration", cfg.MaxSessionDuration, "stop a session and finalize its recording once it has run this long, 0 disables it")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "time allowed for in-flight requests on SIGINT/SIGTERM")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "time the sessions may go on once draining starts, on SIGHUP or POST /drain, before they are closed")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "time allowed to read the headers of a request, and an SDP or JSON body, before it is answered 408")
+	fs.DurationVar(&cfg.PLIInterval, "pli-interval", cfg.PLIInterval, "interval between keyframe requests on a new video track")
+	fs.IntVar(&cfg.PLIMaxRetries, "pli-max-retries", cfg.PLIMaxRetries, "maximum keyframe requests per video track, 0 disables them")
+	fs.IntVar(&cfg.RTPBufferSize, "rtp-buffer-size", cfg.RTPBufferSize, "largest RTP packet accepted in bytes, larger packets are dropped")
+	fs.IntVar(&cfg.MaxFrameSize, "max-frame-size", cfg.MaxFrameSize, "largest video frame reassembled in bytes, larger frames are dropped and a keyframe requested")
+	fs.IntVar(&cfg.NACKHistorySize, "nack-history", cfg.NACKHistorySize, "sequence numbers tracked per video track for loss detection")
+	fs.DurationVar(&cfg.NACKTimeout, "nack-timeout", cfg.NACKTimeout, "how long a lost packet keeps being requested with NACK")
+	fs.BoolVar(&cfg.NACK, "nack", cfg.NACK, "request lost video packets from publishers and retransmit those viewers lose")
+	fs.BoolVar(&cfg.TWCC, "twcc", cfg.TWCC, "send transport-wide congestion control feedback to publishers")
+	fs.BoolVar(&cfg.RTCPReports, "rtcp-reports", cfg.RTCPReports, "send RTCP sender and receiver reports")
+	fs.IntVar(&cfg.JitterBuffer, "jitter-buffer", cfg.JitterBuffer, "packets each track holds to put late arrivals back in order, 0 disables it")
+	fs.DurationVar(&cfg.BitrateLogInterval, "bitrate-log-interval", cfg.BitrateLogInterval, "how often to log the bitrate of each track, 0 disables it")
+	fs.Int64Var(&cfg.MaxBitrate, "max-bitrate", cfg.MaxBitrate, "upstream bitrate in bits per second publishers are asked to stay under with REMB, 0 disables it")
+	fs.IntVar(&cfg.AnswerBandwidth, "answer-bandwidth", cfg.AnswerBandwidth, "b=AS in kbps set on the video sections of the answers to publishers, capping their video in the SDP; 0 disables it")
+	fs.Var(&iceServerFlag{servers: &cfg.ICEServers}, "ice-server", "STUN/TURN server as URL[,username,credential], repeatable")
+	fs.StringVar(&cfg.TURNSecret, "turn-secret", cfg.TURNSecret, "secret shared with TURN servers using the TURN REST API, for credentials generated per session (env MEDIASERVER_TURN_SECRET)")
+	fs.DurationVar(&cfg.TURNCredentialTTL, "turn-credential-ttl", cfg.TURNCredentialTTL, "how long the credentials generated with -turn-secret stay valid")
+	fs.BoolVar(&cfg.ICELite, "ice-lite", cfg.ICELite, "answer as an ICE-Lite agent, requires -public-ip (env MEDIASERVER_ICE_LITE)")
+	fs.Var(&listFlag{values: &cfg.PublicIPs}, "public-ip", "comma-separated public IPs announced as host candidates (env MEDIASERVER_PUBLIC_IPS)")
+	fs.IntVar(&cfg.ICEPortMin, "ice-port-min", cfg.ICEPortMin, "lowest UDP port of ICE candidates, requires -ice-port-max")
+	fs.IntVar(&cfg.ICEPortMax, "ice-port-max", cfg.ICEPortMax, "highest UDP port of ICE candidates, requires -ice-port-min")
+	fs.IntVar(&cfg.UDPReceiveBuffer, "udp-receive-buffer", cfg.UDPReceiveBuffer, "receive buffer in bytes of the ICE UDP sockets, capped by the OS (net.core.rmem_max on Linux); 0 leaves the OS default")
+	fs.Var(&listFlag{values: &cfg.Codecs}, "codecs", "comma-separated codecs to accept, such as video/VP8,audio/opus; default all (env MEDIASERVER_CODECS)")
+	fs.StringVar(&cfg.TestSource, "test-source", cfg.TestSource, "VP8 IVF file looped to WHEP viewers of streams with no publisher, for smoke tests")
+	fs.Float64Var(&cfg.SimulateLoss, "simulate-loss", cfg.SimulateLoss, "DEBUG ONLY: percentage of incoming RTP packets to drop, to test loss recovery; never set in production")
+	fs.BoolVar(&cfg.ExportKeys, "export-keys", cfg.ExportKeys, "SENSITIVE: write each session's DTLS key log, from which its SRTP keys derive, to <session>.keys for offline decryption")
+	fs.BoolVar(&cfg.DumpSDP, "dump-sdp", cfg.DumpSDP, "log the offer and answer of every WHIP session at debug level, to troubleshoot negotiation")
+	fs.BoolVar(&cfg.DumpSDPCredentials, "dump-sdp-credentials", cfg.DumpSDPCredentials, "SENSITIVE: keep the ICE credentials in the SDP logged by -dump-sdp")
+	fs.BoolVar(&cfg.SelfTest, "selftest", cfg.SelfTest, "publish a bundled sample to the server's own WHIP endpoint, check the recordings and exit with the result, for CI")
+	fs.BoolVar(&cfg.SenderReports, "sender-reports", cfg.SenderReports, "record the RTP to wall-clock time mappings of each track's RTCP sender reports to sender_reports.jsonl, for A/V sync")
+	fs.BoolVar(&cfg.RecordAllLayers, "record-all-layers", cfg.RecordAllLayers, "record every simulcast layer to its own file, not only the highest (env MEDIASERVER_RECORD_ALL_LAYERS)")
+	fs.DurationVar(&cfg.LayerKeyframeInterval, "layer-keyframe-interval", cfg.LayerKeyframeInterval, "with -record-all-layers, how often each simulcast layer is asked for a keyframe, 0 disables it")
+	fs.StringVar(&cfg.FilenameTemplate, "filename-template", cfg.FilenameTemplate, "Go template of the path under -output-dir of the files a track is recorded to on its own, less the extension, of .SessionID, .StreamKey, .Kind, .TrackID, .RID, .SSRC, .Codec, .Date and .Time; default {{.SessionID}}/{{.Kind}}_{{.TrackID}}_{{.SSRC}}")
+	fs.IntVar(&cfg.WAVSampleRate, "wav-sample-rate", cfg.WAVSampleRate, "sample rate in Hz G.711 is resampled to in WAV files, such as 16000 for speech recognition; 0 keeps 8000")
+	fs.IntVar(&cfg.WAVChannels, "wav-channels", cfg.WAVChannels, "channels of the WAV files G.711 is recorded to, 1 or 2; 0 keeps mono")
+	fs.StringVar(&cfg.RecordingFormat, "recording-format", cfg.RecordingFormat, "default recording container: auto, webm, mp4, ivf, raw or hls; a publish may pick another with ?format= (env MEDIASERVER_RECORDING_FORMAT)")
+	fs.DurationVar(&cfg.MaxFileDuration, "max-file-duration", cfg.MaxFileDuration, "start a new segment file after this much media, 0 disables it")
+	fs.Int64Var(&cfg.MaxFileSize, "max-file-size", cfg.MaxFileSize, "start a new segment file after this many bytes of media, 0 disables it")
+	fs.DurationVar(&cfg.HLSSegmentDuration, "hls-segment-duration", cfg.HLSSegmentDuration, "least media in an HLS segment, which starts on the next keyframe after it")
+	fs.IntVar(&cfg.HLSPlaylistSize, "hls-playlist-size", cfg.HLSPlaylistSize, "latest HLS segments listed in the playlist, 0 lists them all")
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "directory for recordings, one subdirectory per session (env MEDIASERVER_OUTPUT_DIR)")
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", cfg.WebhookURL, "URL sent a JSON POST once each session's recording is complete (env MEDIASERVER_WEBHOOK_URL)")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", cfg.WebhookSecret, "secret signing the -webhook-url requests with HMAC-SHA256 in "+webhookSignatureHeader+" (env MEDIASERVER_WEBHOOK_SECRET)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug, info, warn or error (env MEDIASERVER_LOG_LEVEL)")
+	fs.Var(&listFlag{values: &cfg.RequestLogExclude}, "request-log-exclude", "comma-separated paths whose requests aren't logged")
+	fs.Var(&listFlag{values: &cfg.CORSOrigins}, "cors-origins", "comma-separated origins allowed to call the API, * for any (env MEDIASERVER_CORS_ORIGINS)")
+	fs.Var(&listFlag{values: &cfg.Tokens}, "token", "comma-separated bearer tokens accepted by WHIP, repeatable (env MEDIASERVER_TOKENS)")
+}
+
+// loadConfig returns the configuration of the command-line arguments args:
+// the defaults and MEDIASERVER_* environment, then the -config file, then the
+// flags, registered on fs. It is not validated.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	// A first pass finds the file; the flags are reported by the second
+	cfg := defaultConfig()
+	scan := flag.NewFlagSet("", flag.ContinueOnError)
+	scan.SetOutput(io.Discard)
+	registerFlags(scan, &cfg)
+	scan.Parse(args)
+
+	path := cfg.ConfigFile
+	cfg = defaultConfig()
+	if path != "" {
+		if err := readConfigFile(path, &cfg); err != nil {
+			return cfg, fmt.Errorf("invalid -config %q: %w", path, err)
+		}
+	}
+	registerFlags(fs, &cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile sets the options found in the file at path, rejecting
+// unknown ones. JSON being valid YAML, both are read the same way.
+func readConfigFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// validate reports the first option that can't be used
+func (c *Config) validate() error {
+	_, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid -addr %q: %w", c.Addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid -addr %q: port must be a number between 0 and 65535", c.Addr)
+	}
+
+	if c.RTSPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.RTSPAddr); err != nil {
+			return fmt.Errorf("invalid -rtsp-addr %q: %w", c.RTSPAddr, err)
+		}
+	}
+
+	if c.PprofAddr != "" {
+		if _, _, err := net.SplitHostPort(c.PprofAddr); err != nil {
+			return fmt.Errorf("invalid -pprof-addr %q: %w", c.PprofAddr, err)
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("-cert and -key must be set together to enable TLS")
+	}
+	if (c.DTLSCertFile == "") != (c.DTLSKeyFile == "") {
+		return errors.New("-dtls-cert and -dtls-key must be set together")
+	}
+	if _, ok := dtlsRoles[c.DTLSRole]; !ok {
+		return fmt.Errorf("invalid -dtls-role %q: expected auto, client or server", c.DTLSRole)
+	}
+	if len(c.CORSOrigins) == 0 {
+		c.CORSOrigins = []string{"*"}
+	}
+	for _, origin := range c.CORSOrigins {
+		if err := validateOrigin(origin); err != nil {
+			return err
+		}
+	}
+	if err := validateACL(c.ACL); err != nil {
+		return err
+	}
+	// The admin endpoints only take the -token tokens, and would be open
+	// to anyone without one
+	if len(c.ACL) > 0 && len(c.Tokens) == 0 {
+		return errors.New("an acl needs a -token for the admin endpoints")
+	}
+	if c.MaxSessions < 1 {
+		return errors.New("-max-sessions must be at least 1")
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("-idle-timeout must not be negative")
+	}
+	if c.SessionTTL < 0 {
+		return errors.New("-session-ttl must not be negative")
+	}
+	if c.ConnectTimeout < 0 {
+		return errors.New("-connect-timeout must not be negative")
+	}
+	if c.MaxSessionDuration < 0 {
+		return errors.New("-max-session-duration must not be negative")
+	}
+	if c.IngestReconnects < 0 {
+		return errors.New("-ingest-reconnects must not be negative")
+	}
+	if c.IngestReconnects > 0 && c.IngestBackoff <= 0 {
+		return errors.New("-ingest-backoff must be positive")
+	}
+	if c.ReadTimeout <= 0 {
+		return errors.New("-read-timeout must be positive")
+	}
+	if c.DrainTimeout <= 0 {
+		return errors.New("-drain-timeout must be positive")
+	}
+	if c.PLIInterval <= 0 {
+		return errors.New("-pli-interval must be positive")
+	}
+	if c.LayerKeyframeInterval < 0 {
+		return errors.New("-layer-keyframe-interval must not be negative")
+	}
+	if c.PLIMaxRetries < 0 {
+		return errors.New("-pli-max-retries must not be negative")
+	}
+
+	if c.RTPBufferSize < 1200 || c.RTPBufferSize > 65535 {
+		return errors.New("-rtp-buffer-size must be between 1200 and 65535")
+	}
+	if c.MaxFrameSize < c.RTPBufferSize {
+		return errors.New("-max-frame-size must be at least -rtp-buffer-size")
+	}
+	if c.NACKHistorySize < 16 || c.NACKHistorySize > 32768 {
+		return errors.New("-nack-history must be between 16 and 32768")
+	}
+	if c.NACKTimeout <= 0 {
+		return errors.New("-nack-timeout must be positive")
+	}
+	if c.JitterBuffer < 0 || c.JitterBuffer > 1024 {
+		return errors.New("-jitter-buffer must be between 0 and 1024")
+	}
+
+	if c.BitrateLogInterval < 0 {
+		return errors.New("-bitrate-log-interval must not be negative")
+	}
+	if c.MaxBitrate < 0 {
+		return errors.New("-max-bitrate must not be negative")
+	}
+	if c.AnswerBandwidth != 0 && (c.AnswerBandwidth < minAnswerBandwidth || c.AnswerBandwidth > maxAnswerBandwidth) {
+		return fmt.Errorf("-answer-bandwidth must be 0 or between %d and %d kbps", minAnswerBandwidth, maxAnswerBandwidth)
+	}
+
+	if c.SimulateLoss < 0 || c.SimulateLoss > 100 {
+		return errors.New("-simulate-loss must be between 0 and 100")
+	}
+
+	if c.WAVSampleRate != 0 && (c.WAVSampleRate < 8000 || c.WAVSampleRate > 192000) {
+		return errors.New("-wav-sample-rate must be 0 or between 8000 and 192000")
+	}
+	if c.WAVChannels < 0 || c.WAVChannels > 2 {
+		return errors.New("-wav-channels must be 0, 1 or 2")
+	}
+	if c.FilenameTemplate != "" {
+		if _, err := renderFileName(c.FilenameTemplate, sampleFileNameData); err != nil {
+			return fmt.Errorf("invalid -filename-template: %w", err)
+		}
+	}
+	if !slices.Contains(recordingFormats, c.RecordingFormat) {
+		return fmt.Errorf("invalid -recording-format %q: use %s", c.RecordingFormat, strings.Join(recordingFormats, ", "))
+	}
+
+	if c.MaxFileDuration < 0 {
+		return errors.New("-max-file-duration must not be negative")
+	}
+	if c.MaxFileSize < 0 {
+		return errors.New("-max-file-size must not be negative")
+	}
+	if c.HLSSegmentDuration <= 0 {
+		return errors.New("-hls-segment-duration must be positive")
+	}
+	if c.HLSPlaylistSize < 0 {
+		return errors.New("-hls-playlist-size must not be negative")
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+
+	for _, server := range c.ICEServers {
+		if err := validateICEServer(server, c.TURNSecret != ""); err != nil {
+			return err
+		}
+	}
+	if c.TURNCredentialTTL <= 0 {
+		return errors.New("-turn-credential-ttl must be positive")
+	}
+	for _, ip := range c.PublicIPs {
+		if err := validatePublicIP(ip); err != nil {
+			return fmt.Errorf("invalid -public-ip %q: %w", ip, err)
+		}
+	}
+	if c.ICELite && len(c.PublicIPs) == 0 {
+		return errors.New("-ice-lite requires -public-ip")
+	}
+	if c.UDPReceiveBuffer < 0 {
+		return errors.New("-udp-receive-buffer must not be negative")
+	}
+	if err := c.validateICEPorts(); err != nil {
+		return err
+	}
+
+	for i, name := range c.Codecs {
+		mimeType, ok := canonicalCodec(name)
+		if !ok {
+			return fmt.Errorf("invalid -codecs entry %q: unsupported codec", name)
+		}
+		c.Codecs[i] = mimeType
+	}
+
+	if c.TestSource != "" {
+		if _, err := loadTestSource(c.TestSource); err != nil {
+			return fmt.Errorf("invalid -test-source %q: %w", c.TestSource, err)
+		}
+	}
+
+	if err := checkWritableDir(c.OutputDir); err != nil {
+		return fmt.Errorf("invalid -output-dir %q: %w", c.OutputDir, err)
+	}
+
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid -webhook-url %q: expected an http or https URL", c.WebhookURL)
+		}
+	}
+	if c.WebhookSecret != "" && c.WebhookURL == "" {
+		return errors.New("-webhook-secret requires -webhook-url")
+	}
+
+	if c.TLSEnabled() {
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return fmt.Errorf("invalid TLS key pair: %w", err)
+		}
+	}
+	if c.DTLSCertFile != "" {
+		if _, err := loadDTLSCertificate(c.DTLSCertFile, c.DTLSKeyFile); err != nil {
+			return fmt.Errorf("invalid DTLS certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateICEPorts checks the ICE port range is complete and leaves every
+// session a port of its own, the transports being bundled
+func (c *Config) validateICEPorts() error {
+	if c.ICEPortMin == 0 && c.ICEPortMax == 0 {
+		return nil
+	}
+	if c.ICEPortMin < 1 || c.ICEPortMax > 65535 || c.ICEPortMin > c.ICEPortMax {
+		return fmt.Errorf("invalid ICE port range %d-%d: -ice-port-min and -ice-port-max must be set together, with 1 <= min <= max <= 65535",
+			c.ICEPortMin, c.ICEPortMax)
+	}
+	if ports := c.ICEPortMax - c.ICEPortMin + 1; ports < c.MaxSessions {
+		return fmt.Errorf("ICE port range %d-%d has %d ports, fewer than -max-sessions %d", c.ICEPortMin, c.ICEPortMax, ports, c.MaxSessions)
+	}
+	return nil
+}
+
+// TLSEnabled reports whether the server should listen with HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// checkWritableDir creates dir if needed and makes sure files can be created in it
+func checkWritableDir(dir string) error {
+	if dir == "" {
+		return errors.New("must not be empty")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func envOr(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList parses a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// listFlag is a comma-separated flag that may also be repeated. The first use
+// on the command line replaces the default instead of appending to it.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+	*f.values = append(*f.values, splitList(value)...)
+	return nil
+}
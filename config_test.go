@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// writeTestCertificate writes a self-signed ECDSA certificate and its key as
+// PEM files in dir, returning their paths
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mediaserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     func(root string) string
+		wantErr bool
+	}{
+		{name: "existing", dir: func(root string) string { return root }},
+		{name: "created", dir: func(root string) string { return filepath.Join(root, "recordings", "today") }},
+		{name: "under a file", dir: func(root string) string { return filepath.Join(root, "file", "recordings") }, wantErr: true},
+		{name: "empty", dir: func(string) string { return "" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.WriteFile(filepath.Join(root, "file"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			dir := tt.dir(root)
+			err := checkWritableDir(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkWritableDir(%q) error = %v, want error %v", dir, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				t.Errorf("%s is not a directory: %v", dir, err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 && dir != root {
+				t.Errorf("write check left %d files behind", len(entries))
+			}
+		})
+	}
+}
+
+func TestAddrConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: ":8080"},
+		{name: "environment", env: "127.0.0.1:9000", want: "127.0.0.1:9000"},
+		{name: "flag over environment", env: ":9000", args: []string{"-addr", ":9100"}, want: ":9100"},
+		{name: "IPv6 host", args: []string{"-addr", "[::1]:9000"}, want: "[::1]:9000"},
+		{name: "no port", args: []string{"-addr", "localhost"}, wantErr: true},
+		{name: "named port", args: []string{"-addr", ":http"}, wantErr: true},
+		{name: "port out of range", env: ":70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MEDIASERVER_ADDR", tt.env)
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.Addr != tt.want {
+				t.Errorf("Addr = %q, want %q", cfg.Addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	_, otherKey := writeTestCertificate(t, t.TempDir())
+	tests := []struct {
+		name    string
+		args    []string
+		wantTLS bool
+		wantErr bool
+	}{
+		{name: "HTTP"},
+		{name: "HTTPS", args: []string{"-cert", certFile, "-key", keyFile}, wantTLS: true},
+		{name: "cert only", args: []string{"-cert", certFile}, wantErr: true},
+		{name: "key only", args: []string{"-key", keyFile}, wantErr: true},
+		{name: "mismatched key", args: []string{"-cert", certFile, "-key", otherKey}, wantErr: true},
+		{name: "missing files", args: []string{"-cert", certFile + ".missing", "-key", keyFile + ".missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MEDIASERVER_CERT", "")
+			t.Setenv("MEDIASERVER_KEY", "")
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.TLSEnabled() != tt.wantTLS {
+				t.Errorf("TLSEnabled() = %v, want %v", cfg.TLSEnabled(), tt.wantTLS)
+			}
+		})
+	}
+}
+
+// TestConfigFile loads the options from a -config file, with the flags
+// given alongside it taking precedence
+func TestConfigFile(t *testing.T) {
+	yamlConfig := `
+addr: ":9000"
+max-sessions: 20
+idle-timeout: 1m30s
+ice-server:
+  - urls: ["stun:stun.example.com"]
+  - urls: ["turn:turn.example.com:3478"]
+    username: alice
+    credential: secret
+codecs: [vp8, audio/opus]
+record-all-layers: true
+max-file-size: 1048576
+`
+	jsonConfig := `{"addr": ":9000", "max-sessions": 20, "idle-timeout": "90s", "codecs": ["video/VP8"]}`
+
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		check   func(t *testing.T, cfg Config)
+		wantErr string
+	}{
+		{
+			name: "YAML",
+			file: yamlConfig,
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Addr != ":9000" || cfg.MaxSessions != 20 || cfg.IdleTimeout != 90*time.Second {
+					t.Errorf("addr %q, max sessions %d, idle timeout %v", cfg.Addr, cfg.MaxSessions, cfg.IdleTimeout)
+				}
+				wantServers := []webrtc.ICEServer{
+					{URLs: []string{"stun:stun.example.com"}},
+					{URLs: []string{"turn:turn.example.com:3478"}, Username: "alice", Credential: "secret"},
+				}
+				if !reflect.DeepEqual(cfg.ICEServers, wantServers) {
+					t.Errorf("ICE servers %+v, want %+v", cfg.ICEServers, wantServers)
+				}
+				if want := []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}; !slices.Equal(cfg.Codecs, want) {
+					t.Errorf("codecs %v, want %v", cfg.Codecs, want)
+				}
+				if !cfg.RecordAllLayers || cfg.MaxFileSize != 1<<20 {
+					t.Errorf("record all layers %v, max file size %d", cfg.RecordAllLayers, cfg.MaxFileSize)
+				}
+				// Options the file leaves out keep their defaults
+				if cfg.PLIInterval != time.Second || cfg.LogLevel != "info" {
+					t.Errorf("PLI interval %v, log level %q, want the defaults", cfg.PLIInterval, cfg.LogLevel)
+				}
+			},
+		},
+		{
+			name: "JSON",
+			file: jsonConfig,
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Addr != ":9000" || cfg.MaxSessions != 20 || cfg.IdleTimeout != 90*time.Second || !slices.Equal(cfg.Codecs, []string{webrtc.MimeTypeVP8}) {
+					t.Errorf("addr %q, max sessions %d, idle timeout %v, codecs %v", cfg.Addr, cfg.MaxSessions, cfg.IdleTimeout, cfg.Codecs)
+				}
+			},
+		},
+		{
+			name: "flags override the file",
+			file: yamlConfig,
+			args: []string{"-max-sessions", "5", "-codecs", "h264"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Addr != ":9000" || cfg.MaxSessions != 5 || !slices.Equal(cfg.Codecs, []string{webrtc.MimeTypeH264}) {
+					t.Errorf("addr %q, max sessions %d, codecs %v", cfg.Addr, cfg.MaxSessions, cfg.Codecs)
+				}
+			},
+		},
+		{name: "unknown option", file: "max-session: 5\n", wantErr: "field max-session not found"},
+		{name: "wrong type", file: "max-sessions: many\n", wantErr: "line 1: cannot unmarshal"},
+		{name: "invalid value", file: "max-sessions: 0\n", wantErr: "-max-sessions must be at least 1"},
+		{name: "missing file", wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mediaserver.yaml")
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := flag.NewFlagSet("", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg, err := loadConfig(fs, append([]string{"-config", path, "-output-dir", t.TempDir()}, tt.args...))
+			if err == nil {
+				err = cfg.validate()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loading the config failed with %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
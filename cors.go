@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/rs/cors"
+)
+
+// withCORS answers preflights and adds CORS headers for the configured origins
+func withCORS(handler http.Handler) http.Handler {
+	return newCORS().Handler(handler)
+}
+
+// newCORS returns the CORS policy of the -cors-origins
+func newCORS() *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins: config.CORSOrigins,
+		AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "If-Match"},
+		ExposedHeaders: []string{"Content-Type", "Location", "ETag"},
+	})
+}
+
+// validateOrigin accepts "*" or a scheme://host[:port] origin, whose host may
+// hold a "*" wildcard such as https://*.example.com
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid -cors-origins entry %q: %w", origin, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid -cors-origins entry %q: must be * or an http(s)://host origin", origin)
+	}
+	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("invalid -cors-origins entry %q: an origin has no path, query or credentials", origin)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{origin: "*"},
+		{origin: "https://app.example.com"},
+		{origin: "http://localhost:8080"},
+		{origin: "https://*.example.com"},
+		{origin: "app.example.com", wantErr: true},
+		{origin: "ftp://example.com", wantErr: true},
+		{origin: "https://", wantErr: true},
+		{origin: "https://example.com/path", wantErr: true},
+		{origin: "https://example.com?q=1", wantErr: true},
+		{origin: "https://user@example.com", wantErr: true},
+		{origin: "https://exa mple.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if err := validateOrigin(tt.origin); (err != nil) != tt.wantErr {
+				t.Errorf("validateOrigin(%q) = %v, want error %v", tt.origin, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		args    []string
+		want    []string
+		wantErr string
+	}{
+		{name: "default", want: []string{"*"}},
+		{name: "env", env: "https://a.example.com, https://b.example.com", want: []string{"https://a.example.com", "https://b.example.com"}},
+		{name: "flag", args: []string{"-cors-origins", "https://a.example.com"}, want: []string{"https://a.example.com"}},
+		{name: "malformed", args: []string{"-cors-origins", "https://a.example.com,a.example.com"}, wantErr: "a.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("MEDIASERVER_CORS_ORIGINS", tt.env)
+			}
+			cfg := parseFlags(t, tt.args...)
+			err := cfg.validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validate = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.CORSOrigins, tt.want) {
+				t.Errorf("CORSOrigins = %q, want %q", cfg.CORSOrigins, tt.want)
+			}
+		})
+	}
+}
+
+// TestCORSPreflight sends the preflight of a browser publishing from origin
+// and checks whether it is allowed
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		// want is the Access-Control-Allow-Origin answered, "" when rejected
+		want string
+	}{
+		{name: "any origin", origins: []string{"*"}, origin: "https://app.example.com", want: "*"},
+		{name: "allowed origin", origins: []string{"https://app.example.com"}, origin: "https://app.example.com", want: "https://app.example.com"},
+		{name: "disallowed origin", origins: []string{"https://app.example.com"}, origin: "https://evil.example.com"},
+		{name: "other port", origins: []string{"https://app.example.com"}, origin: "https://app.example.com:8443"},
+		{name: "wildcard subdomain", origins: []string{"https://*.example.com"}, origin: "https://app.example.com", want: "https://app.example.com"},
+		{name: "outside the wildcard", origins: []string{"https://*.example.com"}, origin: "https://example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.CORSOrigins = tt.origins })
+			// main adds CORS around the router
+			server := httptest.NewServer(withCORS(newRouter()))
+			t.Cleanup(server.Close)
+			req, err := http.NewRequest(http.MethodOptions, server.URL+"/whip/cam", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			// Sorted and lowercase, as browsers send them
+			req.Header.Set("Access-Control-Request-Headers", "authorization,content-type")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.want)
+			}
+			if tt.want == "" {
+				return
+			}
+			if methods := resp.Header.Get("Access-Control-Allow-Methods"); !strings.Contains(methods, http.MethodPost) {
+				t.Errorf("Access-Control-Allow-Methods = %q, want POST", methods)
+			}
+			if headers := strings.ToLower(resp.Header.Get("Access-Control-Allow-Headers")); !strings.Contains(headers, "authorization") {
+				t.Errorf("Access-Control-Allow-Headers = %q, want Authorization", headers)
+			}
+		})
+	}
+}
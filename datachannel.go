@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// metadataChannel is the label of the DataChannel whose messages are recorded
+const metadataChannel = "metadata"
+
+// metadataRecord is one line of the metadata sidecar file. Binary messages
+// are stored base64 encoded.
+type metadataRecord struct {
+	Received time.Time `json:"received"`
+	Data     string    `json:"data"`
+	Binary   bool      `json:"binary,omitempty"`
+}
+
+// metadataWriter appends the messages of a session's metadata channels to
+// metadata.jsonl in the session directory
+type metadataWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func createMetadataWriter(dir string) (*metadataWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "metadata.jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &metadataWriter{file: file}, nil
+}
+
+func (w *metadataWriter) write(msg webrtc.DataChannelMessage, received time.Time) error {
+	record := metadataRecord{Received: received, Data: string(msg.Data)}
+	if !msg.IsString {
+		record.Data = base64.StdEncoding.EncodeToString(msg.Data)
+		record.Binary = true
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	_, err = w.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file; later calls do nothing
+func (w *metadataWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// handleDataChannel records the messages of the metadata channel; messages
+// on any other channel are dropped
+func (s *session) handleDataChannel(channel *webrtc.DataChannel) {
+	logger := s.log.With("channel", channel.Label())
+	if channel.Label() != metadataChannel {
+		logger.Info("Data channel not recorded")
+		return
+	}
+
+	writer, err := s.openMetadata()
+	if err != nil {
+		logger.Error("Failed to create metadata file", "error", err)
+		return
+	}
+	logger.Info("Recording data channel")
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := writer.write(msg, time.Now()); err != nil {
+			logger.Warn("Failed to write metadata", "error", err)
+		}
+	})
+}
+
+// openMetadata returns the session's metadata file, creating it for the first channel
+func (s *session) openMetadata() (*metadataWriter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, os.ErrClosed
+	}
+	if s.metadata == nil {
+		writer, err := createMetadataWriter(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.metadata = writer
+	}
+	return s.metadata, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// dataChannelMessage is a message a test publisher sends on a data channel
+type dataChannelMessage struct {
+	text   string
+	binary []byte
+}
+
+// TestDataChannelRecording sends messages on a data channel of a publisher
+// and checks they were recorded only for the metadata channel
+func TestDataChannelRecording(t *testing.T) {
+	tests := []struct {
+		name     string
+		label    string
+		messages []dataChannelMessage
+		// want are the lines of the metadata file, none when it isn't written
+		want []metadataRecord
+	}{
+		{
+			name:     "metadata",
+			label:    metadataChannel,
+			messages: []dataChannelMessage{{text: `{"marker":"start"}`}, {binary: []byte{0, 1, 0xff}}, {text: "scene 2"}},
+			want:     []metadataRecord{{Data: `{"marker":"start"}`}, {Data: "AAH/", Binary: true}, {Data: "scene 2"}},
+		},
+		{name: "other channel", label: "chat", messages: []dataChannelMessage{{text: "hello"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			pc := newTestPeerConnection(t)
+			track, err := webrtc.NewTrackLocalStaticSample(trackCapability(webrtc.MimeTypeVP8), "video", "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := pc.AddTrack(track); err != nil {
+				t.Fatal(err)
+			}
+			channel, err := pc.CreateDataChannel(tt.label, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened := make(chan struct{})
+			channel.OnOpen(func() { close(opened) })
+
+			resp, body := postOffer(t, base+"/whip/cam", pc, nil)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+			}
+			p := &testPublisher{pc: pc, location: resp.Header.Get("Location"), tracks: []*webrtc.TrackLocalStaticSample{track}}
+			select {
+			case <-opened:
+			case <-time.After(testTimeout):
+				t.Fatal("data channel did not open")
+			}
+			start := time.Now()
+			for _, msg := range tt.messages {
+				if msg.binary != nil {
+					err = channel.Send(msg.binary)
+				} else {
+					err = channel.SendText(msg.text)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			path := filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"), "metadata.jsonl")
+			lines := func() int {
+				data, _ := os.ReadFile(path)
+				return bytes.Count(data, []byte("\n"))
+			}
+			if tt.want != nil {
+				waitFor(t, "the messages to be recorded", func() bool { return lines() == len(tt.want) })
+			} else {
+				// Nothing to wait for; give the messages time to arrive
+				p.play(t, 300*time.Millisecond)
+			}
+			p.stop(t, base)
+
+			file, err := os.Open(path)
+			if tt.want == nil {
+				if err == nil {
+					file.Close()
+					t.Errorf("metadata.jsonl written for channel %q", tt.label)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var got []metadataRecord
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var record metadataRecord
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					t.Fatalf("line %q: %v", scanner.Text(), err)
+				}
+				if record.Received.Before(start.Truncate(time.Second)) || record.Received.After(time.Now()) {
+					t.Errorf("message received at %v, sent at %v", record.Received, start)
+				}
+				record.Received = time.Time{}
+				got = append(got, record)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("recorded %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("line %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
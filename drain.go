@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainState tells whether the server is draining, ahead of a deploy: it
+// takes no new sessions, and closes those it has once -drain-timeout has
+// passed, finalizing their recordings. Draining lasts until the process
+// exits or it is cancelled.
+type drainState struct {
+	mu    sync.Mutex
+	since time.Time
+	timer *time.Timer
+}
+
+var drain = &drainState{}
+
+// start starts draining, reporting whether the server wasn't already. The
+// ingests waiting to reconnect are stopped, as each would start a session.
+func (d *drainState) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.since.IsZero() {
+		return false
+	}
+	d.since = time.Now()
+	d.timer = time.AfterFunc(config.DrainTimeout, func() {
+		if !d.active() {
+			return
+		}
+		slog.Warn("Drain timeout passed, closing the remaining sessions", "sessions", sessions.count(), "viewers", viewers.total())
+		sessions.closeAll()
+		viewers.closeAll()
+	})
+	ingestRetries.stopAll()
+	slog.Info("Draining, new sessions are refused", "sessions", sessions.count(), "timeout", config.DrainTimeout)
+	return true
+}
+
+// cancel stops draining, reporting whether the server was. The sessions
+// are taken again, but the ingests stopped by start aren't restarted.
+func (d *drainState) cancel() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		return false
+	}
+	d.timer.Stop()
+	d.since, d.timer = time.Time{}, nil
+	slog.Info("Draining cancelled, new sessions are taken")
+	return true
+}
+
+// started returns when draining started, the zero time if it hasn't
+func (d *drainState) started() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.since
+}
+
+// active reports whether the server is draining
+func (d *drainState) active() bool {
+	return !d.started().IsZero()
+}
+
+// acceptingSessions answers 503 to a request for a new session while the
+// server drains, and reports whether the handler may continue
+func acceptingSessions(w http.ResponseWriter, writeError errorWriter) bool {
+	if !drain.active() {
+		return true
+	}
+	writeError(w, "Server is draining", http.StatusServiceUnavailable)
+	return false
+}
+
+// drainResponse answers /drain
+type drainResponse struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+	Sessions int        `json:"sessions"`
+}
+
+// Handler for /drain, refused unless a -token is configured, as draining
+// refuses every new session. POST starts draining the server like SIGHUP,
+// answering 202 when draining starts and 200 if it already had. DELETE
+// cancels draining.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, writeJSONError, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		if drain.start() {
+			status = http.StatusAccepted
+		}
+	case http.MethodDelete:
+		drain.cancel()
+	}
+	response := drainResponse{Sessions: sessions.count()}
+	if since := drain.started(); !since.IsZero() {
+		response.Draining, response.Since = true, &since
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// startDraining gives the test a drain state of its own, cancelled after
+// it so its timeout cannot close a later test's sessions
+func startDraining(t *testing.T) {
+	t.Helper()
+	saved := drain
+	drain = &drainState{}
+	t.Cleanup(func() {
+		drain.cancel()
+		drain = saved
+	})
+}
+
+// health returns the body of /healthz
+func health(t *testing.T, base string) map[string]any {
+	t.Helper()
+	resp, err := http.Get(base + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// TestDrain drains the server under a publisher and checks new publishers
+// and viewers are refused while the publisher's session goes on, then
+// cancels draining and checks they are taken again
+func TestDrain(t *testing.T) {
+	startDraining(t)
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	useAdminToken(t)
+	p.token = testAdminToken
+	if body := health(t, base); body["status"] != "ok" || body["draining"] != false {
+		t.Errorf("/healthz before draining = %v", body)
+	}
+
+	for _, want := range []int{http.StatusAccepted, http.StatusOK} {
+		resp, body := adminRequest(t, http.MethodPost, base+"/drain", "")
+		var got drainResponse
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want || !got.Draining || got.Sessions != 1 {
+			t.Errorf("POST /drain answered %d %+v, want %d draining 1 session", resp.StatusCode, got, want)
+		}
+	}
+	body := health(t, base)
+	if body["status"] != "draining" || body["draining"] != true || body["draining_since"] == nil {
+		t.Errorf("/healthz while draining = %v", body)
+	}
+
+	for _, path := range []string{"/whip/other", "/whep/cam"} {
+		pc := newCodecPublisher(t, webrtc.MimeTypeVP8).pc
+		header := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+		if resp, body := postOffer(t, base+path, pc, header); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("POST %s answered %d: %s, want 503", path, resp.StatusCode, body)
+		}
+	}
+	if resp, body := postIngest(t, base, `{"url": "`+base+`/whep/cam"}`); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST /ingest answered %d: %s, want 503", resp.StatusCode, body)
+	}
+
+	// The publisher goes on recording until it ends its session
+	p.play(t, time.Second)
+	if n := sessions.count(); n != 1 {
+		t.Fatalf("%d sessions while draining, want the publisher's", n)
+	}
+	p.stop(t, base)
+	entries, err := os.ReadDir(filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/")))
+	if err != nil || len(entries) == 0 {
+		t.Errorf("nothing recorded while draining: %v", err)
+	}
+
+	resp, data := adminRequest(t, http.MethodDelete, base+"/drain", "")
+	var got drainResponse
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || got.Draining || got.Since != nil {
+		t.Errorf("DELETE /drain answered %d %+v, want 200 not draining", resp.StatusCode, got)
+	}
+	if body := health(t, base); body["status"] != "ok" || body["draining"] != false {
+		t.Errorf("/healthz after draining = %v", body)
+	}
+	pc := newCodecPublisher(t, webrtc.MimeTypeVP8).pc
+	header := http.Header{"Authorization": {"Bearer " + testAdminToken}}
+	if resp, body := postOffer(t, base+"/whip/other", pc, header); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST /whip/other after draining answered %d: %s, want 201", resp.StatusCode, body)
+	}
+}
+
+// TestDrainNoToken checks /drain is refused unless a -token is configured
+func TestDrainNoToken(t *testing.T) {
+	startDraining(t)
+	base := startServer(t)
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		if resp, body := adminRequest(t, method, base+"/drain", ""); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s /drain answered %d: %s, want 403", method, resp.StatusCode, body)
+		}
+	}
+	if drain.active() {
+		t.Error("draining without a -token")
+	}
+}
+
+// TestDrainTimeout checks the sessions still open once -drain-timeout has
+// passed are closed
+func TestDrainTimeout(t *testing.T) {
+	startDraining(t)
+	setConfig(t, func(c *Config) { c.DrainTimeout = 500 * time.Millisecond })
+	base := startServer(t)
+	publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+
+	if !drain.start() || drain.start() {
+		t.Fatal("draining didn't start exactly once")
+	}
+	time.Sleep(config.DrainTimeout / 2)
+	if n := sessions.count(); n != 1 {
+		t.Fatalf("%d sessions before the drain timeout, want 1", n)
+	}
+	waitFor(t, "the session to be closed", func() bool { return sessions.count() == 0 })
+}
+
+func TestDrainTimeoutFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: 10 * time.Minute},
+		{name: "set", args: []string{"-drain-timeout", "1h"}, want: time.Hour},
+		{name: "zero", args: []string{"-drain-timeout", "0s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.DrainTimeout != tt.want {
+				t.Errorf("DrainTimeout = %v, want %v", cfg.DrainTimeout, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// dtlsRoles maps the -dtls-role values to the role taken when answering;
+// auto leaves it to pion, which takes the client role
+var dtlsRoles = map[string]webrtc.DTLSRole{
+	"auto":   webrtc.DTLSRoleAuto,
+	"client": webrtc.DTLSRoleClient,
+	"server": webrtc.DTLSRoleServer,
+}
+
+// dtlsCertificates are handed to every PeerConnection, loaded in main from
+// -dtls-cert and -dtls-key. Empty, pion generates a certificate for each.
+var dtlsCertificates []webrtc.Certificate
+
+// loadDTLSCertificate reads the PEM certificate and private key of
+// -dtls-cert and -dtls-key. Clients can pin its fingerprint, which every
+// answer then carries.
+func loadDTLSCertificate(certFile, keyFile string) (webrtc.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return webrtc.Certificate{}, err
+	}
+	switch pair.PrivateKey.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+	default:
+		return webrtc.Certificate{}, fmt.Errorf("unsupported %T private key, expected ECDSA or RSA", pair.PrivateKey)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return webrtc.Certificate{}, fmt.Errorf("certificate expired on %s", cert.NotAfter.Format(time.DateOnly))
+	}
+	return webrtc.CertificateFromX509(pair.PrivateKey, cert), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestDTLSFlags(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not PEM"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "certificate", args: []string{"-dtls-cert", certFile, "-dtls-key", keyFile}},
+		{name: "server role", args: []string{"-dtls-role", "server"}},
+		{name: "client role", args: []string{"-dtls-role", "client"}},
+		{name: "unknown role", args: []string{"-dtls-role", "active"}, wantErr: "invalid -dtls-role"},
+		{name: "certificate alone", args: []string{"-dtls-cert", certFile}, wantErr: "must be set together"},
+		{name: "key alone", args: []string{"-dtls-key", keyFile}, wantErr: "must be set together"},
+		{name: "invalid certificate", args: []string{"-dtls-cert", garbage, "-dtls-key", keyFile}, wantErr: "invalid DTLS certificate"},
+		{name: "missing file", args: []string{"-dtls-cert", filepath.Join(dir, "missing.crt"), "-dtls-key", keyFile}, wantErr: "invalid DTLS certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestDTLSCertificate publishes twice with -dtls-cert and checks both
+// answers carry the fingerprint of the configured certificate, and the
+// setup of the -dtls-role
+func TestDTLSCertificate(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	digest := sha256.Sum256(block.Bytes)
+	hex := make([]string, len(digest))
+	for i, b := range digest {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	fingerprint := "a=fingerprint:sha-256 " + strings.Join(hex, ":")
+
+	tests := []struct {
+		role      string
+		wantSetup string
+	}{
+		{role: "auto", wantSetup: "a=setup:active"},
+		{role: "client", wantSetup: "a=setup:active"},
+		{role: "server", wantSetup: "a=setup:passive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.DTLSCertFile, c.DTLSKeyFile, c.DTLSRole = certFile, keyFile, tt.role })
+			certificate, err := loadDTLSCertificate(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			savedCertificates, savedAPI := dtlsCertificates, webrtcAPI
+			t.Cleanup(func() { dtlsCertificates, webrtcAPI = savedCertificates, savedAPI })
+			dtlsCertificates = []webrtc.Certificate{certificate}
+			if webrtcAPI, err = newAPI(); err != nil {
+				t.Fatal(err)
+			}
+			base := startServer(t)
+
+			for i := range 2 {
+				p := newCodecPublisher(t, webrtc.MimeTypeVP8)
+				resp, body := postOffer(t, base+fmt.Sprintf("/whip/cam%d", i), p.pc, nil)
+				if resp.StatusCode != http.StatusCreated {
+					t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+				}
+				if !strings.Contains(body, fingerprint+"\r\n") {
+					t.Errorf("answer %d lacks %q:\n%s", i, fingerprint, body)
+				}
+				if !strings.Contains(body, tt.wantSetup+"\r\n") {
+					t.Errorf("answer %d lacks %q:\n%s", i, tt.wantSetup, body)
+				}
+				waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+			}
+		})
+	}
+}
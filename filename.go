@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// fileNameData are the variables of -filename-template. Client-chosen
+// values are sanitized before the template sees them.
+type fileNameData struct {
+	SessionID string
+	StreamKey string
+	Kind      string
+	TrackID   string
+	RID       string
+	SSRC      uint32
+	Codec     string
+	Date      string
+	Time      string
+}
+
+// newFileNameData returns the template variables of a track arriving at now
+func newFileNameData(sess *session, track *webrtc.TrackRemote, now time.Time) fileNameData {
+	_, codec, _ := strings.Cut(track.Codec().MimeType, "/")
+	data := fileNameData{
+		SessionID: sess.id,
+		StreamKey: sess.streamKey,
+		Kind:      track.Kind().String(),
+		TrackID:   sanitizeFileName(track.ID()),
+		SSRC:      uint32(track.SSRC()),
+		Codec:     codec,
+		Date:      now.Format("2006-01-02"),
+		Time:      now.Format("150405"),
+	}
+	if track.RID() != "" {
+		data.RID = sanitizeFileName(track.RID())
+	}
+	return data
+}
+
+// sampleFileNameData is what -filename-template is tried with on startup
+var sampleFileNameData = fileNameData{
+	SessionID: "00000000-0000-0000-0000-000000000000",
+	StreamKey: defaultStreamKey,
+	Kind:      "video",
+	TrackID:   "track",
+	RID:       "h",
+	SSRC:      1,
+	Codec:     "VP8",
+	Date:      "2006-01-02",
+	Time:      "150405",
+}
+
+var errEscapesOutputDir = errors.New("the path leaves the output directory")
+
+// renderFileName renders the template text into the path of a track's
+// outputs relative to the output directory, without their extension. Paths
+// that are absolute or climb out with ".." are rejected, and every
+// component of the rest is sanitized.
+func renderFileName(text string, data fileNameData) (string, error) {
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	rendered := filepath.ToSlash(b.String())
+	if strings.Trim(rendered, "/") == "" {
+		return "", errors.New("the path is empty")
+	}
+	if strings.HasPrefix(rendered, "/") || !filepath.IsLocal(filepath.FromSlash(rendered)) {
+		return "", errEscapesOutputDir
+	}
+	var components []string
+	for _, component := range strings.Split(rendered, "/") {
+		if component != "" && component != "." {
+			components = append(components, sanitizeFileName(component))
+		}
+	}
+	return filepath.Join(components...), nil
+}
+
+// trackOutputName returns the path of the files a track is recorded to on
+// its own, less their extension: rendered from -filename-template if set,
+// otherwise named by trackFileName in the session directory. The directories
+// it needs are created.
+func (s *session) trackOutputName(track *webrtc.TrackRemote) (string, error) {
+	if config.FilenameTemplate == "" {
+		return filepath.Join(s.dir, trackFileName(track.Kind(), track.ID(), track.RID(), track.SSRC())), nil
+	}
+	name, err := renderFileName(config.FilenameTemplate, newFileNameData(s, track, time.Now()))
+	if err != nil {
+		return "", err
+	}
+	name = filepath.Join(config.OutputDir, name)
+	return name, os.MkdirAll(filepath.Dir(name), 0o755)
+}
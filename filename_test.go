@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRenderFileName(t *testing.T) {
+	data := fileNameData{
+		SessionID: "3f2a",
+		StreamKey: "cam",
+		Kind:      "video",
+		TrackID:   "camera",
+		SSRC:      1234,
+		Codec:     "VP8",
+		Date:      "2024-05-06",
+		Time:      "070809",
+	}
+	tests := []struct {
+		name     string
+		template string
+		rid      string
+		want     string
+		wantErr  bool
+	}{
+		{name: "like the default", template: "{{.SessionID}}/{{.Kind}}_{{.TrackID}}_{{.SSRC}}", want: "3f2a/video_camera_1234"},
+		{name: "by stream and date", template: "{{.StreamKey}}/{{.Date}}/{{.Kind}}-{{.SSRC}}", want: "cam/2024-05-06/video-1234"},
+		{name: "codec and time", template: "{{.StreamKey}}-{{.Time}}.{{.Codec}}", want: "cam-070809.VP8"},
+		{name: "with a layer", template: "{{.Kind}}{{if .RID}}_{{.RID}}{{end}}", rid: "low", want: "video_low"},
+		{name: "without a layer", template: "{{.Kind}}{{if .RID}}_{{.RID}}{{end}}", want: "video"},
+		{name: "unsafe characters", template: "my streams/{{.StreamKey}}:{{.Kind}}", want: "my_streams/cam_video"},
+		{name: "empty and dot components", template: "./{{.StreamKey}}//{{.Kind}}/", want: "cam/video"},
+		{name: "hidden file", template: ".{{.Kind}}", want: "video"},
+		{name: "parent directory", template: "../{{.Kind}}", wantErr: true},
+		{name: "climbing out", template: "{{.StreamKey}}/../../{{.Kind}}", wantErr: true},
+		{name: "absolute", template: "/tmp/{{.Kind}}", wantErr: true},
+		{name: "empty", template: "{{.RID}}", wantErr: true},
+		{name: "unknown variable", template: "{{.Bitrate}}", wantErr: true},
+		{name: "invalid syntax", template: "{{.Kind", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := data
+			data.RID = tt.rid
+			got, err := renderFileName(tt.template, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderFileName(%q) error = %v, want error %v", tt.template, err, tt.wantErr)
+			}
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("renderFileName(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilenameTemplateFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "template", args: []string{"-filename-template", "{{.StreamKey}}/{{.Date}}/{{.Kind}}-{{.SSRC}}"}},
+		{name: "escaping", args: []string{"-filename-template", "../{{.StreamKey}}"}, wantErr: true},
+		{name: "escaping with a layer", args: []string{"-filename-template", "{{if .RID}}../{{end}}{{.Kind}}"}, wantErr: true},
+		{name: "unknown variable", args: []string{"-filename-template", "{{.Ext}}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestFilenameTemplate records two VP8 tracks to IVF under -filename-template
+// and checks they were written to the paths it renders, in directories
+// created for them
+func TestFilenameTemplate(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) { c.FilenameTemplate = "{{.StreamKey}}/{{.Date}}/{{.Kind}}-{{.Codec}}-{{.SSRC}}" })
+	p := newCodecPublisher(t, webrtc.MimeTypeVP8, webrtc.MimeTypeVP8)
+	resp, body := postOffer(t, base+"/whip/cam?format=ivf", p.pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	p.location = resp.Header.Get("Location")
+	waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	p.play(t, 500*time.Millisecond)
+	p.stop(t, base)
+
+	var want []string
+	for _, sender := range p.pc.GetSenders() {
+		want = append(want, fmt.Sprintf("video-VP8-%d.ivf", sender.GetParameters().Encodings[0].SSRC))
+	}
+	slices.Sort(want)
+	dir := filepath.Join(config.OutputDir, "cam", time.Now().Format("2006-01-02"))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Size() > 0 {
+			got = append(got, entry.Name())
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("recorded %v in %s, want %v", got, dir, want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// recordingFormats are the containers a session can be recorded in. auto
+// picks MP4 for H.264 video and WebM otherwise; ivf and raw write a file
+// per track, and hls fMP4 segments under the stream's own directory. Audio
+// tracks a container can't carry get files of their own.
+var recordingFormats = []string{"auto", "webm", "mp4", "ivf", "raw", "hls"}
+
+// formatCarries reports whether recordings in format hold codec
+func formatCarries(format, mimeType string) bool {
+	switch format {
+	case "webm":
+		return webmCodecID(mimeType) != ""
+	case "mp4", "hls":
+		return mimeType == webrtc.MimeTypeH264 || mimeType == webrtc.MimeTypeOpus
+	case "ivf":
+		return mimeType == webrtc.MimeTypeVP8 || mimeType == webrtc.MimeTypeVP9 || mimeType == webrtc.MimeTypeAV1
+	case "raw":
+		return mimeType == webrtc.MimeTypeH264 || mimeType == webrtc.MimeTypeH265
+	}
+	return canRecord(mimeType)
+}
+
+// applyRecordingFormat narrows the codecs of every video track negotiated
+// on peerConnection to those format carries, so the answer only accepts
+// them. It fails if a video track is left without a codec or format carries
+// none of the tracks.
+func applyRecordingFormat(peerConnection *webrtc.PeerConnection, format string) error {
+	if format == "auto" {
+		return nil
+	}
+	carried := false
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		switch transceiver.Direction() {
+		case webrtc.RTPTransceiverDirectionRecvonly, webrtc.RTPTransceiverDirectionSendrecv:
+		default:
+			continue
+		}
+		receiver := transceiver.Receiver()
+		if receiver == nil {
+			continue
+		}
+		var codecs []webrtc.RTPCodecParameters
+		for _, codec := range receiver.GetParameters().Codecs {
+			if formatCarries(format, codec.MimeType) && codecAllowed(config.Codecs, codec.MimeType) {
+				codecs = append(codecs, codec)
+			}
+		}
+		carried = carried || len(codecs) > 0
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if len(codecs) == 0 {
+			return fmt.Errorf("recording format %s can't carry the offered video codecs", format)
+		}
+		if err := transceiver.SetCodecPreferences(codecs); err != nil {
+			return err
+		}
+	}
+	if !carried {
+		return fmt.Errorf("recording format %s can't carry the offered codecs", format)
+	}
+	return nil
+}
+
+// newSessionMuxer returns the muxer recording the session's tracks in
+// format to dir, or for hls to the directory of streamKey under the output
+// directory. auto records H.264 video to MP4, as WebM can't carry it.
+func newSessionMuxer(dir, streamKey string, peerConnection *webrtc.PeerConnection, tracks int, format string) trackMuxer {
+	switch format {
+	case "hls":
+		return newHLSMuxer(filepath.Join(config.OutputDir, streamKey), tracks)
+	case "webm":
+		return newWebMMuxer(filepath.Join(dir, "recording.webm"), tracks)
+	case "mp4":
+		return newMP4Muxer(filepath.Join(dir, "recording.mp4"), tracks)
+	case "ivf", "raw":
+		return trackFiles{}
+	}
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		receiver := transceiver.Receiver()
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo || receiver == nil {
+			continue
+		}
+		h264, webm := false, false
+		for _, codec := range receiver.GetParameters().Codecs {
+			if !codecAllowed(config.Codecs, codec.MimeType) {
+				continue
+			}
+			h264 = h264 || codec.MimeType == webrtc.MimeTypeH264
+			webm = webm || webmCodecID(codec.MimeType) != ""
+		}
+		if h264 && !webm {
+			return newMP4Muxer(filepath.Join(dir, "recording.mp4"), tracks)
+		}
+	}
+	return newWebMMuxer(filepath.Join(dir, "recording.webm"), tracks)
+}
+
+// trackFiles muxes nothing, leaving every track to a file of its own
+type trackFiles struct{}
+
+func (trackFiles) addTrack(webrtc.RTPCodecParameters) (mediaWriter, rtp.Depacketizer, error) {
+	return nil, nil, errUnsupportedCodec
+}
+
+func (trackFiles) skipTrack() {}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRecordingFormatFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: "auto"},
+		{name: "mp4", args: []string{"-recording-format", "mp4"}, want: "mp4"},
+		{name: "unknown", args: []string{"-recording-format", "avi"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "-recording-format") {
+					t.Errorf("validate() = %v, want a -recording-format error", err)
+				}
+				return
+			}
+			if err != nil || cfg.RecordingFormat != tt.want {
+				t.Errorf("validate() = %v, format %q, want %q", err, cfg.RecordingFormat, tt.want)
+			}
+		})
+	}
+}
+
+// TestRecordingFormat publishes with a ?format, or the -recording-format
+// default, and checks the files recorded or the publish rejected
+func TestRecordingFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		def     string
+		publish []string
+		// offer are extra codecs the publisher accepts for its tracks
+		offer      []string
+		wantStatus int
+		// want are the extensions of the recorded files, sorted
+		want []string
+	}{
+		{name: "webm", query: "?format=webm", publish: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, wantStatus: http.StatusCreated, want: []string{".webm"}},
+		{name: "mp4", query: "?format=mp4", publish: []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}, wantStatus: http.StatusCreated, want: []string{".mp4"}},
+		{name: "mp4 with G.711", query: "?format=mp4", publish: []string{webrtc.MimeTypeH264, webrtc.MimeTypePCMU}, wantStatus: http.StatusCreated, want: []string{".mp4", ".wav"}},
+		{name: "ivf", query: "?format=ivf", publish: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, wantStatus: http.StatusCreated, want: []string{".ivf", ".ogg"}},
+		{name: "raw", query: "?format=raw", publish: []string{webrtc.MimeTypeH264}, wantStatus: http.StatusCreated, want: []string{".h264"}},
+		{name: "auto", query: "?format=auto", publish: []string{webrtc.MimeTypeVP8}, wantStatus: http.StatusCreated, want: []string{".webm"}},
+		{name: "server default", def: "ivf", publish: []string{webrtc.MimeTypeVP8}, wantStatus: http.StatusCreated, want: []string{".ivf"}},
+		{name: "query over default", query: "?format=webm", def: "ivf", publish: []string{webrtc.MimeTypeVP8}, wantStatus: http.StatusCreated, want: []string{".webm"}},
+		{name: "webm narrows the offer", query: "?format=webm", publish: []string{webrtc.MimeTypeVP8}, offer: []string{webrtc.MimeTypeH264}, wantStatus: http.StatusCreated, want: []string{".webm"}},
+		{name: "mp4 for VP8", query: "?format=mp4", publish: []string{webrtc.MimeTypeVP8}, wantStatus: http.StatusBadRequest},
+		{name: "webm for H.264", query: "?format=webm", publish: []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}, wantStatus: http.StatusBadRequest},
+		{name: "ivf for audio only", query: "?format=ivf", publish: []string{webrtc.MimeTypeOpus}, wantStatus: http.StatusBadRequest},
+		{name: "unknown", query: "?format=avi", publish: []string{webrtc.MimeTypeVP8}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.def != "" {
+				setConfig(t, func(c *Config) { c.RecordingFormat = tt.def })
+			}
+			base := startServer(t)
+			p := newOfferPublisher(t, tt.publish, tt.offer)
+			resp, body := postOffer(t, base+"/whip/cam"+tt.query, p.pc, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("publish answered %d: %s, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if resp.StatusCode != http.StatusCreated {
+				if sessions.count() != 0 {
+					t.Error("rejected publish left a session")
+				}
+				return
+			}
+			for _, mimeType := range tt.offer {
+				if strings.Contains(body, strings.TrimPrefix(mimeType, "video/")) {
+					t.Errorf("answer accepts %s, which the format can't carry", mimeType)
+				}
+			}
+			p.location = resp.Header.Get("Location")
+			waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+			p.play(t, 500*time.Millisecond)
+			p.stop(t, base)
+
+			entries, err := os.ReadDir(filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				if info, err := entry.Info(); err != nil || info.Size() == 0 {
+					t.Errorf("%s is empty", entry.Name())
+				}
+				got = append(got, filepath.Ext(entry.Name()))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recorded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// mediaWriter persists the complete frames of a single track. pts is the
+// presentation time of the frame relative to the first one written.
+type mediaWriter interface {
+	WriteFrame(frame []byte, pts time.Duration) error
+	Close() error
+}
+
+// finalizer is implemented by writers whose container has to be completed
+// once the track ends: the stream terminated and the durations and sizes in
+// the header patched. Close finalizes first if Finalize wasn't called.
+type finalizer interface {
+	Finalize() error
+}
+
+// trackMuxer records the tracks of a session into a single file
+type trackMuxer interface {
+	// addTrack returns the writer and depacketizer of a track, or
+	// errUnsupportedCodec if the container can't carry its codec
+	addTrack(codec webrtc.RTPCodecParameters) (mediaWriter, rtp.Depacketizer, error)
+	// skipTrack stops waiting for a track that won't be part of the file
+	skipTrack()
+}
+
+// teeWriter writes every frame to each of its writers, such as the session's
+// muxer and the file of the simulcast layer
+type teeWriter []mediaWriter
+
+func (w teeWriter) WriteFrame(frame []byte, pts time.Duration) error {
+	for _, writer := range w {
+		if err := writer.WriteFrame(frame, pts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finalize completes the container of each writer needing it
+func (w teeWriter) Finalize() error {
+	var errs []error
+	for _, writer := range w {
+		if f, ok := writer.(finalizer); ok {
+			errs = append(errs, f.Finalize())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// awaitingKeyframe reports whether any of the writers waits for a keyframe
+func (w teeWriter) awaitingKeyframe() bool {
+	for _, writer := range w {
+		if waiter, ok := writer.(keyframeWaiter); ok && waiter.awaitingKeyframe() {
+			return true
+		}
+	}
+	return false
+}
+
+func (w teeWriter) Close() error {
+	var errs []error
+	for _, writer := range w {
+		errs = append(errs, writer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// rawWriter writes frames back to back with no container framing, so timing is lost
+type rawWriter struct {
+	file *os.File
+}
+
+func (w *rawWriter) WriteFrame(frame []byte, pts time.Duration) error {
+	_, err := w.file.Write(frame)
+	return err
+}
+
+func (w *rawWriter) Close() error {
+	return w.file.Close()
+}
+
+// errFrameTooLarge reports a frame dropped for growing past -max-frame-size
+var errFrameTooLarge = errors.New("frame exceeds the maximum frame size")
+
+// frameAssembler collects depacketized RTP payloads into complete video frames
+type frameAssembler struct {
+	buf       []byte
+	inFrame   bool
+	timestamp uint32
+
+	// maxSize caps the frame being reassembled, 0 leaving it unbounded
+	maxSize int
+	// dropping skips the rest of the frame on timestamp once it was dropped
+	dropping bool
+}
+
+// push adds the payload of packet and returns the finished frame once the
+// packet that closes it arrives. Payloads that arrive before a frame start are
+// dropped, and a new frame start discards any frame whose last packet was
+// lost. A frame growing past maxSize is dropped with errFrameTooLarge. The
+// returned slice is only valid until the next call.
+func (a *frameAssembler) push(depacketizer rtp.Depacketizer, packet *rtp.Packet, payload []byte) ([]byte, error) {
+	start, end, skip := a.boundaries(depacketizer, packet)
+	if skip {
+		return nil, nil
+	}
+	if a.dropping {
+		if packet.Timestamp == a.timestamp {
+			return nil, nil
+		}
+		a.dropping = false
+	}
+	if start {
+		a.buf = a.buf[:0]
+		a.inFrame = true
+		a.timestamp = packet.Timestamp
+	}
+	if !a.inFrame {
+		return nil, nil
+	}
+
+	if a.maxSize > 0 && len(a.buf)+len(payload) > a.maxSize {
+		a.drop(a.timestamp)
+		return nil, errFrameTooLarge
+	}
+	a.buf = append(a.buf, payload...)
+	if !end {
+		return nil, nil
+	}
+	a.inFrame = false
+	return a.buf, nil
+}
+
+// drop discards the frame being reassembled, and the packets still to come
+// of the frame on timestamp
+func (a *frameAssembler) drop(timestamp uint32) {
+	a.buf = a.buf[:0]
+	a.inFrame = false
+	a.timestamp = timestamp
+	a.dropping = true
+}
+
+// boundaries reports whether packet starts or ends a frame, or belongs to a
+// layer that isn't recorded. It must be called after depacketizer has parsed
+// the packet.
+func (a *frameAssembler) boundaries(depacketizer rtp.Depacketizer, packet *rtp.Packet) (start, end, skip bool) {
+	switch d := depacketizer.(type) {
+	case *codecs.VP8Packet:
+		// First packet of the first partition
+		return d.S == 1 && d.PID == 0, packet.Marker, false
+	case *codecs.VP9Packet:
+		// Only the base spatial layer is recorded; its frame ends with the E
+		// bit even when higher layers follow before the marker
+		if d.L && d.SID > 0 {
+			return false, false, true
+		}
+		return d.B, d.E, false
+	default:
+		return !a.inFrame || packet.Timestamp != a.timestamp, packet.Marker, false
+	}
+}
+
+var errUnsupportedCodec = errors.New("unsupported codec")
+
+// newTrackWriter creates the output file for a track and picks the matching depacketizer
+func newTrackWriter(fileName string, codec webrtc.RTPCodecParameters) (mediaWriter, rtp.Depacketizer, error) {
+	switch codec.MimeType {
+	case webrtc.MimeTypeVP8:
+		writer, err := createIVFWriter(fileName+".ivf", "VP80")
+		return writer, &codecs.VP8Packet{}, err
+	case webrtc.MimeTypeVP9:
+		writer, err := createIVFWriter(fileName+".ivf", "VP90")
+		return writer, &codecs.VP9Packet{}, err
+	case webrtc.MimeTypeAV1:
+		writer, err := createIVFWriter(fileName+".ivf", "AV01")
+		return writer, &av1Depacketizer{}, err
+	case webrtc.MimeTypeH264:
+		file, err := os.Create(fileName + ".h264")
+		if err != nil {
+			return nil, nil, err
+		}
+		return &rawWriter{file: file}, &h264Depacketizer{}, nil
+	case webrtc.MimeTypeH265:
+		file, err := os.Create(fileName + ".h265")
+		if err != nil {
+			return nil, nil, err
+		}
+		return &rawWriter{file: file}, newH265Depacketizer(codec.SDPFmtpLine), nil
+	case webrtc.MimeTypePCMU:
+		writer, err := createWAVWriter(fileName+".wav", ulawToPCM)
+		return writer, g711Depacketizer{}, err
+	case webrtc.MimeTypePCMA:
+		writer, err := createWAVWriter(fileName+".wav", alawToPCM)
+		return writer, g711Depacketizer{}, err
+	case webrtc.MimeTypeOpus:
+		file, err := os.Create(fileName + ".ogg")
+		if err != nil {
+			return nil, nil, err
+		}
+		writer, err := newOggOpusWriter(file, codec.Channels)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return writer, &codecs.OpusPacket{}, nil
+	default:
+		return nil, nil, errUnsupportedCodec
+	}
+}
+
+// canRecord reports whether newTrackWriter or the WebM muxer has a writer for the codec
+func canRecord(mimeType string) bool {
+	switch mimeType {
+	case webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeAV1, webrtc.MimeTypeH264, webrtc.MimeTypeH265,
+		webrtc.MimeTypePCMU, webrtc.MimeTypePCMA, webrtc.MimeTypeOpus:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// TestFrameAssemblerMaxSize feeds a VP8 frame of many packets past the
+// assembler's maximum size and checks it's dropped with the rest of its
+// packets, the buffer stays within the cap and the next frame is whole
+func TestFrameAssemblerMaxSize(t *testing.T) {
+	const maxSize = 16 << 10
+	frames := frameAssembler{maxSize: maxSize}
+	depacketizer := &codecs.VP8Packet{}
+	chunk := bytes.Repeat([]byte{0x5a}, 1000)
+
+	// push sends one packet of a VP8 frame, the first one starting it
+	push := func(seq uint16, timestamp uint32, first, last bool) ([]byte, error) {
+		t.Helper()
+		descriptor := byte(0x00)
+		if first {
+			descriptor = 0x10
+		}
+		packet := &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: timestamp, Marker: last},
+			Payload: append([]byte{descriptor}, chunk...),
+		}
+		payload, err := depacketizer.Unmarshal(packet.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frames.push(depacketizer, packet, payload)
+	}
+
+	const packets = 1000
+	dropped := 0
+	for i := range packets {
+		frame, err := push(uint16(i), 3000, i == 0, i == packets-1)
+		if errors.Is(err, errFrameTooLarge) {
+			dropped++
+		} else if err != nil || frame != nil {
+			t.Fatalf("packet %d of the over-size frame returned %d bytes, %v", i, len(frame), err)
+		}
+	}
+	if dropped != 1 {
+		t.Errorf("over-size frame dropped %d times, want once", dropped)
+	}
+	if cap(frames.buf) > 2*maxSize {
+		t.Errorf("buffer grew to %d bytes for a cap of %d", cap(frames.buf), maxSize)
+	}
+
+	// The next frame is reassembled whole
+	if _, err := push(packets, 6000, true, false); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := push(packets+1, 6000, false, true)
+	if err != nil || len(frame) != 2*len(chunk) {
+		t.Errorf("frame after the dropped one is %d bytes, %v, want %d", len(frame), err, 2*len(chunk))
+	}
+}
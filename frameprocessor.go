@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// FrameInfo describes a frame handed to the FrameProcessors
+type FrameInfo struct {
+	SessionID string
+	StreamKey string
+	Kind      webrtc.RTPCodecType
+	TrackID   string
+	// RID is the simulcast layer of the track, empty without simulcast
+	RID      string
+	SSRC     uint32
+	MimeType string
+	// Keyframe is set on the video frames that start a group of pictures
+	Keyframe bool
+	// PTS is the presentation time of the frame, as it is recorded
+	PTS time.Duration
+}
+
+// FrameProcessor is handed every depacketized frame of the recorded tracks,
+// in the read loop of each track before the frame is written. It is called
+// from the loops of many tracks at once, so it must be safe for concurrent
+// use, and it holds up the recording of the track while it runs: heavy
+// work, such as inference, belongs on a goroutine of its own. The payload
+// is only valid for the call and must not be modified.
+type FrameProcessor interface {
+	ProcessFrame(info FrameInfo, payload []byte)
+}
+
+var (
+	frameProcessorsMu sync.Mutex
+	frameProcessors   []FrameProcessor
+)
+
+// RegisterFrameProcessor adds p to the processors of the tracks arriving
+// from then on. Processors are meant to be registered from the init function
+// of a file added to the build, such as frameprocessor_example.go.
+func RegisterFrameProcessor(p FrameProcessor) {
+	frameProcessorsMu.Lock()
+	defer frameProcessorsMu.Unlock()
+	frameProcessors = append(frameProcessors, p)
+}
+
+// registeredFrameProcessor returns the registered processors as one, the
+// nopFrameProcessor if there are none
+func registeredFrameProcessor() FrameProcessor {
+	frameProcessorsMu.Lock()
+	defer frameProcessorsMu.Unlock()
+	switch len(frameProcessors) {
+	case 0:
+		return nopFrameProcessor{}
+	case 1:
+		return frameProcessors[0]
+	}
+	return frameProcessorList(append([]FrameProcessor(nil), frameProcessors...))
+}
+
+// nopFrameProcessor ignores every frame
+type nopFrameProcessor struct{}
+
+func (nopFrameProcessor) ProcessFrame(FrameInfo, []byte) {}
+
+// frameProcessorList hands every frame to each of its processors in turn
+type frameProcessorList []FrameProcessor
+
+func (l frameProcessorList) ProcessFrame(info FrameInfo, payload []byte) {
+	for _, p := range l {
+		p.ProcessFrame(info, payload)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build example_processor
+
+package main
+
+import "log/slog"
+
+// Building with -tags example_processor registers the example processor. A
+// processor of your own is added the same way, by a file like this one.
+func init() {
+	RegisterFrameProcessor(keyframeLogger{})
+}
+
+// keyframeLogger is an example processor, logging every keyframe of the
+// video tracks with its size and time, to follow how often publishers send
+// them and how large they are
+type keyframeLogger struct{}
+
+func (keyframeLogger) ProcessFrame(info FrameInfo, payload []byte) {
+	if info.Keyframe {
+		slog.Info("Keyframe processed", "session", info.SessionID, "stream", info.StreamKey, "ssrc", info.SSRC, "codec", info.MimeType, "pts", info.PTS, "bytes", len(payload))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// countingProcessor keeps the info and a copy of each frame it is handed
+type countingProcessor struct {
+	mu       sync.Mutex
+	infos    []FrameInfo
+	payloads [][]byte
+}
+
+func (p *countingProcessor) ProcessFrame(info FrameInfo, payload []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.infos = append(p.infos, info)
+	p.payloads = append(p.payloads, bytes.Clone(payload))
+}
+
+// frames returns the frames of kind processed so far
+func (p *countingProcessor) frames(kind webrtc.RTPCodecType) ([]FrameInfo, [][]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var infos []FrameInfo
+	var payloads [][]byte
+	for i, info := range p.infos {
+		if info.Kind == kind {
+			infos = append(infos, info)
+			payloads = append(payloads, p.payloads[i])
+		}
+	}
+	return infos, payloads
+}
+
+// registerTestProcessors registers processors, in place of any others, for
+// the rest of the test
+func registerTestProcessors(t *testing.T, processors ...FrameProcessor) {
+	saved := frameProcessors
+	t.Cleanup(func() { frameProcessors = saved })
+	frameProcessors = nil
+	for _, p := range processors {
+		RegisterFrameProcessor(p)
+	}
+}
+
+func TestRegisteredFrameProcessor(t *testing.T) {
+	registerTestProcessors(t)
+	if _, ok := registeredFrameProcessor().(nopFrameProcessor); !ok {
+		t.Errorf("processor without registrations = %T, want nopFrameProcessor", registeredFrameProcessor())
+	}
+
+	first, second := &countingProcessor{}, &countingProcessor{}
+	registerTestProcessors(t, first, second)
+	if _, ok := registeredFrameProcessor().(frameProcessorList); !ok {
+		t.Errorf("processor of two registrations = %T, want frameProcessorList", registeredFrameProcessor())
+	}
+	registeredFrameProcessor().ProcessFrame(FrameInfo{Kind: webrtc.RTPCodecTypeAudio}, []byte{1})
+	for i, p := range []*countingProcessor{first, second} {
+		if infos, _ := p.frames(webrtc.RTPCodecTypeAudio); len(infos) != 1 {
+			t.Errorf("processor %d called %d times, want once", i+1, len(infos))
+		}
+	}
+}
+
+// TestFrameProcessor publishes VP8 and Opus recorded to IVF with a counting
+// processor registered and checks it was handed each recorded video frame
+// once, in order, before it was written
+func TestFrameProcessor(t *testing.T) {
+	counter := &countingProcessor{}
+	registerTestProcessors(t, counter)
+	base := startServer(t)
+	p := newCodecPublisher(t, webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	resp, body := postOffer(t, base+"/whip/cam?format=ivf", p.pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	p.location = resp.Header.Get("Location")
+	waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	p.play(t, 1500*time.Millisecond)
+	p.stop(t, base)
+
+	dir := filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"))
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ivf"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("recorded %v, want one IVF file: %v", paths, err)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, recorded := readIVF(t, data)
+
+	infos, payloads := counter.frames(webrtc.RTPCodecTypeVideo)
+	if len(infos) == 0 || len(infos) != len(recorded) {
+		t.Fatalf("processor handed %d video frames, %d recorded", len(infos), len(recorded))
+	}
+	for i, info := range infos {
+		if !bytes.Equal(payloads[i], recorded[i].data) {
+			t.Fatalf("frame %d handed to the processor differs from the one recorded", i)
+		}
+		if i > 0 && info.PTS <= infos[i-1].PTS {
+			t.Errorf("frame %d at %v after one at %v", i, info.PTS, infos[i-1].PTS)
+		}
+		if want := bytes.Equal(payloads[i], testVP8Keyframe); info.Keyframe != want {
+			t.Errorf("frame %d keyframe = %v, want %v", i, info.Keyframe, want)
+		}
+		if info.StreamKey != "cam" || info.MimeType != webrtc.MimeTypeVP8 || info.SessionID == "" || info.SSRC == 0 {
+			t.Errorf("frame %d info %+v, want the stream, codec, session and SSRC", i, info)
+			break
+		}
+	}
+	if audio, _ := counter.frames(webrtc.RTPCodecTypeAudio); len(audio) == 0 || audio[0].MimeType != webrtc.MimeTypeOpus {
+		t.Errorf("processor handed %d audio frames, want the Opus frames", len(audio))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "gzip", want: true},
+		{header: "deflate, gzip;q=0.5", want: true},
+		{header: "GZIP", want: true},
+		{header: "*", want: true},
+		{header: "gzip;q=0", want: false},
+		{header: "br, deflate", want: false},
+		{header: "gzipped", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/sessions", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				r.Header.Set("Accept-Encoding", tt.header)
+			}
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestGzip gets the admin endpoints with and without Accept-Encoding: gzip
+// and checks only those asking for it get a compressed body
+func TestGzip(t *testing.T) {
+	base := startServer(t)
+	// Compression is left to the test, so the client sends no Accept-Encoding of its own
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{name: "sessions gzip", path: "/sessions", acceptEncoding: "gzip", wantGzip: true},
+		{name: "sessions plain", path: "/sessions"},
+		{name: "sessions refused", path: "/sessions", acceptEncoding: "gzip;q=0"},
+		{name: "stats gzip", path: "/stats/missing", acceptEncoding: "gzip", wantGzip: true},
+		{name: "not an admin endpoint", path: "/healthz", acceptEncoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, base+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("Content-Encoding %q, want gzip %v", resp.Header.Get("Content-Encoding"), tt.wantGzip)
+			}
+			if tt.path != "/healthz" && resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary %q, want Accept-Encoding", resp.Header.Get("Vary"))
+			}
+			var body io.Reader = resp.Body
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.path == "/sessions" {
+				var list []sessionInfo
+				if err := json.Unmarshal(data, &list); err != nil {
+					t.Errorf("body %q isn't the session list: %v", data, err)
+				}
+			} else if len(data) == 0 {
+				t.Error("empty body")
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	h264NALUTypeMask = 0x1F
+	h264NALUTypeSPS  = 7
+	h264NALUTypePPS  = 8
+	h264NALUTypeAUD  = 9
+	h264FUAType      = 28
+	h264FUStartBit   = 0x80
+	h264FUEndBit     = 0x40
+)
+
+var errH264MissingFUAStart = errors.New("h264: FU-A fragment without start")
+
+// h264Depacketizer wraps codecs.H264Packet so that a lost FU-A fragment can't
+// splice the tail of one NAL unit onto the next, and a NAL unit can't be
+// buffered past -max-frame-size. The output is Annex-B, every NAL unit
+// prefixed with a 0x00000001 start code.
+type h264Depacketizer struct {
+	codecs.H264Packet
+	inFragment bool
+	// fragment counts the bytes of the FU-A fragments buffered
+	fragment int
+}
+
+func (d *h264Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) >= 2 && payload[0]&h264NALUTypeMask == h264FUAType {
+		start := payload[1]&h264FUStartBit != 0
+		end := payload[1]&h264FUEndBit != 0
+
+		switch {
+		case start && d.inFragment:
+			// The previous NAL unit never completed, drop what was buffered
+			d.H264Packet = codecs.H264Packet{}
+		case !start && !d.inFragment:
+			return nil, errH264MissingFUAStart
+		}
+		if start {
+			d.fragment = 0
+		}
+		d.fragment += len(payload) - 2
+		if config.MaxFrameSize > 0 && d.fragment > config.MaxFrameSize {
+			d.H264Packet = codecs.H264Packet{}
+			d.inFragment = false
+			return nil, errFrameTooLarge
+		}
+		d.inFragment = !end
+	} else if d.inFragment {
+		// Any other packet type ends an unfinished fragmented NAL unit
+		d.H264Packet = codecs.H264Packet{}
+		d.inFragment = false
+	}
+
+	return d.H264Packet.Unmarshal(payload)
+}
+
+// annexBUnits splits an Annex-B stream into its NAL units, without their start codes
+func annexBUnits(stream []byte) [][]byte {
+	startCode := []byte{0x00, 0x00, 0x01}
+	var units [][]byte
+	for {
+		i := bytes.Index(stream, startCode)
+		if i < 0 {
+			return units
+		}
+		stream = stream[i+len(startCode):]
+		end := bytes.Index(stream, startCode)
+		if end < 0 {
+			end = len(stream)
+		}
+		// A NAL unit never ends in a zero byte; those belong to a 4-byte start code
+		if unit := bytes.TrimRight(stream[:end], "\x00"); len(unit) > 0 {
+			units = append(units, unit)
+		}
+		stream = stream[end:]
+	}
+}
+
+// h264RBSP strips the emulation prevention bytes from the payload of a NAL unit
+func h264RBSP(payload []byte) []byte {
+	rbsp := make([]byte, 0, len(payload))
+	zeros := 0
+	for _, b := range payload {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// readSE reads a signed Exp-Golomb code, se(v). The unsigned ue(v) codes are
+// read with readUVLC, which AV1 defines the same way.
+func readSE(r *bitReader) int32 {
+	code := readUVLC(r)
+	if code%2 == 0 {
+		return -int32(code / 2)
+	}
+	return int32(code/2 + 1)
+}
+
+// h264SPSSize returns the picture size of a sequence parameter set, given
+// with its NAL header, or zeros if it can't be parsed (H.264 7.3.2.1.1)
+func h264SPSSize(sps []byte) (width, height uint16) {
+	if len(sps) < 4 || sps[0]&h264NALUTypeMask != h264NALUTypeSPS {
+		return 0, 0
+	}
+	r := bitReader{data: h264RBSP(sps[4:])}
+	readUVLC(&r) // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch profile := sps[1]; profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = readUVLC(&r)
+		if chromaFormat == 3 {
+			r.read(1) // separate_colour_plane_flag
+		}
+		readUVLC(&r) // bit_depth_luma_minus8
+		readUVLC(&r) // bit_depth_chroma_minus8
+		r.read(1)    // qpprime_y_zero_transform_bypass_flag
+		if present, _ := r.read(1); present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if listPresent, _ := r.read(1); listPresent == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for range size {
+					if next != 0 {
+						next = (last + readSE(&r) + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	readUVLC(&r) // log2_max_frame_num_minus4
+	pocType := readUVLC(&r)
+	switch pocType {
+	case 0:
+		readUVLC(&r) // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.read(1)  // delta_pic_order_always_zero_flag
+		readSE(&r) // offset_for_non_ref_pic
+		readSE(&r) // offset_for_top_to_bottom_field
+		for range readUVLC(&r) {
+			readSE(&r) // offset_for_ref_frame
+		}
+	}
+	readUVLC(&r) // max_num_ref_frames
+	r.read(1)    // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := readUVLC(&r) + 1
+	heightInMapUnits := readUVLC(&r) + 1
+	frameMbsOnly, ok := r.read(1)
+	if !ok {
+		return 0, 0
+	}
+	if frameMbsOnly == 0 {
+		r.read(1) // mb_adaptive_frame_field_flag
+	}
+	r.read(1) // direct_8x8_inference_flag
+
+	w := widthInMbs * 16
+	h := (2 - frameMbsOnly) * heightInMapUnits * 16
+	if cropping, _ := r.read(1); cropping == 1 {
+		left, right, top, bottom := readUVLC(&r), readUVLC(&r), readUVLC(&r), readUVLC(&r)
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		if cropX*(left+right) >= w || cropY*(top+bottom) >= h {
+			return 0, 0
+		}
+		w -= cropX * (left + right)
+		h -= cropY * (top + bottom)
+	}
+	if w > 0xFFFF || h > 0xFFFF {
+		return 0, 0
+	}
+	return uint16(w), uint16(h)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	testH264SPS   = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0xf6, 0x40}
+	testH264PPS   = []byte{0x68, 0xce, 0x3c, 0x80}
+	testH264IDR   = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff, 0x10, 0x20, 0x30}
+	testH264Slice = []byte{0x41, 0x9a, 0x02, 0x04}
+)
+
+// annexB joins NAL units with 4-byte start codes
+func annexB(units ...[]byte) []byte {
+	var b []byte
+	for _, unit := range units {
+		b = append(append(b, 0, 0, 0, 1), unit...)
+	}
+	return b
+}
+
+// stapA aggregates NAL units into a STAP-A payload
+func stapA(units ...[]byte) []byte {
+	b := []byte{0x78}
+	for _, unit := range units {
+		b = append(b, byte(len(unit)>>8), byte(len(unit)))
+		b = append(b, unit...)
+	}
+	return b
+}
+
+// fuA splits a NAL unit into FU-A payloads of at most size bytes of it
+func fuA(unit []byte, size int) [][]byte {
+	indicator := unit[0]&0xe0 | h264FUAType
+	var payloads [][]byte
+	data := unit[1:]
+	for i := 0; i < len(data); i += size {
+		header := unit[0] & h264NALUTypeMask
+		if i == 0 {
+			header |= h264FUStartBit
+		}
+		if i+size >= len(data) {
+			header |= h264FUEndBit
+		}
+		payloads = append(payloads, append([]byte{indicator, header}, data[i:min(i+size, len(data))]...))
+	}
+	return payloads
+}
+
+func TestH264Depacketizer(t *testing.T) {
+	fragments := fuA(testH264IDR, 3)
+	tests := []struct {
+		name     string
+		maxSize  int
+		payloads [][]byte
+		want     []byte
+		wantErr  error
+	}{
+		{name: "single NAL unit", payloads: [][]byte{testH264Slice}, want: annexB(testH264Slice)},
+		{name: "STAP-A", payloads: [][]byte{stapA(testH264SPS, testH264PPS)}, want: annexB(testH264SPS, testH264PPS)},
+		{name: "FU-A", payloads: fragments, want: annexB(testH264IDR)},
+		{name: "FU-A without start", payloads: fragments[1:], wantErr: errH264MissingFUAStart},
+		{
+			name:     "FU-A restarted",
+			payloads: append([][]byte{fragments[0], fragments[1]}, fragments...),
+			want:     annexB(testH264IDR),
+		},
+		{
+			name:     "FU-A cut off by a single NAL unit",
+			payloads: [][]byte{fragments[0], testH264Slice, fragments[2]},
+			want:     annexB(testH264Slice),
+			wantErr:  errH264MissingFUAStart,
+		},
+		{
+			name:     "FU-A over the maximum frame size",
+			maxSize:  len(testH264IDR) / 2,
+			payloads: append(slices.Clone(fragments), testH264Slice),
+			want:     annexB(testH264Slice),
+			wantErr:  errFrameTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxFrameSize = tt.maxSize })
+			var d h264Depacketizer
+			var got []byte
+			var gotErr error
+			for _, payload := range tt.payloads {
+				out, err := d.Unmarshal(payload)
+				if err != nil {
+					// The first error, as the fragments after it lack their start
+					if gotErr == nil {
+						gotErr = err
+					}
+					continue
+				}
+				got = append(got, out...)
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("error = %v, want %v", gotErr, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Unmarshal = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestH264Recording feeds the RTP packets of a stream to the recording of an
+// H.264 track and compares the file with the Annex-B stream of the frames
+// that were complete
+func TestH264Recording(t *testing.T) {
+	idr := fuA(testH264IDR, 3)
+	tests := []struct {
+		name    string
+		packets []testPacket
+		want    []byte
+	}{
+		{
+			name: "parameter sets and fragmented IDR",
+			packets: []testPacket{
+				{0, false, stapA(testH264SPS, testH264PPS)},
+				{0, false, idr[0]},
+				{0, false, idr[1]},
+				{0, true, idr[2]},
+				{3000, true, testH264Slice},
+			},
+			want: append(annexB(testH264SPS, testH264PPS, testH264IDR), annexB(testH264Slice)...),
+		},
+		{
+			name: "frame with its last fragment lost",
+			packets: []testPacket{
+				{0, true, testH264Slice},
+				{3000, false, idr[0]},
+				{3000, false, idr[1]},
+				{6000, true, testH264Slice},
+			},
+			want: annexB(testH264Slice, testH264Slice),
+		},
+		{
+			name: "frame starting with a fragment lost",
+			packets: []testPacket{
+				{0, false, idr[1]},
+				{0, true, idr[2]},
+				{3000, true, testH264Slice},
+			},
+			want: annexB(testH264Slice),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recordPackets(t, webrtc.MimeTypeH264, tt.packets); !bytes.Equal(got, tt.want) {
+				t.Errorf("recorded\n% x\nwant\n% x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestH264SPSSize(t *testing.T) {
+	tests := []struct {
+		name                  string
+		sps                   []byte
+		wantWidth, wantHeight uint16
+	}{
+		{name: "baseline", sps: testH264SPS, wantWidth: 640, wantHeight: 480},
+		// High profile 1920x1080, coded as 1088 lines and cropped
+		{name: "high with cropping", sps: []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58}, wantWidth: 1920, wantHeight: 1080},
+		{name: "not an SPS", sps: testH264PPS},
+		{name: "truncated", sps: testH264SPS[:5]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if width, height := h264SPSSize(tt.sps); width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("h264SPSSize = %dx%d, want %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestAnnexBUnits(t *testing.T) {
+	got := annexBUnits(testH264Keyframe)
+	want := [][]byte{testH264SPS, testH264PPS, testH264IDR[:6]}
+	if len(got) != len(want) {
+		t.Fatalf("annexBUnits = % x, want % x", got, want)
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("unit %d = % x, want % x", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+)
+
+// IRAP pictures, from which decoding can start, are the NAL unit types from
+// BLA_W_LP to CRA_NUT
+const (
+	h265NALUTypeBLAWLP = 16
+	h265NALUTypeCRA    = 21
+)
+
+var (
+	errH265MissingFUStart = errors.New("h265: FU fragment without start")
+	errH265PACI           = errors.New("h265: PACI packets are not supported")
+)
+
+// h265Depacketizer reassembles the NAL units of H.265 RTP payloads (RFC
+// 7798), whether sent alone, in aggregation packets or fragmentation units,
+// into Annex-B with a 0x00000001 start code before every NAL unit. The DONL
+// and DOND fields sent when sprop-max-don-diff is above 0 are skipped, so NAL
+// units are written in the order they arrive.
+type h265Depacketizer struct {
+	codecs.H265Packet
+
+	// fragment is the NAL unit being reassembled from FUs, nil outside one
+	fragment []byte
+}
+
+// newH265Depacketizer returns a depacketizer for the fmtp line negotiated
+// for the track, which tells whether DONL fields are present
+func newH265Depacketizer(fmtp string) *h265Depacketizer {
+	d := &h265Depacketizer{}
+	d.WithDONL(h265MaxDONDiff(fmtp) > 0)
+	return d
+}
+
+// h265MaxDONDiff returns the sprop-max-don-diff of an fmtp line, 0 if absent
+func h265MaxDONDiff(fmtp string) int {
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(name, "sprop-max-don-diff") {
+			n, _ := strconv.Atoi(value)
+			return n
+		}
+	}
+	return 0
+}
+
+func (d *h265Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if _, err := d.H265Packet.Unmarshal(payload); err != nil {
+		d.fragment = nil
+		return nil, err
+	}
+
+	switch packet := d.Packet().(type) {
+	case *codecs.H265FragmentationUnitPacket:
+		fu := packet.FuHeader()
+		switch {
+		case fu.S():
+			// A fragment still open never completed and is dropped
+			header := packet.PayloadHeader()
+			d.fragment = []byte{byte(header>>8)&0x81 | fu.FuType()<<1, byte(header)}
+		case d.fragment == nil:
+			return nil, errH265MissingFUStart
+		}
+		if config.MaxFrameSize > 0 && len(d.fragment)+len(packet.Payload()) > config.MaxFrameSize {
+			d.fragment = nil
+			return nil, errFrameTooLarge
+		}
+		d.fragment = append(d.fragment, packet.Payload()...)
+		if !fu.E() {
+			return nil, nil
+		}
+		unit := d.fragment
+		d.fragment = nil
+		return append([]byte{0, 0, 0, 1}, unit...), nil
+	case *codecs.H265AggregationPacket:
+		// Any other packet type ends an unfinished fragmented NAL unit
+		d.fragment = nil
+		out := append([]byte{0, 0, 0, 1}, packet.FirstUnit().NalUnit()...)
+		for _, unit := range packet.OtherUnits() {
+			out = append(append(out, 0, 0, 0, 1), unit.NalUnit()...)
+		}
+		return out, nil
+	case *codecs.H265SingleNALUnitPacket:
+		d.fragment = nil
+		header := packet.PayloadHeader()
+		out := []byte{0, 0, 0, 1, byte(header >> 8), byte(header)}
+		return append(out, packet.Payload()...), nil
+	default:
+		d.fragment = nil
+		return nil, errH265PACI
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Parameter sets and slices of a 640x480 Main profile stream. Nothing decodes
+// the slices, so only their NAL unit headers need to be right.
+var (
+	testH265VPS   = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	testH265SPS   = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x05, 0x02, 0x01, 0xe1, 0x65, 0x95, 0x9a, 0x49, 0x32, 0xbc, 0x05, 0xa8, 0x08}
+	testH265PPS   = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	testH265IDR   = []byte{0x26, 0x01, 0xaf, 0x1d, 0x80, 0xa4, 0x6f, 0x33, 0x12, 0x8c, 0x51, 0x07, 0xfe, 0x3a}
+	testH265Slice = []byte{0x02, 0x01, 0xd0, 0x09, 0x7e, 0x10, 0xc3}
+)
+
+// h265AP aggregates NAL units into an aggregation packet payload, each
+// preceded by a DONL or DOND field when donl is set
+func h265AP(donl bool, units ...[]byte) []byte {
+	b := []byte{48 << 1, 0x01}
+	for i, unit := range units {
+		if donl && i == 0 {
+			b = append(b, 0, 0)
+		} else if donl {
+			b = append(b, 0)
+		}
+		b = append(b, byte(len(unit)>>8), byte(len(unit)))
+		b = append(b, unit...)
+	}
+	return b
+}
+
+// h265FU splits a NAL unit into fragmentation unit payloads carrying at most
+// size bytes of it, the first with a DONL field when donl is set
+func h265FU(unit []byte, size int, donl bool) [][]byte {
+	header := []byte{unit[0]&0x81 | 49<<1, unit[1]}
+	naluType := unit[0] >> 1 & 0x3f
+	var payloads [][]byte
+	data := unit[2:]
+	for i := 0; i < len(data); i += size {
+		fu := naluType
+		if i == 0 {
+			fu |= 0x80
+		}
+		if i+size >= len(data) {
+			fu |= 0x40
+		}
+		payload := append(slices.Clone(header), fu)
+		if donl && i == 0 {
+			payload = append(payload, 0, 0)
+		}
+		payloads = append(payloads, append(payload, data[i:min(i+size, len(data))]...))
+	}
+	return payloads
+}
+
+// withDONL inserts a DONL field after the header of a single NAL unit packet
+func withDONL(unit []byte) []byte {
+	return slices.Concat(unit[:2], []byte{0, 1}, unit[2:])
+}
+
+// nalUnits splits an Annex-B stream with 4-byte start codes into its NAL units
+func nalUnits(stream []byte) [][]byte {
+	var units [][]byte
+	for _, unit := range bytes.Split(stream, []byte{0, 0, 0, 1}) {
+		if len(unit) > 0 {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+func TestH265Depacketizer(t *testing.T) {
+	fragments := h265FU(testH265IDR, 4, false)
+	tests := []struct {
+		name     string
+		fmtp     string
+		maxSize  int
+		payloads [][]byte
+		want     [][]byte
+		wantErr  error
+	}{
+		{name: "single NAL unit", payloads: [][]byte{testH265Slice}, want: [][]byte{testH265Slice}},
+		{name: "aggregation packet", payloads: [][]byte{h265AP(false, testH265VPS, testH265SPS, testH265PPS)}, want: [][]byte{testH265VPS, testH265SPS, testH265PPS}},
+		{name: "fragmentation units", payloads: fragments, want: [][]byte{testH265IDR}},
+		{name: "fragment without start", payloads: fragments[1:], wantErr: errH265MissingFUStart},
+		{
+			name:     "fragments restarted",
+			payloads: append([][]byte{fragments[0], fragments[1]}, fragments...),
+			want:     [][]byte{testH265IDR},
+		},
+		{
+			name:     "fragments cut off by a single NAL unit",
+			payloads: [][]byte{fragments[0], testH265Slice, fragments[2]},
+			want:     [][]byte{testH265Slice},
+			wantErr:  errH265MissingFUStart,
+		},
+		{
+			name: "DONL",
+			fmtp: "profile-id=1;sprop-max-don-diff=2",
+			payloads: slices.Concat(
+				[][]byte{h265AP(true, testH265VPS, testH265SPS, testH265PPS)},
+				h265FU(testH265IDR, 4, true),
+				[][]byte{withDONL(testH265Slice)},
+			),
+			want: [][]byte{testH265VPS, testH265SPS, testH265PPS, testH265IDR, testH265Slice},
+		},
+		{
+			name:     "fragments over the maximum frame size",
+			maxSize:  len(testH265IDR) / 2,
+			payloads: append(slices.Clone(fragments), testH265Slice),
+			want:     [][]byte{testH265Slice},
+			wantErr:  errFrameTooLarge,
+		},
+		{name: "PACI", payloads: [][]byte{{50 << 1, 0x01, 0x00, 0x00, 0x02, 0x01}}, wantErr: errH265PACI},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxFrameSize = tt.maxSize })
+			d := newH265Depacketizer(tt.fmtp)
+			var got []byte
+			var gotErr error
+			for _, payload := range tt.payloads {
+				out, err := d.Unmarshal(payload)
+				if err != nil {
+					// The first error, as the fragments after it lack their start
+					if gotErr == nil {
+						gotErr = err
+					}
+					continue
+				}
+				got = append(got, out...)
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("error = %v, want %v", gotErr, tt.wantErr)
+			}
+			if units := nalUnits(got); !slices.EqualFunc(units, tt.want, bytes.Equal) {
+				t.Errorf("Unmarshal = % x, want the NAL units % x", units, tt.want)
+			}
+		})
+	}
+}
+
+// TestH265Recording feeds the RTP packets of a stream to the recording of an
+// H.265 track and checks the NAL units of the file are those of the frames
+// that were complete
+func TestH265Recording(t *testing.T) {
+	idr := h265FU(testH265IDR, 4, false)
+	packets := []testPacket{
+		{0, false, h265AP(false, testH265VPS, testH265SPS, testH265PPS)},
+	}
+	for i, fragment := range idr {
+		packets = append(packets, testPacket{0, i == len(idr)-1, fragment})
+	}
+	packets = append(packets,
+		testPacket{3000, true, testH265Slice},
+		// The last fragment of the next frame is lost
+		testPacket{6000, false, idr[0]},
+		testPacket{6000, false, idr[1]},
+		testPacket{9000, true, testH265Slice},
+	)
+
+	got := recordPackets(t, webrtc.MimeTypeH265, packets)
+	want := [][]byte{testH265VPS, testH265SPS, testH265PPS, testH265IDR, testH265Slice, testH265Slice}
+	if units := nalUnits(got); !slices.EqualFunc(units, want, bytes.Equal) {
+		t.Errorf("recorded the NAL units\n% x\nwant\n% x", units, want)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Time the process started, reported as uptime by /healthz
+var startTime = time.Now()
+
+// Handler for load balancer and orchestrator health checks; no authentication
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.Error, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	// A draining server is still healthy, its sessions going on, but load
+	// balancers should send it no new ones
+	status, since := "ok", drain.started()
+	var drainingSince *time.Time
+	if !since.IsZero() {
+		status, drainingSince = "draining", &since
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Status        string     `json:"status"`
+		UptimeSeconds float64    `json:"uptime_seconds"`
+		Sessions      int        `json:"sessions"`
+		Draining      bool       `json:"draining"`
+		DrainingSince *time.Time `json:"draining_since,omitempty"`
+	}{
+		Status:        status,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		Sessions:      sessions.count(),
+		Draining:      drainingSince != nil,
+		DrainingSince: drainingSince,
+	})
+}
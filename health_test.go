@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		tokens     []string
+		publish    bool
+		wantStatus int
+		// want is the status of the body, when the request succeeds
+		want         string
+		wantSessions int
+	}{
+		{name: "idle", method: http.MethodGet, wantStatus: http.StatusOK, want: "ok"},
+		{name: "publishing", method: http.MethodGet, publish: true, wantStatus: http.StatusOK, want: "ok", wantSessions: 1},
+		{name: "no authentication", method: http.MethodGet, tokens: []string{"secret"}, wantStatus: http.StatusOK, want: "ok"},
+		{name: "POST", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.Tokens = tt.tokens })
+			base := startServer(t)
+			if tt.publish {
+				publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			}
+
+			req, err := http.NewRequest(tt.method, base+"/healthz", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+
+			var body map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body["status"] != tt.want {
+				t.Errorf("status = %v, want %q", body["status"], tt.want)
+			}
+			if uptime, ok := body["uptime_seconds"].(float64); !ok || uptime <= 0 {
+				t.Errorf("uptime_seconds = %v, want a positive number", body["uptime_seconds"])
+			}
+			if sessions, ok := body["sessions"].(float64); !ok || int(sessions) != tt.wantSessions {
+				t.Errorf("sessions = %v, want %d", body["sessions"], tt.wantSessions)
+			}
+		})
+	}
+}
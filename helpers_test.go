@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// testTimeout bounds each wait of the tests on the network
+const testTimeout = 10 * time.Second
+
+// testAdminToken is the -token of the tests of the admin endpoints
+const testAdminToken = "admin"
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var err error
+	if webrtcAPI, err = newAPI(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setConfig changes the configuration for the test, restoring it after.
+// The sessions still running are closed first, as their goroutines read the
+// configuration.
+func setConfig(t *testing.T, change func(*Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() {
+		closeSessions()
+		config = saved
+	})
+	change(&config)
+}
+
+// closeSessions closes every session and viewer, waiting for the sessions
+// being closed to finish
+func closeSessions() {
+	sessions.closeAll()
+	viewers.closeAll()
+}
+
+// parseFlags returns the configuration of the command-line arguments args,
+// over the defaults of the environment and any -config file, unvalidated
+func parseFlags(t *testing.T, args ...string) Config {
+	t.Helper()
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// startServer serves the API on a loopback port for the test, recording to
+// a temporary output directory, and returns its URL. The sessions still
+// running are closed after the test.
+func startServer(t *testing.T) string {
+	t.Helper()
+	setConfig(t, func(c *Config) { c.OutputDir = t.TempDir() })
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		server.Close()
+		closeSessions()
+	})
+	return server.URL
+}
+
+// useAdminToken configures testAdminToken for the test
+func useAdminToken(t *testing.T) {
+	t.Helper()
+	setConfig(t, func(c *Config) { c.Tokens = []string{testAdminToken} })
+}
+
+// adminRequest sends a request with testAdminToken and returns the response
+// with its body
+func adminRequest(t *testing.T, method, url, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+// waitFor polls cond until it holds, failing the test after testTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// newTestPeerConnection returns a PeerConnection closed after the test
+func newTestPeerConnection(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// postOffer sends the offer of pc, with every candidate, to url and returns
+// the response with its body. A 201 answer is applied to pc.
+func postOffer(t *testing.T, url string, pc *webrtc.PeerConnection, header http.Header) (*http.Response, string) {
+	t.Helper()
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+	return postSDP(t, url, pc, pc.LocalDescription().SDP, header)
+}
+
+// postSDP posts sdp to url as an offer of pc, applying a 201 answer to pc
+func postSDP(t *testing.T, url string, pc *webrtc.PeerConnection, sdp string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(sdp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusCreated && pc != nil {
+		answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)}
+		if err := pc.SetRemoteDescription(answer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, string(body)
+}
+
+// testPublisher is a WHIP client publishing sample tracks
+type testPublisher struct {
+	pc       *webrtc.PeerConnection
+	location string
+	answer   string
+	token    string // authorizes the DELETE of stop, if set
+	tracks   []*webrtc.TrackLocalStaticSample
+	senders  []*webrtc.RTPSender
+}
+
+// trackCapability is the capability of a test track of mimeType, with the
+// clock rate and channels the server registers it with
+func trackCapability(mimeType string) webrtc.RTPCodecCapability {
+	capability := webrtc.RTPCodecCapability{MimeType: mimeType}
+	if i := slices.IndexFunc(supportedCodecs, func(c codecSpec) bool { return c.mimeType == mimeType }); i >= 0 {
+		capability.ClockRate, capability.Channels = supportedCodecs[i].clockRate, supportedCodecs[i].channels
+	}
+	return capability
+}
+
+// publish connects a publisher of a track of each of mimeTypes to url,
+// failing the test unless it is answered with 201 and connects
+func publish(t *testing.T, url string, mimeTypes ...string) *testPublisher {
+	t.Helper()
+	pc := newTestPeerConnection(t)
+	p := &testPublisher{pc: pc}
+	for _, mimeType := range mimeTypes {
+		track, err := webrtc.NewTrackLocalStaticSample(trackCapability(mimeType), mimeType[:5], "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.tracks = append(p.tracks, track)
+		p.senders = append(p.senders, sender)
+	}
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+
+	resp, body := postOffer(t, url, pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	p.location, p.answer = resp.Header.Get("Location"), body
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Fatal("publisher did not connect")
+	}
+	return p
+}
+
+// Sample media: a 640x480 VP8 keyframe and interframe, an H.264 IDR access
+// unit with the parameter sets of a 640x480 baseline stream, and an Opus
+// silence frame. Nothing decodes the slices, so only their headers need to
+// be right.
+var (
+	testVP8Keyframe   = append([]byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}, make([]byte, 2000)...)
+	testVP8Interframe = append([]byte{0x01}, make([]byte, 500)...)
+	testH264Keyframe  = []byte{
+		0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0xf6, 0x40,
+		0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80,
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00, 0x33, 0xff,
+	}
+	testH264Interframe = []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02, 0x04}
+	testOpusSilence    = []byte{0xf8, 0xff, 0xfe}
+)
+
+// sample returns frame i of the sample media of mimeType, with a keyframe
+// every 30 video frames, and its duration
+func sample(mimeType string, i int) media.Sample {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		if i%30 == 0 {
+			return media.Sample{Data: testVP8Keyframe, Duration: time.Second / 30}
+		}
+		return media.Sample{Data: testVP8Interframe, Duration: time.Second / 30}
+	case webrtc.MimeTypeH264:
+		if i%30 == 0 {
+			return media.Sample{Data: testH264Keyframe, Duration: time.Second / 30}
+		}
+		return media.Sample{Data: testH264Interframe, Duration: time.Second / 30}
+	}
+	return media.Sample{Data: testOpusSilence, Duration: 20 * time.Millisecond}
+}
+
+// play writes d of the sample media to every track of p in real time
+func (p *testPublisher) play(t *testing.T, d time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	p.playUntil(ctx)
+}
+
+// playUntil writes the sample media to every track of p in real time until ctx ends
+func (p *testPublisher) playUntil(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, track := range p.tracks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mimeType := track.Codec().MimeType
+			for i := 0; ; i++ {
+				s := sample(mimeType, i)
+				if err := track.WriteSample(s); err != nil {
+					return
+				}
+				select {
+				case <-time.After(s.Duration):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// stop ends the session of p with a WHIP DELETE, failing the test unless it is answered with 200
+func (p *testPublisher) stop(t *testing.T, base string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, base+p.location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE answered %d", resp.StatusCode)
+	}
+}
+
+// newCodecPublisher returns an unconnected publisher of a track of each of
+// mimeTypes, offering only those codecs
+func newCodecPublisher(t *testing.T, mimeTypes ...string) *testPublisher {
+	t.Helper()
+	return newOfferPublisher(t, mimeTypes, nil)
+}
+
+// newOfferPublisher returns an unconnected publisher of a track of each of
+// mimeTypes, offering the extra codecs as well
+func newOfferPublisher(t *testing.T, mimeTypes, extra []string) *testPublisher {
+	t.Helper()
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, append(slices.Clone(mimeTypes), extra...)); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	p := &testPublisher{pc: pc}
+	for _, mimeType := range mimeTypes {
+		track, err := webrtc.NewTrackLocalStaticSample(trackCapability(mimeType), mimeType[:5], "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pc.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+		p.tracks = append(p.tracks, track)
+	}
+	return p
+}
+
+// publishRTP connects a publisher of a VP8 track written packet by packet
+// to url, failing the test unless it is answered with 201 and connects
+func publishRTP(t *testing.T, url string) (*webrtc.TrackLocalStaticRTP, *webrtc.RTPSender, string) {
+	t.Helper()
+	return publishCodecRTP(t, url, webrtc.MimeTypeVP8)
+}
+
+// publishCodecRTP is publishRTP with a track of mimeType
+func publishCodecRTP(t *testing.T, url, mimeType string) (*webrtc.TrackLocalStaticRTP, *webrtc.RTPSender, string) {
+	t.Helper()
+	pc := newTestPeerConnection(t)
+	kind := "video"
+	if mimeType == webrtc.MimeTypeOpus {
+		kind = "audio"
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(trackCapability(mimeType), kind, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+	resp, body := postOffer(t, url, pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Fatal("publisher did not connect")
+	}
+	return track, sender, resp.Header.Get("Location")
+}
+
+// testPacket is an RTP packet of a track fed to its recording
+type testPacket struct {
+	timestamp uint32
+	marker    bool
+	payload   []byte
+}
+
+// testFUAPackets returns the packets of frames H.264 frames of 31 bytes, a
+// keyframe then interframes, each in FU-A fragments of 10 bytes
+func testFUAPackets(frames int) []testPacket {
+	var packets []testPacket
+	for i := range uint32(frames) {
+		nal := append([]byte{0x65}, bytes.Repeat([]byte{byte(i + 1)}, 30)...)
+		if i > 0 {
+			nal[0] = 0x41
+		}
+		header := nal[0]
+		data := nal[1:]
+		for j := 0; len(data) > 0; j++ {
+			n := min(10, len(data))
+			fu := []byte{header&0xe0 | 28, header & 0x1f}
+			if j == 0 {
+				fu[1] |= 0x80
+			}
+			if n == len(data) {
+				fu[1] |= 0x40
+			}
+			packets = append(packets, testPacket{timestamp: i * 3000, marker: n == len(data), payload: append(fu, data[:n]...)})
+			data = data[n:]
+		}
+	}
+	return packets
+}
+
+// recordPackets feeds packets, numbered in order, to the recording of a video
+// track of mimeType the way the read loop does, and returns the file written
+func recordPackets(t *testing.T, mimeType string, packets []testPacket) []byte {
+	t.Helper()
+	order := make([]int, len(packets))
+	for i := range order {
+		order[i] = i
+	}
+	return recordPacketsInOrder(t, mimeType, packets, order)
+}
+
+// recordPacketsInOrder is recordPackets with the packets, still numbered by
+// their index, arriving in order through the jitter buffer
+func recordPacketsInOrder(t *testing.T, mimeType string, packets []testPacket, order []int) []byte {
+	t.Helper()
+	var arrivals []*rtp.Packet
+	for _, i := range order {
+		p := packets[i]
+		arrivals = append(arrivals, &rtp.Packet{
+			Header:  rtp.Header{PayloadType: testPayloadType, SequenceNumber: uint16(i), Timestamp: p.timestamp, Marker: p.marker},
+			Payload: p.payload,
+		})
+	}
+	return recordRTP(t, mimeType, arrivals)
+}
+
+// The payload types recordRTP receives a track and its retransmissions on
+const (
+	testPayloadType    = 102
+	testRTXPayloadType = 103
+)
+
+// recordRTP feeds packets, received the way the read loop does, through the
+// jitter buffer to the recording of a video track of mimeType and returns
+// the file written
+func recordRTP(t *testing.T, mimeType string, packets []*rtp.Packet) []byte {
+	t.Helper()
+	dir := t.TempDir()
+	writer, depacketizer, err := newTrackWriter(filepath.Join(dir, "video"), webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames frameAssembler
+	write := func(packet *rtp.Packet) {
+		payload, err := depacketizer.Unmarshal(packet.Payload)
+		if err != nil {
+			return
+		}
+		if frame, _ := frames.push(depacketizer, packet, payload); frame != nil {
+			if err := writer.WriteFrame(frame, time.Duration(packet.Timestamp)*time.Second/90000); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	jitter := newJitterBuffer(16)
+	for _, packet := range packets {
+		raw, err := packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, _, err := receivePacket(slog.Default(), raw, testPayloadType, testRTXPayloadType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet == nil {
+			continue
+		}
+		ready, _ := jitter.push(packet)
+		for _, packet := range ready {
+			write(packet)
+		}
+	}
+	for _, packet := range jitter.flush() {
+		write(packet)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "video.*"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("recorded %v, want one file: %v", paths, err)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hlsPlaylistName = "playlist.m3u8"
+	hlsInitName     = "init.mp4"
+)
+
+var (
+	// hlsFileName matches the files of a stream's HLS output served by /hls
+	hlsFileName = regexp.MustCompile(`^(playlist\.m3u8|init(_[0-9]+)?\.mp4|segment_[0-9]+\.m4s)$`)
+	// hlsSegmentName matches the media segments, numbered
+	hlsSegmentName = regexp.MustCompile(`^segment_([0-9]+)\.m4s$`)
+)
+
+// newHLSMuxer returns an mp4Muxer recording the H.264 video and Opus audio of
+// a session as HLS under dir: the ftyp and moov boxes in init.mp4, and the
+// fragments in segments of -hls-segment-duration listed by playlist.m3u8.
+// A stream published again numbers its segments on from those already in
+// dir, with an init segment of its own, so earlier sessions stay recorded.
+func newHLSMuxer(dir string, expected int) *mp4Muxer {
+	h := &hlsWriter{dir: dir, init: hlsInitName, sequence: lastSegment(dir)}
+	h.first, h.from = h.sequence+1, h.sequence+1
+	if h.sequence > 0 {
+		h.init = fmt.Sprintf("init_%05d.mp4", h.from)
+	}
+	return &mp4Muxer{path: filepath.Join(dir, h.init), expected: expected, hls: h}
+}
+
+// segmentFileName names media segment n of a playlist
+func segmentFileName(n int) string {
+	return fmt.Sprintf("segment_%05d.m4s", n)
+}
+
+// segmentNumber returns the number of the media segment named name, or 0
+func segmentNumber(name string) int {
+	match := hlsSegmentName.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	return n
+}
+
+// lastSegment returns the highest number of the media segments in dir, 0 if
+// there are none
+func lastSegment(dir string) int {
+	entries, _ := os.ReadDir(dir)
+	last := 0
+	for _, entry := range entries {
+		last = max(last, segmentNumber(entry.Name()))
+	}
+	return last
+}
+
+// hlsSegment is a media segment listed in the playlist
+type hlsSegment struct {
+	name     string
+	duration time.Duration
+}
+
+// hlsWriter groups the fragments of an mp4Muxer into media segment files,
+// each starting on a fragment that decodes on its own, and rewrites the
+// playlist as every segment is completed. Segments leaving the playlist
+// window stay on disk as part of the recording.
+type hlsWriter struct {
+	dir string
+
+	// init names the init segment, and from numbers the first segment of
+	// the session
+	init string
+	from int
+
+	// file is the segment being written, numbered sequence and starting at start
+	file     *os.File
+	sequence int
+	start    time.Duration
+
+	// segments are the completed segments in the playlist, the oldest one
+	// numbered first
+	segments []hlsSegment
+	first    int
+}
+
+// writeFragment adds a moof and mdat pair starting at the given time to
+// the current segment, first starting the next segment if the current one
+// is full and the fragment is independent of those before it
+func (h *hlsWriter) writeFragment(data []byte, at time.Duration, independent bool) error {
+	if h.file != nil && independent && at-h.start >= config.HLSSegmentDuration {
+		if err := h.completeSegment(at - h.start); err != nil {
+			return err
+		}
+		if err := h.writePlaylist(false); err != nil {
+			return err
+		}
+	}
+	if h.file == nil {
+		h.sequence++
+		file, err := os.Create(filepath.Join(h.dir, segmentFileName(h.sequence)))
+		if err != nil {
+			return err
+		}
+		h.file = file
+		h.start = at
+	}
+	_, err := h.file.Write(data)
+	return err
+}
+
+// completeSegment closes the current segment and adds it to the playlist,
+// dropping the oldest ones past -hls-playlist-size
+func (h *hlsWriter) completeSegment(duration time.Duration) error {
+	err := h.file.Close()
+	h.segments = append(h.segments, hlsSegment{name: filepath.Base(h.file.Name()), duration: duration})
+	h.file = nil
+	if n := config.HLSPlaylistSize; n > 0 && len(h.segments) > n {
+		h.first += len(h.segments) - n
+		h.segments = append([]hlsSegment(nil), h.segments[len(h.segments)-n:]...)
+	}
+	return err
+}
+
+// finish completes the last segment, ending at end, and closes the playlist
+func (h *hlsWriter) finish(end time.Duration) error {
+	if h.file != nil {
+		if err := h.completeSegment(max(end-h.start, 0)); err != nil {
+			return err
+		}
+	}
+	if len(h.segments) == 0 {
+		return nil
+	}
+	return h.writePlaylist(true)
+}
+
+// writePlaylist replaces the playlist, never leaving it half written. An
+// ended playlist lists no more segments.
+func (h *hlsWriter) writePlaylist(ended bool) error {
+	var target time.Duration
+	for _, segment := range h.segments {
+		target = max(target, segment.duration)
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", max(int(math.Ceil(target.Seconds())), 1))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.first)
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", h.init)
+	for _, segment := range h.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", segment.duration.Seconds(), segment.name)
+	}
+	if ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	playlist := filepath.Join(h.dir, hlsPlaylistName)
+	tmp := playlist + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, playlist); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// files lists the files of the session written by h so far, relative to
+// the output directory: its init segment and media segments, and the
+// playlist
+func (h *hlsWriter) files() []string {
+	entries, _ := os.ReadDir(h.dir)
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == h.init || name == hlsPlaylistName || segmentNumber(name) >= h.from {
+			files = append(files, filepath.Join(filepath.Base(h.dir), name))
+		}
+	}
+	return files
+}
+
+// hlsContentTypes are the media types of the files served by /hls
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+}
+
+// Handler serving the HLS output of streams as /hls/{streamKey}/{file} to
+// those who may play them, and no other file of the output directory
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.Error, http.MethodGet, http.MethodHead) {
+		return
+	}
+	streamKey, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	if !ok || !streamKeyPattern.MatchString(streamKey) || !hlsFileName.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireStreamAuth(w, r, streamKey, rightPlay) {
+		return
+	}
+
+	w.Header().Set("Content-Type", hlsContentTypes[path.Ext(name)])
+	if name == hlsPlaylistName {
+		// The playlist changes with every segment
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeFile(w, r, filepath.Join(config.OutputDir, streamKey, name))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// playlistSegments returns the segments listed by an HLS playlist, checking
+// its header
+func playlistSegments(t *testing.T, playlist string) []string {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(playlist), "\n")
+	if lines[0] != "#EXTM3U" || !slices.Contains(lines, `#EXT-X-MAP:URI="init.mp4"`) {
+		t.Fatalf("playlist lacks its header or init segment:\n%s", playlist)
+	}
+	var segments []string
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#EXTINF:") && i+1 < len(lines) {
+			segments = append(segments, lines[i+1])
+		}
+	}
+	return segments
+}
+
+// TestHLS publishes H.264 and Opus recorded as HLS and checks the playlist
+// lists segments that each start on a keyframe, served under /hls. Published
+// again, the stream's segments are numbered on, keeping the first ones.
+func TestHLS(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) { c.HLSSegmentDuration = 500 * time.Millisecond })
+	p := publish(t, base+"/whip/cam?format=hls", webrtc.MimeTypeH264, webrtc.MimeTypeOpus)
+	// A keyframe every second makes segments of a second
+	p.play(t, 2500*time.Millisecond)
+	p.stop(t, base)
+
+	dir := filepath.Join(config.OutputDir, "cam")
+	playlist, err := os.ReadFile(filepath.Join(dir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(playlist), "#EXT-X-ENDLIST\n") {
+		t.Errorf("playlist of an ended session isn't closed:\n%s", playlist)
+	}
+	segments := playlistSegments(t, string(playlist))
+	if len(segments) < 2 {
+		t.Fatalf("playlist lists %v, want at least 2 segments", segments)
+	}
+	init, err := os.ReadFile(filepath.Join(dir, "init.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range segments {
+		segment, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracks, samples := readMP4(t, slices.Concat(init, segment))
+		if len(tracks) != 2 {
+			t.Fatalf("init segment has tracks %+v, want H.264 and Opus", tracks)
+		}
+		video := tracks[slices.IndexFunc(tracks, func(track mp4TestTrack) bool { return track.sampleEntry == "avc1" })].id
+		i := slices.IndexFunc(samples, func(s mp4TestSample) bool { return s.track == video })
+		if i < 0 || !samples[i].keyframe {
+			t.Errorf("segment %s doesn't start on a keyframe", name)
+		}
+	}
+
+	for _, tt := range []struct {
+		path            string
+		wantStatus      int
+		wantContentType string
+	}{
+		{path: "/hls/cam/playlist.m3u8", wantStatus: http.StatusOK, wantContentType: "application/vnd.apple.mpegurl"},
+		{path: "/hls/cam/init.mp4", wantStatus: http.StatusOK, wantContentType: "video/mp4"},
+		{path: "/hls/cam/" + segments[0], wantStatus: http.StatusOK, wantContentType: "video/iso.segment"},
+		{path: "/hls/cam/segment_99999.m4s", wantStatus: http.StatusNotFound},
+		{path: "/hls/cam/playlist.m3u8.tmp", wantStatus: http.StatusNotFound},
+		{path: "/hls/nobody/playlist.m3u8", wantStatus: http.StatusNotFound},
+	} {
+		resp, err := http.Get(base + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("GET %s answered %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+		}
+		if tt.wantContentType != "" && resp.Header.Get("Content-Type") != tt.wantContentType {
+			t.Errorf("GET %s answered %q, want %q", tt.path, resp.Header.Get("Content-Type"), tt.wantContentType)
+		}
+	}
+
+	// Publishing the stream again numbers its segments on, leaving those of
+	// the first session and its init segment as they were
+	second := publish(t, base+"/whip/cam?format=hls", webrtc.MimeTypeH264, webrtc.MimeTypeOpus)
+	second.play(t, 1500*time.Millisecond)
+	second.stop(t, base)
+	if again, err := os.ReadFile(filepath.Join(dir, "init.mp4")); err != nil || !slices.Equal(again, init) {
+		t.Errorf("first init segment changed by the second session: %v", err)
+	}
+	playlist, err = os.ReadFile(filepath.Join(dir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := fmt.Sprintf("segment_%05d.m4s", len(segments)+1)
+	secondInit := fmt.Sprintf("init_%05d.mp4", len(segments)+1)
+	secondSegments := playlistSegments(t, strings.ReplaceAll(string(playlist), secondInit, "init.mp4"))
+	if len(secondSegments) == 0 || secondSegments[0] != next {
+		t.Errorf("second playlist lists %v, want segments from %s", secondSegments, next)
+	}
+	if !strings.Contains(string(playlist), `#EXT-X-MAP:URI="`+secondInit+`"`) {
+		t.Errorf("second playlist doesn't map %s:\n%s", secondInit, playlist)
+	}
+	for _, path := range []string{"/hls/cam/" + segments[0], "/hls/cam/" + secondInit, "/hls/cam/" + next} {
+		if resp, err := http.Get(base + path); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %v %v, want 200", path, resp, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+
+	// Each session's metadata lists the HLS files it wrote
+	for _, tt := range []struct {
+		p       *testPublisher
+		want    []string
+		notWant string
+	}{
+		{p: p, want: []string{"cam/init.mp4", "cam/" + segments[0]}, notWant: "cam/" + next},
+		{p: second, want: []string{"cam/" + secondInit, "cam/" + next, "cam/playlist.m3u8"}, notWant: "cam/" + segments[0]},
+	} {
+		data, err := os.ReadFile(filepath.Join(config.OutputDir, strings.TrimPrefix(tt.p.location, "/whip/")) + metaSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta sessionMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !slices.Contains(meta.Files, filepath.FromSlash(want)) {
+				t.Errorf("metadata of %s lists %v, want %s", tt.p.location, meta.Files, want)
+			}
+		}
+		if slices.Contains(meta.Files, filepath.FromSlash(tt.notWant)) {
+			t.Errorf("metadata of %s lists %s of the other session", tt.p.location, tt.notWant)
+		}
+	}
+}
+
+// TestHLSAuth checks /hls takes the play rights of WHEP
+func TestHLSAuth(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) { c.HLSSegmentDuration = 500 * time.Millisecond })
+	p := publish(t, base+"/whip/cam?format=hls", webrtc.MimeTypeH264, webrtc.MimeTypeOpus)
+	p.play(t, 1500*time.Millisecond)
+	p.stop(t, base)
+	setConfig(t, func(c *Config) { c.ACL = testACL })
+
+	for _, tt := range []struct {
+		token      string
+		wantStatus int
+	}{
+		{"", http.StatusUnauthorized},
+		{"cam-publisher", http.StatusForbidden},
+		{"cam-viewer", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, base+"/hls/cam/playlist.m3u8", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("GET with %q answered %d, want %d", tt.token, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+// TestHLSPlaylistWindow writes segments past -hls-playlist-size and checks
+// the playlist only lists the latest ones, numbered on from the first
+func TestHLSPlaylistWindow(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		wantSegments []string
+		wantSequence string
+	}{
+		{name: "every segment", wantSegments: []string{"segment_00001.m4s", "segment_00002.m4s", "segment_00003.m4s", "segment_00004.m4s"}, wantSequence: "#EXT-X-MEDIA-SEQUENCE:1"},
+		{name: "latest two", size: 2, wantSegments: []string{"segment_00003.m4s", "segment_00004.m4s"}, wantSequence: "#EXT-X-MEDIA-SEQUENCE:3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.HLSSegmentDuration = time.Second
+				c.HLSPlaylistSize = tt.size
+			})
+			h := &hlsWriter{dir: t.TempDir(), init: hlsInitName, first: 1, from: 1}
+			// A fragment every half second, only those on the second independent
+			for i := range 8 {
+				if err := h.writeFragment([]byte{byte(i)}, time.Duration(i)*time.Second/2, i%2 == 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h.finish(4 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			playlist, err := os.ReadFile(filepath.Join(h.dir, "playlist.m3u8"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := playlistSegments(t, string(playlist)); !slices.Equal(got, tt.wantSegments) {
+				t.Errorf("playlist lists %v, want %v", got, tt.wantSegments)
+			}
+			if !strings.Contains(string(playlist), tt.wantSequence+"\n") || !strings.Contains(string(playlist), "#EXT-X-TARGETDURATION:1\n") {
+				t.Errorf("playlist:\n%s\nwant %s and a target duration of 1", playlist, tt.wantSequence)
+			}
+			// Segments out of the window are kept as part of the recording
+			for n := 1; n <= 4; n++ {
+				data, err := os.ReadFile(filepath.Join(h.dir, segmentFileName(n)))
+				if err != nil || len(data) != 2 {
+					t.Errorf("segment %d holds % x, %v, want its 2 fragments", n, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHLSFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "set", args: []string{"-hls-segment-duration", "4s", "-hls-playlist-size", "0"}},
+		{name: "zero segment duration", args: []string{"-hls-segment-duration", "0s"}, wantErr: true},
+		{name: "negative playlist size", args: []string{"-hls-playlist-size", "-1"}, wantErr: true},
+		{name: "format", args: []string{"-recording-format", "hls"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/webrtc/v4"
+)
+
+// parseICEServer parses an -ice-server value of the form
+//
+//	URL[,username,credential]
+//
+// for example "stun:stun.l.google.com:19302" or
+// "turn:turn.example.com:3478?transport=udp,alice,secret". The credential is
+// everything after the second comma, so it may itself contain commas. A
+// TURN server may leave the credentials out with -turn-secret, which
+// Config.validate checks.
+func parseICEServer(value string) (webrtc.ICEServer, error) {
+	parts := strings.SplitN(value, ",", 3)
+	server := webrtc.ICEServer{URLs: []string{strings.TrimSpace(parts[0])}}
+	switch len(parts) {
+	case 1:
+	case 3:
+		server.Username = parts[1]
+		server.Credential = parts[2]
+	default:
+		return server, fmt.Errorf("invalid ICE server %q: expected URL[,username,credential]", value)
+	}
+	for _, raw := range server.URLs {
+		if _, err := stun.ParseURI(raw); err != nil {
+			return server, fmt.Errorf("invalid ICE server URL %q: %w", raw, err)
+		}
+	}
+	return server, nil
+}
+
+// validateICEServer checks the URL schemes and that TURN servers carry
+// credentials, unless generated ones are
+func validateICEServer(server webrtc.ICEServer, generated bool) error {
+	for _, raw := range server.URLs {
+		uri, err := stun.ParseURI(raw)
+		if err != nil {
+			return fmt.Errorf("invalid ICE server URL %q: %w", raw, err)
+		}
+		if isTURN(uri) && !generated && !hasCredentials(server) {
+			return fmt.Errorf("TURN server %q requires a username and credential, or -turn-secret", raw)
+		}
+	}
+	return nil
+}
+
+// isTURN reports whether uri names a TURN server
+func isTURN(uri *stun.URI) bool {
+	return uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS
+}
+
+// hasCredentials reports whether server was given a username and credential
+func hasCredentials(server webrtc.ICEServer) bool {
+	return server.Username != "" && server.Credential != nil && server.Credential != ""
+}
+
+// turnCredentials returns a username and password of the TURN REST API
+// (draft-uberti-behave-turn-rest), as checked by coturn's use-auth-secret.
+// The username is the Unix time in seconds the credentials expire at, ttl
+// after now, then a colon and user, as in "1700086400:mediaserver"; the
+// password is the base64 HMAC-SHA1 of the username keyed with secret.
+func turnCredentials(secret, user string, now time.Time, ttl time.Duration) (username, password string) {
+	username = strconv.FormatInt(now.Add(ttl).Unix(), 10) + ":" + user
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// iceServerFlag collects repeated -ice-server values. The first use on the
+// command line replaces the default instead of appending to it.
+type iceServerFlag struct {
+	servers *[]webrtc.ICEServer
+	set     bool
+}
+
+func (f *iceServerFlag) String() string {
+	if f.servers == nil {
+		return ""
+	}
+	urls := make([]string, 0, len(*f.servers))
+	for _, server := range *f.servers {
+		urls = append(urls, server.URLs...)
+	}
+	return strings.Join(urls, " ")
+}
+
+func (f *iceServerFlag) Set(value string) error {
+	server, err := parseICEServer(value)
+	if err != nil {
+		return err
+	}
+	if !f.set {
+		*f.servers = nil
+		f.set = true
+	}
+	*f.servers = append(*f.servers, server)
+	return nil
+}
+
+// turnUser is the user named in the TURN credentials generated with -turn-secret
+const turnUser = "mediaserver"
+
+// peerConnectionConfig builds the configuration of a new PeerConnection. With
+// -turn-secret, the TURN servers without credentials get ones of their own.
+//
+// Its policies state what the server relies on: max-bundle, every m-line
+// sharing a single ICE and DTLS transport, and RTCP multiplexed on the RTP
+// port, there being no socket for RTCP alone. Offers without rtcp-mux are
+// turned away by checkOffer.
+func peerConnectionConfig() webrtc.Configuration {
+	servers := config.ICEServers
+	if config.TURNSecret != "" {
+		servers = make([]webrtc.ICEServer, 0, len(config.ICEServers))
+		username, password := turnCredentials(config.TURNSecret, turnUser, time.Now(), config.TURNCredentialTTL)
+		for _, server := range config.ICEServers {
+			if !hasCredentials(server) && slices.ContainsFunc(server.URLs, func(raw string) bool {
+				uri, err := stun.ParseURI(raw)
+				return err == nil && isTURN(uri)
+			}) {
+				server.Username, server.Credential = username, password
+			}
+			servers = append(servers, server)
+		}
+	}
+	return webrtc.Configuration{
+		ICEServers:    servers,
+		Certificates:  dtlsCertificates,
+		BundlePolicy:  webrtc.BundlePolicyMaxBundle,
+		RTCPMuxPolicy: webrtc.RTCPMuxPolicyRequire,
+	}
+}
+
+// configureICE sets up ICE-Lite, the announced public IPs and the UDP port
+// range. An ICE-Lite agent only answers connectivity checks on its host
+// candidates, so it never waits on STUN or TURN while gathering.
+func configureICE(settingEngine *webrtc.SettingEngine) error {
+	if len(config.PublicIPs) > 0 {
+		settingEngine.SetNAT1To1IPs(config.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	settingEngine.SetLite(config.ICELite)
+	if config.UDPReceiveBuffer > 0 {
+		network, err := stdnet.NewNet()
+		if err != nil {
+			return err
+		}
+		settingEngine.SetNet(&udpBufferNet{Net: network, size: config.UDPReceiveBuffer})
+	}
+	if config.ICEPortMin > 0 {
+		return settingEngine.SetEphemeralUDPPortRange(uint16(config.ICEPortMin), uint16(config.ICEPortMax))
+	}
+	return nil
+}
+
+// validatePublicIP checks ip is a literal address peers can be told to reach
+func validatePublicIP(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return errors.New("not an IP address")
+	}
+	if parsed.IsUnspecified() || parsed.IsLoopback() || parsed.IsMulticast() {
+		return errors.New("not a unicast address peers can reach")
+	}
+	return nil
+}
+
+// whipOptions answers an OPTIONS request to the WHIP endpoint with the ICE
+// servers as Link headers (RFC 9725), TURN credentials included, so clients
+// can configure their PeerConnection before the offer. With -token or an ACL
+// set, the servers carrying credentials are only listed for a request with a
+// valid token, OPTIONS going unauthenticated for CORS preflights.
+func whipOptions(w http.ResponseWriter, r *http.Request) {
+	withCredentials := !streamAuthRequired(rightPublish) || hasValidToken(r) || aclEntryFor(r) != nil
+	for _, server := range peerConnectionConfig().ICEServers {
+		if hasCredentials(server) && !withCredentials {
+			continue
+		}
+		for _, link := range iceServerLinks(server) {
+			w.Header().Add("Link", link)
+		}
+	}
+	w.Header().Set("Allow", "OPTIONS, POST")
+	w.Header().Set("Accept-Post", sdpContentType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// iceServerLinks returns a Link header value of rel ice-server for each URL
+// of server, as in
+//
+//	<turn:turn.example.com?transport=udp>; rel="ice-server"; username="alice"; credential="secret"; credential-type="password"
+func iceServerLinks(server webrtc.ICEServer) []string {
+	links := make([]string, 0, len(server.URLs))
+	for _, raw := range server.URLs {
+		link := "<" + raw + `>; rel="ice-server"`
+		if hasCredentials(server) {
+			link += "; username=" + quoteLinkParam(server.Username) +
+				"; credential=" + quoteLinkParam(fmt.Sprint(server.Credential)) +
+				`; credential-type="password"`
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// quoteLinkParam quotes a Link parameter value as an HTTP quoted-string
+func quoteLinkParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseICEServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    webrtc.ICEServer
+		wantErr string
+	}{
+		{
+			name:  "STUN",
+			value: "stun:stun.l.google.com:19302",
+			want:  webrtc.ICEServer{URLs: []string{"stun:stun.l.google.com:19302"}},
+		},
+		{
+			name:  "TURN with credentials",
+			value: "turn:turn.example.com:3478?transport=udp,alice,secret",
+			want:  webrtc.ICEServer{URLs: []string{"turn:turn.example.com:3478?transport=udp"}, Username: "alice", Credential: "secret"},
+		},
+		{
+			name:  "TURNS with a comma in the credential",
+			value: "turns:turn.example.com,alice,se,cret",
+			want:  webrtc.ICEServer{URLs: []string{"turns:turn.example.com"}, Username: "alice", Credential: "se,cret"},
+		},
+		{
+			// Config.validate checks the credentials, which -turn-secret may generate
+			name:  "TURN without credentials",
+			value: "turn:turn.example.com",
+			want:  webrtc.ICEServer{URLs: []string{"turn:turn.example.com"}},
+		},
+		{name: "username without credential", value: "turn:turn.example.com,alice", wantErr: "expected URL[,username,credential]"},
+		{name: "unknown scheme", value: "http://turn.example.com", wantErr: "invalid ICE server URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseICEServer(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseICEServer(%q) = %v, want an error containing %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseICEServer(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestICEServerFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []webrtc.ICEServer
+		wantErr string
+	}{
+		{name: "none"},
+		{
+			name: "STUN and TURN",
+			args: []string{"-ice-server", "stun:stun.example.com", "-ice-server", "turn:turn.example.com:3478,alice,secret"},
+			want: []webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.com"}},
+				{URLs: []string{"turn:turn.example.com:3478"}, Username: "alice", Credential: "secret"},
+			},
+		},
+		{name: "TURN without credentials", args: []string{"-ice-server", "turn:turn.example.com"}, wantErr: "requires a username and credential"},
+		{name: "TURN with an empty credential", args: []string{"-ice-server", "turn:turn.example.com,alice,"}, wantErr: "requires a username and credential"},
+		{name: "zero TURN credential TTL", args: []string{"-turn-credential-ttl", "0s"}, wantErr: "-turn-credential-ttl must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			err := cfg.validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validate = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			setConfig(t, func(c *Config) { *c = cfg })
+			got := peerConnectionConfig().ICEServers
+			if len(got) != len(tt.want) || len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ICEServers = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTURNCredentials(t *testing.T) {
+	username, password := turnCredentials("north", "mediaserver", time.Unix(1700000000, 0), 24*time.Hour)
+	if username != "1700086400:mediaserver" || password != "jNv84dwHjzsPn7bFXb32ol7f4tY=" {
+		t.Errorf("turnCredentials = %q, %q, want the HMAC-SHA1 of the expiry time", username, password)
+	}
+}
+
+// TestTURNSecret checks the TURN servers given without credentials get ones
+// generated with -turn-secret, which a TURN server sharing it accepts
+func TestTURNSecret(t *testing.T) {
+	const ttl = time.Hour
+	cfg := parseFlags(t,
+		"-ice-server", "stun:stun.example.com",
+		"-ice-server", "turn:turn.example.com:3478",
+		"-ice-server", "turns:static.example.com,alice,secret",
+		"-turn-secret", "north",
+		"-turn-credential-ttl", ttl.String(),
+	)
+	cfg.OutputDir = t.TempDir()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, func(c *Config) { *c = cfg })
+	got := peerConnectionConfig().ICEServers
+	if len(got) != 3 {
+		t.Fatalf("ICEServers = %+v, want 3", got)
+	}
+	if got[0].Username != "" || got[2].Username != "alice" || got[2].Credential != "secret" {
+		t.Errorf("STUN and static TURN servers changed: %+v", got)
+	}
+
+	expiry, user, ok := strings.Cut(got[1].Username, ":")
+	if !ok || user != turnUser {
+		t.Fatalf("generated username %q, want expiry:%s", got[1].Username, turnUser)
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Until(time.Unix(seconds, 0)); left < ttl-time.Minute || left > ttl {
+		t.Errorf("credentials expire in %v, want %v", left, ttl)
+	}
+	mac := hmac.New(sha1.New, []byte("north"))
+	mac.Write([]byte(got[1].Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); got[1].Credential != want {
+		t.Errorf("generated credential %q, want %q", got[1].Credential, want)
+	}
+}
+
+func TestICEServerLinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		server webrtc.ICEServer
+		want   []string
+	}{
+		{
+			name:   "STUN",
+			server: webrtc.ICEServer{URLs: []string{"stun:stun.example.com:19302"}},
+			want:   []string{`<stun:stun.example.com:19302>; rel="ice-server"`},
+		},
+		{
+			name:   "TURN",
+			server: webrtc.ICEServer{URLs: []string{"turn:turn.example.com?transport=udp", "turns:turn.example.com"}, Username: "alice", Credential: "secret"},
+			want: []string{
+				`<turn:turn.example.com?transport=udp>; rel="ice-server"; username="alice"; credential="secret"; credential-type="password"`,
+				`<turns:turn.example.com>; rel="ice-server"; username="alice"; credential="secret"; credential-type="password"`,
+			},
+		},
+		{
+			name:   "quoted credential",
+			server: webrtc.ICEServer{URLs: []string{"turn:turn.example.com"}, Username: "a\\b", Credential: `say "hi"`},
+			want:   []string{`<turn:turn.example.com>; rel="ice-server"; username="a\\b"; credential="say \"hi\""; credential-type="password"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := iceServerLinks(tt.server); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("iceServerLinks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWHIPOptions asks the WHIP endpoint for its ICE servers with OPTIONS
+// and checks the Link headers, TURN credentials generated with -turn-secret
+// only listed for a request with a valid token
+func TestWHIPOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		// wantTURN is whether the TURN servers are listed with credentials
+		wantTURN bool
+	}{
+		{name: "endpoint", path: "/whip", token: "secret", wantTURN: true},
+		{name: "stream key", path: "/whip/cam", token: "secret", wantTURN: true},
+		{name: "no token", path: "/whip"},
+		{name: "wrong token", path: "/whip", token: "guess"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.Tokens = []string{"secret"}
+				c.ICEServers = []webrtc.ICEServer{
+					{URLs: []string{"stun:stun.example.com"}},
+					{URLs: []string{"turn:turn.example.com:3478?transport=udp"}},
+					{URLs: []string{"turns:static.example.com"}, Username: "alice", Credential: "static"},
+				}
+				c.TURNSecret = "north"
+				c.TURNCredentialTTL = time.Hour
+			})
+			base := startServer(t)
+			req, err := http.NewRequest(http.MethodOptions, base+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("OPTIONS answered %d, want 204", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Accept-Post"); got != sdpContentType {
+				t.Errorf("Accept-Post %q, want %s", got, sdpContentType)
+			}
+
+			linkPattern := regexp.MustCompile(`^<([^>]+)>; rel="ice-server"(; username="([^"]*)"; credential="([^"]*)"; credential-type="password")?$`)
+			links := map[string][]string{}
+			for _, link := range resp.Header.Values("Link") {
+				match := linkPattern.FindStringSubmatch(link)
+				if match == nil {
+					t.Fatalf("malformed Link %q", link)
+				}
+				links[match[1]] = match[3:]
+			}
+			if _, ok := links["stun:stun.example.com"]; !ok {
+				t.Errorf("Links %v, want the STUN server", links)
+			}
+			turn, listed := links["turn:turn.example.com:3478?transport=udp"]
+			_, static := links["turns:static.example.com"]
+			if listed != tt.wantTURN || static != tt.wantTURN {
+				t.Fatalf("Links %v, want TURN servers listed %v", links, tt.wantTURN)
+			}
+			if !tt.wantTURN {
+				return
+			}
+			mac := hmac.New(sha1.New, []byte("north"))
+			mac.Write([]byte(turn[0]))
+			if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); !strings.HasSuffix(turn[0], ":"+turnUser) || turn[1] != want {
+				t.Errorf("TURN credentials %q / %q, want generated ones", turn[0], turn[1])
+			}
+		})
+	}
+}
+
+func TestICELiteFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "off"},
+		{name: "lite with a public IP", args: []string{"-ice-lite", "-public-ip", "203.0.113.7"}},
+		{name: "public IPv6", args: []string{"-public-ip", "203.0.113.7,2001:db8::7"}},
+		{name: "lite without a public IP", args: []string{"-ice-lite"}, wantErr: "-ice-lite requires -public-ip"},
+		{name: "hostname", args: []string{"-ice-lite", "-public-ip", "example.com"}, wantErr: "not an IP address"},
+		{name: "unspecified", args: []string{"-public-ip", "0.0.0.0"}, wantErr: "not a unicast address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// gatheredAnswer returns the answer of a PeerConnection of api to a video
+// offer, once every candidate has been gathered
+func gatheredAnswer(t *testing.T, api *webrtc.API) string {
+	t.Helper()
+	client := newTestPeerConnection(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	if err := server.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := server.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(server)
+	if err := server.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return server.LocalDescription().SDP
+}
+
+// TestICELite checks the SettingEngine of an -ice-lite server makes it answer
+// as an ICE-Lite agent, announcing the public IP as its host candidate
+func TestICELite(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ICELite = true
+		c.PublicIPs = []string{"203.0.113.7"}
+	})
+	api, err := newAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sdp := gatheredAnswer(t, api)
+	if !strings.Contains(sdp, "a=ice-lite") {
+		t.Error("answer doesn't announce ICE-Lite")
+	}
+	if !strings.Contains(sdp, " 203.0.113.7 ") {
+		t.Errorf("answer doesn't announce the public IP:\n%s", sdp)
+	}
+}
+
+func TestICEPortFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "ephemeral"},
+		{name: "range", args: []string{"-ice-port-min", "50000", "-ice-port-max", "50199"}},
+		{name: "min only", args: []string{"-ice-port-min", "50000"}, wantErr: "set together"},
+		{name: "reversed", args: []string{"-ice-port-min", "50199", "-ice-port-max", "50000"}, wantErr: "min <= max"},
+		{name: "out of range", args: []string{"-ice-port-min", "65500", "-ice-port-max", "70000"}, wantErr: "65535"},
+		{name: "too small for the sessions", args: []string{"-ice-port-min", "50000", "-ice-port-max", "50009"}, wantErr: "-max-sessions 100"},
+		{name: "fewer sessions", args: []string{"-ice-port-min", "50000", "-ice-port-max", "50009", "-max-sessions", "10"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestICEPortRange checks the SettingEngine gathers its host candidates on
+// ports of the configured range
+func TestICEPortRange(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ICEPortMin = 47300
+		c.ICEPortMax = 47309
+	})
+	api, err := newAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ports int
+	for _, line := range strings.Split(gatheredAnswer(t, api), "\r\n") {
+		fields := strings.Fields(line)
+		if !strings.HasPrefix(line, "a=candidate:") || len(fields) < 8 || fields[2] != "udp" {
+			continue
+		}
+		port, err := strconv.Atoi(fields[5])
+		if err != nil || port < config.ICEPortMin || port > config.ICEPortMax {
+			t.Errorf("candidate port %s outside %d-%d", fields[5], config.ICEPortMin, config.ICEPortMax)
+		}
+		ports++
+	}
+	if ports == 0 {
+		t.Error("no UDP candidates gathered")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// ingestTimeout bounds the WHEP exchange with the remote source of an
+// ingest, and the DELETE ending it
+const ingestTimeout = 10 * time.Second
+
+// ingestClient makes the requests of the ingests. Redirects are answered
+// to the caller as they are, so an ingest only reaches the URL it was given.
+var ingestClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// maxIngestRequestSize bounds the JSON body of POST /ingest
+const maxIngestRequestSize = 16 << 10
+
+// ingestRequest asks the server to pull the stream of a remote WHEP
+// endpoint and record it as a publish to Stream
+type ingestRequest struct {
+	URL    string `json:"url"`
+	Token  string `json:"token,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// ingestResponse answers a started ingest with the ID of its session,
+// ended with a DELETE of /whip/{id} like a WHIP publish
+type ingestResponse struct {
+	Session string `json:"session"`
+	Stream  string `json:"stream"`
+}
+
+// Handler starting a pull from a remote WHEP endpoint, behind the admin
+// auth. As it makes the server request any URL, it is refused unless a
+// -token is configured. The session records and relays the pulled tracks
+// like those of a publisher.
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, writeJSONError, http.MethodPost) {
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+	if !acceptingSessions(w, writeJSONError) {
+		return
+	}
+
+	body, ok := readBody(w, r, maxIngestRequestSize, writeJSONError)
+	if !ok {
+		return
+	}
+	var req ingestRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSONError(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := url.Parse(req.URL)
+	if err != nil || source.Scheme != "http" && source.Scheme != "https" || source.Host == "" {
+		writeJSONError(w, "Expected the http or https URL of a WHEP endpoint", http.StatusBadRequest)
+		return
+	}
+	if req.Stream == "" {
+		req.Stream = defaultStreamKey
+	}
+	if !streamKeyPattern.MatchString(req.Stream) {
+		writeJSONError(w, "Invalid stream key", http.StatusBadRequest)
+		return
+	}
+	if req.Format == "" {
+		req.Format = config.RecordingFormat
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ingestTimeout)
+	defer cancel()
+	pull := &ingest{source: source, token: req.Token, streamKey: req.Stream, format: req.Format}
+	sess, err := startIngest(ctx, pull)
+	if err != nil {
+		writePublishError(w, err, writeJSONError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/whip/"+sess.id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ingestResponse{Session: sess.id, Stream: sess.streamKey})
+
+	sess.log.Info("Ingest session established", "source", source.Redacted())
+}
+
+// startIngest registers a session publishing the tracks pulled by pull,
+// offering to receive video and audio. Failures of the exchange are answered
+// with 502.
+func startIngest(ctx context.Context, pull *ingest) (*session, error) {
+	source, token, format := pull.source, pull.token, pull.format
+	sess, err := newPublishSession(pull.streamKey, format, pull)
+	if err != nil {
+		return nil, err
+	}
+	abort := func(status int, message string) (*session, error) {
+		sessions.removeSession(sess)
+		sess.Close()
+		return nil, &publishError{status, message}
+	}
+	peerConnection := sess.peerConnection
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return abort(http.StatusInternalServerError, "Failed to add transceiver")
+		}
+	}
+	if err := applyRecordingFormat(peerConnection, format); err != nil {
+		return abort(http.StatusBadRequest, "Unsupported recording format: "+err.Error())
+	}
+
+	// Create an SDP offer with every candidate, as WHEP servers needn't trickle
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return abort(http.StatusInternalServerError, "Failed to create offer")
+	}
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		return abort(http.StatusInternalServerError, "Failed to set local description")
+	}
+	select {
+	case <-webrtc.GatheringCompletePromise(peerConnection):
+	case <-ctx.Done():
+		return abort(http.StatusInternalServerError, "Timed out gathering candidates")
+	}
+
+	answer, resource, err := exchangeWHEP(ctx, source, token, peerConnection.LocalDescription().SDP)
+	if err != nil {
+		return abort(http.StatusBadGateway, "Failed to pull the stream: "+err.Error())
+	}
+	if resource != nil {
+		sess.leaveSource = func() { leaveWHEP(resource, token) }
+	}
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		sess.log.Warn("Invalid answer from the remote WHEP endpoint", "error", err)
+		return abort(http.StatusBadGateway, "Remote WHEP endpoint sent an invalid answer")
+	}
+	if err := stopUnsentTransceivers(peerConnection, answer); err != nil {
+		return abort(http.StatusInternalServerError, "Failed to stop transceiver")
+	}
+	tracks, recordable := negotiatedTracks(peerConnection)
+	if recordable == 0 {
+		return abort(http.StatusBadGateway, "Remote WHEP endpoint sends no supported codecs")
+	}
+	sess.muxer = newSessionMuxer(sess.dir, sess.streamKey, peerConnection, tracks, format)
+	sess.pending = tracks
+	if err := sess.saveMeta(false); err != nil {
+		sess.log.Warn("Failed to write session metadata", "error", err)
+	}
+	sess.watchIdle()
+	sess.watchDuration()
+
+	// The tracks arrive once the connection is up, after the muxer is set
+	recordTracks(sess)
+	return sess, nil
+}
+
+// ingest is a pull from a remote WHEP endpoint. When its connection fails,
+// it is reconnected up to -ingest-reconnects times, backing off from
+// -ingest-backoff, each reconnection recording a session of its own.
+type ingest struct {
+	source    *url.URL
+	token     string
+	streamKey string
+	format    string
+
+	// id is the ID of the first session of the pull, which those of its
+	// reconnections take over
+	id string
+	// reconnects counts the reconnections that got the pull going again,
+	// attempts those made since its session was last connected
+	reconnects, attempts atomic.Int32
+}
+
+// maxIngestBackoff caps the wait before a reconnection attempt
+const maxIngestBackoff = 30 * time.Second
+
+// ingestInfo describes the pull of an ingest session in /sessions
+type ingestInfo struct {
+	Source     string `json:"source"`
+	Reconnects int    `json:"reconnects"`
+}
+
+// attach makes sess, new, a session of the pull. Those of the reconnections
+// keep the ID of the first, so the pull's resource and its /sessions entry
+// stay the same, and record to a directory of their own named after it,
+// suffixed with the number of the reconnection.
+func (in *ingest) attach(sess *session) {
+	sess.ingest = in
+	if in.id == "" {
+		in.id = sess.id
+		return
+	}
+	n := in.reconnects.Load() + 1
+	sess.id = in.id
+	sess.dir = filepath.Join(config.OutputDir, fmt.Sprintf("%s_%d", in.id, n))
+	sess.log = slog.With("session", in.id, "stream", sess.streamKey, "reconnect", n)
+}
+
+// info returns the pull as listed by /sessions
+func (in *ingest) info() *ingestInfo {
+	return &ingestInfo{Source: in.source.Redacted(), Reconnects: int(in.reconnects.Load())}
+}
+
+// reconnect starts reconnecting the pull, whose session failed, in the
+// background. The attempts count until a session of the pull connects, so a
+// source answering but never connecting is given up on too. A DELETE of the
+// pull's resource, draining or shutting down stops it.
+func (in *ingest) reconnect(logger *slog.Logger) {
+	if config.IngestReconnects == 0 || drain.active() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ingestRetries.add(in.id, cancel)
+	go func() {
+		defer ingestRetries.remove(in.id)
+		defer cancel()
+		for {
+			attempt := int(in.attempts.Add(1))
+			if attempt > config.IngestReconnects {
+				logger.Warn("Giving up reconnecting ingest", "attempts", config.IngestReconnects)
+				return
+			}
+			backoff := min(config.IngestBackoff, maxIngestBackoff)
+			for range attempt - 1 {
+				backoff = min(2*backoff, maxIngestBackoff)
+			}
+			logger.Info("Reconnecting ingest", "attempt", attempt, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			attemptCtx, cancelAttempt := context.WithTimeout(ctx, ingestTimeout)
+			sess, err := startIngest(attemptCtx, in)
+			cancelAttempt()
+			if err == nil {
+				// Stopped while the session was being set up
+				if ctx.Err() != nil {
+					if sessions.removeSession(sess) {
+						sess.Close()
+					}
+					return
+				}
+				in.reconnects.Add(1)
+				sess.log.Info("Ingest reconnected", "attempt", attempt)
+				return
+			}
+			logger.Warn("Failed to reconnect ingest", "attempt", attempt, "error", err)
+		}
+	}()
+}
+
+// ingestRetryRegistry holds the ingests being reconnected, by ID, with the
+// functions stopping them
+type ingestRetryRegistry struct {
+	mu    sync.Mutex
+	stops map[string]context.CancelFunc
+}
+
+var ingestRetries = &ingestRetryRegistry{stops: map[string]context.CancelFunc{}}
+
+func (r *ingestRetryRegistry) add(id string, stop context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stops[id] = stop
+}
+
+func (r *ingestRetryRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.stops, id)
+}
+
+// stop stops reconnecting the ingest id, reporting whether it was
+func (r *ingestRetryRegistry) stop(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stop, ok := r.stops[id]
+	if ok {
+		stop()
+		delete(r.stops, id)
+	}
+	return ok
+}
+
+// stopAll stops reconnecting every ingest
+func (r *ingestRetryRegistry) stopAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, stop := range r.stops {
+		stop()
+		delete(r.stops, id)
+	}
+}
+
+// exchangeWHEP posts offer to the WHEP endpoint at source and returns its
+// answer, and the URL of the resource it created if it named one
+func exchangeWHEP(ctx context.Context, source *url.URL, token, offer string) (string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, source.String(), strings.NewReader(offer))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", sdpContentType)
+	req.Header.Set("Accept", sdpContentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ingestClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", nil, fmt.Errorf("failed to reach the remote WHEP endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	// Only the status of a failure is returned, as the caller of the ingest
+	// mustn't read what the server can reach through the response
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("remote WHEP endpoint answered %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != sdpContentType {
+		return "", nil, fmt.Errorf("remote WHEP endpoint answered without %s", sdpContentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOfferSize))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read its answer: %w", err)
+	}
+	var resource *url.URL
+	if location := resp.Header.Get("Location"); location != "" {
+		if resource, err = source.Parse(location); err != nil {
+			return "", nil, errors.New("remote WHEP endpoint sent an invalid Location")
+		}
+	}
+	return string(body), resource, nil
+}
+
+// leaveWHEP deletes the resource of a pull at its WHEP endpoint, which may
+// already have ended it
+func leaveWHEP(resource *url.URL, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ingestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource.String(), nil)
+	if err != nil {
+		return
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if resp, err := ingestClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// stopUnsentTransceivers stops the transceivers of peerConnection whose
+// media section the answer rejects or doesn't send on, so they aren't
+// waited for as tracks
+func stopUnsentTransceivers(peerConnection *webrtc.PeerConnection, answer string) error {
+	var description sdp.SessionDescription
+	if err := description.UnmarshalString(answer); err != nil {
+		return err
+	}
+	sending := map[string]bool{}
+	for _, media := range description.MediaDescriptions {
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		_, sendonly := media.Attribute(webrtc.RTPTransceiverDirectionSendonly.String())
+		_, sendrecv := media.Attribute(webrtc.RTPTransceiverDirectionSendrecv.String())
+		sending[mid] = media.MediaName.Port.Value != 0 && (sendonly || sendrecv)
+	}
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if !sending[transceiver.Mid()] {
+			if err := transceiver.Stop(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// postIngest posts body to /ingest with testAdminToken and returns the
+// response with its body
+func postIngest(t *testing.T, base, body string) (*http.Response, string) {
+	t.Helper()
+	return adminRequest(t, http.MethodPost, base+"/ingest", body)
+}
+
+// TestIngest pulls a stream published to the server back from its own WHEP
+// endpoint and checks it's recorded as a session of its own
+func TestIngest(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the track to be relayed", func() bool { return len(publishedTracks("cam")) == 1 })
+	useAdminToken(t)
+
+	resp, body := postIngest(t, base, `{"url": "`+base+`/whep/cam", "stream": "pulled"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /ingest answered %d: %s", resp.StatusCode, body)
+	}
+	var started ingestResponse
+	if err := json.Unmarshal([]byte(body), &started); err != nil {
+		t.Fatal(err)
+	}
+	if started.Stream != "pulled" || resp.Header.Get("Location") != "/whip/"+started.Session {
+		t.Fatalf("ingest %+v at %q, want stream pulled at its session", started, resp.Header.Get("Location"))
+	}
+	s := sessions.get(started.Session)
+	if s == nil {
+		t.Fatalf("no session %s", started.Session)
+	}
+	waitFor(t, "the pulled stream to be recorded", func() bool { return s.bytesWritten.Load() > 0 })
+
+	deleted, _ := adminRequest(t, http.MethodDelete, base+"/whip/"+started.Session, "")
+	if deleted.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE answered %d", deleted.StatusCode)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, blocks := readWebM(t, data)
+	if len(tracks) != 1 || tracks[0].codecID != "V_VP8" || len(blocks) == 0 {
+		t.Errorf("recorded tracks %+v with %d blocks, want VP8 video", tracks, len(blocks))
+	}
+}
+
+// TestIngestReconnect pulls a stream from the server's own WHEP endpoint,
+// drops the remote side and checks the ingest reconnects under the same ID,
+// recording to a directory of its own and counting the reconnection in
+// /sessions. Dropped again with a long backoff, a DELETE stops it.
+func TestIngestReconnect(t *testing.T) {
+	base := startServer(t)
+	setConfig(t, func(c *Config) { c.IngestBackoff = 100 * time.Millisecond })
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the track to be relayed", func() bool { return len(publishedTracks("cam")) == 1 })
+	useAdminToken(t)
+
+	resp, body := postIngest(t, base, `{"url": "`+base+`/whep/cam", "stream": "pulled"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /ingest answered %d: %s", resp.StatusCode, body)
+	}
+	var started ingestResponse
+	if err := json.Unmarshal([]byte(body), &started); err != nil {
+		t.Fatal(err)
+	}
+	first := sessions.get(started.Session)
+	if first == nil {
+		t.Fatalf("no session %s", started.Session)
+	}
+	waitFor(t, "the pulled stream to be recorded", func() bool { return first.bytesWritten.Load() > 0 })
+
+	// The remote side goes away, closing the pull with a DTLS close_notify
+	viewers.closeAll()
+	var second *session
+	waitFor(t, "the ingest to reconnect", func() bool {
+		second = sessions.get(started.Session)
+		return second != nil && second != first && second.bytesWritten.Load() > 0
+	})
+	if second.dir != first.dir+"_1" {
+		t.Errorf("reconnection recorded to %s, want %s_1", second.dir, first.dir)
+	}
+
+	_, listed := adminRequest(t, http.MethodGet, base+"/sessions", "")
+	var list []sessionInfo
+	if err := json.Unmarshal([]byte(listed), &list); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, info := range list {
+		if info.ID == started.Session {
+			found = true
+			if info.Ingest == nil || info.Ingest.Reconnects != 1 || info.Ingest.Source != base+"/whep/cam" {
+				t.Errorf("/sessions lists the ingest with %+v, want 1 reconnect from %s/whep/cam", info.Ingest, base)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("/sessions doesn't list %s", started.Session)
+	}
+
+	// Waiting a minute to reconnect, the ingest is stopped by its resource
+	config.IngestBackoff = time.Minute
+	viewers.closeAll()
+	waitFor(t, "the ingest to wait to reconnect", func() bool {
+		ingestRetries.mu.Lock()
+		defer ingestRetries.mu.Unlock()
+		return ingestRetries.stops[started.Session] != nil
+	})
+	// Both sessions ended, their recordings are complete
+	for _, dir := range []string{first.dir, second.dir} {
+		data, err := os.ReadFile(filepath.Join(dir, "recording.webm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, blocks := readWebM(t, data); len(blocks) == 0 {
+			t.Errorf("%s holds no frames", dir)
+		}
+	}
+	deleted, _ := adminRequest(t, http.MethodDelete, base+"/whip/"+started.Session, "")
+	if deleted.StatusCode != http.StatusOK {
+		t.Errorf("DELETE while reconnecting answered %d, want 200", deleted.StatusCode)
+	}
+	if ingestRetries.stop(started.Session) || sessions.get(started.Session) != nil {
+		t.Error("ingest still reconnecting after its DELETE")
+	}
+}
+
+func TestIngestRejected(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal secret", http.StatusInternalServerError)
+	}))
+	defer internal.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer redirect.Close()
+
+	tests := []struct {
+		name       string
+		noToken    bool
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "no -token", noToken: true, body: `{"url": "BASE/whep/cam"}`, wantStatus: http.StatusForbidden, wantBody: "Needs a -token"},
+		{name: "invalid JSON", body: `{`, wantStatus: http.StatusBadRequest, wantBody: "Invalid JSON body"},
+		{name: "no URL", body: `{}`, wantStatus: http.StatusBadRequest, wantBody: "URL of a WHEP endpoint"},
+		{name: "not HTTP", body: `{"url": "ftp://example.com/whep"}`, wantStatus: http.StatusBadRequest, wantBody: "URL of a WHEP endpoint"},
+		{name: "invalid stream key", body: `{"url": "BASE/whep", "stream": "../x"}`, wantStatus: http.StatusBadRequest, wantBody: "Invalid stream key"},
+		{name: "unknown format", body: `{"url": "BASE/whep", "format": "avi"}`, wantStatus: http.StatusBadRequest, wantBody: "Unknown recording format"},
+		{name: "no publisher", body: `{"url": "BASE/whep/nobody"}`, wantStatus: http.StatusBadGateway, wantBody: "answered 404"},
+		{name: "remote error", body: `{"url": "` + internal.URL + `"}`, wantStatus: http.StatusBadGateway, wantBody: "answered 500"},
+		{name: "redirect", body: `{"url": "` + redirect.URL + `"}`, wantStatus: http.StatusBadGateway, wantBody: "answered 302"},
+		{name: "unreachable", body: `{"url": "` + closed.URL + `/whep"}`, wantStatus: http.StatusBadGateway, wantBody: "failed to reach the remote WHEP endpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			if !tt.noToken {
+				useAdminToken(t)
+			}
+			resp, body := postIngest(t, base, strings.ReplaceAll(tt.body, "BASE", base))
+			if resp.StatusCode != tt.wantStatus || !strings.Contains(body, tt.wantBody) {
+				t.Errorf("POST /ingest answered %d: %s, want %d with %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			// Nothing the remote side answers is passed on
+			if strings.Contains(body, "secret") || strings.Contains(body, "No active publisher") {
+				t.Errorf("POST /ingest passed on the remote response: %s", body)
+			}
+			if n := sessions.count(); n != 0 {
+				t.Errorf("%d sessions left after a failed ingest", n)
+			}
+		})
+	}
+}
+
+func TestIngestReconnectFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "never", args: []string{"-ingest-reconnects", "0", "-ingest-backoff", "0"}},
+		{name: "negative", args: []string{"-ingest-reconnects", "-1"}, wantErr: true},
+		{name: "no backoff", args: []string{"-ingest-backoff", "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
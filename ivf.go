@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	ivfFileHeaderSize  = 32
+	ivfFrameHeaderSize = 12
+
+	// Frame timestamps are written in ticks of the 90 kHz RTP video clock,
+	// so every frame keeps its exact position
+	ivfTimebaseDenominator = 90000
+	ivfTimebaseNumerator   = 1
+)
+
+// ivfWriter writes video frames into an IVF container
+type ivfWriter struct {
+	file          *os.File
+	frameSize     func(frame []byte) (width, height uint16)
+	framePrefix   []byte
+	width, height uint16
+	frameCount    uint32
+}
+
+// newIVFWriter writes the IVF file header for the given codec FourCC. Width,
+// height and frame count are patched on Close once they are known.
+func newIVFWriter(file *os.File, fourcc string) (*ivfWriter, error) {
+	header := make([]byte, ivfFileHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)                 // version
+	binary.LittleEndian.PutUint16(header[6:], ivfFileHeaderSize) // header size
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint32(header[16:], ivfTimebaseDenominator)
+	binary.LittleEndian.PutUint32(header[20:], ivfTimebaseNumerator)
+	if _, err := file.Write(header); err != nil {
+		return nil, err
+	}
+	w := &ivfWriter{file: file}
+	switch fourcc {
+	case "VP80":
+		w.frameSize = vp8FrameSize
+	case "VP90":
+		w.frameSize = vp9FrameSize
+	case "AV01":
+		w.frameSize = av1FrameSize
+		w.framePrefix = av1TemporalDelimiter
+	}
+	return w, nil
+}
+
+// createIVFWriter creates the file at path and writes its IVF header
+func createIVFWriter(path, fourcc string) (mediaWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newIVFWriter(file, fourcc)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+// WriteFrame appends a complete frame with its 12-byte frame header
+func (w *ivfWriter) WriteFrame(frame []byte, pts time.Duration) error {
+	if w.width == 0 && w.frameSize != nil {
+		w.width, w.height = w.frameSize(frame)
+	}
+
+	header := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(w.framePrefix)+len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(durationToTicks(pts, ivfTimebaseDenominator)))
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(w.framePrefix); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		return err
+	}
+	w.frameCount++
+	return nil
+}
+
+// Close patches the file header with the final dimensions and frame count
+func (w *ivfWriter) Close() error {
+	if err := w.patchHeader(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *ivfWriter) patchHeader() error {
+	if _, err := w.file.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	fields := make([]byte, 4)
+	binary.LittleEndian.PutUint16(fields[0:], w.width)
+	binary.LittleEndian.PutUint16(fields[2:], w.height)
+	if _, err := w.file.Write(fields); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Seek(24, io.SeekStart); err != nil {
+		return err
+	}
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frameCount)
+	_, err := w.file.Write(count)
+	return err
+}
+
+// vp8FrameSize returns the dimensions carried by a VP8 keyframe, or zero for interframes
+func vp8FrameSize(frame []byte) (width, height uint16) {
+	// Frame tag (3 bytes), start code 9d 01 2a, then 14-bit width and height
+	if len(frame) < 10 || frame[0]&0x01 != 0 {
+		return 0, 0
+	}
+	if frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0
+	}
+	width = binary.LittleEndian.Uint16(frame[6:]) & 0x3fff
+	height = binary.LittleEndian.Uint16(frame[8:]) & 0x3fff
+	return width, height
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ivfFrame is a frame read back from an IVF file
+type ivfFrame struct {
+	timestamp uint64
+	data      []byte
+}
+
+// readIVF returns the header fields and frames of an IVF file
+func readIVF(t *testing.T, data []byte) (fourcc string, width, height uint16, count uint32, frames []ivfFrame) {
+	t.Helper()
+	if len(data) < ivfFileHeaderSize || string(data[:4]) != "DKIF" {
+		t.Fatalf("not an IVF file: % x", data[:min(len(data), 4)])
+	}
+	if size := binary.LittleEndian.Uint16(data[6:]); size != ivfFileHeaderSize {
+		t.Errorf("header size = %d, want %d", size, ivfFileHeaderSize)
+	}
+	if rate, scale := binary.LittleEndian.Uint32(data[16:]), binary.LittleEndian.Uint32(data[20:]); rate != 90000 || scale != 1 {
+		t.Errorf("timebase = %d/%d, want 1/90000", scale, rate)
+	}
+	for offset := ivfFileHeaderSize; offset < len(data); {
+		size := int(binary.LittleEndian.Uint32(data[offset:]))
+		frames = append(frames, ivfFrame{
+			timestamp: binary.LittleEndian.Uint64(data[offset+4:]),
+			data:      data[offset+ivfFrameHeaderSize : offset+ivfFrameHeaderSize+size],
+		})
+		offset += ivfFrameHeaderSize + size
+	}
+	return string(data[8:12]), binary.LittleEndian.Uint16(data[12:]), binary.LittleEndian.Uint16(data[14:]),
+		binary.LittleEndian.Uint32(data[24:]), frames
+}
+
+func TestIVFWriter(t *testing.T) {
+	tests := []struct {
+		name          string
+		frames        [][]byte
+		pts           []time.Duration
+		width, height uint16
+	}{
+		{
+			name:   "keyframe first",
+			frames: [][]byte{testVP8Keyframe, testVP8Interframe, testVP8Keyframe},
+			pts:    []time.Duration{0, 33 * time.Millisecond, time.Second},
+			width:  640, height: 480,
+		},
+		{
+			name:   "interframes only",
+			frames: [][]byte{testVP8Interframe, testVP8Interframe},
+			pts:    []time.Duration{0, 20 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.ivf")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := newIVFWriter(file, "VP80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, frame := range tt.frames {
+				if err := w.WriteFrame(frame, tt.pts[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fourcc, width, height, count, frames := readIVF(t, data)
+			if fourcc != "VP80" {
+				t.Errorf("FourCC = %q, want VP80", fourcc)
+			}
+			if width != tt.width || height != tt.height {
+				t.Errorf("size = %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+			if int(count) != len(tt.frames) || len(frames) != len(tt.frames) {
+				t.Fatalf("header counts %d frames, file has %d, want %d", count, len(frames), len(tt.frames))
+			}
+			for i, frame := range frames {
+				if want := uint64(tt.pts[i] * 90000 / time.Second); frame.timestamp != want {
+					t.Errorf("frame %d timestamp = %d, want %d", i, frame.timestamp, want)
+				}
+				if !bytes.Equal(frame.data, tt.frames[i]) {
+					t.Errorf("frame %d differs from the one written", i)
+				}
+			}
+		})
+	}
+}
+
+// vp8Packets splits a VP8 frame into RTP payloads of at most size bytes of
+// it, each with a one-byte payload descriptor, the first with the S bit set
+// and partition index 0
+func vp8Packets(frame []byte, size int) [][]byte {
+	var payloads [][]byte
+	for i := 0; i < len(frame); i += size {
+		descriptor := byte(0x00)
+		if i == 0 {
+			descriptor = 0x10
+		}
+		payloads = append(payloads, append([]byte{descriptor}, frame[i:min(i+size, len(frame))]...))
+	}
+	return payloads
+}
+
+// TestVP8Recording feeds the RTP packets of VP8 frames to the recording of a
+// track and checks the IVF frames written
+func TestVP8Recording(t *testing.T) {
+	// frame sends the packets of a frame, the last of which carries the marker
+	frame := func(timestamp uint32, data []byte) []testPacket {
+		var packets []testPacket
+		payloads := vp8Packets(data, 700)
+		for i, payload := range payloads {
+			packets = append(packets, testPacket{timestamp, i == len(payloads)-1, payload})
+		}
+		return packets
+	}
+	keyframe, interframe := frame(0, testVP8Keyframe), frame(3000, testVP8Interframe)
+
+	tests := []struct {
+		name    string
+		packets []testPacket
+		want    [][]byte
+	}{
+		{
+			name:    "fragmented keyframe and interframe",
+			packets: slices.Concat(keyframe, interframe),
+			want:    [][]byte{testVP8Keyframe, testVP8Interframe},
+		},
+		{
+			name:    "first packet lost",
+			packets: slices.Concat(keyframe[1:], interframe),
+			want:    [][]byte{testVP8Interframe},
+		},
+		{
+			name:    "last packet lost",
+			packets: slices.Concat(keyframe[:len(keyframe)-1], interframe),
+			want:    [][]byte{testVP8Interframe},
+		},
+		{
+			name: "second partition",
+			packets: []testPacket{
+				{0, false, append([]byte{0x10}, testVP8Keyframe[:1000]...)},
+				{0, true, append([]byte{0x11}, testVP8Keyframe[1000:]...)},
+			},
+			want: [][]byte{testVP8Keyframe},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, _, recorded := readIVF(t, recordPackets(t, webrtc.MimeTypeVP8, tt.packets))
+			if len(recorded) != len(tt.want) {
+				t.Fatalf("recorded %d frames, want %d", len(recorded), len(tt.want))
+			}
+			for i := range recorded {
+				if !bytes.Equal(recorded[i].data, tt.want[i]) {
+					t.Errorf("frame %d differs: %d bytes, want %d", i, len(recorded[i].data), len(tt.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestVP8FrameSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		frame         []byte
+		width, height uint16
+	}{
+		{name: "keyframe", frame: testVP8Keyframe, width: 640, height: 480},
+		{name: "scaling bits ignored", frame: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x42, 0xe0, 0xc1}, width: 640, height: 480},
+		{name: "interframe", frame: testVP8Interframe},
+		{name: "bad start code", frame: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2b, 0x80, 0x02, 0xe0, 0x01}},
+		{name: "truncated", frame: testVP8Keyframe[:8]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if width, height := vp8FrameSize(tt.frame); width != tt.width || height != tt.height {
+				t.Errorf("vp8FrameSize = %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
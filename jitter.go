@@ -0,0 +1,76 @@
+package main
+
+import "github.com/pion/rtp"
+
+// jitterBuffer puts the RTP packets of a track back in sequence number
+// order. A packet is held until the ones before it arrive, or until the
+// window of size packets past them fills up and the gap is given up on.
+// Packets from before the last one released arrive too late and are
+// dropped, as are duplicates.
+type jitterBuffer struct {
+	size    uint16
+	packets map[uint16]*rtp.Packet
+	next    uint16
+	started bool
+}
+
+func newJitterBuffer(size uint16) *jitterBuffer {
+	return &jitterBuffer{size: size, packets: map[uint16]*rtp.Packet{}}
+}
+
+// push adds packet and returns the packets now in order, oldest first.
+// dropped is set if the packet came too late or twice.
+func (b *jitterBuffer) push(packet *rtp.Packet) (ready []*rtp.Packet, dropped bool) {
+	seq := packet.SequenceNumber
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+
+	diff := seq - b.next
+	if diff >= 0x8000 {
+		// Behind the last packet released, with wraparound
+		return nil, true
+	}
+	if diff >= b.size {
+		if diff >= 2*b.size {
+			// Too big a jump to wait across: release everything and start over
+			ready = b.flush()
+			b.next = seq
+		} else {
+			// Make room by giving up on the oldest gaps
+			for seq-b.next >= b.size {
+				ready = b.release(ready)
+				b.next++
+			}
+		}
+	}
+
+	if b.packets[seq] != nil {
+		return ready, true
+	}
+	b.packets[seq] = packet
+	for b.packets[b.next] != nil {
+		ready = b.release(ready)
+		b.next++
+	}
+	return ready, false
+}
+
+// flush returns every packet held, in order, leaving the buffer empty
+func (b *jitterBuffer) flush() []*rtp.Packet {
+	var ready []*rtp.Packet
+	for ; len(b.packets) > 0; b.next++ {
+		ready = b.release(ready)
+	}
+	return ready
+}
+
+// release appends the packet held for b.next, if any, to ready
+func (b *jitterBuffer) release(ready []*rtp.Packet) []*rtp.Packet {
+	if packet, ok := b.packets[b.next]; ok {
+		ready = append(ready, packet)
+		delete(b.packets, b.next)
+	}
+	return ready
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestJitterBuffer(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		// want are the sequence numbers released, then flushed, in order
+		want        []uint16
+		wantDropped []uint16
+	}{
+		{name: "in order", seqs: []uint16{1, 2, 3}, want: []uint16{1, 2, 3}},
+		{name: "swapped", seqs: []uint16{1, 3, 2, 4}, want: []uint16{1, 2, 3, 4}},
+		{name: "wraparound", seqs: []uint16{65534, 0, 65535, 1}, want: []uint16{65534, 65535, 0, 1}},
+		{name: "late", seqs: []uint16{5, 7, 6, 4}, want: []uint16{5, 6, 7}, wantDropped: []uint16{4}},
+		{name: "late after wraparound", seqs: []uint16{65535, 0, 65535}, want: []uint16{65535, 0}, wantDropped: []uint16{65535}},
+		{name: "duplicate", seqs: []uint16{1, 3, 3, 2}, want: []uint16{1, 2, 3}, wantDropped: []uint16{3}},
+		{name: "gap given up", seqs: []uint16{1, 3, 4, 5, 6}, want: []uint16{1, 3, 4, 5, 6}},
+		{name: "gap filled in time", seqs: []uint16{1, 3, 4, 5, 2}, want: []uint16{1, 2, 3, 4, 5}},
+		{name: "jump", seqs: []uint16{1, 3, 1000, 1001}, want: []uint16{1, 3, 1000, 1001}},
+		{name: "flushed", seqs: []uint16{1, 3, 5}, want: []uint16{1, 3, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newJitterBuffer(4)
+			var got, dropped []uint16
+			for _, seq := range tt.seqs {
+				ready, late := b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+				if late {
+					dropped = append(dropped, seq)
+				}
+				for _, packet := range ready {
+					got = append(got, packet.SequenceNumber)
+				}
+			}
+			for _, packet := range b.flush() {
+				got = append(got, packet.SequenceNumber)
+			}
+			if !slices.Equal(got, tt.want) || !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("released %v, dropped %v, want %v, dropped %v", got, dropped, tt.want, tt.wantDropped)
+			}
+		})
+	}
+}
+
+// TestJitterBufferRecording records H.264 frames fragmented over several
+// packets, reordered, and checks the file matches the one recorded in order
+func TestJitterBufferRecording(t *testing.T) {
+	packets := testFUAPackets(3)
+	want := recordPackets(t, "video/H264", packets)
+	if len(want) == 0 {
+		t.Fatal("nothing recorded in order")
+	}
+
+	order := []int{0, 2, 1, 3, 5, 4, 8, 6, 7}
+	if got := recordPacketsInOrder(t, "video/H264", packets, order); !bytes.Equal(got, want) {
+		t.Errorf("reordered packets recorded %x, want %x", got, want)
+	}
+}
+
+// TestJitterBufferSession publishes VP8 frames of several packets, sent out
+// of order, and checks every frame is recorded intact
+func TestJitterBufferSession(t *testing.T) {
+	base := startServer(t)
+	track, _, location := publishRTP(t, base+"/whip/cam")
+	s := sessions.get(strings.TrimPrefix(location, "/whip/"))
+	if s == nil {
+		t.Fatalf("no session at %s", location)
+	}
+
+	// Each frame is a keyframe header and three parts, sent last part first
+	// after the first frame, which starts the jitter buffer
+	const count = 10
+	var frames [][]byte
+	var seq uint16
+	for i := range count {
+		part := func(b byte) []byte { return bytes.Repeat([]byte{b}, 300) }
+		frame := slices.Concat(testVP8Keyframe[:10], part(byte(3*i)), part(byte(3*i+1)), part(byte(3*i+2)))
+		frames = append(frames, frame)
+		payloads := [][]byte{
+			append([]byte{0x10}, frame[:310]...),
+			append([]byte{0x00}, frame[310:610]...),
+			append([]byte{0x00}, frame[610:]...),
+		}
+		order := []int{2, 0, 1}
+		if i == 0 {
+			order = []int{0, 1, 2}
+		}
+		for _, j := range order {
+			packet := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq + uint16(j), Timestamp: uint32(i) * 3000, Marker: j == 2},
+				Payload: payloads[j],
+			}
+			if err := track.WriteRTP(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		seq += 3
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitFor(t, "the frames to be written", func() bool { return s.info().BytesWritten >= int64(count)*int64(len(frames[0])) })
+	if s.latePackets.Load() != 0 {
+		t.Errorf("%d packets dropped as late", s.latePackets.Load())
+	}
+	(&testPublisher{location: location}).stop(t, base)
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if !bytes.Contains(data, frame) {
+			t.Errorf("frame %d not recorded intact", i)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// isKeyframe reports whether a reassembled frame can be decoded on its own
+func isKeyframe(mimeType string, frame []byte) bool {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		// Inverted key frame flag in the first bit of the frame tag
+		return len(frame) > 0 && frame[0]&0x01 == 0
+	case webrtc.MimeTypeVP9:
+		return vp9IsKeyframe(frame)
+	case webrtc.MimeTypeAV1:
+		return av1IsKeyframe(frame)
+	case webrtc.MimeTypeH264:
+		return h264HasIDR(frame)
+	case webrtc.MimeTypeH265:
+		return h265HasIRAP(frame)
+	default:
+		return false
+	}
+}
+
+// h264HasIDR scans an Annex-B access unit for an IDR slice
+func h264HasIDR(frame []byte) bool {
+	startCode := []byte{0x00, 0x00, 0x01}
+	for {
+		i := bytes.Index(frame, startCode)
+		if i < 0 || i+len(startCode) >= len(frame) {
+			return false
+		}
+		frame = frame[i+len(startCode):]
+		if frame[0]&h264NALUTypeMask == 5 {
+			return true
+		}
+	}
+}
+
+// h265HasIRAP scans an Annex-B access unit for an IRAP picture: BLA, IDR or CRA
+func h265HasIRAP(frame []byte) bool {
+	startCode := []byte{0x00, 0x00, 0x01}
+	for {
+		i := bytes.Index(frame, startCode)
+		if i < 0 || i+len(startCode) >= len(frame) {
+			return false
+		}
+		frame = frame[i+len(startCode):]
+		if naluType := frame[0] >> 1 & 0x3f; naluType >= h265NALUTypeBLAWLP && naluType <= h265NALUTypeCRA {
+			return true
+		}
+	}
+}
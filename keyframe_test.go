@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/codecs/av1/obu"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		frame    []byte
+		want     bool
+	}{
+		{name: "VP8 keyframe", mimeType: webrtc.MimeTypeVP8, frame: testVP8Keyframe, want: true},
+		{name: "VP8 interframe", mimeType: webrtc.MimeTypeVP8, frame: testVP8Interframe},
+		{name: "VP8 empty", mimeType: webrtc.MimeTypeVP8},
+		{name: "VP9 keyframe", mimeType: webrtc.MimeTypeVP9, frame: testVP9Keyframe, want: true},
+		{name: "VP9 interframe", mimeType: webrtc.MimeTypeVP9, frame: testVP9Interframe},
+		{name: "VP9 empty", mimeType: webrtc.MimeTypeVP9},
+		{name: "AV1 sequence header", mimeType: webrtc.MimeTypeAV1, frame: slices.Concat(av1OBU(obu.OBUSequenceHeader, testAV1SequenceHeader, true), av1OBU(obu.OBUFrame, testAV1FrameData, true)), want: true},
+		{name: "AV1 frame only", mimeType: webrtc.MimeTypeAV1, frame: av1OBU(obu.OBUFrame, testAV1FrameData, true)},
+		{name: "H.264 IDR after the parameter sets", mimeType: webrtc.MimeTypeH264, frame: testH264Keyframe, want: true},
+		{name: "H.264 IDR with a 3-byte start code", mimeType: webrtc.MimeTypeH264, frame: []byte{0, 0, 1, 0x65, 0x88}, want: true},
+		{name: "H.264 non-IDR slice", mimeType: webrtc.MimeTypeH264, frame: testH264Interframe},
+		{name: "H.264 parameter sets only", mimeType: webrtc.MimeTypeH264, frame: annexB(testH264SPS, testH264PPS)},
+		{name: "H.264 start code at the end", mimeType: webrtc.MimeTypeH264, frame: []byte{0x41, 0, 0, 1}},
+		{name: "H.265 IDR after the parameter sets", mimeType: webrtc.MimeTypeH265, frame: annexB(testH265VPS, testH265SPS, testH265PPS, testH265IDR), want: true},
+		{name: "H.265 CRA", mimeType: webrtc.MimeTypeH265, frame: []byte{0, 0, 1, 21 << 1, 0x01, 0xaf}, want: true},
+		{name: "H.265 trailing slice", mimeType: webrtc.MimeTypeH265, frame: annexB(testH265Slice)},
+		{name: "H.265 parameter sets only", mimeType: webrtc.MimeTypeH265, frame: annexB(testH265VPS, testH265SPS, testH265PPS)},
+		{name: "audio", mimeType: webrtc.MimeTypeOpus, frame: testVP8Keyframe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isKeyframe(tt.mimeType, tt.frame); got != tt.want {
+				t.Errorf("isKeyframe = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFirstKeyframeLog checks the first keyframe of each video track is
+// logged once, with its RTP timestamp, and later ones only at debug level
+func TestFirstKeyframeLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+	}{
+		{name: "VP8", mimeType: webrtc.MimeTypeVP8},
+		{name: "H.264", mimeType: webrtc.MimeTypeH264},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, slog.LevelDebug)
+			base := startServer(t)
+			// Two keyframes, 30 frames apart
+			p := publish(t, base+"/whip/cam", tt.mimeType, webrtc.MimeTypeOpus)
+			p.play(t, 1500*time.Millisecond)
+			p.stop(t, base)
+
+			first := logs.records(t, "First keyframe")
+			if len(first) != 1 {
+				t.Fatalf("logged the first keyframe %d times, want once", len(first))
+			}
+			if _, ok := first[0]["rtp_timestamp"].(float64); !ok {
+				t.Errorf("first keyframe logged without its RTP timestamp: %v", first[0])
+			}
+			if first[0]["codec"] != tt.mimeType {
+				t.Errorf("first keyframe logged for %v, want %s", first[0]["codec"], tt.mimeType)
+			}
+			var later int
+			for _, record := range logs.records(t, "Keyframe") {
+				if record["level"] != slog.LevelDebug.String() {
+					t.Errorf("later keyframe logged at %v", record["level"])
+				}
+				later++
+			}
+			if later == 0 {
+				t.Error("later keyframes not logged")
+			}
+		})
+	}
+}
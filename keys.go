@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// keysSuffix names the key log kept next to a session directory with -export-keys
+const keysSuffix = ".keys"
+
+// keyLogFile receives the DTLS key log of a session, in the NSS key log
+// format Wireshark reads. It holds the master secret the SRTP keys are
+// derived from (RFC 5764), so the file is created readable by its owner
+// only, on the first write once the handshake completes.
+type keyLogFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// setPath sets the file the key log is written to
+func (k *keyLogFile) setPath(path string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.path = path
+}
+
+func (k *keyLogFile) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.file == nil {
+		file, err := os.OpenFile(k.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return 0, err
+		}
+		k.file = file
+	}
+	return k.file.Write(p)
+}
+
+func (k *keyLogFile) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.file == nil {
+		return nil
+	}
+	return k.file.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TestExportKeys publishes with -export-keys on and off and checks the key
+// log next to the session directory
+func TestExportKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		exportKeys bool
+	}{
+		{name: "enabled", exportKeys: true},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.ExportKeys = tt.exportKeys })
+			base := startServer(t)
+			logs := captureLogs(t, slog.LevelWarn)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			s := sessions.get(strings.TrimPrefix(p.location, "/whip/"))
+			if s == nil {
+				t.Fatalf("no session at %s", p.location)
+			}
+			p.play(t, 200*time.Millisecond)
+			p.stop(t, base)
+
+			info, err := os.Stat(s.dir + keysSuffix)
+			if !tt.exportKeys {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("key log written with -export-keys off: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != 0o600 {
+				t.Errorf("key log mode %v, want -rw-------", mode)
+			}
+			data, err := os.ReadFile(s.dir + keysSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), "CLIENT_RANDOM ") {
+				t.Errorf("key log %q, want NSS CLIENT_RANDOM lines", data)
+			}
+			if len(logs.records(t, "Exporting the session's SRTP key material, which decrypts its media")) != 1 {
+				t.Error("no warning logged for the exported keys")
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{value: "debug", want: slog.LevelDebug},
+		{value: "info", want: slog.LevelInfo},
+		{value: "WARN", want: slog.LevelWarn},
+		{value: "error", want: slog.LevelError},
+		{value: "debug-4", want: slog.LevelDebug - 4},
+		{value: "loud", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseLogLevel(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLogLevel(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseLogLevel(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// logBuffer collects the JSON log records of the default logger
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// captureLogs logs at level to the returned buffer for the rest of the test
+func captureLogs(t *testing.T, level slog.Level) *logBuffer {
+	saved := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	logs := &logBuffer{}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: level})))
+	return logs
+}
+
+// records returns the logged records with message msg
+func (b *logBuffer) records(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range bytes.Split(b.buf.Bytes(), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// TestSessionLogging checks the fields of a session's log records, and that
+// frames are only logged at debug level
+func TestSessionLogging(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  slog.Level
+		frames bool
+	}{
+		{name: "info", level: slog.LevelInfo},
+		{name: "debug", level: slog.LevelDebug, frames: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			logs := captureLogs(t, tt.level)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			p.play(t, 300*time.Millisecond)
+			p.stop(t, base)
+
+			established := logs.records(t, "WHIP session established")
+			if len(established) != 1 {
+				t.Fatalf("%d session established records, want 1", len(established))
+			}
+			session := established[0]["session"]
+			if session == nil || established[0]["stream"] != "cam" {
+				t.Errorf("session established record %v, want session and stream fields", established[0])
+			}
+
+			tracks := logs.records(t, "Received track")
+			if len(tracks) != 1 {
+				t.Fatalf("%d received track records, want 1", len(tracks))
+			}
+			for field, want := range map[string]any{"session": session, "stream": "cam", "kind": "video", "codec": webrtc.MimeTypeVP8} {
+				if got := tracks[0][field]; got != want {
+					t.Errorf("received track %s = %v, want %v", field, got, want)
+				}
+			}
+			if tracks[0]["track"] == nil {
+				t.Error("received track record without the track ID")
+			}
+
+			frames := logs.records(t, "Writing frame")
+			if (len(frames) > 0) != tt.frames {
+				t.Fatalf("%d frame records at level %v", len(frames), tt.level)
+			}
+			for _, frame := range frames {
+				if frame["session"] != session || frame["codec"] != webrtc.MimeTypeVP8 || frame["bytes"] == nil {
+					t.Errorf("frame record %v, want the session, codec and frame size", frame)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestRequestLog publishes through the request logging middleware and checks
+// the WHIP POST is logged with its status, and /healthz only when not excluded
+func TestRequestLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		exclude    []string
+		wantHealth bool
+	}{
+		{name: "default exclusions", exclude: defaultConfig().RequestLogExclude},
+		{name: "nothing excluded", wantHealth: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.OutputDir = t.TempDir()
+				c.RequestLogExclude = tt.exclude
+			})
+			server := httptest.NewServer(withRequestLog(newRouter()))
+			t.Cleanup(func() {
+				server.Close()
+				sessions.closeAll()
+			})
+			logs := captureLogs(t, slog.LevelInfo)
+
+			publish(t, server.URL+"/whip/cam", webrtc.MimeTypeVP8)
+			resp, err := http.Get(server.URL + "/healthz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			// Requests are logged once answered, which the client may see first
+			if tt.wantHealth {
+				waitFor(t, "the /healthz request to be logged", func() bool {
+					return slices.ContainsFunc(logs.records(t, "HTTP request"), func(record map[string]any) bool { return record["path"] == "/healthz" })
+				})
+			}
+			var posts, health int
+			for _, record := range logs.records(t, "HTTP request") {
+				switch record["path"] {
+				case "/whip/cam":
+					posts++
+					if record["method"] != http.MethodPost || record["status"] != float64(http.StatusCreated) {
+						t.Errorf("WHIP request logged as %v %v, want POST 201", record["method"], record["status"])
+					}
+					if size, _ := record["bytes"].(float64); size == 0 || record["remote"] == nil || record["duration"] == nil {
+						t.Errorf("WHIP request record %v, want its size, remote address and duration", record)
+					}
+				case "/healthz":
+					health++
+				}
+			}
+			if posts != 1 {
+				t.Errorf("%d WHIP requests logged, want 1", posts)
+			}
+			if (health > 0) != tt.wantHealth {
+				t.Errorf("%d /healthz requests logged, want logged %v", health, tt.wantHealth)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "math/rand/v2"
+
+// simulatedLoss reports whether an incoming RTP packet is to be dropped as if
+// lost on the network, for -simulate-loss percent of them
+func simulatedLoss() bool {
+	return config.SimulateLoss > 0 && rand.Float64()*100 < config.SimulateLoss
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestSimulateLossFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "off"},
+		{name: "some", args: []string{"-simulate-loss", "2.5"}},
+		{name: "all", args: []string{"-simulate-loss", "100"}},
+		{name: "negative", args: []string{"-simulate-loss", "-1"}, wantErr: "between 0 and 100"},
+		{name: "over 100", args: []string{"-simulate-loss", "101"}, wantErr: "between 0 and 100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestSimulatedLoss drops every packet of a publisher and checks nothing is
+// recorded while the session stays up
+func TestSimulatedLoss(t *testing.T) {
+	setConfig(t, func(c *Config) { c.SimulateLoss = 100 })
+	base := startServer(t)
+	logs := captureLogs(t, slog.LevelDebug)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	id := strings.TrimPrefix(p.location, "/whip/")
+	s := sessions.get(id)
+	if s == nil {
+		t.Fatalf("no session at %s", p.location)
+	}
+	p.play(t, 500*time.Millisecond)
+
+	if len(logs.records(t, "Dropped RTP packet to simulate loss")) == 0 {
+		t.Error("no packet drops logged")
+	}
+	if sessions.get(id) == nil || s.peerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		t.Fatal("session ended while its packets were dropped")
+	}
+	p.stop(t, base)
+
+	if _, err := os.Stat(filepath.Join(s.dir, "recording.webm")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("recording.webm written with every packet dropped: %v", err)
+	}
+}
@@ -1,150 +1,826 @@
-package main
-
-import (
-	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
-
-	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
-	"github.com/pion/webrtc/v4"
-	"github.com/rs/cors"
-)
-
-// Handler for incoming WHIP (WebRTC HTTP)
-func whipHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	offerData, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusInternalServerError)
-		return
-	}
-
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		http.Error(w, "Failed to create PeerConnection", http.StatusInternalServerError)
-		return
-	}
-
-	// When a track arrives
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		fmt.Printf("Received Track ID: %s, PayloadType: %d\n", track.ID(), track.PayloadType())
-
-		// Create a file to save the received frames
-		fileName := track.Kind().String() + "_" + track.ID()
-		var file *os.File
-		var depacketizer rtp.Depacketizer
-
-		// Select depacketizer and file based on codec type
-		switch track.Codec().MimeType {
-		case webrtc.MimeTypeVP8:
-			file, err = os.Create(fileName + ".vp8")
-			if err != nil {
-				log.Println("Failed to create file:", err)
-				return
-			}
-			depacketizer = &codecs.VP8Packet{}
-		case webrtc.MimeTypeOpus:
-			file, err = os.Create(fileName + ".opus")
-			if err != nil {
-				log.Println("Failed to create file:", err)
-				return
-			}
-			depacketizer = &codecs.OpusPacket{}
-		default:
-			log.Println("Unsupported codec:", track.Codec().MimeType)
-			return
-		}
-		defer file.Close()
-
-		rtpBuf := make([]byte, 1400)
-		for {
-			n, _, readErr := track.Read(rtpBuf)
-			if readErr != nil {
-				log.Println("Track read error:", readErr)
-				break
-			}
-
-			packet := &rtp.Packet{}
-			if err := packet.Unmarshal(rtpBuf[:n]); err != nil {
-				log.Println("Failed to unmarshal RTP:", err)
-				continue
-			}
-
-			// Depacketize the RTP packet to get the full frame
-			payload, err := depacketizer.Unmarshal(packet.Payload)
-			if err != nil {
-				log.Println("Failed to depacketize RTP:", err)
-				continue
-			}
-
-			// Write the frame into the file
-
-			fmt.Println("Write.")
-			_, writeErr := file.Write(payload)
-			if writeErr != nil {
-				log.Println("Failed to write to file:", writeErr)
-				break
-			}
-		}
-	})
-
-	// Set remote description from the incoming SDP offer
-	offer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  string(offerData),
-	}
-	if err := peerConnection.SetRemoteDescription(offer); err != nil {
-		http.Error(w, "Failed to set remote description", http.StatusInternalServerError)
-		return
-	}
-
-	// Create an SDP answer and set it as the local description
-	answer, err := peerConnection.CreateAnswer(nil)
-	if err != nil {
-		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
-		return
-	}
-	if err := peerConnection.SetLocalDescription(answer); err != nil {
-		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
-		return
-	}
-
-	// Wait until the connection is ready
-	<-webrtc.GatheringCompletePromise(peerConnection)
-
-	// Send the SDP answer back to the client
-	w.Header().Set("Content-Type", "application/sdp")
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(peerConnection.LocalDescription().SDP))
-
-	log.Println("WHIP session established!")
-}
-
-func main() {
-	// Enable CORS for all origins
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"}, // Allow all origins (you can restrict this if needed)
-		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type", "Authorization"},
-		ExposedHeaders: []string{"Content-Type"},
-	})
-
-	http.HandleFunc("/whip", whipHandler)
-
-	// Use CORS handler properly: Pass DefaultServeMux (the default HTTP handler) to corsHandler
-	handler := corsHandler.Handler(http.DefaultServeMux)
-
-	// Start the server and use CORS middleware
-	fmt.Println("Starting WHIP server on HTTP port 80...")
-	err := http.ListenAndServe(":80", handler) // Apply CORS middleware
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Handler for incoming WHIP (WebRTC HTTP)
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.Error, http.MethodOptions, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodOptions {
+		whipOptions(w, r)
+		return
+	}
+	streamKey, ok := streamKeyFromPath(r.URL.Path, "/whip/")
+	if !ok {
+		http.Error(w, "Invalid stream key", http.StatusBadRequest)
+		return
+	}
+	if !requireStreamAuth(w, r, streamKey, rightPublish) {
+		return
+	}
+	if !acceptingSessions(w, http.Error) {
+		return
+	}
+
+	offerData, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = config.RecordingFormat
+	}
+	// The offer is logged before it is applied, to debug those that fail
+	dumpSDP(slog.With("stream", streamKey), "offer", offerData)
+	sess, err := startPublish(streamKey, offerData, format)
+	if err != nil {
+		writePublishError(w, err, http.Error)
+		return
+	}
+
+	// Trickle ICE clients get the answer right away and exchange candidates
+	// with PATCH; others need every server candidate in the answer
+	if !supportsTrickle(offerData) {
+		<-webrtc.GatheringCompletePromise(sess.peerConnection)
+	}
+	answer := publishAnswer(sess)
+	dumpSDP(sess.log, "answer", answer)
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", "/whip/"+sess.id)
+	w.Header().Set("ETag", sess.etag)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+
+	sess.log.Info("WHIP session established")
+}
+
+// publishError is a failure to start a publisher's session, answered with status
+type publishError struct {
+	status  int
+	message string
+}
+
+func (e *publishError) Error() string {
+	return e.message
+}
+
+// writePublishError answers a publish whose session failed to start with writeError
+func writePublishError(w http.ResponseWriter, err error, writeError errorWriter) {
+	var failed *publishError
+	switch {
+	case errors.Is(err, errTooManySessions):
+		w.Header().Set("Retry-After", "30")
+		writeError(w, "Too many active sessions", http.StatusServiceUnavailable)
+	case errors.Is(err, errStreamKeyInUse):
+		writeError(w, "Stream key already has an active publisher", http.StatusConflict)
+	case errors.As(err, &failed):
+		writeError(w, failed.message, failed.status)
+	default:
+		writeError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// startPublish registers a session publishing to streamKey, applies its
+// offer and sets the answer as its local description, whose candidates may
+// still be gathering. The session records every track it receives in the
+// recording format.
+func startPublish(streamKey, offerData, format string) (*session, error) {
+	sess, err := newPublishSession(streamKey, format, nil)
+	if err != nil {
+		return nil, err
+	}
+	abort := func(status int, message string) (*session, error) {
+		sessions.removeSession(sess)
+		sess.Close()
+		return nil, &publishError{status, message}
+	}
+	peerConnection := sess.peerConnection
+	recordTracks(sess)
+
+	// Set remote description from the incoming SDP offer
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerData,
+	}
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return abort(http.StatusInternalServerError, "Failed to set remote description")
+	}
+	tracks, recordable := negotiatedTracks(peerConnection)
+	if recordable == 0 {
+		return abort(http.StatusUnsupportedMediaType, "Offer has no supported codecs")
+	}
+	if err := applyRecordingFormat(peerConnection, format); err != nil {
+		return abort(http.StatusBadRequest, "Unsupported recording format: "+err.Error())
+	}
+	sess.muxer = newSessionMuxer(sess.dir, sess.streamKey, peerConnection, tracks, format)
+	sess.pending = tracks
+	if err := sess.saveMeta(false); err != nil {
+		sess.log.Warn("Failed to write session metadata", "error", err)
+	}
+	sess.watchIdle()
+	sess.watchDuration()
+
+	// Create an SDP answer and set it as the local description
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return abort(http.StatusInternalServerError, "Failed to create answer")
+	}
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return abort(http.StatusInternalServerError, "Failed to set local description")
+	}
+	return sess, nil
+}
+
+// newPublishSession registers a session publishing to streamKey on a new
+// PeerConnection, closed with the session once the connection ends. The
+// session of an ingest, pull, is reconnected if the connection fails.
+func newPublishSession(streamKey, format string, pull *ingest) (*session, error) {
+	if !slices.Contains(recordingFormats, format) {
+		return nil, &publishError{http.StatusBadRequest, "Unknown recording format " + format}
+	}
+	// A typed nil would not read as no key log
+	var keys *keyLogFile
+	var keyLog io.Writer
+	if config.ExportKeys {
+		keys = &keyLogFile{}
+		keyLog = keys
+	}
+	peerConnection, statsGetter, err := newPeerConnection(keyLog)
+	if err != nil {
+		return nil, &publishError{http.StatusInternalServerError, "Failed to create PeerConnection"}
+	}
+	sess := newSession(streamKey, peerConnection)
+	sess.rtpStats = statsGetter
+	if pull != nil {
+		pull.attach(sess)
+	}
+	if keys != nil {
+		keys.setPath(sess.dir + keysSuffix)
+		sess.keyLog = keys
+		sess.log.Warn("Exporting the session's SRTP key material, which decrypts its media", "path", sess.dir+keysSuffix)
+	}
+	if err := sessions.add(sess); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+	sessionsCreated.Inc()
+
+	// Tear the session down when the publisher goes away without a DELETE.
+	// Both paths go through the registry, so only one of them closes it.
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		sess.log.Info("Connection state changed", "state", state.String())
+		sess.setState(state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if pull != nil {
+				pull.attempts.Store(0)
+			}
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
+			if !sessions.removeSession(sess) {
+				return
+			}
+			if err := sess.Close(); err != nil {
+				sess.log.Warn("Failed to close PeerConnection", "error", err)
+			}
+			sess.log.Info("WHIP session ended", "state", state.String())
+			// The server removes the sessions it ends first, so this one was
+			// ended by the remote side, which closes on a DTLS close_notify
+			if pull != nil {
+				pull.reconnect(sess.log)
+			}
+		}
+	})
+
+	// Record timed metadata sent alongside the media
+	peerConnection.OnDataChannel(sess.handleDataChannel)
+
+	return sess, nil
+}
+
+// recordTracks records every track the session's PeerConnection receives
+// into the session's muxer, which must be set by the time tracks arrive
+func recordTracks(sess *session) {
+	peerConnection := sess.peerConnection
+
+	// When a track arrives
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if !sess.startTrack() {
+			return
+		}
+		defer sess.trackDone()
+
+		logger := sess.log.With("track", track.ID(), "kind", track.Kind().String(), "codec", track.Codec().MimeType)
+
+		// Simulcast sends each layer of an m-line as a track of its own, told
+		// apart by RID. Only the highest layer is recorded and relayed, unless
+		// -record-all-layers asks for the others as well.
+		rid := track.RID()
+		primary := rid == "" || rid == highestLayer(receiver)
+		if rid != "" {
+			logger = logger.With("rid", rid)
+		}
+		logger.Info("Received track", "payload_type", track.PayloadType(), "ssrc", track.SSRC())
+		if !primary && !config.RecordAllLayers {
+			logger.Info("Simulcast layer not recorded", "recorded_rid", highestLayer(receiver))
+			go drainRTCP(receiver, rid, nil)
+			drainRTP(track, sess.touch)
+			return
+		}
+
+		// discard keeps reading a track that won't be recorded
+		discard := func() {
+			go drainRTCP(receiver, rid, nil)
+			if primary {
+				sess.discardTrack(track)
+			} else {
+				drainRTP(track, sess.touch)
+			}
+		}
+		if !codecAllowed(config.Codecs, track.Codec().MimeType) {
+			logger.Warn("Codec not allowed by -codecs, track not recorded")
+			if primary {
+				sess.muxer.skipTrack()
+			}
+			discard()
+			return
+		}
+
+		// Create a file to save the received frames
+		if err := os.MkdirAll(sess.dir, 0o755); err != nil {
+			logger.Error("Failed to create session directory", "error", err)
+			return
+		}
+		// Every m-line and layer gets outputs of its own, even when their
+		// tracks share an ID
+		fileName, err := sess.trackOutputName(track)
+		if err != nil {
+			logger.Error("Failed to name the track's file", "error", err)
+			return
+		}
+		fileName = sess.claimFileName(fileName, transceiverMid(peerConnection, receiver))
+		var writer mediaWriter
+		var depacketizer rtp.Depacketizer
+		if primary {
+			// WebM carries VP8, VP9 and Opus, MP4 H.264 and Opus; other codecs get a file of their own
+			writer, depacketizer, err = sess.muxer.addTrack(track.Codec())
+			if errors.Is(err, errUnsupportedCodec) {
+				writer, depacketizer, err = newSegmentedTrackWriter(fileName, track.Codec())
+			} else if err == nil && rid != "" && config.RecordAllLayers {
+				// Every layer has a file of its own, the highest included
+				layer, _, layerErr := newSegmentedTrackWriter(fileName, track.Codec())
+				if layerErr != nil {
+					writer.Close()
+					writer, err = nil, layerErr
+				} else {
+					writer = teeWriter{writer, layer}
+				}
+			}
+		} else {
+			// Lower simulcast layers are kept out of the WebM file, one file per RID
+			writer, depacketizer, err = newSegmentedTrackWriter(fileName, track.Codec())
+		}
+		if errors.Is(err, errUnsupportedCodec) {
+			logger.Warn("Unsupported codec, track not recorded")
+			discard()
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create file", "error", err)
+			return
+		}
+		defer func() {
+			if err := writer.Close(); err != nil {
+				logger.Error("Failed to close file", "error", err)
+			}
+		}()
+		recorded := sess.addTrackStat(track)
+
+		// Forward the raw RTP of the recorded layer to the stream's WHEP viewers
+		var relay *relayTrack
+		if primary {
+			sess.trackArrived(true)
+			sess.addCodec(track.Codec().MimeType)
+			var requestKeyframe func()
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				requestKeyframe = func() {
+					if err := sendPLI(peerConnection, track.SSRC()); err != nil {
+						logger.Warn("Failed to send PLI", "error", err)
+					}
+				}
+			}
+			relay = publishTrack(sess.streamKey, track, requestKeyframe)
+			defer relay.unpublish()
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				defer snapshots.forget(sess.streamKey)
+			}
+		}
+
+		frames := frameAssembler{maxSize: config.MaxFrameSize}
+		timestamps := newTimestampMapper(track.Codec().ClockRate)
+		isVideo := track.Kind() == webrtc.RTPCodecTypeVideo
+		var audioLevelID uint8
+		if !isVideo {
+			audioLevelID = headerExtensionID(receiver, sdp.AudioLevelURI)
+		}
+
+		// trackCtx ends the helpers running alongside the read loop
+		trackCtx, endTrack := context.WithCancel(context.Background())
+		defer endTrack()
+
+		// Ask the publisher for a keyframe so the recording can start on one
+		keyframeSeen := !isVideo
+		requestCtx, stopKeyframeRequests := context.WithCancel(trackCtx)
+		defer stopKeyframeRequests()
+		if isVideo {
+			go requestKeyframes(requestCtx, logger, peerConnection, track.SSRC())
+		}
+		// Recorded layers keep getting keyframes, so their files can be switched between
+		if isVideo && rid != "" && config.RecordAllLayers && config.LayerKeyframeInterval > 0 {
+			go requestPeriodicKeyframes(trackCtx, logger, peerConnection, track.SSRC(), config.LayerKeyframeInterval)
+		}
+
+		// Read RTCP from the publisher, keeping the sender reports that line
+		// up the tracks, and report lost packets back to it
+		go drainRTCP(receiver, rid, sess.senderReportRecorder(logger, track))
+		var nacks *nackGenerator
+		if supportsNACK(track.Codec()) {
+			nacks = newNACKGenerator(uint16(config.NACKHistorySize), config.NACKTimeout)
+			go nacks.run(trackCtx, logger, peerConnection, track.SSRC())
+		}
+
+		meter := &bitrateMeter{}
+		sess.addMeter(meter)
+		go logBitrate(trackCtx, logger, meter, config.BitrateLogInterval)
+
+		// Cap the publisher's upstream bitrate, which covers every track
+		if isVideo && primary && config.MaxBitrate > 0 {
+			go sess.limitBitrate(trackCtx, logger, track.SSRC())
+		}
+
+		// Pion switches the track to the codec of any negotiated payload type
+		// a packet arrives on, so the one recorded is kept from the start.
+		// Simulcast tracks only carry it in their codec.
+		mimeType := track.Codec().MimeType
+		payloadType := uint8(track.Codec().PayloadType)
+		receivedPackets := rtpPacketsReceived.WithLabelValues(track.Kind().String())
+		failedDepacketizations := depacketizeErrors.WithLabelValues(mimeType)
+		writtenBytes := bytesWritten.WithLabelValues(mimeType)
+		latePackets := rtpPacketsLate.WithLabelValues(track.Kind().String())
+
+		var stopRotationRequests context.CancelFunc
+		processor := registeredFrameProcessor()
+		frameInfo := FrameInfo{
+			SessionID: sess.id,
+			StreamKey: sess.streamKey,
+			Kind:      track.Kind(),
+			TrackID:   track.ID(),
+			RID:       rid,
+			SSRC:      uint32(track.SSRC()),
+			MimeType:  mimeType,
+		}
+
+		// writePacket depacketizes an RTP packet, reassembles the full frame
+		// and writes it into the file
+		writePacket := func(packet *rtp.Packet) error {
+			// Stray packets of another codec would corrupt the frames of this one
+			if packet.PayloadType != payloadType {
+				recorded.skipped.Add(1)
+				logger.Debug("Skipped RTP packet of another payload type", "seq", packet.SequenceNumber, "payload_type", packet.PayloadType)
+				return nil
+			}
+			frame, err := depacketizer.Unmarshal(packet.Payload)
+			if err == nil && isVideo {
+				frame, err = frames.push(depacketizer, packet, frame)
+			} else if errors.Is(err, errFrameTooLarge) {
+				// The depacketizer gave up on a NAL unit; the rest of its frame goes too
+				frames.drop(packet.Timestamp)
+			}
+			switch {
+			case errors.Is(err, errFrameTooLarge):
+				// The frames referencing the dropped one can't be decoded either
+				logger.Warn("Dropped frame over the maximum frame size", "rtp_timestamp", frames.timestamp, "max_frame_size", config.MaxFrameSize)
+				if keyframeSeen {
+					keyframeSeen = false
+					stopKeyframeRequests = startKeyframeRequests(trackCtx, logger, peerConnection, track.SSRC())
+				}
+				return nil
+			case err != nil:
+				logger.Debug("Failed to depacketize RTP", "seq", packet.SequenceNumber, "error", err)
+				failedDepacketizations.Inc()
+				return nil
+			}
+			var keyframe bool
+			if isVideo {
+				if frame == nil {
+					return nil
+				}
+				keyframe = isKeyframe(mimeType, frame)
+				if !keyframeSeen {
+					if !keyframe {
+						return nil
+					}
+					keyframeSeen = true
+					stopKeyframeRequests()
+					logger.Info("First keyframe", "rtp_timestamp", frames.timestamp, "bytes", len(frame))
+				} else if keyframe {
+					logger.Debug("Keyframe", "rtp_timestamp", frames.timestamp, "bytes", len(frame))
+				}
+				if keyframe && primary {
+					snapshots.store(sess.streamKey, mimeType, frame)
+				}
+			}
+
+			// Video frames carry the timestamp of their first packet
+			timestamp := packet.Timestamp
+			if isVideo {
+				timestamp = frames.timestamp
+			}
+
+			// Write the frame into the file
+			pts := timestamps.pts(timestamp)
+			frameInfo.Keyframe, frameInfo.PTS = keyframe, pts
+			processor.ProcessFrame(frameInfo, frame)
+			logger.Debug("Writing frame", "bytes", len(frame), "pts", pts)
+			if err := writer.WriteFrame(frame, pts); err != nil {
+				return err
+			}
+			writtenBytes.Add(float64(len(frame)))
+			sess.bytesWritten.Add(int64(len(frame)))
+			recorded.duration.Store(int64(pts))
+
+			// A full segment waits for a keyframe before the next file is started
+			if waiter, ok := writer.(keyframeWaiter); ok && isVideo {
+				awaiting := waiter.awaitingKeyframe()
+				if awaiting && stopRotationRequests == nil {
+					stopRotationRequests = startKeyframeRequests(trackCtx, logger, peerConnection, track.SSRC())
+				} else if !awaiting && stopRotationRequests != nil {
+					stopRotationRequests()
+					stopRotationRequests = nil
+				}
+			}
+			return nil
+		}
+		writePackets := func(packets []*rtp.Packet) error {
+			for _, packet := range packets {
+				if err := writePacket(packet); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		// Retransmissions on the track itself carry the RTX payload type
+		rtxType := rtxPayloadType(receiver.GetParameters().Codecs, webrtc.PayloadType(payloadType))
+
+		var jitter *jitterBuffer
+		if config.JitterBuffer > 0 {
+			jitter = newJitterBuffer(uint16(config.JitterBuffer))
+		}
+		var writeErr error
+		rtpBuf := make([]byte, config.RTPBufferSize)
+		readErrors := 0
+		for {
+			n, _, readErr := track.Read(rtpBuf)
+			if errors.Is(readErr, io.ErrShortBuffer) || readErr == nil && n == len(rtpBuf) {
+				// The packet didn't fit and was cut short; unmarshaling it would corrupt the frame
+				logger.Warn("Dropped RTP packet larger than the read buffer", "buffer_size", len(rtpBuf))
+				continue
+			}
+			if readErr != nil {
+				// A bad packet is skipped, unless errors keep coming with no packet in between
+				if fatalReadError(readErr) || readErrors >= maxReadErrors {
+					logger.Info("Track ended", "reason", readErr)
+					break
+				}
+				readErrors++
+				sess.packetErrors.Add(1)
+				logger.Warn("Failed to read RTP, packet skipped", "error", readErr)
+				continue
+			}
+			readErrors = 0
+			sess.touch()
+			meter.add(n, time.Now())
+			if simulatedLoss() {
+				logger.Debug("Dropped RTP packet to simulate loss", "size", n)
+				continue
+			}
+
+			packet, raw, err := receivePacket(logger, rtpBuf[:n], payloadType, rtxType)
+			if err != nil {
+				sess.packetErrors.Add(1)
+				logger.Warn("Failed to unmarshal RTP", "error", err)
+				continue
+			}
+			if packet == nil {
+				continue
+			}
+
+			if relay != nil && packet.PayloadType == payloadType {
+				relay.write(raw)
+			}
+			receivedPackets.Inc()
+			recorded.reception.push(packet.SequenceNumber, packet.Timestamp, time.Now())
+			if audioLevelID != 0 {
+				if level, voice, ok := parseAudioLevel(packet, audioLevelID); ok {
+					sess.setAudioLevel(level, voice)
+				}
+			}
+			if nacks != nil {
+				nacks.push(packet.SequenceNumber, time.Now())
+			}
+
+			// Depacketize in sequence order, the jitter buffer holding
+			// packets until those before them arrive
+			ready := []*rtp.Packet{packet}
+			if jitter != nil {
+				var late bool
+				if ready, late = jitter.push(packet); late {
+					sess.latePackets.Add(1)
+					latePackets.Inc()
+					logger.Debug("Dropped RTP packet arriving too late", "seq", packet.SequenceNumber)
+				}
+			}
+			if writeErr = writePackets(ready); writeErr != nil {
+				logger.Error("Failed to write to file", "error", writeErr)
+				break
+			}
+		}
+
+		// The packets still held wait for no more
+		if jitter != nil && writeErr == nil {
+			if err := writePackets(jitter.flush()); err != nil {
+				logger.Error("Failed to write to file", "error", err)
+			}
+		}
+
+		reception := recorded.reception.info()
+		logger.Info("Track reception",
+			"packets_received", reception.Received,
+			"packets_lost", reception.Lost,
+			"packets_out_of_order", reception.OutOfOrder,
+			"jitter_ms", reception.Jitter,
+			"packets_skipped", recorded.skipped.Load(),
+		)
+
+		// Complete the container before the deferred Close
+		if f, ok := writer.(finalizer); ok {
+			if err := f.Finalize(); err != nil {
+				logger.Error("Failed to finalize file", "error", err)
+			}
+		}
+	})
+}
+
+// maxReadErrors is how many track reads in a row may fail before the track
+// is given up on
+const maxReadErrors = 100
+
+// fatalReadError reports whether a track read failed because the track is
+// gone, its PeerConnection or transport closed, rather than on a bad packet
+func fatalReadError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// receivePacket unmarshals an RTP packet read from a track, turning a
+// retransmission on rtxType back into the packet of payloadType it carries.
+// It returns the packet with its marshaled form, or no packet for an RTX one
+// with nothing to recover. The packet doesn't share raw, which depacketizers
+// may hold on to after the next read reuses it.
+func receivePacket(logger *slog.Logger, raw []byte, payloadType, rtxType uint8) (*rtp.Packet, []byte, error) {
+	raw = append([]byte(nil), raw...)
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(raw); err != nil {
+		return nil, nil, err
+	}
+	if rtxType == 0 || packet.PayloadType != rtxType {
+		return packet, raw, nil
+	}
+	if !unwrapRTX(packet, payloadType) {
+		return nil, nil, nil
+	}
+	logger.Debug("Recovered retransmitted RTP packet", "seq", packet.SequenceNumber)
+	raw, err := packet.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return packet, raw, nil
+}
+
+// transceiverMid returns the mid of the m-line receiver belongs to
+func transceiverMid(peerConnection *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) string {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			return transceiver.Mid()
+		}
+	}
+	return ""
+}
+
+// negotiatedTracks counts the media sections of the offer that the publisher
+// sends on with an accepted codec, and how many of those can be recorded.
+// Sections it only receives on or marks inactive never produce a track.
+func negotiatedTracks(peerConnection *webrtc.PeerConnection) (tracks, recordable int) {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		switch transceiver.Direction() {
+		case webrtc.RTPTransceiverDirectionRecvonly, webrtc.RTPTransceiverDirectionSendrecv:
+		default:
+			continue
+		}
+		receiver := transceiver.Receiver()
+		if receiver == nil || len(receiver.GetParameters().Codecs) == 0 {
+			continue
+		}
+		tracks++
+		for _, codec := range receiver.GetParameters().Codecs {
+			if canRecord(codec.MimeType) && codecAllowed(config.Codecs, codec.MimeType) {
+				recordable++
+				break
+			}
+		}
+	}
+	return tracks, recordable
+}
+
+// newRouter returns a ServeMux with the routes of the API. Unknown paths get
+// 404, and each handler answers 405 with an Allow header to the methods it
+// doesn't take (see allowMethods).
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whip", whipHandler)
+	mux.HandleFunc("/whip/", whipResourceHandler)
+	mux.HandleFunc("/whep", whepHandler)
+	mux.HandleFunc("/whep/", whepHandler)
+	mux.HandleFunc("/ws", wsHandler)
+	mux.HandleFunc("/ws/", wsHandler)
+	mux.HandleFunc("/ingest", ingestHandler)
+	mux.HandleFunc("/drain", drainHandler)
+	mux.Handle("/sessions", withGzip(http.HandlerFunc(sessionsHandler)))
+	mux.Handle("/stats/", withGzip(http.HandlerFunc(statsHandler)))
+	mux.HandleFunc("/snapshot/", snapshotHandler)
+	mux.HandleFunc("/hls/", hlsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.Handle("/metrics", registerMetrics())
+	return mux
+}
+
+func main() {
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fatal(err.Error())
+	}
+	config = cfg
+	if err := config.validate(); err != nil {
+		fatal(err.Error())
+	}
+	level, _ := parseLogLevel(config.LogLevel)
+	setupLogging(level)
+	warnUnfinalized()
+	if config.ExportKeys {
+		slog.Warn("Exporting SRTP key material next to every session; anyone with the files can decrypt captured media")
+	}
+	if config.DumpSDP && level > slog.LevelDebug {
+		slog.Warn("-dump-sdp logs at debug level, set -log-level debug to see the SDP")
+	}
+	if config.UDPReceiveBuffer > 0 {
+		logUDPReceiveBuffer()
+	}
+	if config.SimulateLoss > 0 {
+		slog.Warn("Simulating RTP packet loss, for testing only", "percent", config.SimulateLoss)
+	}
+
+	if config.DTLSCertFile != "" {
+		certificate, err := loadDTLSCertificate(config.DTLSCertFile, config.DTLSKeyFile)
+		if err != nil {
+			fatal("Failed to load the DTLS certificate", "error", err)
+		}
+		dtlsCertificates = []webrtc.Certificate{certificate}
+	}
+	if webrtcAPI, err = newAPI(); err != nil {
+		fatal("Failed to set up WebRTC", "error", err)
+	}
+	if config.SelfTest {
+		if err := runSelfTest(); err != nil {
+			fatal("Self-test failed", "error", err)
+		}
+		slog.Info("Self-test passed", "formats", selfTestFormats)
+		return
+	}
+
+	// The routes get a mux of their own, as net/http/pprof registers its
+	// handlers on http.DefaultServeMux
+	mux := newRouter()
+
+	// Browsers may only publish from the -cors-origins, and every request is
+	// logged, preflights and rejected origins included
+	handler := withRequestLog(withCORS(mux))
+
+	// Bind first so a busy port gets a clear error
+	listener, err := net.Listen("tcp", config.Addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		fatal("Cannot listen: address already in use", "addr", config.Addr)
+	}
+	if err != nil {
+		fatal("Cannot listen", "addr", config.Addr, "error", err)
+	}
+
+	// Start the server and use CORS middleware
+	// Slow clients can't hold a connection open by trickling headers; the
+	// handlers reading a body bound it by -read-timeout too
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: config.ReadTimeout}
+	go func() {
+		var err error
+		if config.TLSEnabled() {
+			slog.Info("Starting WHIP server", "scheme", "https", "addr", listener.Addr().String())
+			err = server.ServeTLS(listener, config.CertFile, config.KeyFile)
+		} else {
+			slog.Info("Starting WHIP server", "scheme", "http", "addr", listener.Addr().String())
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", "error", err)
+		}
+	}()
+
+	// Serve the published streams to RTSP players as well
+	var rtspServer *gortsplib.Server
+	if config.RTSPAddr != "" {
+		if rtspServer, err = startRTSPServer(); err != nil {
+			fatal("Cannot serve RTSP", "addr", config.RTSPAddr, "error", err)
+		}
+		slog.Info("Starting RTSP server", "addr", config.RTSPAddr)
+	}
+
+	// Profiles are served on a listener of their own, never the public one
+	var pprofServer *http.Server
+	if config.PprofAddr != "" {
+		pprofListener, err := net.Listen("tcp", config.PprofAddr)
+		if err != nil {
+			fatal("Cannot serve pprof", "addr", config.PprofAddr, "error", err)
+		}
+		pprofServer = servePprof(pprofListener)
+		slog.Warn("Starting pprof server, keep it off public networks", "addr", pprofListener.Addr().String())
+	}
+
+	// Close the sessions their publishers abandoned
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	go runSweeper(sweeperCtx)
+
+	// SIGHUP starts draining, like POST /drain
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			drain.start()
+		}
+	}()
+
+	// Wait for a termination signal, then stop accepting requests and flush every recording
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String())
+	stopSweeper()
+	if rtspServer != nil {
+		rtspServer.Close()
+	}
+	if pprofServer != nil {
+		pprofServer.Close()
+	}
+	shutdown(server)
+}
+
+// shutdown stops accepting requests, waiting up to -shutdown-timeout for
+// those in progress, then closes every session, flushing its recordings
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP shutdown incomplete", "error", err)
+	}
+	ingestRetries.stopAll()
+	sessions.closeAll()
+	viewers.closeAll()
+	webhooks.Wait()
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// TestShutdown publishes a session, then shuts the server down on SIGTERM
+// the way main does, and checks that the recordings were finalized
+func TestShutdown(t *testing.T) {
+	setConfig(t, func(c *Config) { c.OutputDir = t.TempDir() })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newRouter()}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	base := "http://" + listener.Addr().String()
+
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	p.play(t, time.Second)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stop:
+	case <-time.After(testTimeout):
+		t.Fatal("SIGTERM not received")
+	}
+	shutdown(server)
+
+	if s := sessions.get(p.location[len("/whip/"):]); s != nil {
+		t.Error("the session is left after the shutdown")
+	}
+	if _, err := http.Get(base + "/healthz"); err == nil {
+		t.Error("the server still accepts requests")
+	}
+	files, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "*"))
+	if err != nil || len(files) != 1 || filepath.Ext(files[0]) != ".webm" {
+		t.Fatalf("recorded %v, want one WebM file: %v", files, err)
+	}
+	for _, name := range files {
+		if info, err := os.Stat(name); err != nil || info.Size() == 0 {
+			t.Errorf("%s is empty: %v", name, err)
+		}
+	}
+}
+
+// TestPublisherDisconnect checks that a session is torn down once, by
+// whichever of the DELETE and the connection going away comes first
+func TestPublisherDisconnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete bool
+		// wantEnded and wantTerminated count the records of the session ending
+		// on the connection state and on the DELETE
+		wantEnded, wantTerminated int
+		wantDelete                int
+	}{
+		{name: "publisher goes away", wantEnded: 1, wantDelete: http.StatusNotFound},
+		{name: "DELETE first", delete: true, wantTerminated: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			logs := captureLogs(t, slog.LevelInfo)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+			p.play(t, 500*time.Millisecond)
+			if tt.delete {
+				p.stop(t, base)
+			}
+			if err := p.pc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the session to end", func() bool { return sessions.count() == 0 })
+			waitFor(t, "the tracks to end", func() bool { return len(logs.records(t, "Track ended")) == 2 })
+
+			if !tt.delete {
+				req, err := http.NewRequest(http.MethodDelete, base+p.location, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantDelete {
+					t.Errorf("DELETE after the disconnect answered %d, want %d", resp.StatusCode, tt.wantDelete)
+				}
+			}
+			if n := len(logs.records(t, "WHIP session ended")); n != tt.wantEnded {
+				t.Errorf("session ended %d times on its connection state, want %d", n, tt.wantEnded)
+			}
+			if n := len(logs.records(t, "WHIP session terminated")); n != tt.wantTerminated {
+				t.Errorf("session terminated %d times by DELETE, want %d", n, tt.wantTerminated)
+			}
+			if n := len(logs.records(t, "Failed to close PeerConnection")); n != 0 {
+				t.Errorf("%d failed closes", n)
+			}
+			if files, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "*.webm")); err != nil || len(files) != 1 {
+				t.Fatalf("recorded %v, want one WebM file: %v", files, err)
+			}
+		})
+	}
+}
+
+// TestLargeRTPPackets publishes VP8 frames that each fill an RTP packet of
+// more than 1400 bytes, and checks they are recorded intact when they fit
+// -rtp-buffer-size and dropped, not cut short, when they don't
+func TestLargeRTPPackets(t *testing.T) {
+	tests := []struct {
+		name       string
+		bufferSize int
+		wantFrames bool
+	}{
+		{name: "within the buffer", bufferSize: 1500, wantFrames: true},
+		{name: "larger than the buffer", bufferSize: 1200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.RTPBufferSize = tt.bufferSize })
+			base := startServer(t)
+			logs := captureLogs(t, slog.LevelWarn)
+			track, _, location := publishRTP(t, base+"/whip/cam")
+			s := sessions.get(strings.TrimPrefix(location, "/whip/"))
+			if s == nil {
+				t.Fatalf("no session at %s", location)
+			}
+
+			// The keyframe header, with its dimensions, padded to 1420 bytes
+			frame := append(slices.Clone(testVP8Keyframe[:10]), bytes.Repeat([]byte{0x5a}, 1410)...)
+			const count = 10
+			for seq := range uint16(count) {
+				packet := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+					Payload: append([]byte{0x10}, frame...),
+				}
+				if err := track.WriteRTP(packet); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if !tt.wantFrames {
+				waitFor(t, "the packets to be dropped", func() bool {
+					return len(logs.records(t, "Dropped RTP packet larger than the read buffer")) > 0
+				})
+			}
+			req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			// The frames are stored whole in the WebM blocks; with every
+			// packet dropped the recording is never created
+			data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+			if err != nil && (tt.wantFrames || !errors.Is(err, fs.ErrNotExist)) {
+				t.Fatal(err)
+			}
+			recorded := bytes.Count(data, frame)
+			if !tt.wantFrames {
+				if recorded != 0 {
+					t.Errorf("recorded %d frames of packets larger than the buffer", recorded)
+				}
+				return
+			}
+			if recorded < count-1 {
+				t.Errorf("recorded %d intact frames, want %d", recorded, count)
+			}
+			if n := len(logs.records(t, "Dropped RTP packet larger than the read buffer")); n != 0 {
+				t.Errorf("%d packets dropped", n)
+			}
+		})
+	}
+}
+
+// TestOversizedFrame publishes a VP8 keyframe larger than -max-frame-size
+// between two small ones, and checks it's dropped along with the frames
+// referencing it while a keyframe is requested in its place
+func TestOversizedFrame(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.MaxFrameSize = 16 << 10
+		c.PLIInterval = 50 * time.Millisecond
+	})
+	base := startServer(t)
+	logs := captureLogs(t, slog.LevelWarn)
+	track, sender, location := publishRTP(t, base+"/whip/cam")
+	plis := countPLIs(sender)
+	s := sessions.get(strings.TrimPrefix(location, "/whip/"))
+	if s == nil {
+		t.Fatalf("no session at %s", location)
+	}
+
+	// Each frame is told apart in the recording by the bytes filling it
+	fill := func(b byte, n int) []byte { return bytes.Repeat([]byte{b}, n) }
+	keyframe := func(b byte) []byte { return append(slices.Clone(testVP8Keyframe[:10]), fill(b, 500)...) }
+	var seq uint16
+	var timestamp uint32
+	// send writes a frame split into packets of up to 1000 bytes
+	send := func(frame []byte) {
+		t.Helper()
+		for i := 0; i < len(frame); i += 1000 {
+			descriptor := byte(0x00)
+			if i == 0 {
+				descriptor = 0x10
+			}
+			payload := frame[i:min(i+1000, len(frame))]
+			packet := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp, Marker: i+1000 >= len(frame)},
+				Payload: append([]byte{descriptor}, payload...),
+			}
+			if err := track.WriteRTP(packet); err != nil {
+				t.Fatal(err)
+			}
+			seq++
+			if seq%50 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		timestamp += 3000
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	send(keyframe(0x11))
+	before := plis.Load()
+	send(append(slices.Clone(testVP8Keyframe[:10]), fill(0x5a, 1<<20)...))
+	send(append([]byte{0x01}, fill(0x33, 500)...))
+	waitFor(t, "a keyframe to be requested", func() bool { return plis.Load() > before })
+	send(keyframe(0x22))
+	waitFor(t, "the last keyframe to be recorded", func() bool { return s.bytesWritten.Load() >= 2*510 })
+
+	req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if n := len(logs.records(t, "Dropped frame over the maximum frame size")); n != 1 {
+		t.Errorf("logged %d dropped frames, want 1", n)
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range []struct {
+		name   string
+		fill   []byte
+		wanted bool
+	}{
+		{"first keyframe", fill(0x11, 500), true},
+		{"over-size keyframe", fill(0x5a, 1000), false},
+		{"interframe referencing it", fill(0x33, 500), false},
+		{"requested keyframe", fill(0x22, 500), true},
+	} {
+		if got := bytes.Contains(data, frame.fill); got != frame.wanted {
+			t.Errorf("%s recorded: %v, want %v", frame.name, got, frame.wanted)
+		}
+	}
+}
+
+// TestUnsupportedCodec publishes G.722, which is negotiated but can't be
+// recorded, alone and next to a recordable track
+func TestUnsupportedCodec(t *testing.T) {
+	tests := []struct {
+		name       string
+		publish    []string
+		wantStatus int
+		wantWarn   bool
+	}{
+		{name: "only an unsupported codec", publish: []string{webrtc.MimeTypeG722}, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "next to a supported codec", publish: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeG722}, wantStatus: http.StatusCreated, wantWarn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, slog.LevelInfo)
+			base := startServer(t)
+			p := newCodecPublisher(t, tt.publish...)
+			resp, body := postOffer(t, base+"/whip/cam", p.pc, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("publish answered %d: %s, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if resp.StatusCode != http.StatusCreated {
+				if n := sessions.count(); n != 0 {
+					t.Errorf("%d sessions left after a rejected offer", n)
+				}
+				if entries, _ := os.ReadDir(config.OutputDir); len(entries) != 0 {
+					t.Errorf("rejected offer left %d entries in the output directory", len(entries))
+				}
+				return
+			}
+
+			p.location = resp.Header.Get("Location")
+			waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+			p.play(t, 500*time.Millisecond)
+			if state := p.pc.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+				t.Errorf("connection %s while the unsupported track was sent, want connected", state)
+			}
+			p.stop(t, base)
+
+			var warned []any
+			for _, record := range logs.records(t, "Unsupported codec, track not recorded") {
+				warned = append(warned, record["codec"])
+			}
+			if want := []any{webrtc.MimeTypeG722}; tt.wantWarn && !slices.Equal(warned, want) {
+				t.Errorf("warned of unsupported codecs %v, want %v", warned, want)
+			}
+			dir := filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"))
+			if paths, err := filepath.Glob(filepath.Join(dir, "*.webm")); err != nil || len(paths) != 1 {
+				t.Errorf("recorded %v, want one file: %v", paths, err)
+			}
+		})
+	}
+}
+
+// TestOfferMediaSections publishes offers of audio, video or both and checks
+// the answer accepts each of their m-lines and only their tracks are recorded
+func TestOfferMediaSections(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish []string
+		// want are the extensions of the recorded files, sorted
+		want []string
+		// wantWebMTracks and wantMP4Tracks, if set, are the number of tracks
+		// in the WebM or MP4 file
+		wantWebMTracks int
+		wantMP4Tracks  int
+	}{
+		{name: "audio only", publish: []string{webrtc.MimeTypeOpus}, want: []string{".webm"}},
+		{name: "G.711 only", publish: []string{webrtc.MimeTypePCMU}, want: []string{".wav"}},
+		{name: "video only", publish: []string{webrtc.MimeTypeVP8}, want: []string{".webm"}},
+		{name: "audio and video", publish: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, want: []string{".webm"}},
+		{name: "H.264 only", publish: []string{webrtc.MimeTypeH264}, want: []string{".mp4"}},
+		{name: "H.264 and audio", publish: []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}, want: []string{".mp4"}, wantMP4Tracks: 2},
+		{name: "two H.264 tracks", publish: []string{webrtc.MimeTypeH264, webrtc.MimeTypeH264}, want: []string{".mp4"}, wantMP4Tracks: 2},
+		// The tracks of both m-lines share an ID, yet each gets a file of its own
+		{name: "two G.711 tracks", publish: []string{webrtc.MimeTypePCMU, webrtc.MimeTypePCMU}, want: []string{".wav", ".wav"}},
+		{name: "two VP8 tracks", publish: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP8}, want: []string{".webm"}, wantWebMTracks: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			p := newCodecPublisher(t, tt.publish...)
+			resp, body := postOffer(t, base+"/whip/cam", p.pc, nil)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+			}
+			var mediaSections int
+			for _, line := range strings.Split(body, "\r\n") {
+				if !strings.HasPrefix(line, "m=") {
+					continue
+				}
+				mediaSections++
+				if fields := strings.Fields(line); len(fields) < 2 || fields[1] == "0" {
+					t.Errorf("answer rejected %q", line)
+				}
+			}
+			if mediaSections != len(tt.publish) {
+				t.Errorf("answer has %d m-lines, want %d", mediaSections, len(tt.publish))
+			}
+			p.location = resp.Header.Get("Location")
+			waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+			p.play(t, 500*time.Millisecond)
+			p.stop(t, base)
+
+			dir := filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"))
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				if info, err := entry.Info(); err != nil || info.Size() == 0 {
+					t.Errorf("%s is empty", entry.Name())
+				}
+				got = append(got, filepath.Ext(entry.Name()))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recorded %v, want %v", got, tt.want)
+			}
+			if tt.wantWebMTracks > 0 {
+				data, err := os.ReadFile(filepath.Join(dir, "recording.webm"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tracks, _ := readWebM(t, data); len(tracks) != tt.wantWebMTracks {
+					t.Errorf("WebM tracks %+v, want %d", tracks, tt.wantWebMTracks)
+				}
+			}
+			if tt.wantMP4Tracks > 0 {
+				data, err := os.ReadFile(filepath.Join(dir, "recording.mp4"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tracks, _ := readMP4(t, data); len(tracks) != tt.wantMP4Tracks {
+					t.Errorf("MP4 tracks %+v, want %d", tracks, tt.wantMP4Tracks)
+				}
+			}
+		})
+	}
+}
+
+// TestInvalidOffer posts offers that can't be negotiated and checks they are
+// turned away before any session is created
+func TestInvalidOffer(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "empty", wantStatus: http.StatusBadRequest},
+		{name: "oversized", body: "v=0\r\n" + strings.Repeat("a=x\r\n", maxOfferSize/5), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "garbage", body: "not an offer", wantStatus: http.StatusBadRequest},
+		{name: "no media section", body: "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			for _, path := range []string{"/whip/cam", "/whep"} {
+				resp, body := postSDP(t, base+path, nil, tt.body, nil)
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("POST %s answered %d: %s, want %d", path, resp.StatusCode, body, tt.wantStatus)
+				}
+			}
+			if n := sessions.count(); n != 0 {
+				t.Errorf("%d sessions left after an invalid offer", n)
+			}
+		})
+	}
+}
+
+// errInjected is the transient error readErrorInterceptor fails reads with
+var errInjected = errors.New("injected read error")
+
+// readErrorInterceptor fails the remote track reads numbered from first
+// to last with errInjected, without consuming a packet
+type readErrorInterceptor struct {
+	interceptor.NoOp
+	first, last int32
+	reads       atomic.Int32
+}
+
+func (i *readErrorInterceptor) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+func (i *readErrorInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		if n := i.reads.Add(1); n >= i.first && n <= i.last {
+			return 0, a, errInjected
+		}
+		return reader.Read(b, a)
+	})
+}
+
+// TestTransientReadErrors fails a few reads of a published track and checks
+// the track keeps being recorded and the errors are counted in /sessions
+func TestTransientReadErrors(t *testing.T) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, config.Codecs); err != nil {
+		t.Fatal(err)
+	}
+	registry := &interceptor.Registry{}
+	// The first reads are pion's own, peeking at the track before OnTrack
+	registry.Add(&readErrorInterceptor{first: 5, last: 7})
+	saved := webrtcAPI
+	t.Cleanup(func() { webrtcAPI = saved })
+	webrtcAPI = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry))
+
+	base := startServer(t)
+	logs := captureLogs(t, slog.LevelWarn)
+	track, _, location := publishRTP(t, base+"/whip/cam")
+	id := strings.TrimPrefix(location, "/whip/")
+	s := sessions.get(id)
+	if s == nil {
+		t.Fatalf("no session at %s", location)
+	}
+
+	frame := append(slices.Clone(testVP8Keyframe[:10]), bytes.Repeat([]byte{0x5a}, 200)...)
+	const count = 20
+	for seq := range uint16(count) {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+			Payload: append([]byte{0x10}, frame...),
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitFor(t, "the read errors to be counted", func() bool { return s.info().PacketErrors == 3 })
+	if n := len(logs.records(t, "Failed to read RTP, packet skipped")); n != 3 {
+		t.Errorf("%d read errors logged, want 3", n)
+	}
+
+	resp, err := http.Get(base + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []sessionInfo
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].PacketErrors != 3 {
+		t.Fatalf("sessions %+v, want one with 3 packet errors", list)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded := bytes.Count(data, frame); recorded < count-1 {
+		t.Errorf("recorded %d frames past the read errors, want %d", recorded, count)
+	}
+}
+
+// payloadTypeInterceptor rewrites the payload type of the remote packets
+// with an odd sequence number to payloadType, as if the publisher sent them
+// on another codec
+type payloadTypeInterceptor struct {
+	interceptor.NoOp
+	payloadType uint8
+}
+
+func (i *payloadTypeInterceptor) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+func (i *payloadTypeInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil && n >= 4 && b[3]%2 == 1 {
+			b[1] = b[1]&0x80 | i.payloadType
+		}
+		return n, a, err
+	})
+}
+
+// TestMixedPayloadTypes interleaves VP8 frames with packets on the payload
+// type of VP9, and checks only the VP8 ones are recorded while the others
+// are counted as skipped
+func TestMixedPayloadTypes(t *testing.T) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, config.Codecs); err != nil {
+		t.Fatal(err)
+	}
+	registry := &interceptor.Registry{}
+	registry.Add(&payloadTypeInterceptor{payloadType: 98})
+	saved := webrtcAPI
+	t.Cleanup(func() { webrtcAPI = saved })
+	webrtcAPI = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry))
+
+	base := startServer(t)
+	track, _, location := publishRTP(t, base+"/whip/cam")
+	s := sessions.get(strings.TrimPrefix(location, "/whip/"))
+	if s == nil {
+		t.Fatalf("no session at %s", location)
+	}
+
+	// The stray packets would pass for VP8 keyframes of their own
+	frame := append(slices.Clone(testVP8Keyframe[:10]), bytes.Repeat([]byte{0x5a}, 200)...)
+	stray := append(slices.Clone(testVP8Keyframe[:10]), bytes.Repeat([]byte{0x77}, 200)...)
+	const count = 20
+	for seq := range uint16(count) {
+		payload := frame
+		if seq%2 == 1 {
+			payload = stray
+		}
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+			Payload: append([]byte{0x10}, payload...),
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitFor(t, "the stray packets to be skipped", func() bool {
+		tracks := s.info().Tracks
+		return len(tracks) == 1 && tracks[0].PacketsSkipped == count/2
+	})
+
+	req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded := bytes.Count(data, frame); recorded != count/2 {
+		t.Errorf("recorded %d VP8 frames, want %d", recorded, count/2)
+	}
+	if recorded := bytes.Count(data, stray); recorded != 0 {
+		t.Errorf("recorded %d packets of another payload type", recorded)
+	}
+}
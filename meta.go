@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metaSuffix names the metadata file of a session after its directory
+const metaSuffix = ".meta.json"
+
+// sessionMeta is the .meta.json kept next to each session directory. It is
+// written when the session starts and finalized when it closes, so the
+// recordings of a session cut short by a crash or restart can be found.
+type sessionMeta struct {
+	ID        string    `json:"id"`
+	StreamKey string    `json:"stream_key"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended,omitzero"`
+	Codecs    []string  `json:"codecs"`
+	Files     []string  `json:"files"`
+	Finalized bool      `json:"finalized"`
+}
+
+// writeMeta replaces the metadata file at path, never leaving it half written
+func writeMeta(path string, meta sessionMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// saveMeta writes the session's metadata file, listing the files recorded so
+// far. Sessions rejected before it was first written never get one, and once
+// it has been finalized it is no longer changed.
+func (s *session) saveMeta(finalized bool) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	if s.metaFinalized || finalized && !s.metaWritten {
+		return nil
+	}
+
+	s.mu.Lock()
+	meta := sessionMeta{
+		ID:        s.id,
+		StreamKey: s.streamKey,
+		Started:   s.started,
+		Codecs:    append([]string{}, s.codecs...),
+		Files:     []string{},
+		Finalized: finalized,
+	}
+	s.mu.Unlock()
+	if finalized {
+		meta.Ended = time.Now()
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			meta.Files = append(meta.Files, filepath.Join(filepath.Base(s.dir), entry.Name()))
+		}
+	}
+	// HLS is recorded under the stream's directory, shared by its sessions
+	if m, ok := s.muxer.(*mp4Muxer); ok && m.hls != nil {
+		meta.Files = append(meta.Files, m.hls.files()...)
+	}
+
+	if err := writeMeta(s.dir+metaSuffix, meta); err != nil {
+		return err
+	}
+	s.metaWritten = true
+	s.metaFinalized = finalized
+	return nil
+}
+
+// established reports whether the session was set up far enough to have
+// its metadata written, which a publish rejected on its offer never is
+func (s *session) established() bool {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.metaWritten
+}
+
+// scanUnfinalized returns the sessions under dir whose metadata was never
+// finalized, skipping metadata files that can't be read
+func scanUnfinalized(dir string) ([]sessionMeta, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+metaSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var unfinalized []sessionMeta
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("Failed to read session metadata", "path", path, "error", err)
+			continue
+		}
+		var meta sessionMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			slog.Warn("Invalid session metadata", "path", path, "error", err)
+			continue
+		}
+		if !meta.Finalized {
+			unfinalized = append(unfinalized, meta)
+		}
+	}
+	return unfinalized, nil
+}
+
+// warnUnfinalized logs the recordings left unfinalized in the output
+// directory by an earlier run, so they can be recovered by hand
+func warnUnfinalized() {
+	unfinalized, err := scanUnfinalized(config.OutputDir)
+	if err != nil {
+		slog.Warn("Failed to scan for unfinalized recordings", "dir", config.OutputDir, "error", err)
+		return
+	}
+	for _, meta := range unfinalized {
+		slog.Warn("Unfinalized recording from an earlier run", "session", meta.ID, "stream", meta.StreamKey,
+			"started", meta.Started, "files", strings.Join(meta.Files, ","))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TestScanUnfinalized writes the metadata of a session cut short, one closed
+// cleanly and a corrupt file, and checks the startup scan finds the first
+func TestScanUnfinalized(t *testing.T) {
+	setConfig(t, func(c *Config) { c.OutputDir = t.TempDir() })
+
+	crashed := newSession("cam", nil)
+	if err := os.MkdirAll(crashed.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(crashed.dir, "recording.webm"), []byte("webm"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	crashed.codecs = []string{webrtc.MimeTypeVP8}
+	if err := crashed.saveMeta(false); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := newSession("other", nil)
+	if err := closed.saveMeta(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := closed.saveMeta(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config.OutputDir, "corrupt"+metaSuffix), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := scanUnfinalized(config.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("found %d unfinalized sessions, want 1", len(got))
+	}
+	meta := got[0]
+	if meta.ID != crashed.id || meta.StreamKey != "cam" || !meta.Started.Equal(crashed.started) {
+		t.Errorf("found session %s of %q started %v, want %s of %q started %v", meta.ID, meta.StreamKey, meta.Started, crashed.id, "cam", crashed.started)
+	}
+	if !slices.Equal(meta.Codecs, crashed.codecs) {
+		t.Errorf("codecs %v, want %v", meta.Codecs, crashed.codecs)
+	}
+	if want := []string{filepath.Join(crashed.id, "recording.webm")}; !slices.Equal(meta.Files, want) {
+		t.Errorf("files %v, want %v", meta.Files, want)
+	}
+}
+
+// TestSessionMeta publishes a stream and checks its metadata is finalized
+// with the recording once the session closes
+func TestSessionMeta(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	id := strings.TrimPrefix(p.location, "/whip/")
+	if got, err := scanUnfinalized(config.OutputDir); err != nil || len(got) != 1 || got[0].ID != id {
+		t.Fatalf("unfinalized sessions %v while publishing, want %s: %v", got, id, err)
+	}
+	p.play(t, 500*time.Millisecond)
+	p.stop(t, base)
+
+	data, err := os.ReadFile(filepath.Join(config.OutputDir, id+metaSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta sessionMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Finalized || meta.Ended.Before(meta.Started) {
+		t.Errorf("session metadata finalized %v, ended %v, want finalized after %v", meta.Finalized, meta.Ended, meta.Started)
+	}
+	if want := []string{webrtc.MimeTypeVP8}; !slices.Equal(meta.Codecs, want) {
+		t.Errorf("codecs %v, want %v", meta.Codecs, want)
+	}
+	if want := []string{filepath.Join(id, "recording.webm")}; !slices.Equal(meta.Files, want) {
+		t.Errorf("files %v, want %v", meta.Files, want)
+	}
+}
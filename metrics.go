@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server metrics, registered once by registerMetrics
+var (
+	sessionsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaserver_whip_sessions_created_total",
+		Help: "WHIP sessions created since the server started.",
+	})
+	bytesWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaserver_bytes_written_total",
+		Help: "Media bytes written to recordings, by codec.",
+	}, []string{"codec"})
+	rtpPacketsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaserver_rtp_packets_received_total",
+		Help: "RTP packets received from WHIP publishers, by track kind.",
+	}, []string{"kind"})
+	rtpPacketsLate = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaserver_rtp_packets_late_total",
+		Help: "RTP packets dropped for arriving after the jitter buffer released later ones, by track kind.",
+	}, []string{"kind"})
+	depacketizeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaserver_depacketize_errors_total",
+		Help: "RTP packets that could not be depacketized, by codec.",
+	}, []string{"codec"})
+)
+
+// registerMetrics registers the server metrics and returns the /metrics handler
+func registerMetrics() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mediaserver_whip_sessions_active",
+			Help: "WHIP sessions currently publishing.",
+		}, func() float64 { return float64(sessions.count()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mediaserver_whep_viewers_active",
+			Help: "WHEP viewers currently playing a stream.",
+		}, func() float64 { return float64(viewers.total()) }),
+		sessionsCreated,
+		bytesWritten,
+		rtpPacketsReceived,
+		rtpPacketsLate,
+		depacketizeErrors,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// scrapeMetrics returns the series of /metrics by their name and labels, and
+// the names with a HELP line
+func scrapeMetrics(t *testing.T, base string) (map[string]float64, map[string]bool) {
+	t.Helper()
+	resp, err := http.Get(base + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics answered %d", resp.StatusCode)
+	}
+
+	series := map[string]float64{}
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "# HELP "); ok {
+			names[strings.Fields(name)[0]] = true
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad series %q: %v", line, err)
+		}
+		series[line[:i]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return series, names
+}
+
+func TestMetrics(t *testing.T) {
+	names := []string{
+		"mediaserver_whip_sessions_active",
+		"mediaserver_whip_sessions_created_total",
+		"mediaserver_whep_viewers_active",
+		"mediaserver_bytes_written_total",
+		"mediaserver_rtp_packets_received_total",
+		"mediaserver_depacketize_errors_total",
+		"go_goroutines",
+	}
+	tests := []struct {
+		name      string
+		mimeTypes []string
+		// increased are the series that grow while publishing
+		increased []string
+	}{
+		{
+			name:      "video",
+			mimeTypes: []string{webrtc.MimeTypeVP8},
+			increased: []string{
+				"mediaserver_whip_sessions_created_total",
+				`mediaserver_bytes_written_total{codec="video/VP8"}`,
+				`mediaserver_rtp_packets_received_total{kind="video"}`,
+			},
+		},
+		{
+			name:      "video and audio",
+			mimeTypes: []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus},
+			increased: []string{
+				"mediaserver_whip_sessions_created_total",
+				`mediaserver_bytes_written_total{codec="video/H264"}`,
+				`mediaserver_bytes_written_total{codec="audio/opus"}`,
+				`mediaserver_rtp_packets_received_total{kind="video"}`,
+				`mediaserver_rtp_packets_received_total{kind="audio"}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			before, _ := scrapeMetrics(t, base)
+
+			p := publish(t, base+"/whip/cam", tt.mimeTypes...)
+			p.play(t, 500*time.Millisecond)
+			during, present := scrapeMetrics(t, base)
+			for _, name := range names {
+				if !present[name] {
+					t.Errorf("no %s metric", name)
+				}
+			}
+			if got := during["mediaserver_whip_sessions_active"]; got != 1 {
+				t.Errorf("mediaserver_whip_sessions_active = %v while publishing, want 1", got)
+			}
+
+			p.stop(t, base)
+			after, _ := scrapeMetrics(t, base)
+			for _, series := range tt.increased {
+				if after[series] <= before[series] {
+					t.Errorf("%s = %v, want more than %v", series, after[series], before[series])
+				}
+			}
+			if got := after["mediaserver_whip_sessions_active"]; got != 0 {
+				t.Errorf("mediaserver_whip_sessions_active = %v after the session, want 0", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// The movie header counts milliseconds; H.264 tracks count 90 kHz ticks
+	// and Opus tracks 48 kHz samples
+	mp4MovieTimescale = 1000
+	mp4VideoTimescale = 90000
+
+	// A fragment is closed at the next video keyframe, or once it spans this long
+	mp4MaxFragmentDuration = 2 * time.Second
+
+	// Frames held back while waiting for every track's first frame; past
+	// this the header is written with the tracks known so far
+	mp4MaxPendingFrames = 500
+
+	// trun sample flags: sync samples depend on no other, the others do and
+	// are flagged non-sync
+	mp4SyncSampleFlags    = 0x02000000
+	mp4NonSyncSampleFlags = 0x01010000
+
+	// tfhd flag: data offsets are relative to the moof box
+	mp4DefaultBaseIsMoof = 0x020000
+
+	// trun flags: data offset, then the duration, size and flags of each sample
+	mp4TrunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400
+)
+
+// mp4Matrix is the identity transformation of the movie and track headers
+var mp4Matrix = concat(
+	mp4Uint32(0x00010000), mp4Uint32(0), mp4Uint32(0),
+	mp4Uint32(0), mp4Uint32(0x00010000), mp4Uint32(0),
+	mp4Uint32(0), mp4Uint32(0), mp4Uint32(0x40000000),
+)
+
+// mp4Muxer interleaves the H.264 video and Opus audio of one session into a
+// single fragmented MP4 file: ftyp and an empty moov, then a moof and mdat
+// per fragment, so the file plays while it is still being written. Like
+// webmMuxer, the header waits for every track announced in the offer, and
+// for the parameter sets of each video track that the avcC box is built
+// from; frames before that are held in memory. All tracks share the timeline
+// of the first frame received.
+type mp4Muxer struct {
+	path string
+
+	mu       sync.Mutex
+	expected int
+	tracks   []*mp4Track
+	open     int
+	start    time.Time
+	pending  []mp4Sample
+	file     *os.File
+	err      error
+	closed   bool
+
+	// sequence numbers the fragments of the file; the movie duration at
+	// durationOffset is patched on Close
+	sequence       uint32
+	durationOffset int64
+	duration       time.Duration
+
+	// fragment holds the samples of the next fragment, the first at fragmentTime
+	fragment     []mp4Sample
+	fragmentTime time.Duration
+
+	// With rotation enabled, segment numbers the current file, which starts
+	// at base and holds size bytes of samples; due is set once it is full,
+	// at dueAt
+	segment int
+	base    time.Duration
+	size    int64
+	due     bool
+	dueAt   time.Duration
+
+	// hls, when set, takes the fragments as the segments of an HLS playlist,
+	// the file at path then only holding the header
+	hls *hlsWriter
+}
+
+// mp4Track is the mediaWriter handed to a single track of the session
+type mp4Track struct {
+	muxer     *mp4Muxer
+	id        uint32
+	mimeType  string
+	channels  uint16
+	timescale uint32
+
+	inHeader  bool
+	started   bool
+	finalized bool
+	offset    time.Duration
+
+	// sps and pps are the first parameter sets of an H.264 track
+	sps, pps      []byte
+	width, height uint16
+
+	// held is the last sample, written once the next one gives its duration;
+	// the last sample of the track repeats the duration before it
+	held         *mp4Sample
+	lastDuration int64
+}
+
+type mp4Sample struct {
+	track    *mp4Track
+	time     time.Duration
+	ticks    int64
+	duration int64
+	keyframe bool
+	data     []byte
+}
+
+// newMP4Muxer prepares a muxer expecting the given number of tracks. The
+// file at path is only created once there is something to write.
+func newMP4Muxer(path string, expected int) *mp4Muxer {
+	return &mp4Muxer{path: path, expected: expected}
+}
+
+// addTrack registers a track of the session and returns its writer and
+// depacketizer. Codecs other than H.264 and Opus return errUnsupportedCodec,
+// and the muxer stops waiting for that track.
+func (m *mp4Muxer) addTrack(codec webrtc.RTPCodecParameters) (mediaWriter, rtp.Depacketizer, error) {
+	var depacketizer rtp.Depacketizer
+	t := &mp4Track{muxer: m, mimeType: codec.MimeType}
+	switch codec.MimeType {
+	case webrtc.MimeTypeH264:
+		depacketizer = &h264Depacketizer{}
+		t.timescale = mp4VideoTimescale
+		t.lastDuration = mp4VideoTimescale / 30
+	case webrtc.MimeTypeOpus:
+		depacketizer = &codecs.OpusPacket{}
+		t.channels = max(codec.Channels, 1)
+		t.timescale = oggSampleRate
+		t.lastDuration = oggSampleRate / 50
+	default:
+		m.skipTrack()
+		return nil, nil, errUnsupportedCodec
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expected--
+	t.id = uint32(len(m.tracks) + 1)
+	m.tracks = append(m.tracks, t)
+	m.open++
+	return t, depacketizer, nil
+}
+
+// skipTrack stops waiting for a track that won't be part of the file
+func (m *mp4Muxer) skipTrack() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expected--
+	m.tryWriteHeader()
+}
+
+func (t *mp4Track) isVideo() bool {
+	return t.mimeType == webrtc.MimeTypeH264
+}
+
+// WriteFrame adds a frame to the shared timeline, offset by when the track's
+// first frame arrived. H.264 frames are dropped until the parameter sets
+// have been seen.
+func (t *mp4Track) WriteFrame(frame []byte, pts time.Duration) error {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+
+	sample := mp4Sample{track: t, keyframe: true}
+	if t.isVideo() {
+		sample.keyframe = h264HasIDR(frame)
+		sample.data = t.avcSample(frame)
+		if t.sps == nil || t.pps == nil || len(sample.data) == 0 {
+			return nil
+		}
+	} else {
+		sample.data = append([]byte(nil), frame...)
+	}
+
+	now := time.Now()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	if !t.started {
+		t.started = true
+		t.offset = now.Sub(m.start) - pts
+	}
+	sample.time = t.offset + pts
+
+	if m.file == nil {
+		m.pending = append(m.pending, sample)
+		m.tryWriteHeader()
+		return m.err
+	}
+	if !t.inHeader {
+		// The track arrived after the header was written
+		return nil
+	}
+	overdue := sample.time-m.dueAt >= rotationKeyframeWait
+	if m.due && (sample.keyframe && t.isVideo() || !m.hasVideo() || overdue) {
+		if m.err = m.rotate(sample.time); m.err != nil {
+			return m.err
+		}
+	}
+	m.err = m.add(sample)
+	if !m.due && m.hls == nil && rotationDue(sample.time-m.base, m.size) {
+		m.due, m.dueAt = true, sample.time
+	}
+	return m.err
+}
+
+// avcSample converts an Annex-B access unit to the length-prefixed NAL units
+// of an MP4 sample. The parameter sets go to the avcC box instead, the first
+// ones seen being kept.
+func (t *mp4Track) avcSample(frame []byte) []byte {
+	var sample []byte
+	for _, unit := range annexBUnits(frame) {
+		switch unit[0] & h264NALUTypeMask {
+		case h264NALUTypeSPS:
+			if t.sps == nil && len(unit) >= 4 {
+				t.sps = append([]byte(nil), unit...)
+				t.width, t.height = h264SPSSize(unit)
+			}
+		case h264NALUTypePPS:
+			if t.pps == nil {
+				t.pps = append([]byte(nil), unit...)
+			}
+		case h264NALUTypeAUD:
+		default:
+			sample = binary.BigEndian.AppendUint32(sample, uint32(len(unit)))
+			sample = append(sample, unit...)
+		}
+	}
+	return sample
+}
+
+// awaitingKeyframe reports whether the next segment waits for a keyframe of this track
+func (t *mp4Track) awaitingKeyframe() bool {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.due && t.inHeader && t.isVideo()
+}
+
+// hasVideo reports whether the current file has a video track
+func (m *mp4Muxer) hasVideo() bool {
+	for _, t := range m.tracks {
+		if t.inHeader && t.isVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// rotate finalizes the current file and starts the next segment at time at
+func (m *mp4Muxer) rotate(at time.Duration) error {
+	err := m.finalize()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.file = nil
+	if err != nil {
+		return err
+	}
+	m.base = at
+	m.due = false
+	m.writeHeader()
+	return m.err
+}
+
+// Finalize ends the track, and once the last track of the session is done
+// writes the last fragment and patches the movie duration
+func (t *mp4Track) Finalize() error {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.finalized {
+		return m.err
+	}
+	t.finalized = true
+	m.open--
+	if m.open > 0 {
+		return nil
+	}
+
+	if m.file == nil && len(m.pending) > 0 {
+		m.writeHeader()
+	}
+	if m.file != nil && m.err == nil {
+		m.err = m.finalize()
+	}
+	return m.err
+}
+
+// Close finalizes the track if needed, closing the file after the last track
+func (t *mp4Track) Close() error {
+	err := t.Finalize()
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.open > 0 || m.file == nil || m.closed {
+		return err
+	}
+	m.closed = true
+	if closeErr := m.file.Close(); m.err == nil {
+		m.err = closeErr
+	}
+	return m.err
+}
+
+// tryWriteHeader writes the header once every track is ready, or once too
+// many frames are waiting for it
+func (m *mp4Muxer) tryWriteHeader() {
+	if m.file != nil || m.err != nil || len(m.pending) == 0 {
+		return
+	}
+	if len(m.pending) < mp4MaxPendingFrames {
+		if m.expected > 0 {
+			return
+		}
+		for _, t := range m.tracks {
+			if t.isVideo() && !t.started {
+				return
+			}
+		}
+	}
+	m.writeHeader()
+}
+
+// writeHeader creates the file, writes the ftyp and moov boxes, then the
+// frames that were waiting for them in timestamp order
+func (m *mp4Muxer) writeHeader() {
+	path := m.path
+	if m.hls != nil {
+		if err := os.MkdirAll(m.hls.dir, 0o755); err != nil {
+			m.err = err
+			m.pending = nil
+			return
+		}
+	} else if rotationEnabled() {
+		m.segment++
+		path = segmentName(m.path, m.segment)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		m.err = err
+		m.pending = nil
+		return
+	}
+	m.file = file
+	m.size = 0
+	m.duration = 0
+	m.sequence = 0
+
+	var traks, trexs []byte
+	for _, t := range m.tracks {
+		t.held = nil
+		if t.isVideo() && !t.started {
+			continue
+		}
+		t.inHeader = true
+		traks = append(traks, t.trak()...)
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, mp4Uint32(t.id), mp4Uint32(1), mp4Uint32(0), mp4Uint32(0), mp4Uint32(0))...)
+	}
+
+	ftyp := mp4Box("ftyp", []byte("isom"), mp4Uint32(0x200), []byte("isomiso5iso6mp41"))
+	// The duration is patched on Close
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		mp4Uint32(0), mp4Uint32(0), mp4Uint32(mp4MovieTimescale), mp4Uint32(0),
+		mp4Uint32(0x00010000), mp4Uint16(0x0100), make([]byte, 10), mp4Matrix, make([]byte, 24),
+		mp4Uint32(uint32(len(m.tracks)+1)),
+	)
+	m.durationOffset = int64(len(ftyp) + 8 + 8 + 16)
+	header := concat(ftyp, mp4Box("moov", mvhd, traks, mp4Box("mvex", trexs)))
+	if _, err := file.Write(header); err != nil {
+		m.err = err
+		return
+	}
+
+	pending := m.pending
+	m.pending = nil
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].time < pending[j].time })
+	for _, sample := range pending {
+		if !sample.track.inHeader {
+			continue
+		}
+		if m.err = m.add(sample); m.err != nil {
+			return
+		}
+	}
+}
+
+// trak encodes the track box of t, with its sample entry and no samples,
+// those being in the fragments
+func (t *mp4Track) trak() []byte {
+	var volume uint16
+	var handler, name string
+	var mediaHeader, sampleEntry []byte
+	if t.isVideo() {
+		handler, name = "vide", "VideoHandler"
+		mediaHeader = mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+		avcC := mp4Box("avcC",
+			[]byte{1, t.sps[1], t.sps[2], t.sps[3], 0xFF, 0xE1}, mp4Uint16(uint16(len(t.sps))), t.sps,
+			[]byte{1}, mp4Uint16(uint16(len(t.pps))), t.pps,
+		)
+		sampleEntry = mp4Box("avc1",
+			make([]byte, 6), mp4Uint16(1), make([]byte, 16),
+			mp4Uint16(t.width), mp4Uint16(t.height), mp4Uint32(0x00480000), mp4Uint32(0x00480000),
+			mp4Uint32(0), mp4Uint16(1), make([]byte, 32), mp4Uint16(0x0018), mp4Uint16(0xFFFF),
+			avcC,
+		)
+	} else {
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+		// Opus in ISOBMFF: an Opus sample entry with a dOps box, big-endian
+		// unlike the OpusHead it mirrors
+		dOps := mp4Box("dOps",
+			[]byte{0, byte(t.channels)}, mp4Uint16(oggPreSkip), mp4Uint32(oggSampleRate), mp4Uint16(0), []byte{0},
+		)
+		sampleEntry = mp4Box("Opus",
+			make([]byte, 6), mp4Uint16(1), make([]byte, 8),
+			mp4Uint16(t.channels), mp4Uint16(16), make([]byte, 4), mp4Uint32(oggSampleRate<<16),
+			dOps,
+		)
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		mp4Uint32(0), mp4Uint32(0), mp4Uint32(t.id), mp4Uint32(0), mp4Uint32(0),
+		make([]byte, 8), mp4Uint16(0), mp4Uint16(0), mp4Uint16(volume), mp4Uint16(0), mp4Matrix,
+		mp4Uint32(uint32(t.width)<<16), mp4Uint32(uint32(t.height)<<16),
+	)
+	// Language "und", packed as three 5-bit letters
+	mdhd := mp4FullBox("mdhd", 0, 0, mp4Uint32(0), mp4Uint32(0), mp4Uint32(t.timescale), mp4Uint32(0), mp4Uint16(0x55C4), mp4Uint16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, mp4Uint32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)),
+	)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+// add holds sample back until the next sample of its track gives its
+// duration, and releases the sample it replaces
+func (m *mp4Muxer) add(sample mp4Sample) error {
+	t := sample.track
+	sample.ticks = max(durationToTicks(sample.time-m.base, t.timescale), 0)
+	held := t.held
+	if held != nil && sample.ticks <= held.ticks {
+		sample.ticks = held.ticks + 1
+	}
+	t.held = &sample
+	if held == nil {
+		return nil
+	}
+	held.duration = sample.ticks - held.ticks
+	t.lastDuration = held.duration
+	return m.release(*held)
+}
+
+// release adds a sample whose duration is known to the next fragment,
+// writing the fragment first if the sample starts a new one
+func (m *mp4Muxer) release(sample mp4Sample) error {
+	if len(m.fragment) > 0 && (sample.keyframe && sample.track.isVideo() ||
+		sample.time-m.fragmentTime >= mp4MaxFragmentDuration) {
+		if err := m.flushFragment(); err != nil {
+			return err
+		}
+	}
+	if len(m.fragment) == 0 {
+		m.fragmentTime = sample.time
+	}
+	m.fragment = append(m.fragment, sample)
+
+	end := ticksToDuration(sample.ticks+sample.duration, sample.track.timescale)
+	m.duration = max(m.duration, end)
+	m.size += int64(len(sample.data))
+	return nil
+}
+
+// flushFragment writes the samples of the fragment as a moof box, with a
+// traf per track, followed by their data in an mdat box
+func (m *mp4Muxer) flushFragment() error {
+	if len(m.fragment) == 0 {
+		return nil
+	}
+	// Fragments are cut at video keyframes, so one starting on a keyframe
+	// can be decoded without those before it
+	first := m.fragment[0]
+	independent := first.keyframe && first.track.isVideo() || !m.hasVideo()
+	samples := map[*mp4Track][]mp4Sample{}
+	var tracks []*mp4Track
+	for _, sample := range m.fragment {
+		if samples[sample.track] == nil {
+			tracks = append(tracks, sample.track)
+		}
+		samples[sample.track] = append(samples[sample.track], sample)
+	}
+	m.fragment = nil
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].id < tracks[j].id })
+
+	m.sequence++
+	// The data offsets depend on the size of the moof box, which doesn't
+	moof := func(dataOffset int) []byte {
+		var trafs []byte
+		for _, t := range tracks {
+			trafs = append(trafs, mp4Traf(t, samples[t], dataOffset)...)
+			for _, sample := range samples[t] {
+				dataOffset += len(sample.data)
+			}
+		}
+		return mp4Box("moof", mp4FullBox("mfhd", 0, 0, mp4Uint32(m.sequence)), trafs)
+	}
+	var data bytes.Buffer
+	data.Write(moof(len(moof(0)) + 8))
+	var mdat []byte
+	for _, t := range tracks {
+		for _, sample := range samples[t] {
+			mdat = append(mdat, sample.data...)
+		}
+	}
+	data.Write(mp4Box("mdat", mdat))
+	if m.hls != nil {
+		return m.hls.writeFragment(data.Bytes(), first.time, independent)
+	}
+	_, err := m.file.Write(data.Bytes())
+	return err
+}
+
+// mp4Traf encodes the track fragment of samples of t, whose data starts at
+// dataOffset from the moof box
+func mp4Traf(t *mp4Track, samples []mp4Sample, dataOffset int) []byte {
+	run := concat(mp4Uint32(uint32(len(samples))), mp4Uint32(uint32(dataOffset)))
+	for _, sample := range samples {
+		flags := uint32(mp4SyncSampleFlags)
+		if !sample.keyframe {
+			flags = mp4NonSyncSampleFlags
+		}
+		run = concat(run, mp4Uint32(uint32(sample.duration)), mp4Uint32(uint32(len(sample.data))), mp4Uint32(flags))
+	}
+	return mp4Box("traf",
+		mp4FullBox("tfhd", 0, mp4DefaultBaseIsMoof, mp4Uint32(t.id)),
+		mp4FullBox("tfdt", 1, 0, mp4Uint64(uint64(samples[0].ticks))),
+		mp4FullBox("trun", 0, mp4TrunFlags, run),
+	)
+}
+
+// finalize writes the samples held back and the last fragment, and patches
+// the movie duration
+func (m *mp4Muxer) finalize() error {
+	for _, t := range m.tracks {
+		if t.held == nil {
+			continue
+		}
+		held := *t.held
+		t.held = nil
+		held.duration = t.lastDuration
+		if err := m.release(held); err != nil {
+			return err
+		}
+	}
+	if err := m.flushFragment(); err != nil {
+		return err
+	}
+	if m.hls != nil {
+		return m.hls.finish(m.duration)
+	}
+	_, err := m.file.WriteAt(mp4Uint32(uint32(m.duration/time.Millisecond)), m.durationOffset)
+	return err
+}
+
+// mp4Box encodes a box of boxType holding the concatenated payload
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	data := concat(payload...)
+	return concat(mp4Uint32(uint32(8+len(data))), []byte(boxType), data)
+}
+
+// mp4FullBox encodes a box whose payload starts with a version and flags
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	return mp4Box(boxType, append([][]byte{mp4Uint32(uint32(version)<<24 | flags)}, payload...)...)
+}
+
+func mp4Uint16(value uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, value)
+}
+
+func mp4Uint32(value uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, value)
+}
+
+func mp4Uint64(value uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, value)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type mp4TestBox struct {
+	boxType string
+	body    []byte
+}
+
+// readMP4Boxes splits data into its boxes, failing the test if a box runs
+// past the end
+func readMP4Boxes(t *testing.T, data []byte) []mp4TestBox {
+	t.Helper()
+	var boxes []mp4TestBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header % x", data)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("%q box of %d bytes in %d", data[4:8], size, len(data))
+		}
+		boxes = append(boxes, mp4TestBox{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// mp4Child returns the body of the first child box of boxType, skipping skip
+// leading bytes of body that aren't boxes
+func mp4Child(t *testing.T, body []byte, skip int, boxType string) []byte {
+	t.Helper()
+	for _, box := range readMP4Boxes(t, body[skip:]) {
+		if box.boxType == boxType {
+			return box.body
+		}
+	}
+	t.Fatalf("no %q box", boxType)
+	return nil
+}
+
+type mp4TestTrack struct {
+	id            uint32
+	sampleEntry   string
+	width, height uint16
+}
+
+type mp4TestSample struct {
+	track    uint32
+	time     uint64
+	duration uint32
+	keyframe bool
+	data     []byte
+	// fragment is set on the first sample of a track fragment
+	fragment bool
+}
+
+// readMP4 checks the box structure of a fragmented MP4 file, ftyp and moov
+// followed by moof and mdat pairs, and returns its tracks and samples
+func readMP4(t *testing.T, data []byte) ([]mp4TestTrack, []mp4TestSample) {
+	t.Helper()
+	boxes := readMP4Boxes(t, data)
+	if len(boxes) < 2 || boxes[0].boxType != "ftyp" || boxes[1].boxType != "moov" {
+		t.Fatalf("file starts with %d boxes, want ftyp and moov", len(boxes))
+	}
+
+	var tracks []mp4TestTrack
+	moov := boxes[1].body
+	mp4Child(t, moov, 0, "mvex")
+	for _, box := range readMP4Boxes(t, moov) {
+		if box.boxType != "trak" {
+			continue
+		}
+		tkhd := mp4Child(t, box.body, 0, "tkhd")
+		track := mp4TestTrack{
+			id:     binary.BigEndian.Uint32(tkhd[12:]),
+			width:  uint16(binary.BigEndian.Uint32(tkhd[76:]) >> 16),
+			height: uint16(binary.BigEndian.Uint32(tkhd[80:]) >> 16),
+		}
+		stbl := mp4Child(t, mp4Child(t, mp4Child(t, box.body, 0, "mdia"), 0, "minf"), 0, "stbl")
+		entries := readMP4Boxes(t, mp4Child(t, stbl, 0, "stsd")[8:])
+		if len(entries) != 1 {
+			t.Fatalf("track %d has %d sample entries, want 1", track.id, len(entries))
+		}
+		track.sampleEntry = entries[0].boxType
+		switch track.sampleEntry {
+		case "avc1":
+			avcC := mp4Child(t, entries[0].body, 78, "avcC")
+			if !bytes.Contains(avcC, testH264SPS) || !bytes.Contains(avcC, testH264PPS) {
+				t.Errorf("avcC % x lacks the parameter sets", avcC)
+			}
+		case "Opus":
+			if dOps := mp4Child(t, entries[0].body, 28, "dOps"); dOps[1] != 2 {
+				t.Errorf("dOps % x, want 2 channels", dOps)
+			}
+		}
+		tracks = append(tracks, track)
+	}
+
+	var samples []mp4TestSample
+	for i := 2; i < len(boxes); i += 2 {
+		if boxes[i].boxType != "moof" || i+1 >= len(boxes) || boxes[i+1].boxType != "mdat" {
+			t.Fatalf("box %d is %q, want a moof followed by an mdat", i, boxes[i].boxType)
+		}
+		moofSize := len(boxes[i].body) + 8
+		mdat := boxes[i+1].body
+		for _, traf := range readMP4Boxes(t, boxes[i].body) {
+			if traf.boxType != "traf" {
+				continue
+			}
+			track := binary.BigEndian.Uint32(mp4Child(t, traf.body, 0, "tfhd")[4:])
+			decodeTime := binary.BigEndian.Uint64(mp4Child(t, traf.body, 0, "tfdt")[4:])
+			trun := mp4Child(t, traf.body, 0, "trun")
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			// Offsets are from the start of the moof, the samples being in the mdat after it
+			offset := int(binary.BigEndian.Uint32(trun[8:])) - moofSize - 8
+			for j := range count {
+				entry := trun[12+12*j:]
+				duration := binary.BigEndian.Uint32(entry)
+				size := int(binary.BigEndian.Uint32(entry[4:]))
+				if offset < 0 || offset+size > len(mdat) {
+					t.Fatalf("sample of %d bytes at %d outside an mdat of %d", size, offset, len(mdat))
+				}
+				samples = append(samples, mp4TestSample{
+					track:    track,
+					time:     decodeTime,
+					duration: duration,
+					keyframe: binary.BigEndian.Uint32(entry[8:]) == mp4SyncSampleFlags,
+					data:     mdat[offset : offset+size],
+					fragment: j == 0,
+				})
+				decodeTime += uint64(duration)
+				offset += size
+			}
+		}
+	}
+	return tracks, samples
+}
+
+func TestMP4Muxer(t *testing.T) {
+	tests := []struct {
+		name      string
+		mimeTypes []string
+		// Tracks of the offer the muxer can't carry
+		unsupported int
+		// keyframeInterval is the number of video frames per keyframe
+		keyframeInterval int
+		duration         time.Duration
+		wantTracks       []mp4TestTrack
+		// wantSamples counts the samples per track ID
+		wantSamples map[uint32]int
+	}{
+		{
+			name:             "video and audio",
+			mimeTypes:        []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus},
+			keyframeInterval: 10,
+			duration:         time.Second,
+			wantTracks:       []mp4TestTrack{{1, "avc1", 640, 480}, {2, "Opus", 0, 0}},
+			wantSamples:      map[uint32]int{1: 30, 2: 50},
+		},
+		{
+			name:             "video only",
+			mimeTypes:        []string{webrtc.MimeTypeH264},
+			keyframeInterval: 15,
+			duration:         time.Second,
+			wantTracks:       []mp4TestTrack{{1, "avc1", 640, 480}},
+			wantSamples:      map[uint32]int{1: 30},
+		},
+		{
+			name:        "audio only",
+			mimeTypes:   []string{webrtc.MimeTypeOpus},
+			duration:    5 * time.Second,
+			wantTracks:  []mp4TestTrack{{1, "Opus", 0, 0}},
+			wantSamples: map[uint32]int{1: 250},
+		},
+		{
+			name:             "unsupported track left out",
+			mimeTypes:        []string{webrtc.MimeTypeH264},
+			unsupported:      1,
+			keyframeInterval: 30,
+			duration:         time.Second,
+			wantTracks:       []mp4TestTrack{{1, "avc1", 640, 480}},
+			wantSamples:      map[uint32]int{1: 30},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session.mp4")
+			muxer := newMP4Muxer(path, len(tt.mimeTypes)+tt.unsupported)
+			var writers []mediaWriter
+			for _, mimeType := range tt.mimeTypes {
+				writer, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, Channels: 2},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				writers = append(writers, writer)
+			}
+			for range tt.unsupported {
+				_, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+				})
+				if err != errUnsupportedCodec {
+					t.Fatalf("addTrack(VP8) error = %v, want %v", err, errUnsupportedCodec)
+				}
+			}
+			// The VP8 frames of the WebM tests stand for H.264 ones
+			for _, f := range webmFrames(tt.mimeTypes, tt.duration, max(tt.keyframeInterval, 1)) {
+				frame := f.frame
+				switch {
+				case tt.mimeTypes[f.track] == webrtc.MimeTypeOpus:
+				case bytes.Equal(frame, testVP8Keyframe):
+					frame = testH264Keyframe
+				default:
+					frame = testH264Interframe
+				}
+				if err := writers[f.track].WriteFrame(frame, f.pts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, writer := range writers {
+				if err := writer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tracks, samples := readMP4(t, data)
+			if !slices.Equal(tracks, tt.wantTracks) {
+				t.Fatalf("tracks = %+v, want %+v", tracks, tt.wantTracks)
+			}
+
+			counts := map[uint32]int{}
+			next := map[uint32]uint64{}
+			for i, sample := range samples {
+				counts[sample.track]++
+				if want, ok := next[sample.track]; ok && sample.time != want {
+					t.Errorf("sample %d of track %d at %d, want %d after the one before", i, sample.track, sample.time, want)
+				}
+				next[sample.track] = sample.time + uint64(sample.duration)
+				if sample.duration == 0 {
+					t.Errorf("sample %d of track %d has no duration", i, sample.track)
+				}
+				if tracks[sample.track-1].sampleEntry != "avc1" {
+					if !sample.keyframe || !bytes.Equal(sample.data, testOpusSilence) {
+						t.Errorf("audio sample %d: keyframe %v, data % x", i, sample.keyframe, sample.data)
+					}
+					continue
+				}
+				keyframe := (counts[sample.track]-1)%tt.keyframeInterval == 0
+				if sample.keyframe != keyframe {
+					t.Errorf("sample %d: keyframe %v, want %v", i, sample.keyframe, keyframe)
+				}
+				if keyframe && !sample.fragment {
+					t.Errorf("keyframe sample %d doesn't start a fragment", i)
+				}
+				// Length-prefixed NAL units, the parameter sets left to the avcC box
+				want := concat(mp4Uint32(uint32(len(testH264Slice))), testH264Slice)
+				if keyframe {
+					want = concat(mp4Uint32(uint32(len(testH264Keyframe)-21-4)), testH264Keyframe[25:])
+				}
+				if !bytes.Equal(sample.data, want) {
+					t.Errorf("sample %d data % x, want % x", i, sample.data, want)
+				}
+			}
+			if !maps.Equal(counts, tt.wantSamples) {
+				t.Errorf("samples per track %v, want %v", counts, tt.wantSamples)
+			}
+		})
+	}
+}
+
+// TestMP4Recording records a WHIP session of H.264 and Opus and checks the
+// MP4 file
+func TestMP4Recording(t *testing.T) {
+	base := startServer(t)
+	p := newCodecPublisher(t, webrtc.MimeTypeH264, webrtc.MimeTypeOpus)
+	resp, body := postOffer(t, base+"/whip/cam", p.pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	p.location = resp.Header.Get("Location")
+	waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	p.play(t, time.Second)
+	p.stop(t, base)
+
+	files, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "*"))
+	if err != nil || len(files) != 1 || filepath.Base(files[0]) != "recording.mp4" {
+		t.Fatalf("recorded %v, want one MP4 file: %v", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tracks are numbered in the order they arrived
+	tracks, samples := readMP4(t, data)
+	byEntry := map[string]mp4TestTrack{}
+	for _, track := range tracks {
+		byEntry[track.sampleEntry] = track
+	}
+	video, audio := byEntry["avc1"], byEntry["Opus"]
+	if len(tracks) != 2 || video.width != 640 || video.height != 480 || audio.id == 0 {
+		t.Fatalf("tracks = %+v, want a 640x480 avc1 and an Opus track", tracks)
+	}
+	counts := map[uint32]int{}
+	for _, sample := range samples {
+		if sample.track == video.id && counts[video.id] == 0 && !sample.keyframe {
+			t.Error("the first video sample isn't a keyframe")
+		}
+		counts[sample.track]++
+	}
+	if counts[video.id] == 0 || counts[audio.id] == 0 {
+		t.Errorf("samples per track %v, want both tracks", counts)
+	}
+	// The movie duration is patched in once the session ends
+	mvhd := mp4Child(t, readMP4Boxes(t, data)[1].body, 0, "mvhd")
+	if duration := binary.BigEndian.Uint32(mvhd[16:]); duration == 0 {
+		t.Error("movie duration not set")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// How often outstanding losses are reported back to the publisher
+const nackInterval = 50 * time.Millisecond
+
+// nackGenerator tracks the sequence numbers received on one RTP stream and
+// reports the gaps. Losses older than the history window or the timeout are
+// given up on.
+type nackGenerator struct {
+	mu       sync.Mutex
+	size     uint16
+	timeout  time.Duration
+	received []bool
+	highest  uint16
+	started  bool
+	missing  map[uint16]time.Time
+}
+
+func newNACKGenerator(size uint16, timeout time.Duration) *nackGenerator {
+	return &nackGenerator{
+		size:     size,
+		timeout:  timeout,
+		received: make([]bool, size),
+		missing:  map[uint16]time.Time{},
+	}
+}
+
+// push records the arrival of sequence number seq
+func (g *nackGenerator) push(seq uint16, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.started {
+		g.started = true
+		g.highest = seq
+		g.received[seq%g.size] = true
+		return
+	}
+
+	diff := seq - g.highest
+	switch {
+	case diff == 0:
+		return
+	case diff < 0x8000: // newer, with wraparound
+		if diff >= g.size {
+			// Too big a jump to recover, start over from here
+			clear(g.received)
+			clear(g.missing)
+		} else {
+			for s := g.highest + 1; s != seq; s++ {
+				g.received[s%g.size] = false
+				g.missing[s] = now
+			}
+		}
+		g.highest = seq
+		g.received[seq%g.size] = true
+	default: // late or retransmitted
+		if g.highest-seq < g.size {
+			g.received[seq%g.size] = true
+		}
+		delete(g.missing, seq)
+	}
+}
+
+// pending returns the losses still worth requesting, oldest first
+func (g *nackGenerator) pending(now time.Time) []uint16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	seqs := make([]uint16, 0, len(g.missing))
+	for seq, since := range g.missing {
+		if now.Sub(since) > g.timeout || g.highest-seq >= g.size {
+			delete(g.missing, seq)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return g.highest-seqs[i] > g.highest-seqs[j]
+	})
+	return seqs
+}
+
+// run sends a Generic NACK for the outstanding losses every nackInterval until ctx is done
+func (g *nackGenerator) run(ctx context.Context, logger *slog.Logger, peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC) {
+	ticker := time.NewTicker(nackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			seqs := g.pending(now)
+			if len(seqs) == 0 {
+				continue
+			}
+			nack := &rtcp.TransportLayerNack{
+				MediaSSRC: uint32(ssrc),
+				Nacks:     rtcp.NackPairsFromSequenceNumbers(seqs),
+			}
+			if err := peerConnection.WriteRTCP([]rtcp.Packet{nack}); err != nil {
+				logger.Warn("Failed to send NACK", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// supportsNACK reports whether generic NACK feedback was negotiated for the codec
+func supportsNACK(codec webrtc.RTPCodecParameters) bool {
+	for _, feedback := range codec.RTCPFeedback {
+		if strings.EqualFold(feedback.Type, "nack") && feedback.Parameter == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestNACKGenerator(t *testing.T) {
+	const timeout = time.Second
+	tests := []struct {
+		name string
+		// size is the history size, 128 if zero
+		size uint16
+		seqs []uint16
+		// after is how long after the pushes the losses are asked for
+		after time.Duration
+		want  []uint16
+	}{
+		{name: "in order", seqs: []uint16{1, 2, 3, 4}},
+		{name: "gap", seqs: []uint16{1, 2, 5, 6}, want: []uint16{3, 4}},
+		{name: "two gaps, oldest first", seqs: []uint16{1, 3, 6}, want: []uint16{2, 4, 5}},
+		{name: "retransmission fills the gap", seqs: []uint16{1, 2, 5, 3}, want: []uint16{4}},
+		{name: "reordered", seqs: []uint16{1, 3, 2, 4}},
+		{name: "duplicate", seqs: []uint16{1, 2, 2, 3}},
+		{name: "gap across the wraparound", seqs: []uint16{65533, 65534, 1}, want: []uint16{65535, 0}},
+		{name: "gap given up after the timeout", seqs: []uint16{1, 4}, after: 2 * timeout},
+		{name: "jump beyond the history", seqs: []uint16{1, 2, 200}},
+		{name: "loss pushed out of the history", size: 4, seqs: []uint16{1, 3, 5, 7}, want: []uint16{4, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = 128
+			}
+			g := newNACKGenerator(size, timeout)
+			now := time.Now()
+			for _, seq := range tt.seqs {
+				g.push(seq, now)
+			}
+			if got := g.pending(now.Add(tt.after)); !slices.Equal(got, tt.want) {
+				t.Errorf("pending = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupportsNACK(t *testing.T) {
+	tests := []struct {
+		name     string
+		feedback []webrtc.RTCPFeedback
+		want     bool
+	}{
+		{name: "nack", feedback: []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "nack"}}, want: true},
+		{name: "upper case", feedback: []webrtc.RTCPFeedback{{Type: "NACK"}}, want: true},
+		{name: "pli only", feedback: []webrtc.RTCPFeedback{{Type: "nack", Parameter: "pli"}}},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{RTCPFeedback: tt.feedback}}
+			if got := supportsNACK(codec); got != tt.want {
+				t.Errorf("supportsNACK = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNACKSent publishes a video track with a sequence gap and checks that
+// the server asks for the missing packets
+func TestNACKSent(t *testing.T) {
+	base := startServer(t)
+	track, sender, _ := publishRTP(t, base+"/whip/cam")
+
+	nacked := make(chan []uint16, 16)
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+					var seqs []uint16
+					for _, pair := range nack.Nacks {
+						seqs = append(seqs, pair.PacketList()...)
+					}
+					nacked <- seqs
+				}
+			}
+		}
+	}()
+
+	// Packets 3 and 4 are lost, and the stream goes on so it isn't idle
+	deadline := time.After(testTimeout)
+	for seq := uint16(1); ; seq++ {
+		if seq != 3 && seq != 4 {
+			packet := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+				Payload: append([]byte{0x10}, testVP8Interframe...),
+			}
+			if err := track.WriteRTP(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case seqs := <-nacked:
+			if !slices.Equal(seqs, []uint16{3, 4}) {
+				t.Fatalf("NACK for %v, want [3 4]", seqs)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no NACK sent")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
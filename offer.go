@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// maxOfferSize bounds the SDP offer accepted in a request body
+const maxOfferSize = 64 << 10
+
+// sdpContentType is the media type of offers and answers
+const sdpContentType = "application/sdp"
+
+// readOffer reads the SDP offer of a WHIP or WHEP request, answering 415 for
+// a body that isn't application/sdp, 406 to a client that won't accept an
+// application/sdp answer, 413 for an offer over maxOfferSize, 408 for one
+// still arriving after -read-timeout and 400 for one that checkOffer
+// rejects. It returns false once the request has been
+// answered.
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != sdpContentType {
+		http.Error(w, "Content-Type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	if !accepts(r, sdpContentType) {
+		http.Error(w, "The answer is "+sdpContentType+", which Accept doesn't allow", http.StatusNotAcceptable)
+		return "", false
+	}
+	body, ok := readBody(w, r, maxOfferSize, http.Error)
+	if !ok {
+		return "", false
+	}
+	if err := checkOffer(string(body)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
+
+// readBody reads the body of r, answering with writeError 413 for one over
+// limit bytes and 408 for one still arriving after -read-timeout, so a slow
+// or oversized upload can't hold the handler. It returns false once the
+// request has been answered.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64, writeError errorWriter) ([]byte, bool) {
+	// Unsupported by some ResponseWriters, such as those of handler tests
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(time.Now().Add(config.ReadTimeout)); err == nil {
+		// Left set, the deadline would end the request once passed
+		defer controller.SetReadDeadline(time.Time{})
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		w.Header().Set("Connection", "close")
+		writeError(w, "Timed out reading the request body", http.StatusRequestTimeout)
+		return nil, false
+	case err != nil:
+		writeError(w, "Failed to read body", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// checkOffer fails, with a 400 publishError, an offer that is empty, isn't
+// SDP, has no media section or has an RTP one without rtcp-mux
+func checkOffer(offer string) error {
+	if offer == "" {
+		return &publishError{http.StatusBadRequest, "Empty offer, expected an SDP body"}
+	}
+	var description sdp.SessionDescription
+	if err := description.UnmarshalString(offer); err != nil {
+		return &publishError{http.StatusBadRequest, "Offer is not valid SDP: " + err.Error()}
+	}
+	if len(description.MediaDescriptions) == 0 {
+		return &publishError{http.StatusBadRequest, "Offer has no media section"}
+	}
+	for _, media := range description.MediaDescriptions {
+		// Data channels carry no RTCP, and rejected sections nothing at all
+		if media.MediaName.Media == "application" || media.MediaName.Port.Value == 0 && !hasAttribute(media, "bundle-only") {
+			continue
+		}
+		if !hasAttribute(media, sdp.AttrKeyRTCPMux) {
+			return &publishError{http.StatusBadRequest, "Offer's " + media.MediaName.Media + " section lacks a=rtcp-mux: RTCP must share the RTP port"}
+		}
+	}
+	return nil
+}
+
+// hasAttribute reports whether the media section has the attribute key
+func hasAttribute(media *sdp.MediaDescription, key string) bool {
+	_, ok := media.Attribute(key)
+	return ok
+}
+
+// accepts reports whether the Accept header of r allows a response of
+// mediaType, directly or with a wildcard. A request without one accepts
+// anything.
+func accepts(r *http.Request, mediaType string) bool {
+	header := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(header) == "" {
+		return true
+	}
+	kind, _, _ := strings.Cut(mediaType, "/")
+	for _, item := range strings.Split(header, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		// q=0 marks a type as not acceptable
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		if accepted == "*/*" || accepted == kind+"/*" || accepted == mediaType {
+			return true
+		}
+	}
+	return false
+}
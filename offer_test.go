@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   bool
+	}{
+		{name: "no Accept", want: true},
+		{name: "empty", accept: []string{""}, want: true},
+		{name: "exact", accept: []string{"application/sdp"}, want: true},
+		{name: "case insensitive", accept: []string{"Application/SDP"}, want: true},
+		{name: "any", accept: []string{"*/*"}, want: true},
+		{name: "any application", accept: []string{"application/*;q=0.5"}, want: true},
+		{name: "among others", accept: []string{"application/json, application/sdp;q=0.9"}, want: true},
+		{name: "repeated header", accept: []string{"application/json", "application/sdp"}, want: true},
+		{name: "other type", accept: []string{"application/json"}},
+		{name: "refused", accept: []string{"application/sdp;q=0"}},
+		{name: "other kind", accept: []string{"text/*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/whip", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, value := range tt.accept {
+				r.Header.Add("Accept", value)
+			}
+			if got := accepts(r, sdpContentType); got != tt.want {
+				t.Errorf("accepts(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOfferContentType posts offers with various Content-Type and Accept
+// headers to WHIP and WHEP and checks the status and type of the answer
+func TestOfferContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		accept      string
+		wantStatus  int
+	}{
+		{name: "WHIP", path: "/whip/cam", contentType: "application/sdp", wantStatus: http.StatusCreated},
+		{name: "WHIP with parameters", path: "/whip/cam", contentType: "application/sdp; charset=utf-8", wantStatus: http.StatusCreated},
+		{name: "WHIP accepting SDP", path: "/whip/cam", contentType: "application/sdp", accept: "application/sdp", wantStatus: http.StatusCreated},
+		{name: "WHIP accepting anything", path: "/whip/cam", contentType: "application/sdp", accept: "*/*", wantStatus: http.StatusCreated},
+		{name: "WHIP without Content-Type", path: "/whip/cam", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "WHIP as text", path: "/whip/cam", contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "WHIP as an SDP fragment", path: "/whip/cam", contentType: sdpFragContentType, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "WHIP not accepting SDP", path: "/whip/cam", contentType: "application/sdp", accept: "application/json", wantStatus: http.StatusNotAcceptable},
+		{name: "WHEP as text", path: "/whep/cam", contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "WHEP not accepting SDP", path: "/whep/cam", contentType: "application/sdp", accept: "text/*", wantStatus: http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			p := newCodecPublisher(t, webrtc.MimeTypeVP8)
+			header := http.Header{"Content-Type": {tt.contentType}}
+			if tt.accept != "" {
+				header.Set("Accept", tt.accept)
+			}
+			resp, body := postOffer(t, base+tt.path, p.pc, header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("POST %s answered %d: %s, want %d", tt.path, resp.StatusCode, body, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusCreated && resp.Header.Get("Content-Type") != sdpContentType {
+				t.Errorf("answer Content-Type = %q, want %s", resp.Header.Get("Content-Type"), sdpContentType)
+			}
+		})
+	}
+}
+
+// TestRTCPMux publishes audio and video with rtcp-mux, and with the
+// attribute dropped from one section or all, which must be refused before a
+// session starts
+func TestRTCPMux(t *testing.T) {
+	tests := []struct {
+		name       string
+		drop       int
+		wantStatus int
+	}{
+		{name: "rtcp-mux", wantStatus: http.StatusCreated},
+		{name: "without rtcp-mux", drop: -1, wantStatus: http.StatusBadRequest},
+		{name: "one section without rtcp-mux", drop: 1, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			p := newCodecPublisher(t, webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+			offer, err := p.pc.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.pc.SetLocalDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			<-webrtc.GatheringCompletePromise(p.pc)
+			sdp := strings.Replace(p.pc.LocalDescription().SDP, "a=rtcp-mux\r\n", "", tt.drop)
+
+			resp, body := postSDP(t, base+"/whip/cam", p.pc, sdp, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("publish answered %d: %s, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				if !strings.Contains(body, "rtcp-mux") {
+					t.Errorf("refusal %q doesn't name rtcp-mux", body)
+				}
+				if n := sessions.count(); n != 0 {
+					t.Errorf("%d sessions left after the refusal", n)
+				}
+				return
+			}
+			// The answer bundles both sections and muxes their RTCP
+			if !strings.Contains(body, "a=group:BUNDLE 0 1\r\n") || strings.Count(body, "a=rtcp-mux\r\n") != 2 {
+				t.Errorf("answer doesn't bundle and mux both sections:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestReadTimeoutFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: 10 * time.Second},
+		{name: "set", args: []string{"-read-timeout", "2s"}, want: 2 * time.Second},
+		{name: "zero", args: []string{"-read-timeout", "0s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.ReadTimeout != tt.want {
+				t.Errorf("read timeout %v, want %v", cfg.ReadTimeout, tt.want)
+			}
+		})
+	}
+}
+
+// TestSlowBody sends the headers of requests whose body then stalls, sized
+// by Content-Length or chunked, and checks they are answered 408 once
+// -read-timeout passes
+func TestSlowBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{
+			name:    "offer with Content-Length",
+			request: "POST /whip/cam HTTP/1.1\r\nHost: test\r\nContent-Type: application/sdp\r\nContent-Length: 100\r\n\r\nv=0\r\n",
+		},
+		{
+			name:    "chunked offer",
+			request: "POST /whip/cam HTTP/1.1\r\nHost: test\r\nContent-Type: application/sdp\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nv=0\r\n\r\n",
+		},
+		{
+			name:    "ingest request",
+			request: "POST /ingest HTTP/1.1\r\nHost: test\r\nAuthorization: Bearer " + testAdminToken + "\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			setConfig(t, func(c *Config) { c.ReadTimeout = 200 * time.Millisecond })
+			if strings.Contains(tt.request, "/ingest") {
+				useAdminToken(t)
+			}
+			conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			start := time.Now()
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestTimeout {
+				t.Errorf("stalled body answered %d, want %d", resp.StatusCode, http.StatusRequestTimeout)
+			}
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				t.Errorf("answered after %v, before the read timeout", elapsed)
+			}
+			if n := sessions.count(); n != 0 {
+				t.Errorf("%d sessions left after a stalled offer", n)
+			}
+		})
+	}
+}
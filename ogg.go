@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"os"
+	"time"
+)
+
+const (
+	oggPageHeaderSize = 27
+	oggMaxSegments    = 255
+	oggPreSkip        = 3840
+	oggSampleRate     = 48000
+
+	oggFlagBOS = 0x02
+	oggFlagEOS = 0x04
+
+	// Samples of the 20 ms packets filling timestamp gaps
+	oggGapSamples = 960
+)
+
+var errOggPacketTooLarge = errors.New("ogg: packet does not fit in a single page")
+
+// Ogg CRC32: polynomial 0x04c11db7, no reflection, zero initial value
+var oggCRCTable = func() *[256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return &table
+}()
+
+// oggOpusWriter writes Opus packets into an Ogg container (RFC 7845). Every
+// audio packet gets its own page, and the last one is held back so it can
+// carry the EOS flag when the track ends.
+//
+// A jump in the timestamps, left by DTX silence or lost packets, is filled
+// with TOC-only 20 ms packets, which decoders treat as lost and conceal, so
+// the granule positions keep counting the samples of the stream. In-band FEC
+// needs no handling: the redundancy for a lost packet rides in the one after
+// it and is written as received, for the decoder to recover from.
+type oggOpusWriter struct {
+	file      *os.File
+	channels  uint16
+	serial    uint32
+	pageIndex uint32
+	// granulePos counts the samples written; the pages carry it past the
+	// pre-skip, which the decoder drops from the start (RFC 7845 section 4)
+	granulePos uint64
+	pending    []byte
+	pendingPTS time.Duration
+	finalized  bool
+}
+
+// newOggOpusWriter writes the OpusHead and OpusTags header pages
+func newOggOpusWriter(file *os.File, channels uint16) (*oggOpusWriter, error) {
+	w := &oggOpusWriter{file: file, channels: channels, serial: rand.Uint32()}
+	if err := w.writePage(opusHead(channels), oggFlagBOS, 0); err != nil {
+		return nil, err
+	}
+
+	vendor := "mediaserver"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags[0:], "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	binary.LittleEndian.PutUint32(tags[12+len(vendor):], 0) // user comment count
+	if err := w.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// opusHead builds the Opus identification header, also used as the WebM CodecPrivate
+func opusHead(channels uint16) []byte {
+	if channels == 0 {
+		channels = 2
+	}
+	head := make([]byte, 19)
+	copy(head[0:], "OpusHead")
+	head[8] = 1 // version
+	head[9] = uint8(channels)
+	binary.LittleEndian.PutUint16(head[10:], oggPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], oggSampleRate) // input sample rate
+	binary.LittleEndian.PutUint16(head[16:], 0)             // output gain
+	head[18] = 0                                            // channel mapping family
+	return head
+}
+
+// WriteFrame queues an Opus packet, flushing the one before it
+func (w *oggOpusWriter) WriteFrame(frame []byte, pts time.Duration) error {
+	if len(frame) == 0 {
+		return nil
+	}
+	if err := w.flush(0); err != nil {
+		return err
+	}
+	w.pending = append(w.pending[:0], frame...)
+	w.pendingPTS = pts
+	return nil
+}
+
+// Finalize writes the final page with the EOS flag set
+func (w *oggOpusWriter) Finalize() error {
+	if w.finalized {
+		return nil
+	}
+	w.finalized = true
+	if len(w.pending) > 0 {
+		return w.flush(oggFlagEOS)
+	}
+	// Nothing is left to flush, so terminate the stream with an empty page
+	return w.writePage(nil, oggFlagEOS, oggPreSkip+w.granulePos)
+}
+
+// Close finalizes the stream if needed and closes the file
+func (w *oggOpusWriter) Close() error {
+	err := w.Finalize()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *oggOpusWriter) flush(flags byte) error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	// The granule position counts samples up to the end of the packet, taken
+	// from the timestamp so that it never falls behind the stream's clock
+	samples := uint64(opusPacketSamples(w.pending))
+	granulePos := uint64(w.pendingPTS/time.Microsecond)*oggSampleRate/1e6 + samples
+	for granulePos >= w.granulePos+oggGapSamples+samples {
+		if err := w.writePage(w.gapPacket(), 0, oggPreSkip+w.granulePos+oggGapSamples); err != nil {
+			return err
+		}
+		w.granulePos += oggGapSamples
+	}
+	// What remains of the gap is under 20 ms, and a timestamp behind
+	// the samples already written never moves the position backwards
+	w.granulePos = max(granulePos, w.granulePos+samples)
+	if err := w.writePage(w.pending, flags, oggPreSkip+w.granulePos); err != nil {
+		return err
+	}
+	w.pending = w.pending[:0]
+	return nil
+}
+
+// gapPacket returns a TOC-only packet of one 20 ms CELT frame. With no frame
+// data it stands for a lost frame, which the decoder conceals.
+func (w *oggOpusWriter) gapPacket() []byte {
+	toc := byte(31 << 3) // fullband CELT, 20 ms
+	if w.channels != 1 {
+		toc |= 0x04 // stereo
+	}
+	return []byte{toc}
+}
+
+func (w *oggOpusWriter) writePage(packet []byte, flags byte, granulePos uint64) error {
+	// Lacing values: a run of 255s followed by the remainder, which may be zero
+	segments := len(packet)/255 + 1
+	if segments > oggMaxSegments {
+		return errOggPacketTooLarge
+	}
+	page := make([]byte, oggPageHeaderSize+segments+len(packet))
+	copy(page[0:], "OggS")
+	page[4] = 0 // version
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], granulePos)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.pageIndex)
+	page[26] = uint8(segments)
+	for i := 0; i < segments-1; i++ {
+		page[oggPageHeaderSize+i] = 255
+	}
+	page[oggPageHeaderSize+segments-1] = uint8(len(packet) % 255)
+	copy(page[oggPageHeaderSize+segments:], packet)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+
+	if _, err := w.file.Write(page); err != nil {
+		return err
+	}
+	w.pageIndex++
+	return nil
+}
+
+// opusPacketSamples returns the number of 48kHz samples in an Opus packet,
+// read from its TOC byte (RFC 6716 section 3.1)
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frameSamples int
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60 ms
+		frameSamples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10, 20 ms
+		frameSamples = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10, 20 ms
+		frameSamples = []int{120, 240, 480, 960}[config%4]
+	}
+
+	var frames int
+	switch packet[0] & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frameSamples * frames
+}
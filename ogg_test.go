@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// oggPage is a page read back from an Ogg file, with the packet it carries
+type oggPage struct {
+	flags      byte
+	granulePos uint64
+	serial     uint32
+	index      uint32
+	packet     []byte
+}
+
+// readOgg returns the pages of an Ogg file
+func readOgg(t *testing.T, data []byte) []oggPage {
+	t.Helper()
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < oggPageHeaderSize || string(data[:4]) != "OggS" {
+			t.Fatalf("no page at % x", data[:min(len(data), 4)])
+		}
+		segments := int(data[26])
+		size := 0
+		for _, lacing := range data[oggPageHeaderSize : oggPageHeaderSize+segments] {
+			size += int(lacing)
+		}
+		start := oggPageHeaderSize + segments
+		pages = append(pages, oggPage{
+			flags:      data[5],
+			granulePos: binary.LittleEndian.Uint64(data[6:]),
+			serial:     binary.LittleEndian.Uint32(data[14:]),
+			index:      binary.LittleEndian.Uint32(data[18:]),
+			packet:     data[start : start+size],
+		})
+		data = data[start+size:]
+	}
+	return pages
+}
+
+func TestOggOpusWriter(t *testing.T) {
+	// A 20 ms CELT frame
+	frame := []byte{0xf8, 0xff, 0xfe}
+	large := append([]byte{0xf8}, bytes.Repeat([]byte{0x55}, 599)...)
+	// The TOC-only packets filling a gap
+	mono, stereo := []byte{0xf8}, []byte{0xfc}
+
+	// The granule positions count the samples written, before the pre-skip
+	// is added
+	type audioPage struct {
+		granulePos uint64
+		packet     []byte
+	}
+	tests := []struct {
+		name     string
+		channels uint16
+		frames   [][]byte
+		pts      []time.Duration
+		want     []audioPage
+	}{
+		{
+			name:     "contiguous",
+			channels: 2,
+			frames:   [][]byte{frame, frame, frame},
+			pts:      []time.Duration{0, 20 * time.Millisecond, 40 * time.Millisecond},
+			want:     []audioPage{{960, frame}, {1920, frame}, {2880, frame}},
+		},
+		{
+			name:     "gap",
+			channels: 1,
+			frames:   [][]byte{frame, frame},
+			pts:      []time.Duration{0, 60 * time.Millisecond},
+			want:     []audioPage{{960, frame}, {1920, mono}, {2880, mono}, {3840, frame}},
+		},
+		{
+			name:     "DTX with a gap under 20 ms",
+			channels: 2,
+			frames:   [][]byte{frame, frame, frame},
+			pts:      []time.Duration{0, 20 * time.Millisecond, 85 * time.Millisecond},
+			want:     []audioPage{{960, frame}, {1920, frame}, {2880, stereo}, {3840, stereo}, {5040, frame}},
+		},
+		{
+			name:     "timestamp behind the samples written",
+			channels: 2,
+			frames:   [][]byte{frame, frame},
+			pts:      []time.Duration{0, 10 * time.Millisecond},
+			want:     []audioPage{{960, frame}, {1920, frame}},
+		},
+		{
+			name:     "packet over 255 bytes",
+			channels: 2,
+			frames:   [][]byte{large},
+			pts:      []time.Duration{0},
+			want:     []audioPage{{960, large}},
+		},
+		{
+			name:     "no audio",
+			channels: 2,
+			want:     []audioPage{{0, nil}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audio.ogg")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := newOggOpusWriter(file, tt.channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, frame := range tt.frames {
+				if err := w.WriteFrame(frame, tt.pts[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages := readOgg(t, data)
+			if len(pages) != 2+len(tt.want) {
+				t.Fatalf("%d pages, want %d", len(pages), 2+len(tt.want))
+			}
+			for i, page := range pages {
+				if page.index != uint32(i) || page.serial != pages[0].serial {
+					t.Errorf("page %d has index %d and serial %x, want serial %x", i, page.index, page.serial, pages[0].serial)
+				}
+			}
+
+			head, tags := pages[0], pages[1]
+			if head.flags != oggFlagBOS || head.granulePos != 0 {
+				t.Errorf("OpusHead page has flags %x and granule %d, want BOS and 0", head.flags, head.granulePos)
+			}
+			if !bytes.Equal(head.packet, opusHead(tt.channels)) || head.packet[9] != byte(tt.channels) {
+				t.Errorf("OpusHead = % x", head.packet)
+			}
+			if preSkip := binary.LittleEndian.Uint16(head.packet[10:]); preSkip != oggPreSkip {
+				t.Errorf("pre-skip = %d, want %d", preSkip, oggPreSkip)
+			}
+			if !bytes.HasPrefix(tags.packet, []byte("OpusTags")) || tags.flags != 0 {
+				t.Errorf("second page has flags %x and packet % x, want OpusTags", tags.flags, tags.packet)
+			}
+
+			for i, want := range tt.want {
+				page := pages[2+i]
+				wantFlags := byte(0)
+				if i == len(tt.want)-1 {
+					wantFlags = oggFlagEOS
+				}
+				if page.flags != wantFlags || page.granulePos != oggPreSkip+want.granulePos || !bytes.Equal(page.packet, want.packet) {
+					t.Errorf("audio page %d has flags %x, granule %d and %d bytes, want %x, %d and %d",
+						i, page.flags, page.granulePos, len(page.packet), wantFlags, oggPreSkip+want.granulePos, len(want.packet))
+				}
+			}
+		})
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{name: "SILK 10 ms", packet: []byte{0 << 3}, want: 480},
+		{name: "SILK 60 ms", packet: []byte{3 << 3}, want: 2880},
+		{name: "hybrid 20 ms", packet: []byte{13 << 3}, want: 960},
+		{name: "CELT 2.5 ms", packet: []byte{16 << 3}, want: 120},
+		{name: "CELT 20 ms", packet: []byte{31 << 3}, want: 960},
+		{name: "two frames", packet: []byte{31<<3 | 1}, want: 1920},
+		{name: "two frames of different sizes", packet: []byte{31<<3 | 2}, want: 1920},
+		{name: "code 3 with 5 frames", packet: []byte{16<<3 | 3, 5}, want: 600},
+		{name: "code 3 without frame count", packet: []byte{16<<3 | 3}},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := opusPacketSamples(tt.packet); got != tt.want {
+				t.Errorf("opusPacketSamples(% x) = %d, want %d", tt.packet, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOggOpusFinalize checks Finalize ends the stream with the last packet
+// and that Close then only closes the file
+func TestOggOpusFinalize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.ogg")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newOggOpusWriter(file, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := []byte{0xf8, 0xff, 0xfe}
+	for i := range 50 {
+		if err := w.WriteFrame(frame, time.Duration(i)*20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	finalized, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := readOgg(t, finalized)
+	last := pages[len(pages)-1]
+	if len(pages) != 52 || last.flags != oggFlagEOS || last.granulePos != oggPreSkip+oggSampleRate {
+		t.Errorf("%d pages, the last with flags %x and granule %d, want 52 ending with EOS at %d",
+			len(pages), last.flags, last.granulePos, oggPreSkip+oggSampleRate)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if closed, err := os.ReadFile(path); err != nil || !bytes.Equal(closed, finalized) {
+		t.Errorf("Close changed the finalized file: %v", err)
+	}
+}
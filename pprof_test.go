@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "disabled by default"},
+		{name: "set", args: []string{"-pprof-addr", "127.0.0.1:6060"}, want: "127.0.0.1:6060"},
+		{name: "no port", args: []string{"-pprof-addr", "localhost"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.PprofAddr != tt.want {
+				t.Errorf("pprof address %q, want %q", cfg.PprofAddr, tt.want)
+			}
+		})
+	}
+}
+
+// TestPprof checks the profiles are served on their own listener, and
+// never by the WHIP routes
+func TestPprof(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := servePprof(listener)
+	t.Cleanup(func() { server.Close() })
+	public := httptest.NewServer(newRouter())
+	t.Cleanup(public.Close)
+
+	tests := []struct {
+		name       string
+		base       string
+		path       string
+		wantStatus int
+	}{
+		{"index", "http://" + listener.Addr().String(), "/debug/pprof/", http.StatusOK},
+		{"goroutine profile", "http://" + listener.Addr().String(), "/debug/pprof/goroutine?debug=1", http.StatusOK},
+		{"cmdline", "http://" + listener.Addr().String(), "/debug/pprof/cmdline", http.StatusOK},
+		{"not on the WHIP routes", public.URL, "/debug/pprof/", http.StatusNotFound},
+		{"no profile on the WHIP routes", public.URL, "/debug/pprof/goroutine", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(tt.base + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("GET %s answered %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// receptionStats follows the RTP packets of a track as they arrive: how many
+// were received, lost to gaps in the sequence numbers or received out of
+// order, and their interarrival jitter (RFC 3550 section 6.4.1)
+type receptionStats struct {
+	mu        sync.Mutex
+	clockRate uint32
+
+	started bool
+	// first and highest are the first and highest extended sequence
+	// numbers, counting the wraparounds of the 16-bit ones
+	first, highest uint32
+	received       uint64
+	outOfOrder     uint64
+
+	// epoch is the arrival time of the first packet, from which arrivals
+	// are converted to the clock of the RTP timestamps
+	epoch   time.Time
+	transit int64
+	// jitter is in units of the RTP timestamps
+	jitter float64
+}
+
+// receptionInfo is a snapshot of receptionStats
+type receptionInfo struct {
+	Received   uint64
+	Lost       int64
+	OutOfOrder uint64
+	// Jitter is the interarrival jitter in milliseconds
+	Jitter float64
+}
+
+func newReceptionStats(clockRate uint32) *receptionStats {
+	return &receptionStats{clockRate: clockRate}
+}
+
+// push accounts for a packet with sequence number seq and RTP timestamp
+// timestamp, arriving at arrival
+func (s *receptionStats) push(seq uint16, timestamp uint32, arrival time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received++
+
+	if !s.started {
+		s.started = true
+		s.first, s.highest = uint32(seq), uint32(seq)
+		s.epoch = arrival
+		s.transit = s.arrivalUnits(arrival) - int64(timestamp)
+		return
+	}
+
+	// A packet at most half the sequence space ahead moves the highest on,
+	// wrapping around if need be; any other came after a later one
+	if delta := seq - uint16(s.highest); delta != 0 && delta < 1<<15 {
+		s.highest += uint32(delta)
+	} else if delta != 0 {
+		s.outOfOrder++
+	}
+
+	transit := s.arrivalUnits(arrival) - int64(timestamp)
+	d := float64(transit - s.transit)
+	if d < 0 {
+		d = -d
+	}
+	s.transit = transit
+	s.jitter += (d - s.jitter) / 16
+}
+
+// arrivalUnits converts arrival to the clock of the RTP timestamps
+func (s *receptionStats) arrivalUnits(arrival time.Time) int64 {
+	return int64(arrival.Sub(s.epoch)) * int64(s.clockRate) / int64(time.Second)
+}
+
+func (s *receptionStats) info() receptionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := receptionInfo{Received: s.received, OutOfOrder: s.outOfOrder}
+	if !s.started {
+		return info
+	}
+	// Duplicates are counted as received, so they may outnumber the lost packets
+	expected := int64(s.highest-s.first) + 1
+	info.Lost = max(expected-int64(s.received), 0)
+	if s.clockRate > 0 {
+		info.Jitter = s.jitter / float64(s.clockRate) * 1000
+	}
+	return info
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReceptionStats(t *testing.T) {
+	// packet arrives at arrival ms, its timestamp in the 1 kHz clock of the test
+	type packet struct {
+		seq       uint16
+		timestamp uint32
+		arrival   int
+	}
+	tests := []struct {
+		name    string
+		packets []packet
+		want    receptionInfo
+	}{
+		{name: "none"},
+		{
+			name:    "steady",
+			packets: []packet{{0, 0, 0}, {1, 20, 20}, {2, 40, 40}, {3, 60, 60}},
+			want:    receptionInfo{Received: 4},
+		},
+		{
+			name:    "gap",
+			packets: []packet{{0, 0, 0}, {1, 20, 20}, {4, 80, 80}, {5, 100, 100}},
+			want:    receptionInfo{Received: 4, Lost: 2},
+		},
+		{
+			name:    "reordered",
+			packets: []packet{{0, 0, 0}, {2, 40, 40}, {1, 20, 40}, {3, 60, 60}},
+			// 20 ms late, then back on time: 20/16, then 20/16 + (20 - 20/16)/16
+			want: receptionInfo{Received: 4, OutOfOrder: 1, Jitter: 2.421875},
+		},
+		{
+			name:    "sequence wraparound",
+			packets: []packet{{65534, 0, 0}, {65535, 20, 20}, {0, 40, 40}, {2, 80, 80}},
+			want:    receptionInfo{Received: 4, Lost: 1},
+		},
+		{
+			name:    "duplicate",
+			packets: []packet{{0, 0, 0}, {1, 20, 20}, {1, 20, 20}, {2, 40, 40}},
+			want:    receptionInfo{Received: 4},
+		},
+		{
+			name:    "late packet",
+			packets: []packet{{0, 0, 0}, {1, 20, 30}, {2, 40, 40}},
+			// 10/16, then 10/16 + (10 - 10/16)/16
+			want: receptionInfo{Received: 3, Jitter: 1.2109375},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newReceptionStats(1000)
+			start := time.Now()
+			for _, p := range tt.packets {
+				stats.push(p.seq, p.timestamp, start.Add(time.Duration(p.arrival)*time.Millisecond))
+			}
+			got := stats.info()
+			if got.Received != tt.want.Received || got.Lost != tt.want.Lost || got.OutOfOrder != tt.want.OutOfOrder || math.Abs(got.Jitter-tt.want.Jitter) > 1e-9 {
+				t.Errorf("info() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
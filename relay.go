@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// relayQueueSize is how many packets a WHEP viewer may fall behind before
+// packets are dropped for it
+const relayQueueSize = 512
+
+// Published tracks of each stream, keyed by stream key
+var (
+	relayMu sync.Mutex
+	relays  = map[string][]*relayTrack{}
+)
+
+// relayTrack fans out the RTP of one published track to the WHEP viewers of
+// its stream. Every viewer has a queue of its own, so a slow one only loses
+// its own packets and never holds up the publisher or the other viewers.
+type relayTrack struct {
+	streamKey   string
+	codec       webrtc.RTPCodecCapability
+	payloadType webrtc.PayloadType
+	id          string
+	streamID    string
+
+	// requestKeyframe asks the publisher for a keyframe when a viewer joins
+	requestKeyframe func()
+
+	mu          sync.Mutex
+	subscribers map[*relaySubscriber]struct{}
+}
+
+// relayWriter takes the RTP packets relayed to a viewer, such as the track of
+// a WHEP viewer's PeerConnection. A writer that is also an io.Closer is closed
+// once the forwarding to it ends.
+type relayWriter interface {
+	Write(packet []byte) (int, error)
+}
+
+type relaySubscriber struct {
+	queue   chan []byte
+	dropped int
+}
+
+// publishTrack offers track to the viewers of streamKey until unpublish is called
+func publishTrack(streamKey string, track *webrtc.TrackRemote, requestKeyframe func()) *relayTrack {
+	t := &relayTrack{
+		streamKey:       streamKey,
+		codec:           track.Codec().RTPCodecCapability,
+		payloadType:     track.PayloadType(),
+		id:              track.ID(),
+		streamID:        track.StreamID(),
+		requestKeyframe: requestKeyframe,
+		subscribers:     map[*relaySubscriber]struct{}{},
+	}
+	relayMu.Lock()
+	defer relayMu.Unlock()
+	relays[streamKey] = append(relays[streamKey], t)
+	return t
+}
+
+// unpublish withdraws the track and ends the forwarding to its viewers
+func (t *relayTrack) unpublish() {
+	relayMu.Lock()
+	tracks := relays[t.streamKey]
+	for i, track := range tracks {
+		if track == t {
+			tracks = append(tracks[:i:i], tracks[i+1:]...)
+			break
+		}
+	}
+	if len(tracks) == 0 {
+		delete(relays, t.streamKey)
+	} else {
+		relays[t.streamKey] = tracks
+	}
+	relayMu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subscribers {
+		close(sub.queue)
+	}
+	clear(t.subscribers)
+}
+
+// publishedTracks returns a snapshot of the tracks published on streamKey
+func publishedTracks(streamKey string) []*relayTrack {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+	return append([]*relayTrack(nil), relays[streamKey]...)
+}
+
+// write queues an RTP packet for every viewer without waiting on any of them
+func (t *relayTrack) write(packet []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subscribers) == 0 {
+		return
+	}
+	// Viewers only read the packet, so one copy is shared by all of them
+	packet = append([]byte(nil), packet...)
+	for sub := range t.subscribers {
+		select {
+		case sub.queue <- packet:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// subscribe forwards the track to viewer until the returned function is
+// called or the track is unpublished
+func (t *relayTrack) subscribe(viewer relayWriter) (unsubscribe func()) {
+	sub := &relaySubscriber{queue: make(chan []byte, relayQueueSize)}
+	t.mu.Lock()
+	t.subscribers[sub] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		for packet := range sub.queue {
+			if _, err := viewer.Write(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				slog.Warn("Failed to relay RTP", "stream", t.streamKey, "track", t.id, "error", err)
+			}
+		}
+		if closer, ok := viewer.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+
+	// Viewers joining mid-stream can't decode until the next keyframe
+	if t.requestKeyframe != nil {
+		t.requestKeyframe()
+	}
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.subscribers[sub]; !ok {
+			return
+		}
+		delete(t.subscribers, sub)
+		close(sub.queue)
+		if sub.dropped > 0 {
+			slog.Warn("Dropped RTP for a slow viewer", "stream", t.streamKey, "track", t.id, "packets", sub.dropped)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// relayViewer collects the sequence numbers of the packets relayed to it. A
+// blocked viewer doesn't take any until it is released.
+type relayViewer struct {
+	mu      sync.Mutex
+	packets []int
+	release chan struct{}
+}
+
+func (v *relayViewer) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	if v.release != nil {
+		<-v.release
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.packets = append(v.packets, int(header.SequenceNumber))
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (v *relayViewer) Write(b []byte) (int, error) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return v.WriteRTP(&packet.Header, packet.Payload)
+}
+
+func (v *relayViewer) received() []int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return slices.Clone(v.packets)
+}
+
+// relayViewerContext binds a viewer's local track as a PeerConnection
+// would, writing its packets to a relayViewer
+type relayViewerContext struct {
+	viewer *relayViewer
+}
+
+func (c relayViewerContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: relayTestCodec, PayloadType: 96}}
+}
+
+func (relayViewerContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (relayViewerContext) SSRC() webrtc.SSRC                                      { return 1 }
+func (relayViewerContext) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (relayViewerContext) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c relayViewerContext) WriteStream() webrtc.TrackLocalWriter                 { return c.viewer }
+func (relayViewerContext) ID() string                                             { return "viewer" }
+func (relayViewerContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+var relayTestCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+// newRelayViewerTrack returns the local track of a viewer, bound to v
+func newRelayViewerTrack(t *testing.T, v *relayViewer) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	local, err := webrtc.NewTrackLocalStaticRTP(relayTestCodec, "video", "cam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Bind(relayViewerContext{viewer: v}); err != nil {
+		t.Fatal(err)
+	}
+	return local
+}
+
+// TestRelayTrack relays packets of one publisher to several viewers joining,
+// leaving or falling behind, and checks what each of them got
+func TestRelayTrack(t *testing.T) {
+	type viewer struct {
+		// join and leave are the packets the viewer subscribes before and
+		// unsubscribes after, leave being 0 for a viewer that stays
+		join, leave int
+		blocked     bool
+	}
+	tests := []struct {
+		name    string
+		packets int
+		viewers []viewer
+	}{
+		{name: "three viewers", packets: 100, viewers: []viewer{{}, {}, {}}},
+		{name: "slow viewer", packets: 2 * relayQueueSize, viewers: []viewer{{blocked: true}, {}, {}}},
+		{name: "joins mid-stream", packets: 100, viewers: []viewer{{}, {join: 40}}},
+		{name: "leaves mid-stream", packets: 100, viewers: []viewer{{}, {leave: 60}}},
+		{name: "no viewers", packets: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keyframeRequests int
+			track := &relayTrack{
+				streamKey:       "cam",
+				id:              "video",
+				requestKeyframe: func() { keyframeRequests++ },
+				subscribers:     map[*relaySubscriber]struct{}{},
+			}
+			viewers := make([]*relayViewer, len(tt.viewers))
+			locals := make([]*webrtc.TrackLocalStaticRTP, len(tt.viewers))
+			unsubscribe := make([]func(), len(tt.viewers))
+			for i, v := range tt.viewers {
+				viewers[i] = &relayViewer{}
+				if v.blocked {
+					viewers[i].release = make(chan struct{})
+				}
+				locals[i] = newRelayViewerTrack(t, viewers[i])
+			}
+			// want are the packets each viewer should have once caught up
+			want := func(i, written int) []int {
+				v := tt.viewers[i]
+				end := written
+				if v.leave > 0 {
+					end = min(end, v.leave)
+				}
+				var packets []int
+				for n := v.join; n < end; n++ {
+					packets = append(packets, n)
+				}
+				return packets
+			}
+
+			start := time.Now()
+			for n := 0; n <= tt.packets; n++ {
+				for i, v := range tt.viewers {
+					if v.join == n {
+						unsubscribe[i] = track.subscribe(locals[i])
+					}
+					if v.leave > 0 && v.leave == n {
+						unsubscribe[i]()
+					}
+				}
+				// Let viewers that keep up catch up, so only the blocked one drops packets
+				if n%64 == 0 || n == tt.packets {
+					for i, v := range tt.viewers {
+						if !v.blocked && n >= v.join {
+							waitFor(t, "the viewers to catch up", func() bool {
+								got := viewers[i].received()
+								return len(got) == len(want(i, n))
+							})
+						}
+					}
+				}
+				if n < tt.packets {
+					packet, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(n)}}).Marshal()
+					if err != nil {
+						t.Fatal(err)
+					}
+					track.write(packet)
+				}
+			}
+			if elapsed := time.Since(start); elapsed > testTimeout {
+				t.Errorf("publishing took %v", elapsed)
+			}
+			if keyframeRequests != len(tt.viewers) {
+				t.Errorf("%d keyframe requests, want one per viewer joining", keyframeRequests)
+			}
+
+			for i, v := range tt.viewers {
+				if v.blocked {
+					close(viewers[i].release)
+				}
+			}
+			track.unpublish()
+			for i, v := range tt.viewers {
+				if v.blocked {
+					// The queue, and the packet the viewer was blocked writing
+					waitFor(t, "the slow viewer to catch up", func() bool { return len(viewers[i].received()) >= relayQueueSize })
+					if got := viewers[i].received(); len(got) > relayQueueSize+1 || !slices.IsSorted(got) {
+						t.Errorf("slow viewer got %d packets, want at most %d in order", len(got), relayQueueSize+1)
+					}
+					continue
+				}
+				got := viewers[i].received()
+				if w := want(i, tt.packets); !slices.Equal(got, w) {
+					t.Errorf("viewer %d got %d packets, want %d", i, len(got), len(w))
+				}
+			}
+		})
+	}
+}
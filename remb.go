@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// How often the bitrate cap is sent to the publisher
+const rembInterval = time.Second
+
+// limitBitrate asks the publisher to keep its upstream bitrate under
+// MaxBitrate with a REMB for ssrc every rembInterval, until ctx is done.
+// Browsers take the REMB as an upper bound for their encoders, so the cap is
+// sent as is; a session still received over it is logged once per crossing.
+func (s *session) limitBitrate(ctx context.Context, logger *slog.Logger, ssrc webrtc.SSRC) {
+	ticker := time.NewTicker(rembInterval)
+	defer ticker.Stop()
+
+	over := false
+	for {
+		if err := sendREMB(s.peerConnection, ssrc, config.MaxBitrate); err != nil {
+			logger.Warn("Failed to send REMB", "error", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			bitrate := s.bitrate(now)
+			if bitrate > config.MaxBitrate && !over {
+				logger.Warn("Publisher over -max-bitrate", "bps", bitrate, "max_bps", config.MaxBitrate)
+			}
+			over = bitrate > config.MaxBitrate
+		}
+	}
+}
+
+// sendREMB advertises bitrate, in bits per second, as the most the server
+// should receive on ssrc
+func sendREMB(peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC, bitrate int64) error {
+	return peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate: float32(bitrate),
+		SSRCs:   []uint32{uint32(ssrc)},
+	}})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// readREMBs passes on the bitrates of the REMBs the server sends to sender
+func readREMBs(sender *webrtc.RTPSender) <-chan float32 {
+	rembs := make(chan float32, 16)
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				if remb, ok := packet.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+					select {
+					case rembs <- remb.Bitrate:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return rembs
+}
+
+func TestMaxBitrate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBitrate int64
+	}{
+		{name: "capped", maxBitrate: 500_000},
+		{name: "uncapped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxBitrate = tt.maxBitrate })
+			base := startServer(t)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			rembs := readREMBs(p.senders[0])
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.play(t, rembInterval+500*time.Millisecond)
+			}()
+			defer func() { <-done }()
+
+			if tt.maxBitrate == 0 {
+				<-done
+				select {
+				case bitrate := <-rembs:
+					t.Errorf("REMB of %v bps sent without -max-bitrate", bitrate)
+				default:
+				}
+				return
+			}
+			for range 2 {
+				select {
+				case bitrate := <-rembs:
+					if int64(bitrate) != tt.maxBitrate {
+						t.Errorf("REMB of %v bps, want %d", bitrate, tt.maxBitrate)
+					}
+				case <-time.After(testTimeout):
+					t.Fatal("no REMB sent")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+// resampler converts interleaved 16-bit PCM between sample rates and channel
+// counts, a chunk at a time. Channels are mixed first: downmixed to mono by
+// averaging, or mono copied to every channel. Output samples are then
+// interpolated linearly between the input samples around them, their
+// positions kept as exact fractions of the input so ratios such as 441/80
+// don't drift.
+type resampler struct {
+	inRate, outRate         int
+	inChannels, outChannels int
+
+	// pending are the mixed input frames not yet passed by the output,
+	// the first one numbered consumed
+	pending  []int16
+	consumed int64
+	// produced counts the output frames
+	produced int64
+}
+
+func newResampler(inRate, inChannels, outRate, outChannels int) *resampler {
+	return &resampler{inRate: inRate, outRate: outRate, inChannels: inChannels, outChannels: outChannels}
+}
+
+// process returns the output frames the input frames in pcm complete. The
+// last output frames wait for the input after them.
+func (r *resampler) process(pcm []int16) []int16 {
+	r.pending = append(r.pending, r.mix(pcm)...)
+	frames := int64(len(r.pending) / r.outChannels)
+
+	var out []int16
+	for {
+		// Output frame k falls k*inRate/outRate frames into the input
+		position := r.produced * int64(r.inRate)
+		index, frac := position/int64(r.outRate)-r.consumed, position%int64(r.outRate)
+		if index >= frames || frac != 0 && index+1 >= frames {
+			break
+		}
+		for c := range r.outChannels {
+			sample := int64(r.pending[index*int64(r.outChannels)+int64(c)])
+			if frac != 0 {
+				next := int64(r.pending[(index+1)*int64(r.outChannels)+int64(c)])
+				sample += (next - sample) * frac / int64(r.outRate)
+			}
+			out = append(out, int16(sample))
+		}
+		r.produced++
+	}
+
+	// Drop the frames before the one the next output frame starts from
+	drop := r.produced*int64(r.inRate)/int64(r.outRate) - r.consumed
+	drop = min(drop, frames)
+	r.pending = append(r.pending[:0], r.pending[drop*int64(r.outChannels):]...)
+	r.consumed += drop
+	return out
+}
+
+// mix converts interleaved frames of inChannels into frames of outChannels
+func (r *resampler) mix(pcm []int16) []int16 {
+	if r.inChannels == r.outChannels {
+		return pcm
+	}
+	frames := len(pcm) / r.inChannels
+	mixed := make([]int16, 0, frames*r.outChannels)
+	for i := range frames {
+		frame := pcm[i*r.inChannels : (i+1)*r.inChannels]
+		var sum int
+		for _, sample := range frame {
+			sum += int(sample)
+		}
+		mono := int16(sum / r.inChannels)
+		for range r.outChannels {
+			mixed = append(mixed, mono)
+		}
+	}
+	return mixed
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestResampler(t *testing.T) {
+	tests := []struct {
+		name                 string
+		inRate, inChannels   int
+		outRate, outChannels int
+		frames               int
+		input                func(frame, channel int) int16
+		want                 func(frame, channel int) int16
+		wantFrames           int
+	}{
+		{
+			// Each stereo pair averages to 2i+1, and every third frame is kept
+			name: "48 kHz stereo to 16 kHz mono", inRate: 48000, inChannels: 2, outRate: 16000, outChannels: 1,
+			frames:     4800,
+			input:      func(i, c int) int16 { return int16(2*i + 2*c) },
+			want:       func(k, _ int) int16 { return int16(6*k + 1) },
+			wantFrames: 1600,
+		},
+		{
+			name: "8 kHz to 16 kHz", inRate: 8000, inChannels: 1, outRate: 16000, outChannels: 1,
+			frames:     100,
+			input:      func(i, _ int) int16 { return int16(10 * i) },
+			want:       func(k, _ int) int16 { return int16(5 * k) },
+			wantFrames: 199,
+		},
+		{
+			// 441/80 output frames per input frame, interpolated along a ramp
+			name: "8 kHz to 44.1 kHz", inRate: 8000, inChannels: 1, outRate: 44100, outChannels: 1,
+			frames:     8000,
+			input:      func(i, _ int) int16 { return int16(4 * i) },
+			want:       func(k, _ int) int16 { return int16(k * 8000 * 4 / 44100) },
+			wantFrames: 7999*44100/8000 + 1,
+		},
+		{
+			name: "mono to stereo", inRate: 8000, inChannels: 1, outRate: 8000, outChannels: 2,
+			frames:     10,
+			input:      func(i, _ int) int16 { return int16(-i) },
+			want:       func(k, _ int) int16 { return int16(-k) },
+			wantFrames: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input []int16
+			for i := range tt.frames {
+				for c := range tt.inChannels {
+					input = append(input, tt.input(i, c))
+				}
+			}
+			// Chunks of a prime number of frames split the ratio at every offset
+			r := newResampler(tt.inRate, tt.inChannels, tt.outRate, tt.outChannels)
+			var got []int16
+			for chunk := range slices.Chunk(input, 7*tt.inChannels) {
+				got = append(got, r.process(chunk)...)
+			}
+			if len(got) != tt.wantFrames*tt.outChannels {
+				t.Fatalf("%d samples out, want %d", len(got), tt.wantFrames*tt.outChannels)
+			}
+			for k := range tt.wantFrames {
+				for c := range tt.outChannels {
+					if got, want := got[k*tt.outChannels+c], tt.want(k, c); got != want {
+						t.Fatalf("frame %d channel %d = %d, want %d", k, c, got, want)
+					}
+				}
+			}
+			whole := newResampler(tt.inRate, tt.inChannels, tt.outRate, tt.outChannels).process(input)
+			if !slices.Equal(got, whole) {
+				t.Error("output in chunks differs from the output in one go")
+			}
+		})
+	}
+}
+
+// TestWAVResampling records G.711 to WAV converted to 16 kHz stereo and
+// checks the format header and that the audio keeps its length
+func TestWAVResampling(t *testing.T) {
+	setConfig(t, func(c *Config) { c.WAVSampleRate, c.WAVChannels = 16000, 2 })
+	dir := t.TempDir()
+	writer, depacketizer, err := newTrackWriter(filepath.Join(dir, "audio"), webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: g711SampleRate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second of 20 ms packets, with 3 packets lost halfway
+	for i := range 50 {
+		if i >= 25 && i < 28 {
+			continue
+		}
+		frame, err := depacketizer.Unmarshal(bytes.Repeat([]byte{0x80}, 160))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteFrame(frame, time.Duration(i)*20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "audio.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < wavHeaderSize {
+		t.Fatalf("file of %d bytes", len(data))
+	}
+	for _, field := range []struct {
+		name   string
+		offset int
+		size   int
+		want   uint32
+	}{
+		{"channels", 22, 2, 2},
+		{"sample rate", 24, 4, 16000},
+		{"byte rate", 28, 4, 64000},
+		{"block align", 32, 2, 4},
+		{"bits per sample", 34, 2, 16},
+		{"data size", 40, 4, uint32(len(data) - wavHeaderSize)},
+	} {
+		got := uint32(binary.LittleEndian.Uint16(data[field.offset:]))
+		if field.size == 4 {
+			got = binary.LittleEndian.Uint32(data[field.offset:])
+		}
+		if got != field.want {
+			t.Errorf("%s = %d, want %d", field.name, got, field.want)
+		}
+	}
+	// 8000 samples in make 15999 at twice the rate, the last one waiting
+	// for the input after it
+	if frames := (len(data) - wavHeaderSize) / 4; frames != 15999 {
+		t.Errorf("%d frames recorded, want 15999", frames)
+	}
+}
+
+func TestWAVFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "speech", args: []string{"-wav-sample-rate", "16000", "-wav-channels", "1"}},
+		{name: "rate too low", args: []string{"-wav-sample-rate", "4000"}, wantErr: true},
+		{name: "too many channels", args: []string{"-wav-channels", "6"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
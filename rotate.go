@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeWaiter is implemented by writers that hold back the start of a new
+// segment until the next video keyframe, so the track can ask for one
+type keyframeWaiter interface {
+	awaitingKeyframe() bool
+}
+
+// rotationKeyframeWait bounds how long a full segment waits for a video
+// keyframe, which the track asks the publisher for meanwhile. Past it, the
+// next segment starts on whatever frame comes next rather than never.
+const rotationKeyframeWait = 5 * time.Second
+
+// rotationEnabled reports whether recordings are split into segment files
+func rotationEnabled() bool {
+	return config.MaxFileDuration > 0 || config.MaxFileSize > 0
+}
+
+// rotationDue reports whether a segment that has run for elapsed and holds
+// size bytes has crossed -max-file-duration or -max-file-size
+func rotationDue(elapsed time.Duration, size int64) bool {
+	return config.MaxFileDuration > 0 && elapsed >= config.MaxFileDuration ||
+		config.MaxFileSize > 0 && size >= config.MaxFileSize
+}
+
+// segmentName numbers path for segment n, ahead of its extension
+func segmentName(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%03d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// newSegmentedTrackWriter is newTrackWriter, splitting the recording into
+// numbered segment files while rotation is enabled
+func newSegmentedTrackWriter(fileName string, codec webrtc.RTPCodecParameters) (mediaWriter, rtp.Depacketizer, error) {
+	if !rotationEnabled() {
+		return newTrackWriter(fileName, codec)
+	}
+	first, depacketizer, err := newTrackWriter(segmentName(fileName, 1), codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &segmentWriter{
+		current:  first,
+		segment:  1,
+		mimeType: codec.MimeType,
+		video:    strings.HasPrefix(codec.MimeType, "video/"),
+		open: func(n int) (mediaWriter, error) {
+			writer, _, err := newTrackWriter(segmentName(fileName, n), codec)
+			return writer, err
+		},
+	}
+	return w, depacketizer, nil
+}
+
+// segmentWriter closes its file and opens the next one once a segment is
+// full. Video rotates on a keyframe so every segment decodes on its own,
+// waiting rotationKeyframeWait at most, and each segment's timestamps start
+// from zero.
+type segmentWriter struct {
+	current  mediaWriter
+	open     func(n int) (mediaWriter, error)
+	segment  int
+	mimeType string
+	video    bool
+
+	started bool
+	start   time.Duration
+	size    int64
+	due     bool
+	dueAt   time.Duration
+}
+
+func (w *segmentWriter) WriteFrame(frame []byte, pts time.Duration) error {
+	if !w.started {
+		w.started = true
+		w.start = pts
+	}
+	if w.due && (!w.video || isKeyframe(w.mimeType, frame) || pts-w.dueAt >= rotationKeyframeWait) {
+		if err := w.rotate(pts); err != nil {
+			return err
+		}
+	}
+
+	if err := w.current.WriteFrame(frame, pts-w.start); err != nil {
+		return err
+	}
+	w.size += int64(len(frame))
+	if !w.due && rotationDue(pts-w.start, w.size) {
+		w.due, w.dueAt = true, pts
+	}
+	return nil
+}
+
+// rotate finalizes the current segment and opens the next, starting at pts
+func (w *segmentWriter) rotate(pts time.Duration) error {
+	if err := w.current.Close(); err != nil {
+		return err
+	}
+	next, err := w.open(w.segment + 1)
+	if err != nil {
+		return err
+	}
+	w.current = next
+	w.segment++
+	w.start = pts
+	w.size = 0
+	w.due = false
+	return nil
+}
+
+func (w *segmentWriter) awaitingKeyframe() bool {
+	return w.due && w.video
+}
+
+// Finalize completes the container of the current segment
+func (w *segmentWriter) Finalize() error {
+	if f, ok := w.current.(finalizer); ok {
+		return f.Finalize()
+	}
+	return nil
+}
+
+func (w *segmentWriter) Close() error {
+	return w.current.Close()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestSegmentName(t *testing.T) {
+	tests := []struct {
+		path string
+		n    int
+		want string
+	}{
+		{path: "/rec/video.ivf", n: 1, want: "/rec/video_001.ivf"},
+		{path: "/rec.d/audio.ogg", n: 12, want: "/rec.d/audio_012.ogg"},
+		{path: "/rec/video", n: 1000, want: "/rec/video_1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := segmentName(tt.path, tt.n); got != tt.want {
+				t.Errorf("segmentName(%q, %d) = %q, want %q", tt.path, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotationDue(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxDuration time.Duration
+		maxSize     int64
+		elapsed     time.Duration
+		size        int64
+		want        bool
+	}{
+		{name: "disabled", elapsed: time.Hour, size: 1 << 40},
+		{name: "under both", maxDuration: time.Minute, maxSize: 1000, elapsed: time.Second, size: 999},
+		{name: "duration reached", maxDuration: time.Minute, elapsed: time.Minute, want: true},
+		{name: "size reached", maxSize: 1000, size: 1000, want: true},
+		{name: "size reached under the duration", maxDuration: time.Minute, maxSize: 1000, elapsed: time.Second, size: 2000, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxFileDuration, c.MaxFileSize = tt.maxDuration, tt.maxSize })
+			if got := rotationDue(tt.elapsed, tt.size); got != tt.want {
+				t.Errorf("rotationDue(%v, %d) = %v, want %v", tt.elapsed, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSegmentWriter records 30 fps VP8 through a segment writer and checks
+// where the segments were split
+func TestSegmentWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxDuration time.Duration
+		maxSize     int64
+		frames      int
+		// keyframes is the interval of the keyframes, none but the first when 0
+		keyframes int
+		// want is the number of frames of each segment, nil without rotation
+		want []int
+		// wantKeyframes is whether every segment starts on a keyframe
+		wantKeyframes bool
+	}{
+		{name: "disabled", frames: 60, keyframes: 30},
+		{name: "size", maxSize: 1, frames: 90, keyframes: 30, want: []int{30, 30, 30}, wantKeyframes: true},
+		{name: "duration", maxDuration: 500 * time.Millisecond, frames: 90, keyframes: 10, want: []int{20, 20, 20, 20, 10}, wantKeyframes: true},
+		{name: "late keyframe", maxDuration: time.Second, frames: 180, keyframes: 90, want: []int{90, 90}, wantKeyframes: true},
+		{name: "no keyframe in time", maxSize: 1, frames: 200, want: []int{150, 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxFileDuration, c.MaxFileSize = tt.maxDuration, tt.maxSize })
+			fileName := filepath.Join(t.TempDir(), "video")
+			writer, _, err := newSegmentedTrackWriter(fileName, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.frames {
+				frame := testVP8Interframe
+				if i == 0 || tt.keyframes > 0 && i%tt.keyframes == 0 {
+					frame = testVP8Keyframe
+				}
+				if err := writer.WriteFrame(frame, time.Duration(i)*time.Second/30); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			paths := []string{fileName + ".ivf"}
+			want := []int{tt.frames}
+			if tt.want != nil {
+				paths = nil
+				for n := range tt.want {
+					paths = append(paths, segmentName(fileName+".ivf", n+1))
+				}
+				want = tt.want
+			}
+			var got []int
+			for _, path := range paths {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _, _, _, frames := readIVF(t, data)
+				got = append(got, len(frames))
+				if len(frames) == 0 {
+					continue
+				}
+				if frames[0].timestamp != 0 {
+					t.Errorf("%s starts at %d, want 0", filepath.Base(path), frames[0].timestamp)
+				}
+				if tt.wantKeyframes && !isKeyframe(webrtc.MimeTypeVP8, frames[0].data) {
+					t.Errorf("%s doesn't start on a keyframe", filepath.Base(path))
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("segments of %v frames, want %v", got, want)
+			}
+			if extra, _ := filepath.Glob(segmentName(fileName+".ivf", len(want)+1)); len(extra) != 0 {
+				t.Errorf("unexpected segment %s", extra[0])
+			}
+		})
+	}
+}
+
+// TestRotationRecording publishes with a small -max-file-size and checks the
+// recording was split into several valid segments, each starting on a
+// keyframe
+func TestRotationRecording(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxFileSize = 1 })
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	p.play(t, 2500*time.Millisecond)
+	p.stop(t, base)
+
+	paths, err := filepath.Glob(filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"), "recording_[0-9][0-9][0-9].webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("recorded %v, want several segments", paths)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, blocks := readWebM(t, data)
+		if len(blocks) == 0 {
+			t.Errorf("%s holds no frames", filepath.Base(path))
+			continue
+		}
+		if !blocks[0].keyframe {
+			t.Errorf("%s doesn't start on a keyframe", filepath.Base(path))
+		}
+	}
+}
+
+// TestWebMRotationKeyframeWait rotates a WebM recording whose keyframes come
+// later than rotationKeyframeWait, or sooner, and checks where the segments
+// were split
+func TestWebMRotationKeyframeWait(t *testing.T) {
+	tests := []struct {
+		name      string
+		keyframes int
+		// want is the number of frames of each segment
+		want          []int
+		wantKeyframes bool
+	}{
+		{name: "keyframe in time", keyframes: 90, want: []int{90, 90, 60}, wantKeyframes: true},
+		// The first segment is found full on its second frame, written
+		// after the header
+		{name: "no keyframe in time", keyframes: 240, want: []int{151, 89}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxFileSize = 1 })
+			path := filepath.Join(t.TempDir(), "recording.webm")
+			muxer := newWebMMuxer(path, 1)
+			writer, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range webmFrames([]string{webrtc.MimeTypeVP8}, 8*time.Second, tt.keyframes) {
+				if err := writer.WriteFrame(f.frame, f.pts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int
+			for n := 1; ; n++ {
+				data, err := os.ReadFile(segmentName(path, n))
+				if os.IsNotExist(err) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, blocks := readWebM(t, data)
+				if len(blocks) == 0 {
+					t.Fatalf("segment %d holds no frames", n)
+				}
+				got = append(got, len(blocks))
+				if tt.wantKeyframes && !blocks[0].keyframe {
+					t.Errorf("segment %d doesn't start on a keyframe", n)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("segments of %v frames, want %v", got, tt.want)
+			}
+		})
+	}
+}
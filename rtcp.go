@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// requestKeyframes sends a Picture Loss Indication right away and then every
+// PLIInterval until ctx is cancelled or PLIMaxRetries requests have been sent
+func requestKeyframes(ctx context.Context, logger *slog.Logger, peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC) {
+	if config.PLIMaxRetries == 0 {
+		return
+	}
+	ticker := time.NewTicker(config.PLIInterval)
+	defer ticker.Stop()
+
+	for sent := 0; sent < config.PLIMaxRetries; sent++ {
+		if err := sendPLI(peerConnection, ssrc); err != nil {
+			logger.Warn("Failed to send PLI", "error", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	logger.Warn("No keyframe after PLI requests", "requests", config.PLIMaxRetries)
+}
+
+// requestPeriodicKeyframes sends a Picture Loss Indication every interval
+// until ctx is cancelled
+func requestPeriodicKeyframes(ctx context.Context, logger *slog.Logger, peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := sendPLI(peerConnection, ssrc); err != nil {
+			logger.Warn("Failed to send PLI", "error", err)
+			return
+		}
+	}
+}
+
+// sendPLI asks the publisher of ssrc for a keyframe with a Picture Loss Indication
+func sendPLI(peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC) error {
+	return peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}})
+}
+
+// startKeyframeRequests runs requestKeyframes in the background until the
+// returned function is called or ctx is cancelled
+func startKeyframeRequests(ctx context.Context, logger *slog.Logger, peerConnection *webrtc.PeerConnection, ssrc webrtc.SSRC) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go requestKeyframes(ctx, logger, peerConnection, ssrc)
+	return cancel
+}
+
+// drainRTCP reads the RTCP arriving for one track of a receiver, picked by its
+// simulcast RID, so the interceptors see sender reports until it is stopped.
+// onSenderReport, if set, is handed each sender report about the track.
+func drainRTCP(receiver *webrtc.RTPReceiver, rid string, onSenderReport func(*rtcp.SenderReport)) {
+	for {
+		packets, _, err := receiver.ReadSimulcastRTCP(rid)
+		if err != nil {
+			return
+		}
+		if onSenderReport == nil {
+			continue
+		}
+		for _, packet := range packets {
+			if report, ok := packet.(*rtcp.SenderReport); ok {
+				onSenderReport(report)
+			}
+		}
+	}
+}
+
+// drainRTP reads and drops the packets of a track that isn't recorded, so the
+// interceptors keep generating receiver reports for it. onPacket runs after each read.
+func drainRTP(track *webrtc.TrackRemote, onPacket func()) {
+	buf := make([]byte, config.RTPBufferSize)
+	for {
+		if _, _, err := track.Read(buf); err != nil {
+			return
+		}
+		onPacket()
+	}
+}
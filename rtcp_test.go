@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// countPLIs counts the Picture Loss Indications the server sends to sender
+func countPLIs(sender *webrtc.RTPSender) *atomic.Int32 {
+	var plis atomic.Int32
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				if _, ok := packet.(*rtcp.PictureLossIndication); ok {
+					plis.Add(1)
+				}
+			}
+		}
+	}()
+	return &plis
+}
+
+func TestKeyframeRequests(t *testing.T) {
+	const (
+		interval = 50 * time.Millisecond
+		retries  = 8
+	)
+	tests := []struct {
+		name string
+		// keyframeAt is the frame that is a keyframe, -1 for none
+		keyframeAt int
+		minPLIs    int32
+		maxPLIs    int32
+	}{
+		{name: "no keyframe", keyframeAt: -1, minPLIs: retries, maxPLIs: retries},
+		{name: "keyframe first", keyframeAt: 0, minPLIs: 1, maxPLIs: 2},
+		{name: "keyframe after the fourth request", keyframeAt: 8, minPLIs: 3, maxPLIs: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.PLIInterval = interval
+				c.PLIMaxRetries = retries
+			})
+			base := startServer(t)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			plis := countPLIs(p.senders[0])
+
+			// Frames every 20 ms for twice as long as the requests may last
+			ctx, cancel := context.WithTimeout(context.Background(), 2*retries*interval)
+			defer cancel()
+			ticker := time.NewTicker(20 * time.Millisecond)
+			defer ticker.Stop()
+			for i := 0; ctx.Err() == nil; i++ {
+				data := testVP8Interframe
+				if i == tt.keyframeAt {
+					data = testVP8Keyframe
+				}
+				if err := p.tracks[0].WriteSample(media.Sample{Data: data, Duration: 20 * time.Millisecond}); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+				}
+			}
+			if n := plis.Load(); n < tt.minPLIs || n > tt.maxPLIs {
+				t.Errorf("%d PLIs sent, want %d to %d", n, tt.minPLIs, tt.maxPLIs)
+			}
+		})
+	}
+}
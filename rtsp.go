@@ -0,0 +1,273 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtspHandler serves each published stream to RTSP readers at
+// rtsp://host:port/{streamKey}. The RTP of the publisher is relayed as is,
+// VP8, VP9, H.264 and Opus being packetized the same way for both protocols.
+type rtspHandler struct {
+	server *gortsplib.Server
+
+	mu      sync.Mutex
+	streams map[string]*rtspStream
+}
+
+// startRTSPServer serves RTSP on -rtsp-addr, over TCP only
+func startRTSPServer() (*gortsplib.Server, error) {
+	h := &rtspHandler{streams: map[string]*rtspStream{}}
+	h.server = &gortsplib.Server{
+		Handler:     h,
+		RTSPAddress: config.RTSPAddr,
+	}
+	if err := h.server.Start(); err != nil {
+		return nil, err
+	}
+	return h.server, nil
+}
+
+// rtspStream relays the tracks of one publish to its RTSP readers, until the
+// publisher or the last reader that set it up goes away
+type rtspStream struct {
+	h             *rtspHandler
+	streamKey     string
+	stream        *gortsplib.ServerStream
+	tracks        []*relayTrack
+	unsubscribers []func()
+	readers       map[*gortsplib.ServerSession]struct{}
+	closeOnce     sync.Once
+}
+
+// rtspFormat returns the RTSP format of a relayed track, or nil for codecs
+// whose RTP payload RTSP readers don't share with WebRTC
+func rtspFormat(track *relayTrack) (description.MediaType, format.Format) {
+	payloadType := uint8(track.payloadType)
+	switch track.codec.MimeType {
+	case webrtc.MimeTypeVP8:
+		return description.MediaTypeVideo, &format.VP8{PayloadTyp: payloadType}
+	case webrtc.MimeTypeVP9:
+		return description.MediaTypeVideo, &format.VP9{PayloadTyp: payloadType}
+	case webrtc.MimeTypeH264:
+		return description.MediaTypeVideo, &format.H264{PayloadTyp: payloadType, PacketizationMode: 1}
+	case webrtc.MimeTypeOpus:
+		return description.MediaTypeAudio, &format.Opus{PayloadTyp: payloadType, ChannelCount: int(max(track.codec.Channels, 1))}
+	}
+	return "", nil
+}
+
+// stream returns the RTSP stream of streamKey, starting it if the publisher
+// has no stream yet or its tracks changed, or nil if nothing can be relayed
+func (h *rtspHandler) stream(streamKey string) *rtspStream {
+	tracks := publishedTracks(streamKey)
+
+	h.mu.Lock()
+	stale := h.streams[streamKey]
+	if stale != nil && sameTracks(stale.tracks, tracks) {
+		h.mu.Unlock()
+		return stale
+	}
+	delete(h.streams, streamKey)
+	s := h.newStream(streamKey, tracks)
+	if s != nil {
+		h.streams[streamKey] = s
+	}
+	h.mu.Unlock()
+
+	// The readers of a stream from an earlier publisher are disconnected
+	if stale != nil {
+		stale.close()
+	}
+	return s
+}
+
+// newStream starts relaying the tracks RTSP can carry, returning nil if there are none
+func (h *rtspHandler) newStream(streamKey string, tracks []*relayTrack) *rtspStream {
+	s := &rtspStream{h: h, streamKey: streamKey, readers: map[*gortsplib.ServerSession]struct{}{}}
+	desc := &description.Session{}
+	var writers []rtspMediaWriter
+	for _, track := range tracks {
+		mediaType, forma := rtspFormat(track)
+		if forma == nil {
+			continue
+		}
+		media := &description.Media{Type: mediaType, Formats: []format.Format{forma}}
+		desc.Medias = append(desc.Medias, media)
+		s.tracks = append(s.tracks, track)
+		writers = append(writers, rtspMediaWriter{stream: s, media: media, payloadType: forma.PayloadType()})
+	}
+	if len(desc.Medias) == 0 {
+		return nil
+	}
+	s.stream = gortsplib.NewServerStream(h.server, desc)
+	for i, track := range s.tracks {
+		s.unsubscribers = append(s.unsubscribers, track.subscribe(writers[i]))
+	}
+	return s
+}
+
+// sameTracks reports whether relayed are those of tracks RTSP can carry
+func sameTracks(relayed, tracks []*relayTrack) bool {
+	i := 0
+	for _, track := range tracks {
+		if _, forma := rtspFormat(track); forma == nil {
+			continue
+		}
+		if i >= len(relayed) || relayed[i] != track {
+			return false
+		}
+		i++
+	}
+	return i == len(relayed)
+}
+
+// close stops relaying and disconnects the readers of the stream
+func (s *rtspStream) close() {
+	s.closeOnce.Do(func() {
+		s.h.mu.Lock()
+		if s.h.streams[s.streamKey] == s {
+			delete(s.h.streams, s.streamKey)
+		}
+		s.h.mu.Unlock()
+
+		for _, unsubscribe := range s.unsubscribers {
+			unsubscribe()
+		}
+		s.stream.Close()
+	})
+}
+
+// rtspMediaWriter writes the RTP of a relayed track to its media of the RTSP stream
+type rtspMediaWriter struct {
+	stream      *rtspStream
+	media       *description.Media
+	payloadType uint8
+}
+
+func (w rtspMediaWriter) Write(b []byte) (int, error) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	if packet.PayloadType != w.payloadType {
+		// Only the negotiated format is described to the readers
+		return len(b), nil
+	}
+	// Header extensions were negotiated with the publisher alone
+	packet.Extension = false
+	packet.Extensions = nil
+	return len(b), w.stream.stream.WritePacketRTP(w.media, &packet)
+}
+
+// Close ends the stream once its publisher is gone
+func (w rtspMediaWriter) Close() error {
+	w.stream.close()
+	return nil
+}
+
+// rtspStreamKey extracts the stream key from the path of an RTSP request
+func rtspStreamKey(path string) (string, bool) {
+	key := strings.TrimPrefix(path, "/")
+	return key, streamKeyPattern.MatchString(key)
+}
+
+func (h *rtspHandler) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	streamKey, ok := rtspStreamKey(ctx.Path)
+	if !ok {
+		return &base.Response{StatusCode: base.StatusBadRequest}, nil, nil
+	}
+	if res := rtspAuthorize(ctx.Request, streamKey); res != nil {
+		return res, nil, nil
+	}
+	s := h.stream(streamKey)
+	if s == nil {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	return &base.Response{StatusCode: base.StatusOK}, s.stream, nil
+}
+
+func (h *rtspHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	streamKey, ok := rtspStreamKey(ctx.Path)
+	if !ok {
+		return &base.Response{StatusCode: base.StatusBadRequest}, nil, nil
+	}
+	if res := rtspAuthorize(ctx.Request, streamKey); res != nil {
+		return res, nil, nil
+	}
+	s := h.stream(streamKey)
+	if s == nil {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	h.mu.Lock()
+	s.readers[ctx.Session] = struct{}{}
+	h.mu.Unlock()
+	return &base.Response{StatusCode: base.StatusOK}, s.stream, nil
+}
+
+func (h *rtspHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// OnSessionClose stops relaying a stream once its last reader is gone
+func (h *rtspHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	h.mu.Lock()
+	var idle *rtspStream
+	for _, s := range h.streams {
+		if _, ok := s.readers[ctx.Session]; !ok {
+			continue
+		}
+		delete(s.readers, ctx.Session)
+		if len(s.readers) == 0 {
+			idle = s
+		}
+		break
+	}
+	h.mu.Unlock()
+	if idle != nil {
+		idle.close()
+	}
+}
+
+// rtspToken returns the token of an RTSP request: a bearer token, or the
+// password of Basic credentials, as players such as VLC and ffmpeg send
+// from the user info of the URL
+func rtspToken(req *base.Request) string {
+	if values := req.Header["Authorization"]; len(values) == 1 {
+		if token, ok := strings.CutPrefix(values[0], "Bearer "); ok {
+			return token
+		}
+	}
+	var credentials headers.Authorization
+	if err := credentials.Unmarshal(req.Header["Authorization"]); err != nil || credentials.Method != headers.AuthMethodBasic {
+		return ""
+	}
+	return credentials.BasicPass
+}
+
+// rtspAuthorize returns the answer to a request that may not play streamKey,
+// with the play rights of WHEP, or nil if it may
+func rtspAuthorize(req *base.Request, streamKey string) *base.Response {
+	switch streamAccess(rtspToken(req), streamKey, rightPlay) {
+	case http.StatusUnauthorized:
+		return &base.Response{
+			StatusCode: base.StatusUnauthorized,
+			Header: base.Header{
+				"WWW-Authenticate": auth.GenerateWWWAuthenticate([]auth.ValidateMethod{auth.ValidateMethodBasic}, "mediaserver", ""),
+			},
+		}
+	case http.StatusForbidden:
+		return &base.Response{StatusCode: base.StatusForbidden}
+	}
+	return nil
+}
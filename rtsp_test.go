@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	rtspbase "github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// startRTSP serves RTSP on a free loopback port for the test and returns its address
+func startRTSP(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	setConfig(t, func(c *Config) { c.RTSPAddr = addr })
+	server, err := startRTSPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return addr
+}
+
+// TestRTSPPlayback publishes VP8 and Opus over WHIP and plays the stream
+// with an RTSP client, checking RTP arrives for both until the publisher leaves
+func TestRTSPPlayback(t *testing.T) {
+	base := startServer(t)
+	addr := startRTSP(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the tracks to be relayed", func() bool { return len(publishedTracks("cam")) == 2 })
+
+	tcp := gortsplib.TransportTCP
+	client := &gortsplib.Client{Transport: &tcp}
+	u := parseRTSPURL(t, "rtsp://"+addr+"/cam")
+	if err := client.Start(u.Scheme, u.Host); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, res, err := client.Describe(parseRTSPURL(t, "rtsp://"+addr+"/other")); err == nil || res != nil && res.StatusCode != rtspbase.StatusNotFound {
+		t.Errorf("DESCRIBE of a stream without publisher answered %v: %v, want 404", res, err)
+	}
+	desc, _, err := client.Describe(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codecs []string
+	for _, media := range desc.Medias {
+		codecs = append(codecs, media.Formats[0].Codec())
+	}
+	if len(codecs) != 2 {
+		t.Fatalf("described %v, want VP8 and Opus", codecs)
+	}
+	if err := client.SetupAll(desc.BaseURL, desc.Medias); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 64)
+	client.OnPacketRTPAny(func(_ *description.Media, forma format.Format, _ *rtp.Packet) {
+		select {
+		case received <- forma.Codec():
+		default:
+		}
+	})
+	if _, err := client.Play(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	timeout := time.After(testTimeout)
+	for len(got) < 2 {
+		select {
+		case codec := <-received:
+			got[codec] = true
+		case <-timeout:
+			t.Fatalf("received RTP of %v, want VP8 and Opus", got)
+		}
+	}
+
+	// The reader is disconnected once the publisher leaves
+	p.stop(t, base)
+	ended := make(chan error, 1)
+	go func() { ended <- client.Wait() }()
+	select {
+	case <-ended:
+	case <-time.After(testTimeout):
+		t.Fatal("RTSP reader still connected after the publisher left")
+	}
+}
+
+// TestRTSPAuth describes a stream with the credentials of testACL, the
+// token as the password of the URL, checking RTSP takes the play rights of
+// WHEP
+func TestRTSPAuth(t *testing.T) {
+	base := startServer(t)
+	addr := startRTSP(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the track to be relayed", func() bool { return len(publishedTracks("cam")) == 1 })
+	setConfig(t, func(c *Config) { c.ACL = testACL })
+
+	tests := []struct {
+		name string
+		url  string
+		want rtspbase.StatusCode
+	}{
+		{name: "no credentials", url: "rtsp://" + addr + "/cam", want: rtspbase.StatusUnauthorized},
+		{name: "unknown token", url: "rtsp://viewer:wrong@" + addr + "/cam", want: rtspbase.StatusUnauthorized},
+		{name: "publish rights", url: "rtsp://viewer:cam-publisher@" + addr + "/cam", want: rtspbase.StatusForbidden},
+		{name: "another stream", url: "rtsp://viewer:cam-viewer@" + addr + "/other", want: rtspbase.StatusForbidden},
+		{name: "play granted", url: "rtsp://viewer:cam-viewer@" + addr + "/cam", want: rtspbase.StatusOK},
+		{name: "any stream", url: "rtsp://viewer:anything@" + addr + "/cam", want: rtspbase.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := gortsplib.TransportTCP
+			client := &gortsplib.Client{Transport: &tcp}
+			u := parseRTSPURL(t, tt.url)
+			if err := client.Start(u.Scheme, u.Host); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_, res, err := client.Describe(u)
+			if res == nil {
+				t.Fatalf("DESCRIBE failed: %v", err)
+			}
+			if res.StatusCode != tt.want {
+				t.Errorf("DESCRIBE answered %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestRTSPAddrDefault(t *testing.T) {
+	t.Setenv("MEDIASERVER_RTSP_ADDR", "")
+	if cfg := parseFlags(t); cfg.RTSPAddr != "" {
+		t.Errorf("RTSPAddr = %q by default, want RTSP off", cfg.RTSPAddr)
+	}
+}
+
+func parseRTSPURL(t *testing.T, raw string) *rtspbase.URL {
+	t.Helper()
+	u, err := rtspbase.ParseURL(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtxPayloadType returns the payload type of the RTX stream (RFC 4588)
+// negotiated in codecs for the codec on payloadType, or 0 if there is none.
+// Pion hands the retransmissions of a repair stream signaled with its own
+// SSRC to the track already unwrapped; those on the RTX payload type that
+// reach the track anyway are left to the read loop.
+func rtxPayloadType(codecs []webrtc.RTPCodecParameters, payloadType webrtc.PayloadType) uint8 {
+	for _, codec := range codecs {
+		if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+			continue
+		}
+		for _, param := range strings.Split(codec.SDPFmtpLine, ";") {
+			apt, ok := strings.CutPrefix(strings.TrimSpace(param), "apt=")
+			if ok && apt == strconv.Itoa(int(payloadType)) {
+				return uint8(codec.PayloadType)
+			}
+		}
+	}
+	return 0
+}
+
+// unwrapRTX turns an RTX packet back into the packet it retransmits, on
+// payloadType with the original sequence number carried in front of the
+// payload. It returns false for a packet with no payload to recover, such as
+// the padding sent to probe the bandwidth.
+func unwrapRTX(packet *rtp.Packet, payloadType uint8) bool {
+	if len(packet.Payload) <= 2 {
+		return false
+	}
+	packet.SequenceNumber = binary.BigEndian.Uint16(packet.Payload)
+	packet.Payload = packet.Payload[2:]
+	packet.PayloadType = payloadType
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRTXPayloadType(t *testing.T) {
+	codecs := []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, PayloadType: 102},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/RTX", SDPFmtpLine: "rtx-time=3000; apt=102"}, PayloadType: 103},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9}, PayloadType: 98},
+	}
+	tests := []struct {
+		name        string
+		payloadType webrtc.PayloadType
+		want        uint8
+	}{
+		{"paired", 96, 97},
+		{"among other parameters", 102, 103},
+		{"no RTX", 98, 0},
+		{"not a prefix match", 9, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rtxPayloadType(codecs, tt.payloadType); got != tt.want {
+				t.Errorf("rtxPayloadType(%d) = %d, want %d", tt.payloadType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnwrapRTX(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		wantOK  bool
+		wantSeq uint16
+		want    []byte
+	}{
+		{name: "retransmission", payload: []byte{0x12, 0x34, 1, 2, 3}, wantOK: true, wantSeq: 0x1234, want: []byte{1, 2, 3}},
+		{name: "padding probe", payload: []byte{0x12, 0x34}},
+		{name: "empty", payload: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := &rtp.Packet{Header: rtp.Header{PayloadType: 97, SequenceNumber: 7}, Payload: tt.payload}
+			if ok := unwrapRTX(packet, 96); ok != tt.wantOK {
+				t.Fatalf("unwrapRTX = %v, want %v", ok, tt.wantOK)
+			}
+			if !tt.wantOK {
+				return
+			}
+			if packet.PayloadType != 96 || packet.SequenceNumber != tt.wantSeq || !bytes.Equal(packet.Payload, tt.want) {
+				t.Errorf("unwrapped to pt %d seq %d payload %v, want pt 96 seq %d payload %v",
+					packet.PayloadType, packet.SequenceNumber, packet.Payload, tt.wantSeq, tt.want)
+			}
+		})
+	}
+}
+
+// TestRTXRecording loses a fragment of an H.264 frame, recovers it from an
+// RTX packet arriving after the fragments that follow it, and checks the
+// recording matches the one of every packet in order
+func TestRTXRecording(t *testing.T) {
+	const lost = 4
+	packets := testFUAPackets(3)
+	want := recordPackets(t, "video/H264", packets)
+
+	var arrivals []*rtp.Packet
+	for i, p := range packets {
+		if i == lost {
+			continue
+		}
+		arrivals = append(arrivals, &rtp.Packet{
+			Header:  rtp.Header{PayloadType: testPayloadType, SequenceNumber: uint16(i), Timestamp: p.timestamp, Marker: p.marker},
+			Payload: p.payload,
+		})
+	}
+	rtx := &rtp.Packet{
+		Header:  rtp.Header{PayloadType: testRTXPayloadType, SequenceNumber: 5000, Timestamp: packets[lost].timestamp, Marker: packets[lost].marker},
+		Payload: binary.BigEndian.AppendUint16(nil, lost),
+	}
+	rtx.Payload = append(rtx.Payload, packets[lost].payload...)
+	// Padding probing the bandwidth is not recorded
+	padding := &rtp.Packet{
+		Header:  rtp.Header{PayloadType: testRTXPayloadType, SequenceNumber: 5001, Timestamp: packets[lost].timestamp},
+		Payload: []byte{0, 0},
+	}
+	arrivals = append(arrivals, rtx, padding)
+
+	if got := recordRTP(t, "video/H264", arrivals); !bytes.Equal(got, want) {
+		t.Errorf("recovered packet recorded %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// redactedSDPAttributes are the attributes whose values -dump-sdp hides
+// unless -dump-sdp-credentials: the ICE credentials, with which anyone could
+// answer the session's connectivity checks
+var redactedSDPAttributes = []string{"a=ice-ufrag:", "a=ice-pwd:"}
+
+// dumpSDP logs sdp, the offer or answer of a WHIP exchange, to logger at
+// debug level with -dump-sdp
+func dumpSDP(logger *slog.Logger, kind, sdp string) {
+	if !config.DumpSDP || !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if !config.DumpSDPCredentials {
+		sdp = redactSDP(sdp)
+	}
+	logger.Debug("SDP "+kind, "sdp", sdp)
+}
+
+// redactSDP replaces the values of the redactedSDPAttributes of sdp
+func redactSDP(sdp string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	for i, line := range lines {
+		for _, attribute := range redactedSDPAttributes {
+			if strings.HasPrefix(line, attribute) {
+				ending := line[len(strings.TrimRight(line, "\r\n")):]
+				lines[i] = attribute + "REDACTED" + ending
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
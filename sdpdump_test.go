@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRedactSDP(t *testing.T) {
+	tests := []struct {
+		name string
+		sdp  string
+		want string
+	}{
+		{
+			name: "credentials",
+			sdp:  "v=0\r\na=ice-ufrag:abcd\r\na=ice-pwd:secretsecretsecret\r\na=ice-options:trickle\r\n",
+			want: "v=0\r\na=ice-ufrag:REDACTED\r\na=ice-pwd:REDACTED\r\na=ice-options:trickle\r\n",
+		},
+		{
+			name: "last line without a line break",
+			sdp:  "m=video 9 UDP/TLS/RTP/SAVPF 96\na=ice-pwd:secret",
+			want: "m=video 9 UDP/TLS/RTP/SAVPF 96\na=ice-pwd:REDACTED",
+		},
+		{
+			name: "nothing to redact",
+			sdp:  "v=0\r\na=fingerprint:sha-256 AB:CD\r\n",
+			want: "v=0\r\na=fingerprint:sha-256 AB:CD\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactSDP(tt.sdp); got != tt.want {
+				t.Errorf("redactSDP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDumpSDP publishes with -dump-sdp and checks the offer and answer are
+// logged, at debug level only, with the ICE password redacted unless
+// -dump-sdp-credentials
+func TestDumpSDP(t *testing.T) {
+	tests := []struct {
+		name        string
+		dump        bool
+		credentials bool
+		level       slog.Level
+		wantDump    bool
+	}{
+		{name: "off", level: slog.LevelDebug},
+		{name: "redacted", dump: true, level: slog.LevelDebug, wantDump: true},
+		{name: "with credentials", dump: true, credentials: true, level: slog.LevelDebug, wantDump: true},
+		{name: "above debug level", dump: true, level: slog.LevelInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			setConfig(t, func(c *Config) { c.DumpSDP, c.DumpSDPCredentials = tt.dump, tt.credentials })
+			logs := captureLogs(t, tt.level)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			p.stop(t, base)
+
+			offers, answers := logs.records(t, "SDP offer"), logs.records(t, "SDP answer")
+			if !tt.wantDump {
+				if len(offers)+len(answers) > 0 {
+					t.Errorf("%d offers and %d answers logged, want none", len(offers), len(answers))
+				}
+				return
+			}
+			if len(offers) != 1 || len(answers) != 1 {
+				t.Fatalf("%d offers and %d answers logged, want 1 each", len(offers), len(answers))
+			}
+			if offers[0]["stream"] != "cam" || answers[0]["session"] == nil {
+				t.Errorf("offer record %v and answer record %v, want the stream and session", offers[0], answers[0])
+			}
+			for _, dump := range []struct {
+				record map[string]any
+				sdp    string
+			}{
+				{offers[0], p.pc.LocalDescription().SDP},
+				{answers[0], p.answer},
+			} {
+				logged, _ := dump.record["sdp"].(string)
+				want := dump.sdp
+				if !tt.credentials {
+					want = redactSDP(want)
+				}
+				if logged != want {
+					t.Errorf("logged SDP\n%s\nwant\n%s", logged, want)
+				}
+				if !strings.Contains(logged, "m=video") {
+					t.Errorf("logged SDP has no video section:\n%s", logged)
+				}
+			}
+		})
+	}
+}
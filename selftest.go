@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	// selfTestDuration is how much media the self-test publishes per format
+	selfTestDuration = time.Second
+	// selfTestTimeout bounds each publish of the self-test
+	selfTestTimeout = 15 * time.Second
+)
+
+// The bundled sample of the self-test: a 1x1 VP8 keyframe and an Opus
+// silence frame, sent at 30 and 50 frames per second
+var (
+	selfTestVP8Keyframe = []byte{
+		0x30, 0x01, 0x00, 0x9d, 0x01, 0x2a, 0x01, 0x00, 0x01, 0x00, 0x0e, 0xc0,
+		0xfe, 0x25, 0xa4, 0x00, 0x03, 0x70, 0x00, 0x00, 0x00, 0x00,
+	}
+	selfTestOpusSilence = []byte{0xf8, 0xff, 0xfe}
+)
+
+// selfTestFormats are the recording formats the self-test publishes in
+var selfTestFormats = []string{"webm", "ivf"}
+
+// selfTestFiles tell the files of each container the self-test records by
+// the magic they start with, and whether they carry the video
+var selfTestFiles = map[string]struct {
+	magic string
+	video bool
+}{
+	".webm": {"\x1a\x45\xdf\xa3", true},
+	".ivf":  {"DKIF", true},
+	".ogg":  {"OggS", false},
+}
+
+// runSelfTest serves the API on a loopback port and publishes the bundled
+// sample to it over WHIP in each of selfTestFormats, checking the files
+// recorded. It records to a temporary directory, removed afterwards, under
+// the default file names, and sends no webhooks; the rest of the
+// configuration applies.
+func runSelfTest() error {
+	saved := config
+	defer func() {
+		// The goroutines of the sessions read the configuration until closed
+		sessions.closeAll()
+		config = saved
+	}()
+	dir, err := os.MkdirTemp("", "mediaserver-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	config.OutputDir = dir
+	config.WebhookURL = ""
+	config.FilenameTemplate = ""
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: newRouter()}
+	go server.Serve(listener)
+	defer server.Close()
+	defer sessions.closeAll()
+
+	base := "http://" + listener.Addr().String()
+	for _, format := range selfTestFormats {
+		if err := selfTestPublish(base, format); err != nil {
+			return fmt.Errorf("%s: %w", format, err)
+		}
+	}
+	return nil
+}
+
+// selfTestPublish publishes the sample to the server at base in format, ends
+// the session and checks its files
+func selfTestPublish(base, format string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "selftest")
+	if err != nil {
+		return err
+	}
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "selftest")
+	if err != nil {
+		return err
+	}
+	for _, track := range []webrtc.TrackLocal{video, audio} {
+		if _, err := pc.AddTrack(track); err != nil {
+			return err
+		}
+	}
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-webrtc.GatheringCompletePromise(pc):
+	case <-ctx.Done():
+		return errors.New("timed out gathering candidates")
+	}
+	status, answer, header, err := selfTestRequest(ctx, http.MethodPost, base+"/whip/selftest?format="+format, pc.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated {
+		return fmt.Errorf("publish answered %d: %s", status, strings.TrimSpace(answer))
+	}
+	location := header.Get("Location")
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return err
+	}
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return errors.New("publisher did not connect")
+	}
+
+	var nextVideo time.Duration
+	for sent := time.Duration(0); sent < selfTestDuration; sent += 20 * time.Millisecond {
+		if sent >= nextVideo {
+			if err := video.WriteSample(media.Sample{Data: selfTestVP8Keyframe, Duration: time.Second / 30}); err != nil {
+				return err
+			}
+			nextVideo += time.Second / 30
+		}
+		if err := audio.WriteSample(media.Sample{Data: selfTestOpusSilence, Duration: 20 * time.Millisecond}); err != nil {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The session's files are complete once the DELETE is answered
+	status, body, _, err := selfTestRequest(ctx, http.MethodDelete, base+location, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("DELETE answered %d: %s", status, strings.TrimSpace(body))
+	}
+	return checkSelfTestFiles(filepath.Join(config.OutputDir, strings.TrimPrefix(location, "/whip/")))
+}
+
+// selfTestRequest sends a request with the SDP body, if any, and the first
+// of the configured tokens that may publish the self-test's stream
+func selfTestRequest(ctx context.Context, method, url, body string) (int, string, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", sdpContentType)
+	}
+	if token := selfTestToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxOfferSize))
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return resp.StatusCode, string(data), resp.Header, nil
+}
+
+// selfTestToken returns the first token granted publishing the self-test's
+// stream, if any
+func selfTestToken() string {
+	if len(config.Tokens) > 0 {
+		return config.Tokens[0]
+	}
+	for _, entry := range config.ACL {
+		if entry.allows("selftest", rightPublish) {
+			return entry.Token
+		}
+	}
+	return ""
+}
+
+// checkSelfTestFiles checks the session directory holds recordings, each
+// starting as its container should and those of the video holding the
+// sample's frames
+func checkSelfTestFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	checked := 0
+	for _, entry := range entries {
+		want, ok := selfTestFiles[filepath.Ext(entry.Name())]
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte(want.magic)) {
+			return fmt.Errorf("%s is not a valid %s file", entry.Name(), filepath.Ext(entry.Name()))
+		}
+		if want.video && !bytes.Contains(data, selfTestVP8Keyframe) {
+			return fmt.Errorf("%s holds no video frame", entry.Name())
+		}
+		checked++
+	}
+	if checked == 0 {
+		return errors.New("nothing was recorded")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr bool
+	}{
+		{name: "defaults", change: func(*Config) {}},
+		{name: "with tokens", change: func(c *Config) { c.Tokens = []string{"secret"} }},
+		{name: "file name template", change: func(c *Config) { c.FilenameTemplate = "{{.StreamKey}}/{{.Kind}}" }},
+		{name: "VP8 not accepted", change: func(c *Config) { c.Codecs = []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			setConfig(t, func(c *Config) {
+				c.OutputDir = outputDir
+				tt.change(c)
+			})
+			saved := webrtcAPI
+			t.Cleanup(func() { webrtcAPI = saved })
+			var err error
+			if webrtcAPI, err = newAPI(); err != nil {
+				t.Fatal(err)
+			}
+
+			err = runSelfTest()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runSelfTest() = %v, want error %v", err, tt.wantErr)
+			}
+			if config.OutputDir != outputDir {
+				t.Errorf("output directory left at %s", config.OutputDir)
+			}
+			if entries, _ := os.ReadDir(outputDir); len(entries) != 0 {
+				t.Errorf("self-test recorded to the output directory: %v", entries)
+			}
+		})
+	}
+}
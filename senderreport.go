@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// senderReportsFile names the sidecar of the sender reports in a session directory
+const senderReportsFile = "sender_reports.jsonl"
+
+// ntpEpochOffset is the number of seconds from the NTP epoch, 1900, to the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// senderReportRecord is one line of the sender reports sidecar file: the
+// wall-clock time a publisher's RTP timestamp of a track stands for, which
+// lines up the tracks of a recording (RFC 3550 section 6.4.1)
+type senderReportRecord struct {
+	Received  time.Time `json:"received"`
+	Kind      string    `json:"kind"`
+	MimeType  string    `json:"mime_type"`
+	RID       string    `json:"rid,omitempty"`
+	SSRC      uint32    `json:"ssrc"`
+	ClockRate uint32    `json:"clock_rate"`
+	NTPTime   uint64    `json:"ntp_time"`
+	Wallclock time.Time `json:"wallclock"`
+	RTPTime   uint32    `json:"rtp_time"`
+	Packets   uint32    `json:"packets"`
+	Octets    uint32    `json:"octets"`
+}
+
+// ntpToTime converts a 64-bit NTP timestamp, seconds since 1900 in the high
+// 32 bits and their fraction in the low ones, to a time
+func ntpToTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := (ntp & 0xffffffff) * uint64(time.Second) >> 32
+	return time.Unix(seconds, int64(nanos)).UTC()
+}
+
+// senderReportWriter appends the sender reports of a session's recorded
+// tracks to sender_reports.jsonl in the session directory
+type senderReportWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func createSenderReportWriter(dir string) (*senderReportWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, senderReportsFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &senderReportWriter{file: file}, nil
+}
+
+func (w *senderReportWriter) write(record senderReportRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	_, err = w.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file; later calls do nothing
+func (w *senderReportWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// senderReportRecorder returns the function drainRTCP hands the sender
+// reports of a recorded track to, writing them to the session's sidecar,
+// or nil without -sender-reports. A compound packet reaches every track it
+// names, so the reports of the other tracks are skipped.
+func (s *session) senderReportRecorder(logger *slog.Logger, track *webrtc.TrackRemote) func(*rtcp.SenderReport) {
+	if !config.SenderReports {
+		return nil
+	}
+	codec := track.Codec()
+	ssrc := uint32(track.SSRC())
+	return func(report *rtcp.SenderReport) {
+		if report.SSRC != ssrc {
+			return
+		}
+		writer, err := s.openSenderReports()
+		if err != nil {
+			logger.Warn("Failed to create sender reports file", "error", err)
+			return
+		}
+		record := senderReportRecord{
+			Received:  time.Now(),
+			Kind:      track.Kind().String(),
+			MimeType:  codec.MimeType,
+			RID:       track.RID(),
+			SSRC:      report.SSRC,
+			ClockRate: codec.ClockRate,
+			NTPTime:   report.NTPTime,
+			Wallclock: ntpToTime(report.NTPTime),
+			RTPTime:   report.RTPTime,
+			Packets:   report.PacketCount,
+			Octets:    report.OctetCount,
+		}
+		if err := writer.write(record); err != nil {
+			logger.Warn("Failed to write sender report", "error", err)
+		}
+	}
+}
+
+// openSenderReports returns the session's sender reports file, creating it
+// for the first report
+func (s *session) openSenderReports() (*senderReportWriter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, os.ErrClosed
+	}
+	if s.senderReports == nil {
+		writer, err := createSenderReportWriter(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.senderReports = writer
+	}
+	return s.senderReports, nil
+}
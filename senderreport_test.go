@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestNTPToTime(t *testing.T) {
+	tests := []struct {
+		name string
+		ntp  uint64
+		want time.Time
+	}{
+		{name: "Unix epoch", ntp: ntpEpochOffset << 32, want: time.Unix(0, 0).UTC()},
+		{name: "half a second", ntp: (ntpEpochOffset+1)<<32 | 1<<31, want: time.Unix(1, 500_000_000).UTC()},
+		{name: "2024", ntp: (ntpEpochOffset + 1704067200) << 32, want: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ntpToTime(tt.ntp); !got.Equal(tt.want) {
+				t.Errorf("ntpToTime(%#x) = %v, want %v", tt.ntp, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSenderReports sends sender reports of made-up timestamps for each
+// track of a publisher and checks the sidecar file maps them as sent. The
+// publisher's own reports are recorded as well and told apart by their
+// timestamps.
+func TestSenderReports(t *testing.T) {
+	const ntp = (ntpEpochOffset+1704067200)<<32 | 1<<30
+	want := map[string]uint32{"video": 123456789, "audio": 987654}
+
+	setConfig(t, func(c *Config) { c.SenderReports = true })
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	waitFor(t, "the tracks to be recorded", func() bool {
+		s := sessions.get(strings.TrimPrefix(p.location, "/whip/"))
+		return s != nil && len(s.info().Tracks) == 2
+	})
+
+	var reports []rtcp.Packet
+	for _, sender := range p.senders {
+		kind := sender.Track().Kind().String()
+		reports = append(reports, &rtcp.SenderReport{
+			SSRC:        uint32(sender.GetParameters().Encodings[0].SSRC),
+			NTPTime:     ntp,
+			RTPTime:     want[kind],
+			PacketCount: 10,
+			OctetCount:  1000,
+		})
+	}
+	if err := p.pc.WriteRTCP(reports); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"), senderReportsFile)
+	read := func() map[string]senderReportRecord {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		got := map[string]senderReportRecord{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record senderReportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+			}
+			if record.NTPTime == ntp {
+				got[record.Kind] = record
+			}
+		}
+		return got
+	}
+	waitFor(t, "the sender reports to be recorded", func() bool { return len(read()) == len(want) })
+	cancel()
+	<-done
+	p.stop(t, base)
+
+	wallclock := time.Date(2024, 1, 1, 0, 0, 0, 250_000_000, time.UTC)
+	for kind, record := range read() {
+		if record.RTPTime != want[kind] || !record.Wallclock.Equal(wallclock) || record.Packets != 10 || record.Octets != 1000 {
+			t.Errorf("%s report recorded rtp %d at %v, %d packets, %d octets, want rtp %d at %v, 10 packets, 1000 octets",
+				kind, record.RTPTime, record.Wallclock, record.Packets, record.Octets, want[kind], wallclock)
+		}
+		if wantRate := map[string]uint32{"video": 90000, "audio": 48000}[kind]; record.ClockRate != wantRate {
+			t.Errorf("%s report recorded clock rate %d, want %d", kind, record.ClockRate, wantRate)
+		}
+	}
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// session is a single WHIP publish, addressable by its resource ID
+type session struct {
+	id             string
+	streamKey      string
+	peerConnection *webrtc.PeerConnection
+	log            *slog.Logger
+
+	// rtpStats reports the inbound RTP stats of the PeerConnection, if known
+	rtpStats stats.Getter
+
+	// dir holds the recordings of the session, under the output directory
+	dir string
+
+	// etag identifies the ICE session for trickle PATCH requests, changing
+	// with each ICE restart. iceMu serializes the PATCH requests.
+	iceMu sync.Mutex
+	etag  string
+
+	// muxer records the tracks of the session to recording.webm, or to
+	// recording.mp4 for H.264 video; it is set once the offer is applied
+	muxer trackMuxer
+
+	started      time.Time
+	bytesWritten atomic.Int64
+
+	// lastActivity is when RTP or a request on the resource last arrived,
+	// in Unix nanoseconds, for the sweeper
+	lastActivity atomic.Int64
+
+	// packetErrors counts the RTP packets of every track that failed to be
+	// read or parsed and were skipped
+	packetErrors atomic.Int64
+
+	// latePackets counts the RTP packets dropped for arriving too late to
+	// be put back in order
+	latePackets atomic.Int64
+
+	// audioLevel is the last level in dBov reported by the publisher for its
+	// audio, hasAudioLevel set once there is one
+	audioLevel    atomic.Int32
+	hasAudioLevel atomic.Bool
+	voice         atomic.Bool
+
+	mu     sync.Mutex
+	closed bool
+	// added is set once the registry holds the session, counting it as
+	// running until it is closed
+	added bool
+	// state is the PeerConnection state, entered at stateSince
+	state      webrtc.PeerConnectionState
+	stateSince time.Time
+	// done is closed once the session starts closing
+	done   chan struct{}
+	codecs []string
+	meters []*bitrateMeter
+	// trackStats follow the tracks being recorded, in order of arrival
+	trackStats []*trackStat
+
+	// fileNames are the names claimed by the session's tracks for their outputs
+	fileNames map[string]bool
+
+	// leaveSource ends the pull of an ingest session at its remote source
+	leaveSource func()
+	// ingest is the pull an ingest session records
+	ingest *ingest
+
+	// keyLog is the sidecar file of the DTLS keys, with -export-keys
+	keyLog *keyLogFile
+
+	// metadata records the messages of the session's metadata DataChannel
+	metadata *metadataWriter
+	// senderReports records the RTCP sender reports of the recorded tracks
+	senderReports *senderReportWriter
+	tracks        sync.WaitGroup
+
+	// idle ends the session when no RTP arrives on any track for IdleTimeout
+	idle *time.Timer
+	// limit stops the session once it has run for MaxSessionDuration
+	limit *time.Timer
+
+	// pending counts the negotiated tracks yet to arrive, recorded those with a writer
+	pending, recorded int
+
+	// metaMu serializes the writes of the session's .meta.json
+	metaMu                     sync.Mutex
+	metaWritten, metaFinalized bool
+}
+
+func newSession(streamKey string, peerConnection *webrtc.PeerConnection) *session {
+	id := uuid.NewString()
+	now := time.Now()
+	s := &session{
+		id:             id,
+		streamKey:      streamKey,
+		peerConnection: peerConnection,
+		log:            slog.With("session", id, "stream", streamKey),
+		dir:            filepath.Join(config.OutputDir, id),
+		etag:           newETag(),
+		started:        now,
+		state:          webrtc.PeerConnectionStateNew,
+		stateSince:     now,
+		done:           make(chan struct{}),
+	}
+	s.lastActivity.Store(now.UnixNano())
+	return s
+}
+
+// newETag returns a quoted ETag for a new ICE session
+func newETag() string {
+	return `"` + uuid.NewString() + `"`
+}
+
+// active records activity on the session, holding off the sweeper
+func (s *session) active() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// setState records a change of the PeerConnection state
+func (s *session) setState(state webrtc.PeerConnectionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state != s.state {
+		s.state, s.stateSince = state, time.Now()
+	}
+}
+
+// startTrack registers a track recorder; it returns false once the session is closing
+func (s *session) startTrack() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.tracks.Add(1)
+	return true
+}
+
+// addCodec records the codec of a track being recorded
+func (s *session) addCodec(mimeType string) {
+	s.mu.Lock()
+	s.codecs = append(s.codecs, mimeType)
+	s.mu.Unlock()
+	if err := s.saveMeta(false); err != nil {
+		s.log.Warn("Failed to write session metadata", "error", err)
+	}
+}
+
+// watchIdle starts the idle timer, which is pushed back by every RTP packet
+func (s *session) watchIdle() {
+	if config.IdleTimeout <= 0 {
+		return
+	}
+	s.idle = time.AfterFunc(config.IdleTimeout, func() {
+		if !sessions.removeSession(s) {
+			return
+		}
+		s.log.Warn("No RTP received, closing idle session", "timeout", config.IdleTimeout)
+		if err := s.Close(); err != nil {
+			s.log.Warn("Failed to close PeerConnection", "error", err)
+		}
+	})
+}
+
+// watchDuration stops the session once it has run for MaxSessionDuration,
+// its resource answering 410 from then on
+func (s *session) watchDuration() {
+	if config.MaxSessionDuration <= 0 {
+		return
+	}
+	s.limit = time.AfterFunc(config.MaxSessionDuration-time.Since(s.started), func() {
+		if !sessions.expire(s) {
+			return
+		}
+		s.log.Warn("Maximum session duration reached, stopping session", "max_session_duration", config.MaxSessionDuration)
+		if err := s.Close(); err != nil {
+			s.log.Warn("Failed to close PeerConnection", "error", err)
+		}
+	})
+}
+
+// touch resets the idle timer after a packet arrives on any track
+func (s *session) touch() {
+	s.active()
+	if s.idle != nil {
+		s.idle.Reset(config.IdleTimeout)
+	}
+}
+
+// discardTrack reads and drops the packets of a track that can't be recorded,
+// so the publisher keeps getting receiver reports for it. The session is ended
+// once every negotiated track has arrived without any being recorded.
+func (s *session) discardTrack(track *webrtc.TrackRemote) {
+	if s.trackArrived(false) {
+		s.log.Warn("No track of the session can be recorded, closing it")
+		go func() {
+			if sessions.removeSession(s) {
+				s.Close()
+			}
+		}()
+	}
+	drainRTP(track, s.touch)
+}
+
+// trackArrived counts a new track and reports whether all of them have now
+// arrived with none being recorded
+func (s *session) trackArrived(recorded bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	if recorded {
+		s.recorded++
+	}
+	return s.pending <= 0 && s.recorded == 0
+}
+
+// addMeter adds the bitrate of a recorded track to the one reported for the session
+func (s *session) addMeter(meter *bitrateMeter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meters = append(s.meters, meter)
+}
+
+// trackStat follows the recording of a track for /sessions
+type trackStat struct {
+	id, rid, kind, codec string
+	clockRate            uint32
+
+	// duration is the span of the RTP timestamps of the frames written so
+	// far, in the track's clock rather than wall-clock time
+	duration atomic.Int64
+
+	reception *receptionStats
+
+	// skipped counts the packets of another payload type than the track's codec
+	skipped atomic.Uint64
+}
+
+// addTrackStat starts following the recording of track
+func (s *session) addTrackStat(track *webrtc.TrackRemote) *trackStat {
+	stat := &trackStat{
+		id:        track.ID(),
+		rid:       track.RID(),
+		kind:      track.Kind().String(),
+		codec:     track.Codec().MimeType,
+		clockRate: track.Codec().ClockRate,
+		reception: newReceptionStats(track.Codec().ClockRate),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trackStats = append(s.trackStats, stat)
+	return stat
+}
+
+// bitrate returns the estimated bitrate received over the recorded tracks at now
+func (s *session) bitrate(now time.Time) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bitrate int64
+	for _, meter := range s.meters {
+		bitrate += meter.bitrate(now)
+	}
+	return bitrate
+}
+
+// sessionInfo is the JSON form of a session listed by /sessions
+type sessionInfo struct {
+	ID              string      `json:"id"`
+	StreamKey       string      `json:"stream_key"`
+	Codecs          []string    `json:"codecs"`
+	Started         time.Time   `json:"started"`
+	BytesWritten    int64       `json:"bytes_written"`
+	PacketErrors    int64       `json:"packet_errors"`
+	LatePackets     int64       `json:"late_packets"`
+	Bitrate         int64       `json:"bitrate_bps"`
+	ConnectionState string      `json:"connection_state"`
+	Viewers         int         `json:"viewers"`
+	AudioLevel      *int        `json:"audio_level_dbov,omitempty"`
+	Voice           bool        `json:"voice_activity,omitempty"`
+	Ingest          *ingestInfo `json:"ingest,omitempty"`
+	Tracks          []trackInfo `json:"tracks"`
+}
+
+// trackInfo describes a recorded track of a session in /sessions
+type trackInfo struct {
+	ID        string `json:"id"`
+	RID       string `json:"rid,omitempty"`
+	Kind      string `json:"kind"`
+	Codec     string `json:"codec"`
+	ClockRate uint32 `json:"clock_rate"`
+	// Duration is the span of the track's recorded media by its RTP timestamps
+	Duration int64 `json:"duration_ms"`
+
+	// The packets received, lost to gaps in the sequence numbers and
+	// received out of order, and their interarrival jitter
+	PacketsReceived   uint64  `json:"packets_received"`
+	PacketsLost       int64   `json:"packets_lost"`
+	PacketsOutOfOrder uint64  `json:"packets_out_of_order"`
+	Jitter            float64 `json:"jitter_ms"`
+	// PacketsSkipped are those on another payload type than the codec
+	// recorded, never depacketized
+	PacketsSkipped uint64 `json:"packets_skipped"`
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	codecs := append([]string{}, s.codecs...)
+	tracks := []trackInfo{}
+	for _, t := range s.trackStats {
+		reception := t.reception.info()
+		tracks = append(tracks, trackInfo{
+			ID:                t.id,
+			RID:               t.rid,
+			Kind:              t.kind,
+			Codec:             t.codec,
+			ClockRate:         t.clockRate,
+			Duration:          time.Duration(t.duration.Load()).Milliseconds(),
+			PacketsReceived:   reception.Received,
+			PacketsLost:       reception.Lost,
+			PacketsOutOfOrder: reception.OutOfOrder,
+			Jitter:            reception.Jitter,
+			PacketsSkipped:    t.skipped.Load(),
+		})
+	}
+	s.mu.Unlock()
+	info := sessionInfo{
+		ID:              s.id,
+		StreamKey:       s.streamKey,
+		Codecs:          codecs,
+		Started:         s.started,
+		BytesWritten:    s.bytesWritten.Load(),
+		PacketErrors:    s.packetErrors.Load(),
+		LatePackets:     s.latePackets.Load(),
+		Bitrate:         s.bitrate(time.Now()),
+		ConnectionState: s.peerConnection.ConnectionState().String(),
+		Viewers:         viewers.count(s.streamKey),
+		Tracks:          tracks,
+	}
+	if s.hasAudioLevel.Load() {
+		level := int(s.audioLevel.Load())
+		info.AudioLevel = &level
+		info.Voice = s.voice.Load()
+	}
+	if s.ingest != nil {
+		info.Ingest = s.ingest.info()
+	}
+	return info
+}
+
+// setAudioLevel records the level of the latest audio packet carrying one
+func (s *session) setAudioLevel(level int, voice bool) {
+	s.audioLevel.Store(int32(level))
+	s.voice.Store(voice)
+	s.hasAudioLevel.Store(true)
+}
+
+// claimFileName returns name for the outputs of a track, suffixed with the
+// mid of its m-line if another track of the session already took it
+func (s *session) claimFileName(name, mid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fileNames == nil {
+		s.fileNames = map[string]bool{}
+	}
+	claimed := name
+	if s.fileNames[claimed] {
+		claimed = name + "_" + sanitizeFileName(mid)
+	}
+	for n := 2; s.fileNames[claimed]; n++ {
+		claimed = fmt.Sprintf("%s_%s_%d", name, sanitizeFileName(mid), n)
+	}
+	s.fileNames[claimed] = true
+	return claimed
+}
+
+// trackDone marks a track recorder as finished with its output file
+func (s *session) trackDone() {
+	s.tracks.Done()
+}
+
+// Close tears down the PeerConnection and waits for every output file to be closed
+func (s *session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	if s.limit != nil {
+		s.limit.Stop()
+	}
+
+	err := s.peerConnection.Close()
+	if s.leaveSource != nil {
+		s.leaveSource()
+	}
+	s.tracks.Wait()
+
+	// No more messages arrive once the PeerConnection is closed
+	if s.metadata != nil {
+		if closeErr := s.metadata.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if s.senderReports != nil {
+		if closeErr := s.senderReports.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if s.keyLog != nil {
+		if closeErr := s.keyLog.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	// Every file is closed, so the recording is complete
+	if metaErr := s.saveMeta(true); metaErr != nil {
+		s.log.Warn("Failed to finalize session metadata", "error", metaErr)
+	}
+	if config.WebhookURL != "" && s.established() {
+		sendWebhook(s.log, s.recordingEvent())
+	}
+	if s.added {
+		sessions.running.Done()
+	}
+	return err
+}
+
+// goneRetention is how long the resource of a session stopped at its
+// maximum duration keeps answering 410
+const goneRetention = time.Hour
+
+// sessionRegistry holds the active WHIP sessions keyed by resource ID and stream key
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	streams  map[string]*session
+	// gone holds when the sessions stopped at their maximum duration ended
+	gone map[string]time.Time
+	// running counts the sessions added and not yet closed
+	running sync.WaitGroup
+}
+
+var sessions = &sessionRegistry{
+	sessions: map[string]*session{},
+	streams:  map[string]*session{},
+	gone:     map[string]time.Time{},
+}
+
+var (
+	errStreamKeyInUse  = errors.New("stream key already has an active publisher")
+	errTooManySessions = errors.New("too many active sessions")
+)
+
+// add registers the session, failing if its stream key already has a
+// publisher or MaxSessions are already active
+func (r *sessionRegistry) add(s *session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.streams[s.streamKey]; ok {
+		return errStreamKeyInUse
+	}
+	if len(r.sessions) >= config.MaxSessions {
+		return errTooManySessions
+	}
+	r.sessions[s.id] = s
+	r.streams[s.streamKey] = s
+	s.added = true
+	r.running.Add(1)
+	return nil
+}
+
+func (r *sessionRegistry) get(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// count returns the number of active sessions
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// list returns the active sessions, oldest first
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	all := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		all = append(all, s)
+	}
+	r.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].started.Before(all[j].started) })
+	return all
+}
+
+// remove deletes the session and returns it, or nil if it was already gone
+func (r *sessionRegistry) remove(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.sessions[id]
+	if s == nil {
+		return nil
+	}
+	delete(r.sessions, id)
+	delete(r.streams, s.streamKey)
+	return s
+}
+
+// removeSession removes s like remove, unless it is no longer registered
+// under its ID, which the reconnection of an ingest takes over, and reports
+// whether it did
+func (r *sessionRegistry) removeSession(s *session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[s.id] != s {
+		return false
+	}
+	delete(r.sessions, s.id)
+	delete(r.streams, s.streamKey)
+	return true
+}
+
+// expire removes s like removeSession, remembering its ID as gone
+func (r *sessionRegistry) expire(s *session) bool {
+	if !r.removeSession(s) {
+		return false
+	}
+	r.mu.Lock()
+	r.gone[s.id] = time.Now()
+	r.mu.Unlock()
+	return true
+}
+
+// isGone reports whether the session id was stopped at its maximum duration
+func (r *sessionRegistry) isGone(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.gone[id]
+	return ok
+}
+
+// forgetGone drops the sessions that ended goneRetention before now
+func (r *sessionRegistry) forgetGone(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, ended := range r.gone {
+		if now.Sub(ended) > goneRetention {
+			delete(r.gone, id)
+		}
+	}
+}
+
+// closeAll removes every session and closes them, flushing their output
+// files, then waits for those being closed elsewhere to finish too
+func (r *sessionRegistry) closeAll() {
+	r.mu.Lock()
+	all := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		all = append(all, s)
+	}
+	r.sessions = map[string]*session{}
+	r.streams = map[string]*session{}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Close(); err != nil {
+				s.log.Warn("Failed to close PeerConnection", "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	r.running.Wait()
+}
+
+// trackFileName names the outputs of a track by its kind, ID, simulcast RID
+// if any and SSRC, which tells apart the streams of tracks sharing an ID
+func trackFileName(kind webrtc.RTPCodecType, id, rid string, ssrc webrtc.SSRC) string {
+	name := kind.String() + "_" + sanitizeFileName(id)
+	if rid != "" {
+		name += "_" + sanitizeFileName(rid)
+	}
+	return name + "_" + strconv.FormatUint(uint64(ssrc), 10)
+}
+
+// sanitizeFileName makes a client-chosen name such as a track ID safe to use
+// as a file name, keeping only letters, digits, '.', '_' and '-'
+func sanitizeFileName(name string) string {
+	safe := []byte(name)
+	for i, c := range safe {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			safe[i] = '_'
+		}
+	}
+	if len(safe) > 64 {
+		safe = safe[:64]
+	}
+	// Leading dots would make the file hidden, or name "." or ".."
+	name = strings.TrimLeft(string(safe), ".")
+	if name == "" {
+		return "track"
+	}
+	return name
+}
+
+// Handler listing the active WHIP sessions, behind the same auth as WHIP
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, writeJSONError, http.MethodGet) {
+		return
+	}
+	if !requireAdminAuth(w, r) {
+		return
+	}
+
+	list := []sessionInfo{}
+	for _, s := range sessions.list() {
+		list = append(list, s.info())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+const defaultStreamKey = "default"
+
+var streamKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,127}$`)
+
+// streamKeyFromPath extracts the stream key from a path such as
+// /whip/{streamKey}, prefix being "/whip/"; a bare /whip uses the default stream
+func streamKeyFromPath(path, prefix string) (string, bool) {
+	key, found := strings.CutPrefix(path, prefix)
+	if !found {
+		return defaultStreamKey, true
+	}
+	return key, streamKeyPattern.MatchString(key)
+}
+
+// Handler for publishes to /whip/{streamKey} and the /whip/{id} resources they
+// create, which accept DELETE and PATCH for trickle ICE and ICE restarts.
+// Offers posted to a resource, renegotiating its media, get 405, and every
+// request to the resource of a session stopped at its maximum duration 410.
+func whipResourceHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/whip/")
+	if sessions.isGone(id) {
+		if requireResourceToken(w, r, rightPublish) {
+			http.Error(w, "Session stopped at its maximum duration", http.StatusGone)
+		}
+		return
+	}
+	if r.Method == http.MethodOptions && sessions.get(id) == nil {
+		whipHandler(w, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		// WHIP has no renegotiation: a session's media is fixed by its offer
+		if sessions.get(id) != nil {
+			w.Header().Set("Allow", "DELETE, PATCH")
+			http.Error(w, "Renegotiation is not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		whipHandler(w, r)
+		return
+	}
+
+	methods := []string{http.MethodDelete, http.MethodPatch}
+	if sessions.get(id) == nil {
+		// The path may as well name a stream to publish to
+		methods = append([]string{http.MethodOptions, http.MethodPost}, methods...)
+	}
+	if !allowMethods(w, r, http.Error, methods...) {
+		return
+	}
+	// A publisher's token must grant its stream
+	if s := sessions.get(id); s != nil {
+		if !requireStreamAuth(w, r, s.streamKey, rightPublish) {
+			return
+		}
+	} else if !requireResourceToken(w, r, rightPublish) {
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		s := sessions.get(id)
+		if s == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		whipPatchHandler(w, r, s)
+		return
+	}
+
+	s := sessions.remove(id)
+	if s == nil {
+		if ingestRetries.stop(id) {
+			w.WriteHeader(http.StatusOK)
+			slog.Info("Ingest stopped while reconnecting", "session", id)
+			return
+		}
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := s.Close(); err != nil {
+		s.log.Warn("Failed to close PeerConnection", "error", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	s.log.Info("WHIP session terminated")
+}
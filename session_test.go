@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "camera", want: "camera"},
+		{name: "video-1_hd.main", want: "video-1_hd.main"},
+		{name: "{8b4e-4f2a} front cam", want: "_8b4e-4f2a__front_cam"},
+		{name: "../../etc/passwd", want: "_.._etc_passwd"},
+		{name: ".hidden", want: "hidden"},
+		{name: "..", want: "track"},
+		{name: "cámara", want: "c__mara"},
+		{name: strings.Repeat("a", 100), want: strings.Repeat("a", 64)},
+		{name: "", want: "track"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFileName(tt.name); got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		kind webrtc.RTPCodecType
+		id   string
+		rid  string
+		ssrc webrtc.SSRC
+		want string
+	}{
+		{name: "video", kind: webrtc.RTPCodecTypeVideo, id: "camera", ssrc: 1234, want: "video_camera_1234"},
+		{name: "audio", kind: webrtc.RTPCodecTypeAudio, id: "mic", ssrc: 4294967295, want: "audio_mic_4294967295"},
+		{name: "simulcast layer", kind: webrtc.RTPCodecTypeVideo, id: "camera", rid: "low", ssrc: 5678, want: "video_camera_low_5678"},
+		{name: "unsafe ID and RID", kind: webrtc.RTPCodecTypeVideo, id: "../cam", rid: "a/b", ssrc: 1, want: "video__cam_a_b_1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trackFileName(tt.kind, tt.id, tt.rid, tt.ssrc); got != tt.want {
+				t.Errorf("trackFileName(%v, %q, %q, %d) = %q, want %q", tt.kind, tt.id, tt.rid, tt.ssrc, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTrackFileNames records two video tracks sharing an ID to IVF and
+// checks each went to a file named by its SSRC
+func TestTrackFileNames(t *testing.T) {
+	base := startServer(t)
+	p := newCodecPublisher(t, webrtc.MimeTypeVP8, webrtc.MimeTypeVP8)
+	resp, body := postOffer(t, base+"/whip/cam?format=ivf", p.pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	p.location = resp.Header.Get("Location")
+	waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	p.play(t, 500*time.Millisecond)
+	p.stop(t, base)
+
+	var want []string
+	for _, sender := range p.pc.GetSenders() {
+		want = append(want, fmt.Sprintf("video_video_%d.ivf", sender.GetParameters().Encodings[0].SSRC))
+	}
+	slices.Sort(want)
+	entries, err := os.ReadDir(filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".ivf" {
+			got = append(got, entry.Name())
+		}
+	}
+	if !slices.Equal(got, want) || want[0] == want[1] {
+		t.Errorf("recorded %v, want %v", got, want)
+	}
+}
+
+// TestWHIPDelete publishes a session, deletes its resource, possibly from
+// many requests at once, and checks it is closed exactly once with its
+// recording flushed
+func TestWHIPDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		// concurrent is how many DELETEs of the resource are sent at once
+		concurrent int
+		// unknown deletes another resource than the session's
+		unknown    bool
+		wantStatus []int
+	}{
+		{name: "deleted", concurrent: 1, wantStatus: []int{http.StatusOK}},
+		{name: "deleted concurrently", concurrent: 10, wantStatus: append([]int{http.StatusOK}, slices.Repeat([]int{http.StatusNotFound}, 9)...)},
+		{name: "unknown resource", concurrent: 1, unknown: true, wantStatus: []int{http.StatusNotFound}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			p := publish(t, base+"/whip", webrtc.MimeTypeVP8)
+			if ok, _ := regexp.MatchString(`^/whip/[0-9a-f-]{36}$`, p.location); !ok {
+				t.Fatalf("Location %q, want /whip/{id}", p.location)
+			}
+			p.play(t, 300*time.Millisecond)
+
+			location := p.location
+			if tt.unknown {
+				location = "/whip/unknown"
+			}
+			statuses := make([]int, tt.concurrent)
+			var wg sync.WaitGroup
+			for i := range tt.concurrent {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+					statuses[i] = resp.StatusCode
+				}()
+			}
+			wg.Wait()
+			slices.Sort(statuses)
+			if !slices.Equal(statuses, tt.wantStatus) {
+				t.Fatalf("DELETE %s answered %v, want %v", location, statuses, tt.wantStatus)
+			}
+
+			id := p.location[len("/whip/"):]
+			if deleted := sessions.get(id) == nil; deleted == tt.unknown {
+				t.Errorf("session deleted %v, want %v", deleted, !tt.unknown)
+			}
+			if tt.unknown {
+				return
+			}
+			paths, err := filepath.Glob(filepath.Join(config.OutputDir, id, "*.webm"))
+			if err != nil || len(paths) != 1 {
+				t.Fatalf("recorded %v, want one file: %v", paths, err)
+			}
+			if info, err := os.Stat(paths[0]); err != nil || info.Size() == 0 {
+				t.Errorf("recording %s not flushed: %v", paths[0], err)
+			}
+		})
+	}
+}
+
+// TestWHIPRenegotiation posts a new offer to the resource of a session and
+// checks it is turned away, leaving the session as it was
+func TestWHIPRenegotiation(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	p.play(t, 300*time.Millisecond)
+
+	offerer := newCodecPublisher(t, webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	resp, body := postOffer(t, base+p.location, offerer.pc, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST %s answered %d: %s, want %d", p.location, resp.StatusCode, body, http.StatusMethodNotAllowed)
+	}
+	if allow := resp.Header.Get("Allow"); allow != "DELETE, PATCH" {
+		t.Errorf("Allow = %q, want the methods of the resource", allow)
+	}
+	if n := sessions.count(); n != 1 {
+		t.Errorf("%d sessions after renegotiating, want 1", n)
+	}
+	if state := p.pc.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+		t.Errorf("publisher %s after renegotiating, want connected", state)
+	}
+	p.stop(t, base)
+}
+
+func TestStreamKeyFromPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		want   string
+		wantOK bool
+	}{
+		{path: "/whip", want: defaultStreamKey, wantOK: true},
+		{path: "/whip/cam", want: "cam", wantOK: true},
+		{path: "/whip/cam-1.hd_2", want: "cam-1.hd_2", wantOK: true},
+		{path: "/whip/" + strings.Repeat("k", 128), want: strings.Repeat("k", 128), wantOK: true},
+		{path: "/whip/" + strings.Repeat("k", 129)},
+		{path: "/whip/"},
+		{path: "/whip/.hidden"},
+		{path: "/whip/.."},
+		{path: "/whip/cam/1"},
+		{path: "/whip/cam%201"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := streamKeyFromPath(tt.path, "/whip/")
+			if ok != tt.wantOK || ok && got != tt.want {
+				t.Errorf("streamKeyFromPath(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestStreamKeys publishes to stream keys and checks each has a single
+// publisher at a time
+func TestStreamKeys(t *testing.T) {
+	base := startServer(t)
+	cam := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	other := publish(t, base+"/whip/other", webrtc.MimeTypeVP8)
+
+	resp, body := postOffer(t, base+"/whip/cam", newCodecPublisher(t, webrtc.MimeTypeVP8).pc, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("second publish to cam answered %d: %s, want 409", resp.StatusCode, body)
+	}
+	resp, _ = postOffer(t, base+"/whip/.hidden", newCodecPublisher(t, webrtc.MimeTypeVP8).pc, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("publish to .hidden answered %d, want 400", resp.StatusCode)
+	}
+
+	cam.play(t, 300*time.Millisecond)
+	other.play(t, 300*time.Millisecond)
+	cam.stop(t, base)
+	other.stop(t, base)
+	for _, p := range []*testPublisher{cam, other} {
+		dir := filepath.Join(config.OutputDir, strings.TrimPrefix(p.location, "/whip/"))
+		if paths, err := filepath.Glob(filepath.Join(dir, "*.webm")); err != nil || len(paths) != 1 {
+			t.Errorf("%s recorded %v, want one file: %v", p.location, paths, err)
+		}
+	}
+
+	// The key is free again once its publisher is gone
+	publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+}
+
+// TestRecordingDirectory checks that a session's files land in its
+// directory under -output-dir, next to which only its metadata is kept
+func TestRecordingDirectory(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	p.play(t, 300*time.Millisecond)
+	p.stop(t, base)
+
+	id := strings.TrimPrefix(p.location, "/whip/")
+	var files []string
+	err := filepath.WalkDir(config.OutputDir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && path != filepath.Join(config.OutputDir, id+metaSuffix) {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "recording.webm" {
+		t.Fatalf("recorded %v, want recording.webm", files)
+	}
+	for _, file := range files {
+		if dir := filepath.Dir(file); dir != filepath.Join(config.OutputDir, id) {
+			t.Errorf("%s recorded in %s, want the session directory", filepath.Base(file), dir)
+		}
+	}
+}
+
+// TestMaxSessions saturates -max-sessions, checks the next publish is turned
+// away with 503, and that ending a session makes room again
+func TestMaxSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSessions int
+	}{
+		{name: "one", maxSessions: 1},
+		{name: "three", maxSessions: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.MaxSessions = tt.maxSessions })
+			base := startServer(t)
+			var publishers []*testPublisher
+			for i := range tt.maxSessions {
+				publishers = append(publishers, publish(t, base+"/whip/cam"+strconv.Itoa(i), webrtc.MimeTypeVP8))
+			}
+
+			pc := newTestPeerConnection(t)
+			if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+				t.Fatal(err)
+			}
+			resp, body := postOffer(t, base+"/whip/extra", pc, nil)
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("publish past the limit answered %d: %s, want 503", resp.StatusCode, body)
+			}
+			if resp.Header.Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+			if n := sessions.count(); n != tt.maxSessions {
+				t.Errorf("%d sessions, want %d", n, tt.maxSessions)
+			}
+
+			publishers[0].stop(t, base)
+			publish(t, base+"/whip/extra", webrtc.MimeTypeVP8)
+		})
+	}
+}
+
+// TestSessionRegistryLimit adds sessions concurrently and checks that
+// exactly -max-sessions of them are let in
+func TestSessionRegistryLimit(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxSessions = 10 })
+	registry := &sessionRegistry{sessions: map[string]*session{}, streams: map[string]*session{}}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errs := map[error]int{}
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := registry.add(newSession("cam"+strconv.Itoa(i%40), nil))
+			mu.Lock()
+			errs[err]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if errs[nil] != 10 || errs[errTooManySessions]+errs[errStreamKeyInUse] != 40 {
+		t.Errorf("add results %v, want 10 sessions let in", errs)
+	}
+	if n := registry.count(); n != 10 {
+		t.Errorf("%d sessions registered, want 10", n)
+	}
+}
+
+// TestSessionsList checks GET /sessions lists the active sessions, behind
+// the same tokens as WHIP
+func TestSessionsList(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     []string
+		token      string
+		streams    []string
+		wantStatus int
+	}{
+		{name: "no sessions", wantStatus: http.StatusOK},
+		{name: "one session", streams: []string{"cam"}, wantStatus: http.StatusOK},
+		{name: "oldest first", streams: []string{"first", "second"}, wantStatus: http.StatusOK},
+		{name: "token required", tokens: []string{"secret"}, streams: []string{"cam"}, wantStatus: http.StatusUnauthorized},
+		{name: "valid token", tokens: []string{"secret"}, token: "secret", streams: []string{"cam"}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {})
+			base := startServer(t)
+			var publishers []*testPublisher
+			for _, stream := range tt.streams {
+				p := publish(t, base+"/whip/"+stream, webrtc.MimeTypeVP8)
+				p.play(t, 200*time.Millisecond)
+				publishers = append(publishers, p)
+			}
+			// Publishing without a token has to happen before they're required
+			config.Tokens = tt.tokens
+
+			req, err := http.NewRequest(http.MethodGet, base+"/sessions", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("GET /sessions answered %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var list []sessionInfo
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			if list == nil || len(list) != len(tt.streams) {
+				t.Fatalf("listed %+v, want %d sessions", list, len(tt.streams))
+			}
+			for i, info := range list {
+				if want := strings.TrimPrefix(publishers[i].location, "/whip/"); info.ID != want {
+					t.Errorf("session %d ID = %q, want %q", i, info.ID, want)
+				}
+				if info.StreamKey != tt.streams[i] {
+					t.Errorf("session %d stream key = %q, want %q", i, info.StreamKey, tt.streams[i])
+				}
+				if !slices.Contains(info.Codecs, webrtc.MimeTypeVP8) {
+					t.Errorf("session %d codecs = %v, want VP8", i, info.Codecs)
+				}
+				if info.ConnectionState != webrtc.PeerConnectionStateConnected.String() {
+					t.Errorf("session %d connection state = %q, want connected", i, info.ConnectionState)
+				}
+				if info.Started.IsZero() || time.Since(info.Started) > time.Minute {
+					t.Errorf("session %d started %v", i, info.Started)
+				}
+				if info.BytesWritten <= 0 {
+					t.Errorf("session %d wrote %d bytes", i, info.BytesWritten)
+				}
+			}
+		})
+	}
+}
+
+// TestSessionTrackDuration publishes frames whose RTP timestamps span two
+// seconds and wrap around, sent faster than real time, and checks /sessions
+// reports the span in the clock of each codec
+func TestSessionTrackDuration(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		kind     string
+		payload  []byte
+		// step is the timestamp increment between frames
+		step         uint32
+		frames       int
+		wantDuration int64
+	}{
+		{webrtc.MimeTypeVP8, "video", slices.Concat([]byte{0x10}, testVP8Keyframe[:10], make([]byte, 100)), 3000, 61, 2000},
+		{webrtc.MimeTypeOpus, "audio", testOpusSilence, 960, 101, 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mimeType, func(t *testing.T) {
+			base := startServer(t)
+			track, _, location := publishCodecRTP(t, base+"/whip/cam", tt.mimeType)
+			s := sessions.get(strings.TrimPrefix(location, "/whip/"))
+			if s == nil {
+				t.Fatalf("no session at %s", location)
+			}
+
+			// Start a second short of the 32-bit timestamp wrapping
+			start := uint32(1<<32 - int64(tt.step)*int64(tt.frames)/2)
+			for i := range tt.frames {
+				packet := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: start + uint32(i)*tt.step, Marker: true},
+					Payload: tt.payload,
+				}
+				if err := track.WriteRTP(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var info trackInfo
+			waitFor(t, "the track duration", func() bool {
+				tracks := s.info().Tracks
+				if len(tracks) != 1 {
+					return false
+				}
+				info = tracks[0]
+				return info.Duration >= tt.wantDuration
+			})
+			if info.Duration != tt.wantDuration || info.Kind != tt.kind || info.Codec != tt.mimeType {
+				t.Errorf("track %+v, want %s %s of %d ms", info, tt.kind, tt.mimeType, tt.wantDuration)
+			}
+			if want := trackCapability(tt.mimeType).ClockRate; info.ClockRate != want {
+				t.Errorf("clock rate %d, want %d", info.ClockRate, want)
+			}
+			if info.PacketsReceived != uint64(tt.frames) || info.PacketsLost != 0 || info.PacketsOutOfOrder != 0 {
+				t.Errorf("%d packets received, %d lost, %d out of order, want %d received in order",
+					info.PacketsReceived, info.PacketsLost, info.PacketsOutOfOrder, tt.frames)
+			}
+		})
+	}
+}
+
+// TestIdleTimeout checks a session is reaped once no track has received RTP
+// for -idle-timeout, and only then
+func TestIdleTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		// play are the indexes of the tracks sent, of VP8 and Opus
+		play       []int
+		wantReaped bool
+	}{
+		{name: "no media", idleTimeout: timeout, wantReaped: true},
+		{name: "media flowing", idleTimeout: timeout, play: []int{0, 1}},
+		{name: "audio gap", idleTimeout: timeout, play: []int{0}},
+		{name: "video gap", idleTimeout: timeout, play: []int{1}},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, slog.LevelInfo)
+			setConfig(t, func(c *Config) { c.IdleTimeout = tt.idleTimeout })
+			base := startServer(t)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+			sent := &testPublisher{}
+			for _, i := range tt.play {
+				sent.tracks = append(sent.tracks, p.tracks[i])
+			}
+			if len(sent.tracks) == 0 {
+				time.Sleep(3 * timeout)
+			}
+			sent.play(t, 3*timeout)
+
+			if reaped := sessions.count() == 0; reaped != tt.wantReaped {
+				t.Fatalf("session reaped %v, want %v", reaped, tt.wantReaped)
+			}
+			if n := len(logs.records(t, "No RTP received, closing idle session")); n != 0 != tt.wantReaped {
+				t.Errorf("logged %d idle closes", n)
+			}
+			if !tt.wantReaped {
+				p.stop(t, base)
+				return
+			}
+			waitFor(t, "the publisher to disconnect", func() bool {
+				return p.pc.ConnectionState() != webrtc.PeerConnectionStateConnected
+			})
+			req, err := http.NewRequest(http.MethodDelete, base+p.location, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("DELETE of a reaped session answered %d, want 404", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMaxSessionDurationFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "set", args: []string{"-max-session-duration", "2h"}, want: 2 * time.Hour},
+		{name: "negative", args: []string{"-max-session-duration", "-1s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.MaxSessionDuration != tt.want {
+				t.Errorf("max session duration %v, want %v", cfg.MaxSessionDuration, tt.want)
+			}
+		})
+	}
+}
+
+// TestMaxSessionDuration publishes past -max-session-duration and checks the
+// session is stopped with its recording finalized, its resource then gone
+func TestMaxSessionDuration(t *testing.T) {
+	const limit = 700 * time.Millisecond
+	logs := captureLogs(t, slog.LevelInfo)
+	setConfig(t, func(c *Config) { c.MaxSessionDuration = limit })
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	s := sessions.get(strings.TrimPrefix(p.location, "/whip/"))
+	if s == nil {
+		t.Fatalf("no session at %s", p.location)
+	}
+	p.play(t, 2*limit)
+
+	if sessions.get(s.id) != nil {
+		t.Fatal("session still active past its maximum duration")
+	}
+	if n := len(logs.records(t, "Maximum session duration reached, stopping session")); n != 1 {
+		t.Errorf("logged %d stops at the maximum duration, want 1", n)
+	}
+	if n := len(logs.records(t, "WHIP session terminated")); n != 0 {
+		t.Errorf("stop logged as %d client DELETEs", n)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration, sized := webmInfo(t, data); !sized || duration <= 0 || duration > float64(limit.Milliseconds()) {
+		t.Errorf("recording of %v ms, sized %v, want finalized within %v", duration, sized, limit)
+	}
+
+	for _, method := range []string{http.MethodDelete, http.MethodPatch, http.MethodPost} {
+		req, err := http.NewRequest(method, base+p.location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGone {
+			t.Errorf("%s of the stopped session answered %d, want 410", method, resp.StatusCode)
+		}
+	}
+}
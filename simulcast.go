@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// simulcastSchemes are common RID naming schemes, lowest layer first
+var simulcastSchemes = [][]string{
+	{"q", "h", "f"},
+	{"l", "m", "h"},
+	{"low", "mid", "high"},
+	{"low", "medium", "high"},
+}
+
+// highestLayer returns the RID of the best simulcast layer of a receiver, or
+// "" without simulcast. RIDs that all belong to a known naming scheme are
+// ranked by it; otherwise the first RID of the offer wins, as layers are
+// listed in order of preference (RFC 8853).
+func highestLayer(receiver *webrtc.RTPReceiver) string {
+	var rids []string
+	for _, track := range receiver.Tracks() {
+		if track.RID() != "" {
+			rids = append(rids, track.RID())
+		}
+	}
+	return highestRID(rids)
+}
+
+// highestRID returns the best of the simulcast layers rids, in the order of
+// the offer, or "" when there are none
+func highestRID(rids []string) string {
+	if len(rids) == 0 {
+		return ""
+	}
+
+	for _, scheme := range simulcastSchemes {
+		best, rank := "", -1
+		for _, rid := range rids {
+			i := slices.Index(scheme, strings.ToLower(rid))
+			if i < 0 {
+				rank = -1
+				break
+			}
+			if i > rank {
+				best, rank = rid, i
+			}
+		}
+		if rank >= 0 {
+			return best
+		}
+	}
+	return rids[0]
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestHighestRID(t *testing.T) {
+	tests := []struct {
+		name string
+		rids []string
+		want string
+	}{
+		{name: "no simulcast"},
+		{name: "q h f", rids: []string{"q", "h", "f"}, want: "f"},
+		{name: "f first", rids: []string{"f", "q"}, want: "f"},
+		{name: "l m h", rids: []string{"l", "m", "h"}, want: "h"},
+		{name: "low mid", rids: []string{"low", "mid"}, want: "mid"},
+		{name: "low medium high", rids: []string{"medium", "high", "low"}, want: "high"},
+		{name: "other case", rids: []string{"Low", "HIGH"}, want: "HIGH"},
+		// h ranks low in q/h/f, which doesn't hold l
+		{name: "mixed schemes", rids: []string{"l", "h", "f"}, want: "l"},
+		{name: "unknown names", rids: []string{"b", "a"}, want: "b"},
+		{name: "single layer", rids: []string{"q"}, want: "q"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highestRID(tt.rids); got != tt.want {
+				t.Errorf("highestRID(%v) = %q, want %q", tt.rids, got, tt.want)
+			}
+		})
+	}
+}
+
+// simulcastPublisher sends a VP8 track in a simulcast layer for each of its
+// RIDs. pion leaves the MID and RID header extensions that tell the layers
+// apart to the application, so it writes the RTP itself.
+type simulcastPublisher struct {
+	pc     *webrtc.PeerConnection
+	sender *webrtc.RTPSender
+	rids   []string
+	tracks []*webrtc.TrackLocalStaticRTP
+}
+
+func newSimulcastPublisher(t *testing.T, rids ...string) *simulcastPublisher {
+	t.Helper()
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, []string{webrtc.MimeTypeVP8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	p := &simulcastPublisher{pc: pc, rids: rids}
+	for _, rid := range rids {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "test", webrtc.WithRTPStreamID(rid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.sender == nil {
+			p.sender, err = pc.AddTrack(track)
+		} else {
+			err = p.sender.AddEncoding(track)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.tracks = append(p.tracks, track)
+	}
+	return p
+}
+
+// play sends frames of the sample VP8 media on every layer in real time
+func (p *simulcastPublisher) play(t *testing.T, frames int) {
+	t.Helper()
+	var midID, ridID uint8
+	for _, ext := range p.sender.GetParameters().HeaderExtensions {
+		switch ext.URI {
+		case sdp.SDESMidURI:
+			midID = uint8(ext.ID)
+		case sdp.SDESRTPStreamIDURI:
+			ridID = uint8(ext.ID)
+		}
+	}
+	if midID == 0 || ridID == 0 {
+		t.Fatal("MID and RID header extensions not negotiated")
+	}
+	mid := p.pc.GetTransceivers()[0].Mid()
+
+	packetizers := make([]rtp.Packetizer, len(p.tracks))
+	for i := range packetizers {
+		packetizers[i] = rtp.NewPacketizer(1200, 96, uint32(i+1), &codecs.VP8Payloader{}, rtp.NewRandomSequencer(), 90000)
+	}
+	for i := range frames {
+		s := sample(webrtc.MimeTypeVP8, i)
+		for j, track := range p.tracks {
+			for _, packet := range packetizers[j].Packetize(s.Data, 3000) {
+				if err := packet.SetExtension(midID, []byte(mid)); err != nil {
+					t.Fatal(err)
+				}
+				if err := packet.SetExtension(ridID, []byte(p.rids[j])); err != nil {
+					t.Fatal(err)
+				}
+				if err := track.WriteRTP(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		time.Sleep(s.Duration)
+	}
+}
+
+// TestSimulcast publishes simulcast layers and checks which of them were
+// recorded
+func TestSimulcast(t *testing.T) {
+	tests := []struct {
+		name      string
+		rids      []string
+		allLayers bool
+		// want are the RIDs recorded
+		want []string
+	}{
+		{name: "highest layer", rids: []string{"q", "f"}, want: []string{"f"}},
+		{name: "highest layer listed first", rids: []string{"f", "q"}, want: []string{"f"}},
+		{name: "unknown names", rids: []string{"b", "a"}, want: []string{"b"}},
+		{name: "all layers", rids: []string{"q", "f"}, allLayers: true, want: []string{"f", "q"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) { c.RecordAllLayers = tt.allLayers })
+			logs := captureLogs(t, slog.LevelInfo)
+			base := startServer(t)
+			p := newSimulcastPublisher(t, tt.rids...)
+			resp, body := postOffer(t, base+"/whip/cam", p.pc, nil)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+			}
+			waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+			p.play(t, 40)
+			(&testPublisher{location: resp.Header.Get("Location")}).stop(t, base)
+
+			// The recorded layer goes to recording.webm, the lower layers
+			// kept with -record-all-layers to a file of their own
+			if paths, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "recording.webm")); err != nil || len(paths) != 1 {
+				t.Fatalf("recorded %v, want one WebM file: %v", paths, err)
+			}
+			paths, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "video_*.ivf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, path := range paths {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fourcc, _, _, _, _ := readIVF(t, data); fourcc != "VP80" {
+					t.Errorf("%s has FourCC %q, want VP80", path, fourcc)
+				}
+				// video_<track>_<rid>_<ssrc>.ivf
+				parts := strings.Split(strings.TrimSuffix(filepath.Base(path), ".ivf"), "_")
+				got = append(got, parts[len(parts)-2])
+			}
+			dropped := map[any]bool{}
+			for _, record := range logs.records(t, "Simulcast layer not recorded") {
+				dropped[record["rid"]] = true
+			}
+			for _, rid := range tt.rids {
+				if !dropped[rid] && !slices.Contains(got, rid) {
+					got = append(got, rid)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recorded layers %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSimulcastAllLayers records three simulcast layers with
+// -record-all-layers and checks each went to a valid file of its own, and
+// was asked for keyframes every -layer-keyframe-interval
+func TestSimulcastAllLayers(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.RecordAllLayers = true
+		c.LayerKeyframeInterval = 300 * time.Millisecond
+	})
+	base := startServer(t)
+	rids := []string{"q", "h", "f"}
+	p := newSimulcastPublisher(t, rids...)
+
+	// pion races a read of RTCP with the Close of the PeerConnection, so the
+	// readers stop on the first packet after the play, before it is closed
+	var (
+		mu      sync.Mutex
+		plis    = map[string]int{}
+		readers sync.WaitGroup
+		played  atomic.Bool
+	)
+	for _, rid := range rids {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for !played.Load() {
+				packets, _, err := p.sender.ReadSimulcastRTCP(rid)
+				if err != nil {
+					return
+				}
+				for _, packet := range packets {
+					if _, ok := packet.(*rtcp.PictureLossIndication); ok {
+						mu.Lock()
+						plis[rid]++
+						mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+
+	resp, body := postOffer(t, base+"/whip/cam", p.pc, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("publish answered %d: %s", resp.StatusCode, body)
+	}
+	waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	p.play(t, 45)
+	played.Store(true)
+	readersDone := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(readersDone)
+	}()
+	select {
+	case <-readersDone:
+	case <-time.After(testTimeout):
+		t.Fatal("RTCP still read after the play")
+	}
+	// The publisher going away ends the session, finalizing its recordings
+	p.pc.Close()
+	waitFor(t, "the session to end", func() bool { return sessions.count() == 0 })
+	sessions.closeAll()
+
+	mu.Lock()
+	for _, rid := range rids {
+		// The first request, then one per interval for the second and a half played
+		if plis[rid] < 4 {
+			t.Errorf("layer %s asked for %d keyframes, want 4 at least", rid, plis[rid])
+		}
+	}
+	mu.Unlock()
+
+	dir := filepath.Join(config.OutputDir, strings.TrimPrefix(resp.Header.Get("Location"), "/whip/"))
+	if _, err := os.Stat(filepath.Join(dir, "recording.webm")); err != nil {
+		t.Errorf("highest layer not recorded with the session: %v", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "video_*.ivf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fourcc, _, _, _, frames := readIVF(t, data)
+		if fourcc != "VP80" || len(frames) == 0 || !isKeyframe(webrtc.MimeTypeVP8, frames[0].data) {
+			t.Errorf("%s holds %d %q frames, want VP80 starting on a keyframe", filepath.Base(path), len(frames), fourcc)
+		}
+		// video_<track>_<rid>_<ssrc>.ivf
+		parts := strings.Split(strings.TrimSuffix(filepath.Base(path), ".ivf"), "_")
+		got = append(got, parts[len(parts)-2])
+	}
+	slices.Sort(got)
+	if want := []string{"f", "h", "q"}; !slices.Equal(got, want) {
+		t.Errorf("layer files %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/image/vp8"
+)
+
+// snapshotQuality is the JPEG quality of the images served by /snapshot
+const snapshotQuality = 85
+
+// cachedKeyframe is the latest keyframe of a stream's video track
+type cachedKeyframe struct {
+	mimeType string
+	frame    []byte
+	received time.Time
+}
+
+// keyframeCache holds the latest keyframe of each stream, keyed by stream key.
+// Frames are kept as received and only decoded when a snapshot is asked for.
+type keyframeCache struct {
+	mu     sync.Mutex
+	frames map[string]cachedKeyframe
+}
+
+var snapshots = &keyframeCache{frames: map[string]cachedKeyframe{}}
+
+// store replaces the keyframe of streamKey with a copy of frame. Only the
+// codec is kept of a frame no snapshot can be decoded from.
+func (c *keyframeCache) store(streamKey, mimeType string, frame []byte) {
+	if !snapshotDecodable(mimeType) {
+		frame = nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames[streamKey] = cachedKeyframe{mimeType: mimeType, frame: bytes.Clone(frame), received: time.Now()}
+}
+
+func (c *keyframeCache) get(streamKey string) (cachedKeyframe, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.frames[streamKey]
+	return k, ok
+}
+
+// forget drops the keyframe of streamKey once its video track ends
+func (c *keyframeCache) forget(streamKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.frames, streamKey)
+}
+
+// errNoDecoder reports a keyframe of a codec snapshots can't be decoded from
+var errNoDecoder = errors.New("no decoder for the codec")
+
+// snapshotDecodable reports whether snapshots can be decoded from the
+// keyframes of mimeType. Only VP8 can: there is no Go decoder for VP9, H.264
+// or AV1, so their snapshots are answered 501.
+func snapshotDecodable(mimeType string) bool {
+	return mimeType == webrtc.MimeTypeVP8
+}
+
+// decodeKeyframe decodes a keyframe into an image, failing with errNoDecoder
+// for the codecs snapshotDecodable rejects
+func decodeKeyframe(mimeType string, frame []byte) (image.Image, error) {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		d := vp8.NewDecoder()
+		d.Init(bytes.NewReader(frame), len(frame))
+		if _, err := d.DecodeFrameHeader(); err != nil {
+			return nil, err
+		}
+		return d.DecodeFrame()
+	default:
+		return nil, fmt.Errorf("%w %s", errNoDecoder, mimeType)
+	}
+}
+
+// Handler for GET /snapshot/{streamKey}, answering the latest keyframe of
+// the stream's video as a JPEG, or 404 until one has been received. Streams
+// of a codec without a decoder, VP9 among them, are answered 501.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, writeJSONError, http.MethodGet) {
+		return
+	}
+	if !requireAdminAuth(w, r) {
+		return
+	}
+	streamKey, ok := streamKeyFromPath(r.URL.Path, "/snapshot/")
+	if !ok {
+		writeJSONError(w, "Invalid stream key", http.StatusBadRequest)
+		return
+	}
+
+	keyframe, ok := snapshots.get(streamKey)
+	if !ok {
+		writeJSONError(w, "No keyframe received for the stream", http.StatusNotFound)
+		return
+	}
+	img, err := decodeKeyframe(keyframe.mimeType, keyframe.frame)
+	if errors.Is(err, errNoDecoder) {
+		writeJSONError(w, "Snapshots can't be taken of "+keyframe.mimeType+": only VP8 can be decoded", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to decode the keyframe: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: snapshotQuality}); err != nil {
+		writeJSONError(w, "Failed to encode the snapshot", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Last-Modified", keyframe.received.UTC().Format(http.TimeFormat))
+	w.Write(buf.Bytes())
+}
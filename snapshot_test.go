@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// testVP8Decodable is a 1x1 VP8 keyframe that decodes, unlike the padded
+// header of testVP8Keyframe
+var testVP8Decodable = []byte{
+	0x30, 0x01, 0x00, 0x9d, 0x01, 0x2a, 0x01, 0x00, 0x01, 0x00, 0x0e, 0xc0,
+	0xfe, 0x25, 0xa4, 0x00, 0x03, 0x70, 0x00, 0x00, 0x00, 0x00,
+}
+
+// getSnapshot gets the snapshot at path and returns the response with its body
+func getSnapshot(t *testing.T, base, path string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// TestSnapshot publishes a VP8 keyframe and checks its snapshot decodes as a
+// JPEG of the frame's size, until the publisher leaves
+func TestSnapshot(t *testing.T) {
+	base := startServer(t)
+	if resp, body := getSnapshot(t, base, "/snapshot/cam"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("snapshot before any keyframe answered %d: %s, want 404", resp.StatusCode, body)
+	}
+
+	track, _, location := publishRTP(t, base+"/whip/cam")
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: 1, Timestamp: 3000, Marker: true},
+		Payload: append([]byte{0x10}, testVP8Decodable...),
+	}
+	if err := track.WriteRTP(packet); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the keyframe to be cached", func() bool {
+		_, ok := snapshots.get("cam")
+		return ok
+	})
+
+	resp, body := getSnapshot(t, base, "/snapshot/cam")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("snapshot answered %d with %q: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("snapshot isn't a JPEG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 1 || size.Y != 1 {
+		t.Errorf("snapshot is %v, want the 1x1 of the keyframe", size)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted.Body.Close()
+	waitFor(t, "the keyframe to be forgotten", func() bool {
+		_, ok := snapshots.get("cam")
+		return !ok
+	})
+	if resp, body := getSnapshot(t, base, "/snapshot/cam"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("snapshot after the publisher left answered %d: %s, want 404", resp.StatusCode, body)
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		mimeType   string
+		frame      []byte
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "no keyframe", path: "/snapshot/cam", wantStatus: http.StatusNotFound, wantBody: "No keyframe"},
+		{name: "invalid stream key", path: "/snapshot/", wantStatus: http.StatusBadRequest, wantBody: "Invalid stream key"},
+		{name: "no H.264 decoder", path: "/snapshot/cam", mimeType: webrtc.MimeTypeH264, frame: testH264Keyframe, wantStatus: http.StatusNotImplemented, wantBody: "video/H264: only VP8"},
+		{name: "no VP9 decoder", path: "/snapshot/cam", mimeType: webrtc.MimeTypeVP9, frame: []byte{0x82, 0x49, 0x83, 0x42, 0x00}, wantStatus: http.StatusNotImplemented, wantBody: "video/VP9: only VP8"},
+		{name: "corrupt keyframe", path: "/snapshot/cam", mimeType: webrtc.MimeTypeVP8, frame: testVP8Keyframe, wantStatus: http.StatusInternalServerError, wantBody: "Failed to decode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			if tt.mimeType != "" {
+				snapshots.store("cam", tt.mimeType, tt.frame)
+				t.Cleanup(func() { snapshots.forget("cam") })
+			}
+			resp, body := getSnapshot(t, base, tt.path)
+			if resp.StatusCode != tt.wantStatus || !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("GET %s answered %d: %s, want %d with %q", tt.path, resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
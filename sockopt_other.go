@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// receiveBufferSize can't read the receive buffer outside Unix
+func receiveBufferSize(*net.UDPConn) (int, error) {
+	return 0, errors.ErrUnsupported
+}
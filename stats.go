@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtpStats hands each PeerConnection the getter of its stats interceptor,
+// which records the inbound RTP stats pion's GetStats leaves out. Interceptors
+// are built with no PeerConnection ID, so newPeerConnection creates one
+// PeerConnection at a time and takes the getter that was just built.
+var rtpStats struct {
+	mu     sync.Mutex
+	getter stats.Getter
+}
+
+// configureStats registers the stats interceptor
+func configureStats(registry *interceptor.Registry) error {
+	factory, err := stats.NewInterceptor()
+	if err != nil {
+		return err
+	}
+	factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		rtpStats.getter = getter
+	})
+	registry.Add(factory)
+	return nil
+}
+
+// newPeerConnection creates a PeerConnection with the shared configuration,
+// along with the getter of its RTP stats. With a keyLog it gets an API of
+// its own, logging the keys of its DTLS handshake there.
+func newPeerConnection(keyLog io.Writer) (*webrtc.PeerConnection, stats.Getter, error) {
+	api := webrtcAPI
+	if keyLog != nil {
+		var err error
+		if api, err = newKeyLogAPI(keyLog); err != nil {
+			return nil, nil, err
+		}
+	}
+	rtpStats.mu.Lock()
+	defer rtpStats.mu.Unlock()
+	rtpStats.getter = nil
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfig())
+	return peerConnection, rtpStats.getter, err
+}
+
+// stats returns the WebRTC stats of the session's PeerConnection, with an
+// inbound-rtp entry for every track received
+func (s *session) stats() webrtc.StatsReport {
+	report := s.peerConnection.GetStats()
+	if s.rtpStats == nil {
+		return report
+	}
+	for _, transceiver := range s.peerConnection.GetTransceivers() {
+		for _, track := range transceiver.Receiver().Tracks() {
+			recorded := s.rtpStats.Get(uint32(track.SSRC()))
+			if recorded == nil {
+				continue
+			}
+			inbound := recorded.InboundRTPStreamStats
+			id := fmt.Sprintf("InboundRTPStream-%d", track.SSRC())
+			report[id] = webrtc.InboundRTPStreamStats{
+				Mid:                         transceiver.Mid(),
+				Timestamp:                   statsTimestamp(time.Now()),
+				Type:                        webrtc.StatsTypeInboundRTP,
+				ID:                          id,
+				SSRC:                        track.SSRC(),
+				Kind:                        track.Kind().String(),
+				FIRCount:                    inbound.FIRCount,
+				PLICount:                    inbound.PLICount,
+				NACKCount:                   inbound.NACKCount,
+				LastPacketReceivedTimestamp: statsTimestamp(inbound.LastPacketReceivedTimestamp),
+				HeaderBytesReceived:         inbound.HeaderBytesReceived,
+				BytesReceived:               inbound.BytesReceived,
+				PacketsReceived:             uint32(inbound.PacketsReceived),
+				PacketsLost:                 int32(inbound.PacketsLost),
+				// The interceptor keeps the jitter in RTP timestamp units
+				Jitter: inbound.Jitter / float64(track.Codec().ClockRate),
+			}
+		}
+	}
+	return report
+}
+
+// statsTimestamp converts t to milliseconds since the epoch, as stats report them
+func statsTimestamp(t time.Time) webrtc.StatsTimestamp {
+	return webrtc.StatsTimestamp(float64(t.UnixNano()) / float64(time.Millisecond))
+}
+
+// statsHandler serves GET /stats/{id} with the WebRTC stats of a session's
+// PeerConnection, keyed by stats ID
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, writeJSONError, http.MethodGet) {
+		return
+	}
+	if !requireAdminAuth(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/stats/")
+	sess := sessions.get(id)
+	if sess == nil {
+		writeJSONError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess.stats())
+}
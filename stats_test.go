@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TestStats publishes a stream and checks its stats report the inbound RTP
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     []string
+		token      string
+		id         string
+		wantStatus int
+	}{
+		{name: "session", wantStatus: http.StatusOK},
+		{name: "unknown session", id: "unknown", wantStatus: http.StatusNotFound},
+		{name: "token required", tokens: []string{"secret"}, wantStatus: http.StatusUnauthorized},
+		{name: "valid token", tokens: []string{"secret"}, token: "secret", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			p.play(t, 500*time.Millisecond)
+			// Publishing without a token has to happen before they're required
+			config.Tokens = tt.tokens
+
+			id := tt.id
+			if id == "" {
+				id = strings.TrimPrefix(p.location, "/whip/")
+			}
+			req, err := http.NewRequest(http.MethodGet, base+"/stats/"+id, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("GET /stats/%s answered %d, want %d", id, resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var report map[string]map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			var inbound int
+			for _, stats := range report {
+				if stats["type"] != string(webrtc.StatsTypeInboundRTP) {
+					continue
+				}
+				inbound++
+				if received, _ := stats["packetsReceived"].(float64); received <= 0 {
+					t.Errorf("inbound-rtp %v received %v packets", stats["id"], stats["packetsReceived"])
+				}
+				for _, field := range []string{"packetsLost", "jitter"} {
+					if _, ok := stats[field]; !ok {
+						t.Errorf("inbound-rtp %v has no %s", stats["id"], field)
+					}
+				}
+			}
+			if inbound == 0 {
+				t.Errorf("no inbound-rtp stats in %v", report)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// sweepInterval is how often the sweeper looks for expired sessions
+const sweepInterval = 5 * time.Second
+
+// runSweeper sweeps the session registry every sweepInterval until ctx ends,
+// forgetting the sessions gone for goneRetention
+func runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sessions.sweep(now)
+			sessions.forgetGone(now)
+		}
+	}
+}
+
+// sweep closes the sessions abandoned by their publisher: those with no
+// activity for -session-ttl and those out of the connected state for
+// -connect-timeout. It returns how many it closed. Like a DELETE or the idle
+// timer, it only closes the sessions it removes from the registry, so each
+// session is closed once.
+func (r *sessionRegistry) sweep(now time.Time) int {
+	swept := 0
+	for _, s := range r.list() {
+		reason, ok := s.expired(now)
+		if !ok || !r.removeSession(s) {
+			continue
+		}
+		s.log.Warn("Closing abandoned session", "reason", reason)
+		if err := s.Close(); err != nil {
+			s.log.Warn("Failed to close PeerConnection", "error", err)
+		}
+		swept++
+	}
+	return swept
+}
+
+// expired reports whether s is due to be swept at now, and why
+func (s *session) expired(now time.Time) (string, bool) {
+	if config.SessionTTL > 0 && now.Sub(time.Unix(0, s.lastActivity.Load())) > config.SessionTTL {
+		return "no activity within -session-ttl", true
+	}
+	s.mu.Lock()
+	state, since := s.state, s.stateSince
+	s.mu.Unlock()
+	if config.ConnectTimeout > 0 && state != webrtc.PeerConnectionStateConnected && now.Sub(since) > config.ConnectTimeout {
+		return "not connected within -connect-timeout", true
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TestSweep fakes the activity and connection state of a session and checks
+// whether the sweeper closes it
+func TestSweep(t *testing.T) {
+	const ttl, connectTimeout = time.Minute, 10 * time.Second
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		idle       time.Duration
+		state      webrtc.PeerConnectionState
+		stateAge   time.Duration
+		deleted    bool
+		wantSwept  bool
+		wantReason string
+	}{
+		{name: "active", ttl: ttl, idle: time.Second, state: webrtc.PeerConnectionStateConnected, stateAge: time.Hour},
+		{name: "stale", ttl: ttl, idle: 2 * ttl, state: webrtc.PeerConnectionStateConnected, stateAge: time.Hour, wantSwept: true, wantReason: "-session-ttl"},
+		{name: "stale without a TTL", idle: 2 * ttl, state: webrtc.PeerConnectionStateConnected, stateAge: time.Hour},
+		{name: "connecting", ttl: ttl, state: webrtc.PeerConnectionStateConnecting, stateAge: time.Second},
+		{name: "never connected", ttl: ttl, state: webrtc.PeerConnectionStateNew, stateAge: 2 * connectTimeout, wantSwept: true, wantReason: "-connect-timeout"},
+		{name: "stuck connecting", ttl: ttl, state: webrtc.PeerConnectionStateConnecting, stateAge: 2 * connectTimeout, wantSwept: true, wantReason: "-connect-timeout"},
+		{name: "already deleted", ttl: ttl, idle: 2 * ttl, state: webrtc.PeerConnectionStateConnected, deleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.OutputDir = t.TempDir()
+				c.SessionTTL = tt.ttl
+				c.ConnectTimeout = connectTimeout
+			})
+			t.Cleanup(sessions.closeAll)
+			logs := captureLogs(t, slog.LevelWarn)
+			s := newSession("cam", newTestPeerConnection(t))
+			if err := sessions.add(s); err != nil {
+				t.Fatal(err)
+			}
+			// Close the session even if the test leaves it out of the registry
+			t.Cleanup(func() { s.Close() })
+			now := time.Now()
+			s.lastActivity.Store(now.Add(-tt.idle).UnixNano())
+			s.state, s.stateSince = tt.state, now.Add(-tt.stateAge)
+			if tt.deleted {
+				sessions.remove(s.id)
+			}
+
+			swept := sessions.sweep(now)
+			if swept == 1 != tt.wantSwept {
+				t.Fatalf("swept %d sessions, want swept %v", swept, tt.wantSwept)
+			}
+			if !tt.wantSwept {
+				if s.closed || !tt.deleted && sessions.get(s.id) == nil {
+					t.Error("session closed without being swept")
+				}
+				return
+			}
+			if sessions.get(s.id) != nil || !s.closed {
+				t.Error("swept session still registered or open")
+			}
+			records := logs.records(t, "Closing abandoned session")
+			if len(records) != 1 || !strings.Contains(records[0]["reason"].(string), tt.wantReason) {
+				t.Errorf("logged %v, want one close for %s", records, tt.wantReason)
+			}
+		})
+	}
+}
+
+// TestSweepPublish checks the sweeper leaves a connected publisher alone,
+// then closes it once it goes quiet past -session-ttl, after which DELETE
+// finds no session
+func TestSweepPublish(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.IdleTimeout = 0
+		c.SessionTTL = time.Minute
+		c.ConnectTimeout = time.Second
+	})
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	p.play(t, 200*time.Millisecond)
+	s := sessions.get(strings.TrimPrefix(p.location, "/whip/"))
+	if s == nil {
+		t.Fatal("no session")
+	}
+	if n := sessions.sweep(time.Now().Add(30 * time.Second)); n != 0 {
+		t.Fatalf("swept %d connected sessions", n)
+	}
+	if n := sessions.sweep(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("swept %d sessions, want the quiet one", n)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, base+p.location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE of a swept session answered %d, want 404", resp.StatusCode)
+	}
+}
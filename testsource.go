@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// testSourceFrameDuration is the duration of a frame whose successor doesn't tell it
+const testSourceFrameDuration = time.Second / 30
+
+// testSource is the VP8 IVF file of -test-source, looped to WHEP viewers of
+// streams that have no publisher, for smoke-testing playback without a camera
+type testSource struct {
+	samples []media.Sample
+}
+
+// loadTestSource reads the frames of a VP8 IVF file, timing each by the
+// timestamp of the next
+func loadTestSource(path string) (*testSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < ivfFileHeaderSize || string(data[:4]) != "DKIF" {
+		return nil, errors.New("not an IVF file")
+	}
+	if fourcc := string(data[8:12]); fourcc != "VP80" {
+		return nil, fmt.Errorf("codec %q is not VP8", fourcc)
+	}
+	// The timebase is scale/rate seconds per tick
+	rate, scale := binary.LittleEndian.Uint32(data[16:]), binary.LittleEndian.Uint32(data[20:])
+	if rate == 0 || scale == 0 {
+		return nil, errors.New("invalid timebase")
+	}
+
+	source := &testSource{}
+	var timestamps []uint64
+	for offset := ivfFileHeaderSize; offset < len(data); {
+		if len(data)-offset < ivfFrameHeaderSize {
+			return nil, errors.New("truncated frame header")
+		}
+		size := int(binary.LittleEndian.Uint32(data[offset:]))
+		timestamps = append(timestamps, binary.LittleEndian.Uint64(data[offset+4:]))
+		offset += ivfFrameHeaderSize
+		if size > len(data)-offset {
+			return nil, errors.New("truncated frame")
+		}
+		source.samples = append(source.samples, media.Sample{Data: data[offset : offset+size], Duration: testSourceFrameDuration})
+		offset += size
+	}
+	if len(source.samples) == 0 {
+		return nil, errors.New("no frames")
+	}
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] > timestamps[i-1] {
+			ticks := time.Duration(timestamps[i]-timestamps[i-1]) * time.Duration(scale)
+			source.samples[i-1].Duration = ticks * time.Second / time.Duration(rate)
+		}
+	}
+	return source, nil
+}
+
+// play writes the frames to track in real time, from the start again once
+// the last was sent, until ctx ends
+func (s *testSource) play(ctx context.Context, track *webrtc.TrackLocalStaticSample) {
+	for i := 0; ; i = (i + 1) % len(s.samples) {
+		sample := s.samples[i]
+		if err := track.WriteSample(sample); err != nil {
+			return
+		}
+		select {
+		case <-time.After(sample.Duration):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
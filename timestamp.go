@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+// rtpClock turns the RTP timestamps of a track into presentation times
+// relative to the first frame written
+type rtpClock struct {
+	clockRate uint32
+	started   bool
+	last      uint32
+	elapsed   int64 // ticks since the first timestamp, extended past 32 bits
+}
+
+func newRTPClock(clockRate uint32) *rtpClock {
+	return &rtpClock{clockRate: clockRate}
+}
+
+// pts returns the presentation time of timestamp. The first call sets the
+// baseline; later timestamps are taken relative to the previous one, so the
+// 32-bit counter may wrap around during long recordings.
+func (c *rtpClock) pts(timestamp uint32) time.Duration {
+	return ticksToDuration(c.ticks(timestamp), c.clockRate)
+}
+
+// ticks returns the clock ticks from the first timestamp to timestamp
+func (c *rtpClock) ticks(timestamp uint32) int64 {
+	if !c.started {
+		c.started = true
+		c.last = timestamp
+	}
+	// A signed difference keeps slightly reordered timestamps from looking
+	// like a jump of almost 2^32 ticks
+	c.elapsed += int64(int32(timestamp - c.last))
+	c.last = timestamp
+	return c.elapsed
+}
+
+// ticksToDuration converts ticks of a clockRate clock into a duration
+func ticksToDuration(ticks int64, clockRate uint32) time.Duration {
+	if clockRate == 0 {
+		return 0
+	}
+	// Split into whole seconds first so the nanosecond product can't overflow
+	rate := int64(clockRate)
+	return time.Duration(ticks/rate)*time.Second + time.Duration(ticks%rate)*time.Second/time.Duration(rate)
+}
+
+// durationToTicks converts d into the nearest tick of a clockRate clock
+func durationToTicks(d time.Duration, clockRate uint32) int64 {
+	rate := int64(clockRate)
+	seconds, rest := int64(d/time.Second), int64(d%time.Second)
+	return seconds*rate + (rest*rate+int64(time.Second)/2)/int64(time.Second)
+}
+
+// timestampMapper maps the RTP timestamps of the frames of a track onto
+// presentation times that only move forward, as containers and the players
+// seeking in them expect. The first timestamp, whatever its random offset,
+// maps to zero and wraps of the 32-bit counter are followed. A frame that
+// falls behind the previous one, as reordering can cause, is placed a tick
+// after it instead.
+type timestampMapper struct {
+	clock rtpClock
+	last  int64
+	// frames counts the frames mapped, the index of the next one
+	frames int64
+}
+
+func newTimestampMapper(clockRate uint32) *timestampMapper {
+	return &timestampMapper{clock: rtpClock{clockRate: clockRate}}
+}
+
+// ticks returns the position of the frame with timestamp in clock ticks
+func (m *timestampMapper) ticks(timestamp uint32) int64 {
+	ticks := m.clock.ticks(timestamp)
+	if m.frames > 0 && ticks <= m.last {
+		ticks = m.last + 1
+	}
+	m.last = ticks
+	m.frames++
+	return ticks
+}
+
+// pts returns the presentation time of the frame with timestamp
+func (m *timestampMapper) pts(timestamp uint32) time.Duration {
+	return ticksToDuration(m.ticks(timestamp), m.clock.clockRate)
+}
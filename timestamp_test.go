@@ -0,0 +1,114 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRTPClock(t *testing.T) {
+	tests := []struct {
+		name       string
+		clockRate  uint32
+		timestamps []uint32
+		// want are the presentation times in milliseconds
+		want []time.Duration
+	}{
+		{
+			name:       "video at 30 fps",
+			clockRate:  90000,
+			timestamps: []uint32{1000, 4000, 7000, 10000},
+			want:       []time.Duration{0, 33, 66, 100},
+		},
+		{
+			name:       "Opus at 20 ms",
+			clockRate:  48000,
+			timestamps: []uint32{123456, 124416, 125376, 173376},
+			want:       []time.Duration{0, 20, 40, 1040},
+		},
+		{
+			name:       "wraparound",
+			clockRate:  90000,
+			timestamps: []uint32{1<<32 - 6000, 1<<32 - 3000, 0, 3000, 90000},
+			want:       []time.Duration{0, 33, 66, 100, 1066},
+		},
+		{
+			name:       "reordered frame",
+			clockRate:  90000,
+			timestamps: []uint32{0, 6000, 3000, 9000},
+			want:       []time.Duration{0, 66, 33, 100},
+		},
+		{
+			name:       "unknown clock rate",
+			timestamps: []uint32{0, 3000},
+			want:       []time.Duration{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newRTPClock(tt.clockRate)
+			var got []time.Duration
+			for _, timestamp := range tt.timestamps {
+				got = append(got, clock.pts(timestamp)/time.Millisecond)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pts = %v ms, want %v ms", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampMapper(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []uint32
+		want       []int64
+	}{
+		{
+			name:       "random offset",
+			timestamps: []uint32{3735928559, 3735931562, 3735934565},
+			want:       []int64{0, 3003, 6006},
+		},
+		{
+			name:       "wraparound",
+			timestamps: []uint32{1<<32 - 6000, 1<<32 - 3000, 0, 3000, 90000},
+			want:       []int64{0, 3000, 6000, 9000, 96000},
+		},
+		{
+			name:       "reordered across the wrap",
+			timestamps: []uint32{1<<32 - 3000, 3000, 0, 6000},
+			want:       []int64{0, 6000, 6001, 9000},
+		},
+		{
+			name:       "backward jump",
+			timestamps: []uint32{90000, 93000, 60000, 61000, 96000},
+			want:       []int64{0, 3000, 3001, 3002, 6000},
+		},
+		{
+			name:       "repeated timestamp",
+			timestamps: []uint32{0, 0, 3000},
+			want:       []int64{0, 1, 3000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTimestampMapper(90000)
+			var got []int64
+			for _, timestamp := range tt.timestamps {
+				got = append(got, m.ticks(timestamp))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ticks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Going through a duration keeps every tick of the 90 kHz clock
+	m := newTimestampMapper(90000)
+	for i := range 100000 {
+		timestamp := uint32(1<<32-50000) + uint32(i)*3003
+		if ticks := durationToTicks(m.pts(timestamp), 90000); ticks != int64(i)*3003 {
+			t.Fatalf("frame %d at tick %d, want %d", i, ticks, int64(i)*3003)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const sdpFragContentType = "application/trickle-ice-sdpfrag"
+
+// sdpFrag is the part of a trickle-ice-sdpfrag body (RFC 8840) the server acts on
+type sdpFrag struct {
+	ufrag           string
+	pwd             string
+	candidates      []string
+	endOfCandidates bool
+}
+
+// parseSDPFrag collects the ICE credentials and candidates from an SDP fragment.
+// With BUNDLE every candidate belongs to the one transport, so media sections
+// are not told apart.
+func parseSDPFrag(body string) sdpFrag {
+	var frag sdpFrag
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			frag.candidates = append(frag.candidates, strings.TrimPrefix(line, "a="))
+		case line == "a=end-of-candidates":
+			frag.endOfCandidates = true
+		}
+	}
+	return frag
+}
+
+// supportsTrickle reports whether an offer advertises trickle ICE (RFC 8838).
+// Peers that don't would never learn candidates sent after the answer.
+func supportsTrickle(sdp string) bool {
+	for _, line := range strings.Split(sdp, "\n") {
+		options, ok := strings.CutPrefix(strings.TrimSpace(line), "a=ice-options:")
+		if !ok {
+			continue
+		}
+		for _, option := range strings.FieldsFunc(options, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if option == "trickle" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sdpAttribute returns the value of the first a=name: line in sdp
+func sdpAttribute(sdp, name string) string {
+	prefix := "a=" + name + ":"
+	for _, line := range strings.Split(sdp, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), prefix); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// localSDPFrag builds a fragment with the server candidates gathered so far,
+// taken from the first media section of the local description. It returns ""
+// when there are none yet.
+func localSDPFrag(sdp string) string {
+	var mediaLine, mid, ufrag, pwd string
+	var candidates []string
+	end := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			if mediaLine != "" {
+				break
+			}
+			mediaLine = line
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = line
+		case strings.HasPrefix(line, "a=ice-ufrag:") && ufrag == "":
+			ufrag = line
+		case strings.HasPrefix(line, "a=ice-pwd:") && pwd == "":
+			pwd = line
+		case strings.HasPrefix(line, "a=candidate:") && mediaLine != "":
+			candidates = append(candidates, line)
+		case line == "a=end-of-candidates" && mediaLine != "":
+			end = true
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	lines := []string{ufrag, pwd, mediaLine, mid}
+	lines = append(lines, candidates...)
+	if end {
+		lines = append(lines, "a=end-of-candidates")
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// restartOffer rewrites the publisher's offer for an ICE restart: the
+// credentials become ufrag and pwd, and the candidates of the old ICE session
+// are dropped
+func restartOffer(sdp, ufrag, pwd string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(sdp, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag + "\r\n"
+		case strings.HasPrefix(trimmed, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd + "\r\n"
+		case strings.HasPrefix(trimmed, "a=candidate:"), trimmed == "a=end-of-candidates":
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "")
+}
+
+// restartICE restarts the ICE session of s with the publisher credentials
+// of frag, the way an offer with new credentials would, and returns the
+// fragment with the new server credentials and candidates
+func (s *session) restartICE(frag sdpFrag) (string, error) {
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  restartOffer(s.peerConnection.RemoteDescription().SDP, frag.ufrag, frag.pwd),
+	}
+	if err := s.peerConnection.SetRemoteDescription(offer); err != nil {
+		return "", err
+	}
+	answer, err := s.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+	if err := s.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatheringComplete
+	s.etag = newETag()
+	return localSDPFrag(s.peerConnection.LocalDescription().SDP), nil
+}
+
+// Handler for PATCH requests to a WHIP session's resource URL, carrying
+// trickled ICE candidates or, with new credentials, an ICE restart. The
+// server candidates are only returned to clients that accept fragments.
+func whipPatchHandler(w http.ResponseWriter, r *http.Request, s *session) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != sdpFragContentType {
+		http.Error(w, "Content-Type must be "+sdpFragContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	s.active()
+	s.iceMu.Lock()
+	defer s.iceMu.Unlock()
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != s.etag {
+		http.Error(w, "ETag does not match the ICE session", http.StatusPreconditionFailed)
+		return
+	}
+
+	body, ok := readBody(w, r, maxOfferSize, http.Error)
+	if !ok {
+		return
+	}
+	frag := parseSDPFrag(string(body))
+
+	// A new ufrag asks for an ICE restart, answered with new credentials and ETag
+	remote := s.peerConnection.RemoteDescription()
+	if frag.ufrag != "" && remote != nil && frag.ufrag != sdpAttribute(remote.SDP, "ice-ufrag") {
+		if frag.pwd == "" {
+			http.Error(w, "ICE restart without a password", http.StatusBadRequest)
+			return
+		}
+		if !accepts(r, sdpFragContentType) {
+			http.Error(w, "The new credentials are "+sdpFragContentType+", which Accept doesn't allow", http.StatusNotAcceptable)
+			return
+		}
+		local, err := s.restartICE(frag)
+		if err != nil {
+			s.log.Warn("Failed to restart ICE", "error", err)
+			http.Error(w, "Failed to restart ICE", http.StatusUnprocessableEntity)
+			return
+		}
+		s.log.Info("Restarted ICE")
+		w.Header().Set("Content-Type", sdpFragContentType)
+		w.Header().Set("ETag", s.etag)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(local))
+		return
+	}
+
+	for _, candidate := range frag.candidates {
+		if err := s.peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+			s.log.Warn("Failed to add ICE candidate", "candidate", candidate, "error", err)
+			http.Error(w, "Invalid ICE candidate", http.StatusBadRequest)
+			return
+		}
+	}
+	if frag.endOfCandidates {
+		if err := s.peerConnection.AddICECandidate(webrtc.ICECandidateInit{}); err != nil {
+			s.log.Warn("Failed to signal end of candidates", "error", err)
+		}
+	}
+	s.log.Debug("Added trickled ICE candidates", "count", len(frag.candidates))
+
+	// Reply with the server candidates gathered since the answer was sent, to
+	// a client that accepts them
+	local := localSDPFrag(s.peerConnection.LocalDescription().SDP)
+	if local == "" || !accepts(r, sdpFragContentType) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", sdpFragContentType)
+	w.Header().Set("ETag", s.etag)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(local))
+}
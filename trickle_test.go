@@ -0,0 +1,296 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const testCandidate = "candidate:1 1 udp 2130706431 127.0.0.1 50000 typ host"
+
+// patchSDPFrag sends an SDP fragment to a session resource and returns the
+// response with its body
+func patchSDPFrag(t *testing.T, url, frag string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, url, strings.NewReader(frag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", sdpFragContentType)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestParseSDPFrag(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want sdpFrag
+	}{
+		{
+			name: "candidates",
+			body: "a=ice-ufrag:abcd\r\na=ice-pwd:secret\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=" + testCandidate + "\r\na=end-of-candidates\r\n",
+			want: sdpFrag{ufrag: "abcd", pwd: "secret", candidates: []string{testCandidate}, endOfCandidates: true},
+		},
+		{
+			name: "LF line endings",
+			body: "a=" + testCandidate + "\na=" + testCandidate + "\n",
+			want: sdpFrag{candidates: []string{testCandidate, testCandidate}},
+		},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSDPFrag(tt.body)
+			if got.ufrag != tt.want.ufrag || got.pwd != tt.want.pwd || got.endOfCandidates != tt.want.endOfCandidates ||
+				!slices.Equal(got.candidates, tt.want.candidates) {
+				t.Errorf("parseSDPFrag = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupportsTrickle(t *testing.T) {
+	tests := []struct {
+		name string
+		sdp  string
+		want bool
+	}{
+		{name: "trickle", sdp: "v=0\r\na=ice-options:trickle\r\n", want: true},
+		{name: "among other options", sdp: "v=0\r\na=ice-options:ice2 trickle\r\n", want: true},
+		{name: "other options", sdp: "v=0\r\na=ice-options:ice2\r\n"},
+		{name: "no options", sdp: "v=0\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := supportsTrickle(tt.sdp); got != tt.want {
+				t.Errorf("supportsTrickle = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWHIPPatch(t *testing.T) {
+	frag := "a=ice-ufrag:%s\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=" + testCandidate + "\r\n"
+	tests := []struct {
+		name        string
+		contentType string
+		accept      string
+		// ifMatch is sent as If-Match, with "etag" standing for the session's ETag
+		ifMatch    string
+		frag       string
+		unknown    bool
+		wantStatus int
+	}{
+		{name: "candidate", frag: frag, wantStatus: http.StatusOK},
+		{name: "accepting fragments", accept: sdpFragContentType, frag: frag, wantStatus: http.StatusOK},
+		{name: "not accepting fragments", accept: "application/json", frag: frag, wantStatus: http.StatusNoContent},
+		{name: "content type with parameters", contentType: sdpFragContentType + "; charset=utf-8", frag: frag, wantStatus: http.StatusOK},
+		{name: "matching ETag", ifMatch: "etag", frag: frag, wantStatus: http.StatusOK},
+		{name: "stale ETag", ifMatch: `"stale"`, frag: frag, wantStatus: http.StatusPreconditionFailed},
+		{name: "end of candidates", frag: "a=end-of-candidates\r\n", wantStatus: http.StatusOK},
+		{name: "invalid candidate", frag: "a=candidate:garbage\r\n", wantStatus: http.StatusBadRequest},
+		{name: "oversized fragment", frag: strings.Repeat("a=x\r\n", maxOfferSize/5+1), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "wrong content type", contentType: "application/sdp", frag: frag, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "unknown session", unknown: true, frag: frag, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+			s := sessions.get(strings.TrimPrefix(p.location, "/whip/"))
+			if s == nil {
+				t.Fatalf("no session at %s", p.location)
+			}
+			url := base + p.location
+			if tt.unknown {
+				url = base + "/whip/unknown"
+			}
+			header := http.Header{}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			if tt.accept != "" {
+				header.Set("Accept", tt.accept)
+			}
+			if tt.ifMatch == "etag" {
+				header.Set("If-Match", s.etag)
+			} else if tt.ifMatch != "" {
+				header.Set("If-Match", tt.ifMatch)
+			}
+			ufrag := sdpAttribute(p.pc.LocalDescription().SDP, "ice-ufrag")
+
+			resp, body := patchSDPFrag(t, url, strings.ReplaceAll(tt.frag, "%s", ufrag), header)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("PATCH answered %d: %s, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("ETag"); got != s.etag {
+				t.Errorf("ETag = %q, want %q", got, s.etag)
+			}
+			if got := resp.Header.Get("Content-Type"); got != sdpFragContentType {
+				t.Errorf("Content-Type = %q, want %s", got, sdpFragContentType)
+			}
+			if !strings.Contains(body, "a=candidate:") {
+				t.Errorf("server candidates missing from\n%s", body)
+			}
+		})
+	}
+}
+
+// TestTrickleICE publishes with an offer that has no candidates, trickling
+// them to the session with PATCH and applying the server candidates returned
+func TestTrickleICE(t *testing.T) {
+	base := startServer(t)
+	pc := newTestPeerConnection(t)
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	// pion doesn't advertise trickle ICE, though it trickles
+	sdp := strings.Replace(offer.SDP, "\r\nt=0 0\r\n", "\r\nt=0 0\r\na=ice-options:trickle\r\n", 1)
+	if !supportsTrickle(sdp) {
+		t.Fatal("no session level t= line to add ice-options after")
+	}
+	resp, body := postSDP(t, base+"/whip/cam", pc, sdp, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST answered %d: %s", resp.StatusCode, body)
+	}
+	location, etag := resp.Header.Get("Location"), resp.Header.Get("ETag")
+	if location == "" || etag == "" {
+		t.Fatalf("Location %q, ETag %q: want both", location, etag)
+	}
+
+	select {
+	case <-gatheringComplete:
+	case <-time.After(testTimeout):
+		t.Fatal("ICE gathering did not complete")
+	}
+	local := localSDPFrag(pc.LocalDescription().SDP)
+	if local == "" {
+		t.Fatal("no local candidates to trickle")
+	}
+	header := http.Header{"If-Match": {etag}, "Accept": {sdpFragContentType}}
+	resp, body = patchSDPFrag(t, base+location, local, header)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		for _, candidate := range parseSDPFrag(body).candidates {
+			if err := pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	case http.StatusNoContent:
+	default:
+		t.Fatalf("PATCH answered %d: %s", resp.StatusCode, body)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Fatal("publisher did not connect")
+	}
+}
+
+// TestICERestart restarts the ICE session of a publisher with PATCH, checks
+// new server credentials and ETag come back, and that the publisher
+// reconnects with them
+func TestICERestart(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	s := sessions.get(strings.TrimPrefix(p.location, "/whip/"))
+	if s == nil {
+		t.Fatalf("no session at %s", p.location)
+	}
+	etag := s.etag
+
+	offer, err := p.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-gatheringComplete:
+	case <-time.After(testTimeout):
+		t.Fatal("ICE gathering did not complete")
+	}
+	local := localSDPFrag(p.pc.LocalDescription().SDP)
+
+	resp, body := patchSDPFrag(t, base+p.location, local, http.Header{"If-Match": {"*"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("ICE restart answered %d: %s", resp.StatusCode, body)
+	}
+	newETag := resp.Header.Get("ETag")
+	if newETag == "" || newETag == etag {
+		t.Errorf("ETag %q after the restart, want a new one for %q", newETag, etag)
+	}
+	frag := parseSDPFrag(body)
+	ufrag, pwd := sdpAttribute(p.answer, "ice-ufrag"), sdpAttribute(p.answer, "ice-pwd")
+	if frag.ufrag == "" || frag.ufrag == ufrag || frag.pwd == "" || frag.pwd == pwd {
+		t.Fatalf("credentials %q/%q after the restart, want new ones for %q/%q", frag.ufrag, frag.pwd, ufrag, pwd)
+	}
+	if len(frag.candidates) == 0 {
+		t.Fatalf("server candidates missing from\n%s", body)
+	}
+
+	// The old ETag no longer identifies the ICE session
+	resp, body = patchSDPFrag(t, base+p.location, "a=end-of-candidates\r\n", http.Header{"If-Match": {etag}})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with the old ETag answered %d: %s, want %d", resp.StatusCode, body, http.StatusPreconditionFailed)
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: restartOffer(p.answer, frag.ufrag, frag.pwd)}
+	if err := p.pc.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range frag.candidates {
+		if err := p.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the restarted ICE session", func() bool {
+		return s.peerConnection.ICEConnectionState() == webrtc.ICEConnectionStateConnected &&
+			sdpAttribute(s.peerConnection.RemoteDescription().SDP, "ice-ufrag") == sdpAttribute(local, "ice-ufrag")
+	})
+	p.play(t, 500*time.Millisecond)
+}
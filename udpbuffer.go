@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/pion/transport/v3"
+)
+
+// udpBufferNet is the network ICE listens on with -udp-receive-buffer: every
+// UDP socket gets a receive buffer of size bytes, so bursts of a
+// high-bitrate stream aren't dropped by the kernel before pion reads them.
+// Linux caps the size at net.core.rmem_max, which may need raising with
+// sysctl -w net.core.rmem_max=<bytes>; macOS at kern.ipc.maxsockbuf.
+type udpBufferNet struct {
+	transport.Net
+	size int
+}
+
+func (n *udpBufferNet) ListenUDP(network string, addr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadBuffer(n.size); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (n *udpBufferNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		if err := udpConn.SetReadBuffer(n.size); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// logUDPReceiveBuffer logs the receive buffer the kernel gives a socket
+// asking for -udp-receive-buffer, warning if it is smaller. Linux reports
+// twice the size asked for, the extra being its bookkeeping.
+func logUDPReceiveBuffer() {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		slog.Warn("Failed to check the UDP receive buffer", "error", err)
+		return
+	}
+	defer conn.Close()
+	if err := conn.SetReadBuffer(config.UDPReceiveBuffer); err != nil {
+		slog.Warn("Failed to set the UDP receive buffer", "error", err)
+		return
+	}
+	effective, err := receiveBufferSize(conn)
+	if err != nil {
+		slog.Info("UDP receive buffer set", "requested", config.UDPReceiveBuffer)
+		return
+	}
+	if effective < config.UDPReceiveBuffer {
+		slog.Warn("UDP receive buffer capped by the OS, raise net.core.rmem_max", "requested", config.UDPReceiveBuffer, "effective", effective)
+		return
+	}
+	slog.Info("UDP receive buffer set", "requested", config.UDPReceiveBuffer, "effective", effective)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestUDPReceiveBufferFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "OS default"},
+		{name: "4 MiB", args: []string{"-udp-receive-buffer", "4194304"}},
+		{name: "negative", args: []string{"-udp-receive-buffer", "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestUDPBufferNet checks both ways ICE opens UDP sockets get the receive
+// buffer. The size asked for is below any default rmem_max.
+func TestUDPBufferNet(t *testing.T) {
+	const size = 64 << 10
+	network, err := stdnet.NewNet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &udpBufferNet{Net: network, size: size}
+
+	udpConn, err := n.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	packetConn, err := n.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+
+	for name, conn := range map[string]any{"ListenUDP": udpConn, "ListenPacket": packetConn} {
+		got, err := receiveBufferSize(conn.(*net.UDPConn))
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip("SO_RCVBUF can't be read on this OS")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got < size {
+			t.Errorf("%s socket has a receive buffer of %d bytes, want at least %d", name, got, size)
+		}
+	}
+}
+
+// TestUDPReceiveBuffer checks configureICE hands the SettingEngine a network
+// with the configured buffer, and candidates are still gathered on it
+func TestUDPReceiveBuffer(t *testing.T) {
+	setConfig(t, func(c *Config) { c.UDPReceiveBuffer = 64 << 10 })
+	var settingEngine webrtc.SettingEngine
+	if err := configureICE(&settingEngine); err != nil {
+		t.Fatal(err)
+	}
+	// The SettingEngine keeps its network unexported
+	n := reflect.ValueOf(&settingEngine).Elem().FieldByName("net").Elem()
+	if n.Type() != reflect.TypeFor[*udpBufferNet]() {
+		t.Fatalf("SettingEngine network is a %v, want a *udpBufferNet", n.Type())
+	}
+	if size := n.Elem().FieldByName("size").Int(); size != int64(config.UDPReceiveBuffer) {
+		t.Errorf("SettingEngine network buffers %d bytes, want %d", size, config.UDPReceiveBuffer)
+	}
+
+	api, err := newAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var candidates int
+	for _, line := range strings.Split(gatheredAnswer(t, api), "\r\n") {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "a=candidate:") && len(fields) >= 8 && fields[2] == "udp" {
+			candidates++
+		}
+	}
+	if candidates == 0 {
+		t.Error("no UDP candidates gathered")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+// bitReader reads big-endian bit fields, as used by the VP9 and AV1 headers
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+// read returns the next n bits, or ok=false once the data runs out
+func (r *bitReader) read(n int) (value uint32, ok bool) {
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, false
+		}
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		value = value<<1 | uint32(bit)
+		r.pos++
+	}
+	return value, true
+}
+
+// vp9Header holds the leading fields of a VP9 uncompressed frame header
+type vp9Header struct {
+	profile  uint32
+	keyframe bool
+	r        bitReader
+}
+
+// parseVP9Header reads up to frame_type, leaving r positioned after it
+func parseVP9Header(frame []byte) (vp9Header, bool) {
+	h := vp9Header{r: bitReader{data: frame}}
+	if marker, ok := h.r.read(2); !ok || marker != 2 {
+		return h, false
+	}
+	low, _ := h.r.read(1)
+	high, _ := h.r.read(1)
+	h.profile = high<<1 | low
+	if h.profile == 3 {
+		h.r.read(1) // reserved_zero
+	}
+	showExisting, ok := h.r.read(1)
+	if !ok || showExisting == 1 {
+		return h, false
+	}
+	frameType, ok := h.r.read(1)
+	if !ok {
+		return h, false
+	}
+	h.keyframe = frameType == 0
+	return h, true
+}
+
+// vp9IsKeyframe reports whether frame is a VP9 key frame
+func vp9IsKeyframe(frame []byte) bool {
+	h, ok := parseVP9Header(frame)
+	return ok && h.keyframe
+}
+
+// vp9FrameSize returns the dimensions carried by a VP9 keyframe, or zero for interframes
+func vp9FrameSize(frame []byte) (width, height uint16) {
+	h, ok := parseVP9Header(frame)
+	if !ok || !h.keyframe {
+		return 0, 0
+	}
+	r := &h.r
+	r.read(2) // show_frame, error_resilient_mode
+	if sync, ok := r.read(24); !ok || sync != 0x498342 {
+		return 0, 0
+	}
+
+	// color_config
+	if h.profile >= 2 {
+		r.read(1) // ten_or_twelve_bit
+	}
+	colorSpace, _ := r.read(3)
+	if colorSpace != 7 { // CS_RGB
+		r.read(1) // color_range
+		if h.profile == 1 || h.profile == 3 {
+			r.read(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if h.profile == 1 || h.profile == 3 {
+		r.read(1) // reserved_zero
+	}
+
+	w, ok := r.read(16)
+	if !ok {
+		return 0, 0
+	}
+	ht, ok := r.read(16)
+	if !ok {
+		return 0, 0
+	}
+	return uint16(w + 1), uint16(ht + 1)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	// A 640x480 profile 0 key frame and an inter frame; only the
+	// uncompressed headers matter
+	testVP9Keyframe   = append([]byte{0x82, 0x49, 0x83, 0x42, 0x20, 0x27, 0xf0, 0x1d, 0xf0}, make([]byte, 1200)...)
+	testVP9Interframe = append([]byte{0x86}, make([]byte, 300)...)
+)
+
+// VP9 payload descriptor bits (RFC 9628 section 4.2)
+const (
+	vp9DescI = 0x80
+	vp9DescL = 0x20
+	vp9DescF = 0x10
+	vp9DescB = 0x08
+	vp9DescE = 0x04
+)
+
+// vp9Packets splits a VP9 frame into RTP payloads of at most size bytes of
+// it. Each starts with the descriptor flags, B set on the first and E on the
+// last, followed by head, the picture ID and layer fields
+func vp9Packets(frame []byte, size int, flags byte, head []byte) [][]byte {
+	var payloads [][]byte
+	for i := 0; i < len(frame); i += size {
+		descriptor := flags
+		if i == 0 {
+			descriptor |= vp9DescB
+		}
+		if i+size >= len(frame) {
+			descriptor |= vp9DescE
+		}
+		payload := append([]byte{descriptor}, head...)
+		payloads = append(payloads, append(payload, frame[i:min(i+size, len(frame))]...))
+	}
+	return payloads
+}
+
+// vp9Frame returns the packets of a frame, the marker set on the last one when marker is
+func vp9Frame(timestamp uint32, frame []byte, flags byte, head []byte, marker bool) []testPacket {
+	var packets []testPacket
+	payloads := vp9Packets(frame, 500, flags, head)
+	for i, payload := range payloads {
+		packets = append(packets, testPacket{timestamp, marker && i == len(payloads)-1, payload})
+	}
+	return packets
+}
+
+func TestVP9Recording(t *testing.T) {
+	// A spatial layer 1 frame, which isn't recorded
+	layer1 := append([]byte{0x86}, bytes.Repeat([]byte{0xee}, 800)...)
+
+	tests := []struct {
+		name    string
+		packets []testPacket
+		want    [][]byte
+	}{
+		{
+			name: "no descriptor fields",
+			packets: slices.Concat(
+				vp9Frame(0, testVP9Keyframe, 0, nil, true),
+				vp9Frame(3000, testVP9Interframe, 0, nil, true),
+			),
+			want: [][]byte{testVP9Keyframe, testVP9Interframe},
+		},
+		{
+			name: "flexible mode with 15-bit picture IDs",
+			packets: slices.Concat(
+				vp9Frame(0, testVP9Keyframe, vp9DescI|vp9DescF, []byte{0x80 | 0x12, 0x34}, true),
+				vp9Frame(3000, testVP9Interframe, vp9DescI|vp9DescF, []byte{0x80 | 0x12, 0x35}, true),
+			),
+			want: [][]byte{testVP9Keyframe, testVP9Interframe},
+		},
+		{
+			name: "non-flexible mode with layer indices and TL0PICIDX",
+			packets: slices.Concat(
+				vp9Frame(0, testVP9Keyframe, vp9DescI|vp9DescL, []byte{0x01, 0x00, 0x07}, true),
+				vp9Frame(3000, testVP9Interframe, vp9DescI|vp9DescL, []byte{0x02, 0x20, 0x07}, true),
+			),
+			want: [][]byte{testVP9Keyframe, testVP9Interframe},
+		},
+		{
+			name: "spatial layers, only the base one recorded",
+			packets: slices.Concat(
+				// Layer indices: TID 0, U 0, SID in bits 3-1, D
+				vp9Frame(0, testVP9Keyframe, vp9DescI|vp9DescF|vp9DescL, []byte{0x01, 0x00}, false),
+				vp9Frame(0, layer1, vp9DescI|vp9DescF|vp9DescL, []byte{0x01, 0x03}, true),
+				vp9Frame(3000, testVP9Interframe, vp9DescI|vp9DescF|vp9DescL, []byte{0x02, 0x00}, false),
+				vp9Frame(3000, layer1, vp9DescI|vp9DescF|vp9DescL, []byte{0x02, 0x03}, true),
+			),
+			want: [][]byte{testVP9Keyframe, testVP9Interframe},
+		},
+		{
+			name: "first packet lost",
+			packets: slices.Concat(
+				vp9Frame(0, testVP9Keyframe, 0, nil, true)[1:],
+				vp9Frame(3000, testVP9Interframe, 0, nil, true),
+			),
+			want: [][]byte{testVP9Interframe},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fourcc, width, height, _, recorded := readIVF(t, recordPackets(t, webrtc.MimeTypeVP9, tt.packets))
+			if fourcc != "VP90" {
+				t.Errorf("FourCC = %q, want VP90", fourcc)
+			}
+			if len(recorded) != len(tt.want) {
+				t.Fatalf("recorded %d frames, want %d", len(recorded), len(tt.want))
+			}
+			for i := range recorded {
+				if !bytes.Equal(recorded[i].data, tt.want[i]) {
+					t.Errorf("frame %d differs: %d bytes, want %d", i, len(recorded[i].data), len(tt.want[i]))
+				}
+			}
+			if isKeyframe(webrtc.MimeTypeVP9, tt.want[0]) && (width != 640 || height != 480) {
+				t.Errorf("size = %dx%d, want 640x480", width, height)
+			}
+		})
+	}
+}
+
+func TestVP9FrameHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		frame         []byte
+		keyframe      bool
+		width, height uint16
+	}{
+		{name: "key frame", frame: testVP9Keyframe, keyframe: true, width: 640, height: 480},
+		{name: "inter frame", frame: testVP9Interframe},
+		{name: "show existing frame", frame: []byte{0x88}},
+		{name: "bad frame marker", frame: []byte{0x02, 0x49, 0x83, 0x42, 0x20, 0x27, 0xf0, 0x1d, 0xf0}},
+		{name: "bad sync code", frame: []byte{0x82, 0x49, 0x83, 0x43, 0x20, 0x27, 0xf0, 0x1d, 0xf0}, keyframe: true},
+		{name: "truncated", frame: testVP9Keyframe[:6], keyframe: true},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := vp9IsKeyframe(tt.frame); got != tt.keyframe {
+				t.Errorf("vp9IsKeyframe = %v, want %v", got, tt.keyframe)
+			}
+			if width, height := vp9FrameSize(tt.frame); width != tt.width || height != tt.height {
+				t.Errorf("vp9FrameSize = %dx%d, want %dx%d", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	wavHeaderSize    = 44
+	g711SampleRate   = 8000
+	wavBitsPerSample = 16
+)
+
+// Lookup tables from G.711 code words to 16-bit linear PCM
+var (
+	ulawToPCM = g711Table(ulawDecode)
+	alawToPCM = g711Table(alawDecode)
+)
+
+func g711Table(decode func(byte) int16) *[256]int16 {
+	var table [256]int16
+	for i := range table {
+		table[i] = decode(byte(i))
+	}
+	return &table
+}
+
+// ulawDecode expands a µ-law code word (ITU-T G.711)
+func ulawDecode(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0f)<<3 + 0x84) << ((u & 0x70) >> 4)
+	if u&0x80 != 0 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
+
+// alawDecode expands an A-law code word (ITU-T G.711)
+func alawDecode(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0f) << 4
+	switch segment := (a & 0x70) >> 4; segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (segment - 1)
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// g711Depacketizer passes G.711 payloads through; every packet is a frame of samples
+type g711Depacketizer struct{}
+
+func (g711Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func (g711Depacketizer) IsPartitionHead(payload []byte) bool {
+	return true
+}
+
+func (g711Depacketizer) IsPartitionTail(marker bool, payload []byte) bool {
+	return true
+}
+
+// wavWriter decodes G.711 into 16-bit PCM in a WAV file, mono at 8 kHz
+// unless -wav-sample-rate or -wav-channels ask for another format. Gaps in
+// the timestamps are filled with silence so the audio keeps its timing.
+type wavWriter struct {
+	file     *os.File
+	table    *[256]int16
+	rate     int
+	channels int
+	// resample converts the decoded audio to the output format, if it differs
+	resample *resampler
+	// received counts the decoded samples and the silence, samples the
+	// frames written
+	received int64
+	samples  int64
+}
+
+// createWAVWriter creates the file at path and writes a WAV header whose sizes are patched on Close
+func createWAVWriter(path string, table *[256]int16) (mediaWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{file: file, table: table, rate: g711SampleRate, channels: 1}
+	if config.WAVSampleRate != 0 {
+		w.rate = config.WAVSampleRate
+	}
+	if config.WAVChannels != 0 {
+		w.channels = config.WAVChannels
+	}
+	if w.rate != g711SampleRate || w.channels != 1 {
+		w.resample = newResampler(g711SampleRate, 1, w.rate, w.channels)
+	}
+	if _, err := file.Write(w.header()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) header() []byte {
+	header := make([]byte, wavHeaderSize)
+	blockAlign := w.channels * wavBitsPerSample / 8
+	dataSize := uint32(w.samples * int64(blockAlign))
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 36+dataSize)
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(header[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(w.rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(w.rate*blockAlign)) // byte rate
+	binary.LittleEndian.PutUint16(header[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:], wavBitsPerSample)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataSize)
+	return header
+}
+
+// WriteFrame decodes the code words of one packet, after any silence needed to reach pts
+func (w *wavWriter) WriteFrame(frame []byte, pts time.Duration) error {
+	target := int64(pts / (time.Second / g711SampleRate))
+	if err := w.writeSilence(target - w.received); err != nil {
+		return err
+	}
+
+	pcm := make([]int16, len(frame))
+	for i, code := range frame {
+		pcm[i] = w.table[code]
+	}
+	return w.write(pcm)
+}
+
+// writeSilence appends n zero samples, a second at a time
+func (w *wavWriter) writeSilence(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	chunk := make([]int16, min(n, g711SampleRate))
+	for n > 0 {
+		size := min(n, g711SampleRate)
+		if err := w.write(chunk[:size]); err != nil {
+			return err
+		}
+		n -= size
+	}
+	return nil
+}
+
+// write appends decoded samples, converted to the output format
+func (w *wavWriter) write(pcm []int16) error {
+	w.received += int64(len(pcm))
+	if w.resample != nil {
+		pcm = w.resample.process(pcm)
+	}
+	data := make([]byte, len(pcm)*2)
+	for i, sample := range pcm {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	w.samples += int64(len(pcm) / w.channels)
+	return nil
+}
+
+// Close patches the RIFF and data chunk sizes
+func (w *wavWriter) Close() error {
+	_, err := w.file.WriteAt(w.header(), 0)
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestG711Decode(t *testing.T) {
+	tests := []struct {
+		name  string
+		table *[256]int16
+		code  byte
+		want  int16
+	}{
+		{name: "µ-law zero", table: ulawToPCM, code: 0xff, want: 0},
+		{name: "µ-law negative zero", table: ulawToPCM, code: 0x7f, want: 0},
+		{name: "µ-law smallest step", table: ulawToPCM, code: 0xfe, want: 8},
+		{name: "µ-law smallest negative step", table: ulawToPCM, code: 0x7e, want: -8},
+		{name: "µ-law mid segment", table: ulawToPCM, code: 0xc0, want: 1884},
+		{name: "µ-law maximum", table: ulawToPCM, code: 0x80, want: 32124},
+		{name: "µ-law minimum", table: ulawToPCM, code: 0x00, want: -32124},
+		{name: "A-law smallest step", table: alawToPCM, code: 0xd5, want: 8},
+		{name: "A-law smallest negative step", table: alawToPCM, code: 0x55, want: -8},
+		{name: "A-law mid segment", table: alawToPCM, code: 0xe5, want: 1056},
+		{name: "A-law maximum", table: alawToPCM, code: 0xaa, want: 32256},
+		{name: "A-law minimum", table: alawToPCM, code: 0x2a, want: -32256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.table[tt.code]; got != tt.want {
+				t.Errorf("decode(%#02x) = %d, want %d", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+// g711Packet is a G.711 RTP payload at an 8 kHz timestamp
+type g711Packet struct {
+	timestamp uint32
+	payload   []byte
+}
+
+func TestWAVRecording(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		packets  []g711Packet
+		want     []int16
+	}{
+		{
+			name:     "PCMU",
+			mimeType: webrtc.MimeTypePCMU,
+			packets:  []g711Packet{{0, []byte{0xff, 0x80, 0x00}}, {3, []byte{0xfe, 0x7e}}},
+			want:     []int16{0, 32124, -32124, 8, -8},
+		},
+		{
+			name:     "PCMA",
+			mimeType: webrtc.MimeTypePCMA,
+			packets:  []g711Packet{{0, []byte{0xd5, 0xaa}}, {2, []byte{0x2a, 0x55}}},
+			want:     []int16{8, 32256, -32256, -8},
+		},
+		{
+			name:     "gap filled with silence",
+			mimeType: webrtc.MimeTypePCMU,
+			packets:  []g711Packet{{0, []byte{0x80, 0x80}}, {5, []byte{0x00}}},
+			want:     []int16{32124, 32124, 0, 0, 0, -32124},
+		},
+		{
+			name:     "no packets",
+			mimeType: webrtc.MimeTypePCMA,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writer, depacketizer, err := newTrackWriter(filepath.Join(dir, "audio"), webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: tt.mimeType, ClockRate: g711SampleRate},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.packets {
+				frame, err := depacketizer.Unmarshal(p.payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.WriteFrame(frame, time.Duration(p.timestamp)*time.Second/g711SampleRate); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, "audio.wav"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (&wavWriter{rate: g711SampleRate, channels: 1, samples: int64(len(tt.want))}).header(); !bytes.Equal(data[:min(len(data), wavHeaderSize)], want) {
+				t.Errorf("header = % x\nwant % x", data[:min(len(data), wavHeaderSize)], want)
+			}
+			if got := binary.LittleEndian.Uint32(data[40:]); int(got) != len(data)-wavHeaderSize {
+				t.Errorf("data chunk size = %d, want %d", got, len(data)-wavHeaderSize)
+			}
+			var samples []int16
+			for i := wavHeaderSize; i+1 < len(data); i += 2 {
+				samples = append(samples, int16(binary.LittleEndian.Uint16(data[i:])))
+			}
+			if !slices.Equal(samples, tt.want) {
+				t.Errorf("samples = %v, want %v", samples, tt.want)
+			}
+		})
+	}
+}
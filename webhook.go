@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookAttempts is how many times an event is sent before giving up
+	webhookAttempts = 3
+	// webhookTimeout bounds each attempt
+	webhookTimeout = 5 * time.Second
+	// webhookBackoff is the wait before the second attempt, doubled after each failure
+	webhookBackoff = time.Second
+)
+
+// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+// body keyed with -webhook-secret
+const webhookSignatureHeader = "X-Mediaserver-Signature"
+
+// webhooks tracks the events being sent, which shutdown waits for
+var webhooks sync.WaitGroup
+
+// recordingEvent is posted to -webhook-url once a session is closed and its
+// recordings are complete. The files are relative to -output-dir.
+type recordingEvent struct {
+	Event        string         `json:"event"`
+	Session      string         `json:"session"`
+	StreamKey    string         `json:"stream_key"`
+	Started      time.Time      `json:"started"`
+	Ended        time.Time      `json:"ended"`
+	Duration     int64          `json:"duration_ms"`
+	BytesWritten int64          `json:"bytes_written"`
+	Codecs       []string       `json:"codecs"`
+	Files        []recordedFile `json:"files"`
+	Tracks       []trackInfo    `json:"tracks"`
+}
+
+// recordedFile is a file of a session's recordings and its size
+type recordedFile struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// recordingEvent describes the session's recordings, once closed
+func (s *session) recordingEvent() recordingEvent {
+	info := s.info()
+	ended := time.Now()
+	event := recordingEvent{
+		Event:        "recording.complete",
+		Session:      info.ID,
+		StreamKey:    info.StreamKey,
+		Started:      info.Started,
+		Ended:        ended,
+		Duration:     ended.Sub(info.Started).Milliseconds(),
+		BytesWritten: info.BytesWritten,
+		Codecs:       info.Codecs,
+		Files:        []recordedFile{},
+		Tracks:       info.Tracks,
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		s.log.Warn("Failed to list the recorded files", "error", err)
+	}
+	for _, entry := range entries {
+		if fileInfo, err := entry.Info(); err == nil && !entry.IsDir() {
+			path := filepath.Join(filepath.Base(s.dir), entry.Name())
+			event.Files = append(event.Files, recordedFile{Path: path, Bytes: fileInfo.Size()})
+		}
+	}
+	return event
+}
+
+// sendWebhook posts event to -webhook-url in the background, retrying
+// failed attempts. A delivery that fails for good is only logged.
+func sendWebhook(logger *slog.Logger, event recordingEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Failed to encode webhook event", "error", err)
+		return
+	}
+	webhooks.Add(1)
+	go func() {
+		defer webhooks.Done()
+		backoff := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(body)
+			if err == nil {
+				logger.Info("Webhook delivered", "event", event.Event, "attempt", attempt)
+				return
+			}
+			if attempt == webhookAttempts {
+				logger.Error("Webhook delivery failed", "event", event.Event, "attempts", attempt, "error", err)
+				return
+			}
+			logger.Warn("Webhook attempt failed, retrying", "attempt", attempt, "retry_in", backoff, "error", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+// postWebhook makes a single attempt at sending body, signed with
+// -webhook-secret if set. Any status but 2xx is a failure.
+func postWebhook(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(config.WebhookSecret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature returns the value of webhookSignatureHeader for body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWebhookFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "disabled"},
+		{name: "URL", args: []string{"-webhook-url", "https://hooks.example.com/recordings"}},
+		{name: "signed", args: []string{"-webhook-url", "http://localhost:9000/hook", "-webhook-secret", "north"}},
+		{name: "not HTTP", args: []string{"-webhook-url", "ftp://hooks.example.com"}, wantErr: "invalid -webhook-url"},
+		{name: "no host", args: []string{"-webhook-url", "/hook"}, wantErr: "invalid -webhook-url"},
+		{name: "secret alone", args: []string{"-webhook-secret", "north"}, wantErr: "-webhook-secret requires -webhook-url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, tt.args...)
+			cfg.OutputDir = t.TempDir()
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// RFC 4231 test case 2
+	const want = "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got := webhookSignature("Jefe", []byte("what do ya want for nothing?")); got != want {
+		t.Errorf("webhookSignature = %q, want %q", got, want)
+	}
+}
+
+// webhookRequest is a request received by a test webhook
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// startWebhook serves a webhook answering with the statuses in turn, then
+// 204, and returns the requests it received
+func startWebhook(t *testing.T, statuses ...int) (url string, received func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, webhookRequest{r.Header.Clone(), body})
+		status := http.StatusNoContent
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(requests)
+	}
+}
+
+// TestWebhook publishes a session, ends it and checks the webhook was sent
+// its recording, signed
+func TestWebhook(t *testing.T) {
+	hook, received := startWebhook(t)
+	setConfig(t, func(c *Config) { c.WebhookURL, c.WebhookSecret = hook, "north" })
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	p.play(t, time.Second)
+	p.stop(t, base)
+	webhooks.Wait()
+
+	requests := received()
+	if len(requests) != 1 {
+		t.Fatalf("webhook received %d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if got, want := request.header.Get(webhookSignatureHeader), webhookSignature("north", request.body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if contentType := request.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", contentType)
+	}
+	var event recordingEvent
+	if err := json.Unmarshal(request.body, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	id := strings.TrimPrefix(p.location, "/whip/")
+	if event.Event != "recording.complete" || event.Session != id || event.StreamKey != "cam" {
+		t.Errorf("event %q of session %q on %q, want recording.complete of %s on cam", event.Event, event.Session, event.StreamKey, id)
+	}
+	if event.Duration < 900 || !event.Ended.After(event.Started) {
+		t.Errorf("lasted %d ms from %v to %v, want about a second", event.Duration, event.Started, event.Ended)
+	}
+	slices.Sort(event.Codecs)
+	if want := []string{webrtc.MimeTypeOpus, webrtc.MimeTypeVP8}; !slices.Equal(event.Codecs, want) {
+		t.Errorf("codecs %v, want %v", event.Codecs, want)
+	}
+	if len(event.Tracks) != 2 {
+		t.Errorf("tracks %+v, want 2", event.Tracks)
+	}
+	if event.BytesWritten <= 0 {
+		t.Errorf("%d bytes written", event.BytesWritten)
+	}
+	want := filepath.Join(id, "recording.webm")
+	i := slices.IndexFunc(event.Files, func(f recordedFile) bool { return f.Path == want })
+	if i < 0 {
+		t.Fatalf("files %+v, want %s", event.Files, want)
+	}
+	info, err := os.Stat(filepath.Join(config.OutputDir, want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Files[i].Bytes != info.Size() {
+		t.Errorf("%s of %d bytes, want %d", want, event.Files[i].Bytes, info.Size())
+	}
+}
+
+// TestWebhookRetry checks failed attempts are retried, and a delivery
+// failing every attempt only logged
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantLog  string
+	}{
+		{name: "recovered", statuses: []int{http.StatusBadGateway}, wantLog: "Webhook delivered"},
+		{name: "failed", statuses: slices.Repeat([]int{http.StatusInternalServerError}, webhookAttempts), wantLog: "Webhook delivery failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, slog.LevelInfo)
+			hook, received := startWebhook(t, tt.statuses...)
+			setConfig(t, func(c *Config) { c.WebhookURL = hook })
+			sendWebhook(slog.Default(), recordingEvent{Event: "recording.complete", Session: "s"})
+			webhooks.Wait()
+
+			want := min(len(tt.statuses)+1, webhookAttempts)
+			if got := len(received()); got != want {
+				t.Errorf("webhook received %d requests, want %d", got, want)
+			}
+			if records := logs.records(t, tt.wantLog); len(records) != 1 {
+				t.Errorf("logged %q %d times, want once", tt.wantLog, len(records))
+			}
+		})
+	}
+}
+
+// TestWebhookRejectedPublish checks a publish rejected on its offer sends
+// no webhook
+func TestWebhookRejectedPublish(t *testing.T) {
+	hook, received := startWebhook(t)
+	setConfig(t, func(c *Config) { c.WebhookURL = hook })
+	base := startServer(t)
+	p := newCodecPublisher(t, webrtc.MimeTypeVP8)
+	if resp, _ := postOffer(t, base+"/whip/cam?format=avi", p.pc, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("publish answered %d, want 400", resp.StatusCode)
+	}
+	webhooks.Wait()
+	if n := len(received()); n != 0 {
+		t.Errorf("webhook received %d requests for a rejected publish", n)
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Matroska element IDs, including their length marker bits
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	mkvIDSegment           = 0x18538067
+	mkvIDInfo              = 0x1549A966
+	mkvIDTimecodeScale     = 0x2AD7B1
+	mkvIDDuration          = 0x4489
+	mkvIDMuxingApp         = 0x4D80
+	mkvIDWritingApp        = 0x5741
+	mkvIDTracks            = 0x1654AE6B
+	mkvIDTrackEntry        = 0xAE
+	mkvIDTrackNumber       = 0xD7
+	mkvIDTrackUID          = 0x73C5
+	mkvIDTrackType         = 0x83
+	mkvIDCodecID           = 0x86
+	mkvIDCodecPrivate      = 0x63A2
+	mkvIDCodecDelay        = 0x56AA
+	mkvIDSeekPreRoll       = 0x56BB
+	mkvIDVideo             = 0xE0
+	mkvIDPixelWidth        = 0xB0
+	mkvIDPixelHeight       = 0xBA
+	mkvIDAudio             = 0xE1
+	mkvIDSamplingFrequency = 0xB5
+	mkvIDChannels          = 0x9F
+	mkvIDCluster           = 0x1F43B675
+	mkvIDTimecode          = 0xE7
+	mkvIDSimpleBlock       = 0xA3
+
+	mkvTrackTypeVideo = 1
+	mkvTrackTypeAudio = 2
+)
+
+const (
+	// Block timecodes are in milliseconds
+	webmTimecodeScale = time.Millisecond
+
+	// A cluster is closed at the next video keyframe, or once it spans this long
+	webmMaxClusterDuration = 5000
+
+	// Frames held back while waiting for every track's first frame; past
+	// this the header is written with the tracks known so far
+	webmMaxPendingFrames = 500
+
+	// A frame waits for the other tracks to catch up so blocks are written in
+	// timestamp order, but for no more than this many ms of media
+	webmMaxInterleaveDelay = 500
+
+	// Size of an 8-byte element size field set to "unknown"
+	webmUnknownSize = 0x01FFFFFFFFFFFFFF
+)
+
+// webmMuxer interleaves the VP8/VP9 video and Opus audio of one session into
+// a single WebM file. The header is written once every track announced in
+// the offer has arrived and each video track has produced its first
+// keyframe, so that the video dimensions are known; frames before that are
+// held in memory. All tracks share the timeline of the first frame received,
+// and their frames are queued to be written in timestamp order.
+type webmMuxer struct {
+	path string
+
+	mu       sync.Mutex
+	expected int
+	tracks   []*webmTrack
+	open     int
+	start    time.Time
+	pending  []webmBlock
+	queue    []webmBlock
+	file     *os.File
+	err      error
+	closed   bool
+
+	segmentOffset  int64
+	durationOffset int64
+	duration       int64
+
+	// With rotation enabled, segment numbers the current file, which starts
+	// at timecode base and holds size bytes of frames; due is set once it is
+	// full, at timecode dueAt
+	segment int
+	base    int64
+	size    int64
+	due     bool
+	dueAt   int64
+
+	cluster     bytes.Buffer
+	clusterTime int64
+	clusterOpen bool
+}
+
+// webmTrack is the mediaWriter handed to a single track of the session
+type webmTrack struct {
+	muxer    *webmMuxer
+	number   uint64
+	codecID  string
+	mimeType string
+	channels uint16
+
+	inHeader      bool
+	started       bool
+	finalized     bool
+	offset        time.Duration
+	width, height uint16
+
+	// latest is the time of the track's latest frame
+	latest int64
+}
+
+type webmBlock struct {
+	track    *webmTrack
+	time     int64
+	keyframe bool
+	data     []byte
+}
+
+// newWebMMuxer prepares a muxer expecting the given number of tracks. The
+// file at path is only created once there is something to write.
+func newWebMMuxer(path string, expected int) *webmMuxer {
+	return &webmMuxer{path: path, expected: expected}
+}
+
+// webmCodecID returns the Matroska codec ID for mimeType, or "" if WebM can't carry it
+func webmCodecID(mimeType string) string {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		return "V_VP8"
+	case webrtc.MimeTypeVP9:
+		return "V_VP9"
+	case webrtc.MimeTypeOpus:
+		return "A_OPUS"
+	default:
+		return ""
+	}
+}
+
+// addTrack registers a track of the session and returns its writer and
+// depacketizer. Codecs WebM can't carry return errUnsupportedCodec, and the
+// muxer stops waiting for that track.
+func (m *webmMuxer) addTrack(codec webrtc.RTPCodecParameters) (mediaWriter, rtp.Depacketizer, error) {
+	codecID := webmCodecID(codec.MimeType)
+	if codecID == "" {
+		m.skipTrack()
+		return nil, nil, errUnsupportedCodec
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expected--
+	t := &webmTrack{
+		muxer:    m,
+		number:   uint64(len(m.tracks) + 1),
+		codecID:  codecID,
+		mimeType: codec.MimeType,
+		channels: codec.Channels,
+	}
+	m.tracks = append(m.tracks, t)
+	m.open++
+
+	var depacketizer rtp.Depacketizer
+	switch codec.MimeType {
+	case webrtc.MimeTypeVP8:
+		depacketizer = &codecs.VP8Packet{}
+	case webrtc.MimeTypeVP9:
+		depacketizer = &codecs.VP9Packet{}
+	default:
+		depacketizer = &codecs.OpusPacket{}
+	}
+	return t, depacketizer, nil
+}
+
+// skipTrack stops waiting for a track that won't be part of the file
+func (m *webmMuxer) skipTrack() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expected--
+	m.tryWriteHeader()
+}
+
+func (t *webmTrack) isVideo() bool {
+	return t.codecID != "A_OPUS"
+}
+
+// WriteFrame adds a frame to the shared timeline, offset by when the track's first frame arrived
+func (t *webmTrack) WriteFrame(frame []byte, pts time.Duration) error {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+
+	now := time.Now()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	if !t.started {
+		t.started = true
+		t.offset = now.Sub(m.start) - pts
+	}
+
+	block := webmBlock{
+		track:    t,
+		time:     int64((t.offset + pts) / webmTimecodeScale),
+		keyframe: true,
+	}
+	t.latest = max(t.latest, block.time)
+	if t.isVideo() {
+		block.keyframe = isKeyframe(t.mimeType, frame)
+		if block.keyframe && t.width == 0 {
+			if t.mimeType == webrtc.MimeTypeVP8 {
+				t.width, t.height = vp8FrameSize(frame)
+			} else {
+				t.width, t.height = vp9FrameSize(frame)
+			}
+		}
+	}
+
+	if m.file == nil {
+		block.data = append([]byte(nil), frame...)
+		m.pending = append(m.pending, block)
+		m.tryWriteHeader()
+		return m.err
+	}
+	if !t.inHeader {
+		// The track arrived after the header was written
+		return nil
+	}
+	block.data = append([]byte(nil), frame...)
+	i := sort.Search(len(m.queue), func(i int) bool { return m.queue[i].time > block.time })
+	m.queue = slices.Insert(m.queue, i, block)
+	m.err = m.drain(false)
+	return m.err
+}
+
+// drain writes the queued blocks every other track of the file has caught
+// up with, in timestamp order. A track whose frames stop coming holds the
+// others back by webmMaxInterleaveDelay at most. With all set, the whole
+// queue is written.
+func (m *webmMuxer) drain(all bool) error {
+	for len(m.queue) > 0 {
+		block := m.queue[0]
+		if !all && !m.caughtUp(block) {
+			return nil
+		}
+		m.queue = m.queue[1:]
+		overdue := time.Duration(block.time-m.dueAt)*webmTimecodeScale >= rotationKeyframeWait
+		if m.due && (block.keyframe && block.track.isVideo() || !m.hasVideo() || overdue) {
+			if err := m.rotate(block.time); err != nil {
+				return err
+			}
+		}
+		if err := m.writeBlock(block); err != nil {
+			return err
+		}
+		if !m.due && rotationDue(time.Duration(block.time-m.base)*webmTimecodeScale, m.size) {
+			m.due, m.dueAt = true, block.time
+		}
+	}
+	return nil
+}
+
+// caughtUp reports whether every other track of the file has a frame as late
+// as block, has ended, or trails the latest frame queued by more than
+// webmMaxInterleaveDelay
+func (m *webmMuxer) caughtUp(block webmBlock) bool {
+	if m.queue[len(m.queue)-1].time-block.time > webmMaxInterleaveDelay {
+		return true
+	}
+	for _, t := range m.tracks {
+		if t == block.track || !t.inHeader || t.finalized {
+			continue
+		}
+		if !t.started || t.latest < block.time {
+			return false
+		}
+	}
+	return true
+}
+
+// awaitingKeyframe reports whether the next segment waits for a keyframe of this track
+func (t *webmTrack) awaitingKeyframe() bool {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.due && t.inHeader && t.isVideo()
+}
+
+// hasVideo reports whether the current file has a video track
+func (m *webmMuxer) hasVideo() bool {
+	for _, t := range m.tracks {
+		if t.inHeader && t.isVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// rotate finalizes the current file and starts the next segment at timecode at
+func (m *webmMuxer) rotate(at int64) error {
+	err := m.finalize()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.file = nil
+	if err != nil {
+		return err
+	}
+	m.base = at
+	m.due = false
+	m.writeHeader()
+	return m.err
+}
+
+// Finalize ends the track, and once the last track of the session is done
+// writes the last cluster and patches the segment size and duration
+func (t *webmTrack) Finalize() error {
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.finalized {
+		return m.err
+	}
+	t.finalized = true
+	m.open--
+	if m.open > 0 {
+		// The other tracks no longer wait for this one
+		if m.file != nil && m.err == nil {
+			m.err = m.drain(false)
+		}
+		return m.err
+	}
+
+	if m.file == nil && len(m.pending) > 0 {
+		m.writeHeader()
+	}
+	if m.file != nil && m.err == nil {
+		if m.err = m.drain(true); m.err == nil {
+			m.err = m.finalize()
+		}
+	}
+	return m.err
+}
+
+// Close finalizes the track if needed, closing the file after the last track
+func (t *webmTrack) Close() error {
+	err := t.Finalize()
+	m := t.muxer
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.open > 0 || m.file == nil || m.closed {
+		return err
+	}
+	m.closed = true
+	if closeErr := m.file.Close(); m.err == nil {
+		m.err = closeErr
+	}
+	return m.err
+}
+
+// tryWriteHeader writes the header once every track is ready, or once too
+// many frames are waiting for it
+func (m *webmMuxer) tryWriteHeader() {
+	if m.file != nil || m.err != nil || len(m.pending) == 0 {
+		return
+	}
+	if len(m.pending) < webmMaxPendingFrames {
+		if m.expected > 0 {
+			return
+		}
+		for _, t := range m.tracks {
+			if t.isVideo() && !t.started {
+				return
+			}
+		}
+	}
+	m.writeHeader()
+}
+
+// writeHeader creates the file, writes the EBML header, segment info and
+// track list, then the frames that were waiting for it in timestamp order
+func (m *webmMuxer) writeHeader() {
+	path := m.path
+	if rotationEnabled() {
+		m.segment++
+		path = segmentName(m.path, m.segment)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		m.err = err
+		m.pending = nil
+		return
+	}
+	m.file = file
+	m.size = 0
+	m.duration = 0
+
+	var header bytes.Buffer
+	header.Write(ebmlElement(ebmlIDHeader, concat(
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)))
+
+	// The segment size and duration are patched on Close
+	header.Write(ebmlID(mkvIDSegment))
+	header.Write(ebmlSize8(webmUnknownSize))
+	m.segmentOffset = int64(header.Len())
+
+	info := concat(
+		ebmlUint(mkvIDTimecodeScale, uint64(webmTimecodeScale)),
+		ebmlString(mkvIDMuxingApp, "mediaserver"),
+		ebmlString(mkvIDWritingApp, "mediaserver"),
+	)
+	duration := ebmlFloat(mkvIDDuration, 0)
+	header.Write(ebmlID(mkvIDInfo))
+	header.Write(ebmlSize(uint64(len(info) + len(duration))))
+	header.Write(info)
+	m.durationOffset = int64(header.Len() + len(duration) - 8)
+	header.Write(duration)
+
+	var tracks []byte
+	for _, t := range m.tracks {
+		if t.isVideo() && !t.started {
+			continue
+		}
+		t.inHeader = true
+		tracks = append(tracks, t.entry()...)
+	}
+	header.Write(ebmlElement(mkvIDTracks, tracks))
+
+	if _, err := file.Write(header.Bytes()); err != nil {
+		m.err = err
+		return
+	}
+
+	pending := m.pending
+	m.pending = nil
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].time < pending[j].time })
+	for _, block := range pending {
+		if !block.track.inHeader {
+			continue
+		}
+		if m.err = m.writeBlock(block); m.err != nil {
+			return
+		}
+	}
+}
+
+// entry encodes the TrackEntry of t
+func (t *webmTrack) entry() []byte {
+	fields := concat(
+		ebmlUint(mkvIDTrackNumber, t.number),
+		ebmlUint(mkvIDTrackUID, t.number),
+		ebmlString(mkvIDCodecID, t.codecID),
+	)
+	if t.isVideo() {
+		return ebmlElement(mkvIDTrackEntry, concat(fields,
+			ebmlUint(mkvIDTrackType, mkvTrackTypeVideo),
+			ebmlElement(mkvIDVideo, concat(
+				ebmlUint(mkvIDPixelWidth, uint64(t.width)),
+				ebmlUint(mkvIDPixelHeight, uint64(t.height)),
+			)),
+		))
+	}
+
+	channels := t.channels
+	if channels == 0 {
+		channels = 2
+	}
+	preSkip := time.Duration(oggPreSkip) * time.Second / oggSampleRate
+	return ebmlElement(mkvIDTrackEntry, concat(fields,
+		ebmlUint(mkvIDTrackType, mkvTrackTypeAudio),
+		ebmlElement(mkvIDCodecPrivate, opusHead(channels)),
+		ebmlUint(mkvIDCodecDelay, uint64(preSkip)),
+		ebmlUint(mkvIDSeekPreRoll, uint64(80*time.Millisecond)),
+		ebmlElement(mkvIDAudio, concat(
+			ebmlFloat(mkvIDSamplingFrequency, oggSampleRate),
+			ebmlUint(mkvIDChannels, uint64(channels)),
+		)),
+	))
+}
+
+// writeBlock adds a SimpleBlock to the current cluster, starting a new
+// cluster on video keyframes so players can seek to them
+func (m *webmMuxer) writeBlock(block webmBlock) error {
+	blockTime := block.time - m.base
+	relative := blockTime - m.clusterTime
+	if m.clusterOpen && (block.keyframe && block.track.isVideo() && relative > 0 ||
+		relative > webmMaxClusterDuration || relative < math.MinInt16) {
+		if err := m.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if !m.clusterOpen {
+		m.clusterOpen = true
+		m.clusterTime = max(blockTime, 0)
+		m.cluster.Reset()
+		m.cluster.Write(ebmlUint(mkvIDTimecode, uint64(m.clusterTime)))
+		relative = blockTime - m.clusterTime
+	}
+
+	// Track number as a 1-byte vint, signed 16-bit timecode relative to the cluster, flags
+	data := make([]byte, 4, 4+len(block.data))
+	data[0] = 0x80 | byte(block.track.number)
+	binary.BigEndian.PutUint16(data[1:], uint16(int16(relative)))
+	if block.keyframe {
+		data[3] = 0x80
+	}
+	data = append(data, block.data...)
+	m.cluster.Write(ebmlElement(mkvIDSimpleBlock, data))
+
+	m.duration = max(m.duration, blockTime)
+	m.size += int64(len(block.data))
+	return nil
+}
+
+func (m *webmMuxer) flushCluster() error {
+	if !m.clusterOpen {
+		return nil
+	}
+	m.clusterOpen = false
+	_, err := m.file.Write(ebmlElement(mkvIDCluster, m.cluster.Bytes()))
+	return err
+}
+
+// finalize writes the last cluster and patches the segment size and duration
+func (m *webmMuxer) finalize() error {
+	if err := m.flushCluster(); err != nil {
+		return err
+	}
+	end, err := m.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := m.file.WriteAt(ebmlSize8(uint64(end-m.segmentOffset)), m.segmentOffset-8); err != nil {
+		return err
+	}
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(float64(m.duration)))
+	_, err = m.file.WriteAt(duration, m.durationOffset)
+	return err
+}
+
+// ebmlID encodes an element ID, which already carries its length marker
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// ebmlSize encodes size as the shortest variable-length integer
+func ebmlSize(size uint64) []byte {
+	length := 1
+	// All-ones values are reserved for "unknown", so each length holds one less
+	for size >= 1<<(7*length)-1 && length < 8 {
+		length++
+	}
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = byte(size)
+		size >>= 8
+	}
+	buf[0] |= 0x80 >> (length - 1)
+	return buf
+}
+
+// ebmlSize8 encodes size as an 8-byte variable-length integer so it can be patched later
+func ebmlSize8(size uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, size)
+	buf[0] = 0x01
+	return buf
+}
+
+func ebmlElement(id uint32, data []byte) []byte {
+	return concat(ebmlID(id), ebmlSize(uint64(len(data))), data)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	return ebmlElement(id, buf[i:])
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(value))
+	return ebmlElement(id, buf)
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type webmTestTrack struct {
+	number        uint64
+	codecID       string
+	width, height uint64
+}
+
+type webmTestBlock struct {
+	track    byte
+	time     int64
+	keyframe bool
+	// cluster is set on the first block of a cluster
+	cluster bool
+}
+
+// body, returning the data after it. An unknown size runs to the end of data.
+func readEBMLElement(data []byte) (id uint32, body, rest []byte, err error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, nil, nil, errors.New("invalid EBML element ID")
+	}
+	idLength := 1
+	for data[0]&(0x80>>(idLength-1)) == 0 {
+		idLength++
+	}
+	if idLength > 4 || len(data) < idLength+1 {
+		return 0, nil, nil, errors.New("invalid EBML element ID")
+	}
+	for _, b := range data[:idLength] {
+		id = id<<8 | uint32(b)
+	}
+	data = data[idLength:]
+
+	if data[0] == 0 {
+		return 0, nil, nil, errors.New("invalid EBML element size")
+	}
+	sizeLength := 1
+	for data[0]&(0x80>>(sizeLength-1)) == 0 {
+		sizeLength++
+	}
+	if len(data) < sizeLength {
+		return 0, nil, nil, errors.New("truncated EBML element size")
+	}
+	size := uint64(data[0] & (0xff >> sizeLength))
+	unknown := size == uint64(0xff>>sizeLength)
+	for _, b := range data[1:sizeLength] {
+		size = size<<8 | uint64(b)
+		unknown = unknown && b == 0xff
+	}
+	data = data[sizeLength:]
+	if unknown {
+		return id, data, nil, nil
+	}
+	if size > uint64(len(data)) {
+		return 0, nil, nil, fmt.Errorf("EBML element %#x runs past its parent", id)
+	}
+	return id, data[:size], data[size:], nil
+}
+
+// ebmlUintValue decodes the body of an unsigned integer element
+func ebmlUintValue(body []byte) uint64 {
+	var value uint64
+	for _, b := range body {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// readWebM returns the track entries and blocks of a WebM file, with the
+// block times made absolute
+func readWebM(t *testing.T, data []byte) ([]webmTestTrack, []webmTestBlock) {
+	t.Helper()
+	if err := checkEBMLHeader(data); err != nil {
+		t.Fatal(err)
+	}
+	_, _, rest, _ := readEBMLElement(data)
+	id, segment, _, err := readEBMLElement(rest)
+	if err != nil || id != mkvIDSegment {
+		t.Fatalf("no segment: %v", err)
+	}
+
+	var tracks []webmTestTrack
+	var blocks []webmTestBlock
+	for len(segment) > 0 {
+		id, body, next, err := readEBMLElement(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment = next
+		switch id {
+		case mkvIDTracks:
+			for len(body) > 0 {
+				_, entry, after, err := readEBMLElement(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = after
+				tracks = append(tracks, readWebMTrackEntry(t, entry))
+			}
+		case mkvIDCluster:
+			var clusterTime int64
+			first := true
+			for len(body) > 0 {
+				child, childBody, after, err := readEBMLElement(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = after
+				switch child {
+				case mkvIDTimecode:
+					clusterTime = int64(ebmlUintValue(childBody))
+				case mkvIDSimpleBlock:
+					blocks = append(blocks, webmTestBlock{
+						track:    childBody[0] & 0x7f,
+						time:     clusterTime + int64(int16(binary.BigEndian.Uint16(childBody[1:]))),
+						keyframe: childBody[3]&0x80 != 0,
+						cluster:  first,
+					})
+					first = false
+				}
+			}
+		}
+	}
+	return tracks, blocks
+}
+
+func readWebMTrackEntry(t *testing.T, entry []byte) webmTestTrack {
+	t.Helper()
+	var track webmTestTrack
+	for len(entry) > 0 {
+		id, body, rest, err := readEBMLElement(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry = rest
+		switch id {
+		case mkvIDTrackNumber:
+			track.number = ebmlUintValue(body)
+		case mkvIDCodecID:
+			track.codecID = string(body)
+		case mkvIDVideo:
+			for len(body) > 0 {
+				child, value, after, err := readEBMLElement(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = after
+				switch child {
+				case mkvIDPixelWidth:
+					track.width = ebmlUintValue(value)
+				case mkvIDPixelHeight:
+					track.height = ebmlUintValue(value)
+				}
+			}
+		}
+	}
+	return track
+}
+
+// checkEBMLHeader checks that data starts with the EBML header of a WebM document
+func checkEBMLHeader(data []byte) error {
+	id, header, _, err := readEBMLElement(data)
+	if err != nil {
+		return err
+	}
+	if id != ebmlIDHeader || !bytes.Contains(header, ebmlString(ebmlIDDocType, "webm")) {
+		return os.ErrInvalid
+	}
+	return nil
+}
+
+// webmTestFrame is a frame written to track of the muxer at pts
+type webmTestFrame struct {
+	track int
+	frame []byte
+	pts   time.Duration
+}
+
+// webmFrames returns d of frames of each of mimeTypes, in the order they'd
+// arrive in real time, with a video keyframe every keyframeInterval frames
+func webmFrames(mimeTypes []string, d time.Duration, keyframeInterval int) []webmTestFrame {
+	var frames []webmTestFrame
+	next := make([]time.Duration, len(mimeTypes))
+	count := make([]int, len(mimeTypes))
+	for {
+		// The track whose next frame is due first
+		track := -1
+		for i := range mimeTypes {
+			if next[i] < d && (track < 0 || next[i] < next[track]) {
+				track = i
+			}
+		}
+		if track < 0 {
+			return frames
+		}
+		frame := testOpusSilence
+		rate := 50
+		if mimeTypes[track] != webrtc.MimeTypeOpus {
+			frame = testVP8Interframe
+			if count[track]%keyframeInterval == 0 {
+				frame = testVP8Keyframe
+			}
+			rate = 30
+		}
+		frames = append(frames, webmTestFrame{track, frame, next[track]})
+		count[track]++
+		next[track] = time.Duration(count[track]) * time.Second / time.Duration(rate)
+	}
+}
+
+// webmBursts reorders frames as if each track delivered d of them at a time,
+// one track after the other
+func webmBursts(frames []webmTestFrame, d time.Duration) []webmTestFrame {
+	tracks := 0
+	for _, f := range frames {
+		tracks = max(tracks, f.track+1)
+	}
+	var bursts []webmTestFrame
+	for start := time.Duration(0); len(bursts) < len(frames); start += d {
+		for track := range tracks {
+			for _, f := range frames {
+				if f.track == track && f.pts >= start && f.pts < start+d {
+					bursts = append(bursts, f)
+				}
+			}
+		}
+	}
+	return bursts
+}
+
+func TestWebMMuxer(t *testing.T) {
+	tests := []struct {
+		name      string
+		mimeTypes []string
+		// Tracks of the offer the muxer can't carry
+		unsupported int
+		// keyframeInterval is the number of video frames per keyframe
+		keyframeInterval int
+		frames           []webmTestFrame
+		wantTracks       []webmTestTrack
+		// wantBlocks counts the blocks per track number
+		wantBlocks map[byte]int
+	}{
+		{
+			name:             "video and audio",
+			mimeTypes:        []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus},
+			keyframeInterval: 10,
+			frames:           webmFrames([]string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, time.Second, 10),
+			wantTracks:       []webmTestTrack{{1, "V_VP8", 640, 480}, {2, "A_OPUS", 0, 0}},
+			wantBlocks:       map[byte]int{1: 30, 2: 50},
+		},
+		{
+			name:             "interleaved in bursts",
+			mimeTypes:        []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus},
+			keyframeInterval: 10,
+			frames:           webmBursts(webmFrames([]string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, 2*time.Second, 10), 300*time.Millisecond),
+			wantTracks:       []webmTestTrack{{1, "V_VP8", 640, 480}, {2, "A_OPUS", 0, 0}},
+			wantBlocks:       map[byte]int{1: 60, 2: 100},
+		},
+		{
+			name:             "video only",
+			mimeTypes:        []string{webrtc.MimeTypeVP8},
+			keyframeInterval: 15,
+			frames:           webmFrames([]string{webrtc.MimeTypeVP8}, time.Second, 15),
+			wantTracks:       []webmTestTrack{{1, "V_VP8", 640, 480}},
+			wantBlocks:       map[byte]int{1: 30},
+		},
+		{
+			name:       "audio only",
+			mimeTypes:  []string{webrtc.MimeTypeOpus},
+			frames:     webmFrames([]string{webrtc.MimeTypeOpus}, 7*time.Second, 0),
+			wantTracks: []webmTestTrack{{1, "A_OPUS", 0, 0}},
+			wantBlocks: map[byte]int{1: 350},
+		},
+		{
+			name:        "unsupported track left out",
+			mimeTypes:   []string{webrtc.MimeTypeOpus},
+			unsupported: 1,
+			frames:      webmFrames([]string{webrtc.MimeTypeOpus}, time.Second, 0),
+			wantTracks:  []webmTestTrack{{1, "A_OPUS", 0, 0}},
+			wantBlocks:  map[byte]int{1: 50},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session.webm")
+			muxer := newWebMMuxer(path, len(tt.mimeTypes)+tt.unsupported)
+			var writers []mediaWriter
+			for _, mimeType := range tt.mimeTypes {
+				writer, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				writers = append(writers, writer)
+			}
+			for range tt.unsupported {
+				_, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+				})
+				if err != errUnsupportedCodec {
+					t.Fatalf("addTrack(H264) error = %v, want %v", err, errUnsupportedCodec)
+				}
+			}
+			for _, f := range tt.frames {
+				if err := writers[f.track].WriteFrame(f.frame, f.pts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, writer := range writers {
+				if err := writer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tracks, blocks := readWebM(t, data)
+			if len(tracks) != len(tt.wantTracks) {
+				t.Fatalf("tracks = %+v, want %+v", tracks, tt.wantTracks)
+			}
+			for i := range tracks {
+				if tracks[i] != tt.wantTracks[i] {
+					t.Errorf("track %d = %+v, want %+v", i, tracks[i], tt.wantTracks[i])
+				}
+			}
+
+			counts := map[byte]int{}
+			var last int64
+			for i, block := range blocks {
+				counts[block.track]++
+				if block.time < last {
+					t.Errorf("block %d at %d ms after one at %d ms", i, block.time, last)
+				}
+				last = block.time
+				if tracks[block.track-1].codecID != "V_VP8" {
+					if !block.keyframe {
+						t.Errorf("audio block %d not marked as a keyframe", i)
+					}
+					continue
+				}
+				keyframe := (counts[block.track]-1)%tt.keyframeInterval == 0
+				if block.keyframe != keyframe {
+					t.Errorf("block %d: keyframe %v, want %v", i, block.keyframe, keyframe)
+				}
+				if keyframe && !block.cluster {
+					t.Errorf("keyframe block %d doesn't start a cluster", i)
+				}
+			}
+			for track, want := range tt.wantBlocks {
+				if counts[track] != want {
+					t.Errorf("%d blocks on track %d, want %d", counts[track], track, want)
+				}
+			}
+		})
+	}
+}
+
+// TestWebMInterleaveStall stops the audio of a recording for a while and
+// checks the video isn't held back for longer than webmMaxInterleaveDelay
+func TestWebMInterleaveStall(t *testing.T) {
+	mimeTypes := []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}
+	path := filepath.Join(t.TempDir(), "session.webm")
+	muxer := newWebMMuxer(path, len(mimeTypes))
+	var writers []mediaWriter
+	for _, mimeType := range mimeTypes {
+		writer, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers = append(writers, writer)
+	}
+	var written int
+	for _, f := range webmFrames(mimeTypes, 3*time.Second, 30) {
+		if f.track == 1 && f.pts >= 200*time.Millisecond && f.pts < 2*time.Second {
+			// The audio stalls
+			continue
+		}
+		if err := writers[f.track].WriteFrame(f.frame, f.pts); err != nil {
+			t.Fatal(err)
+		}
+		written++
+		if n := len(muxer.queue); n > 0 {
+			if held := muxer.queue[n-1].time - muxer.queue[0].time; held > webmMaxInterleaveDelay {
+				t.Fatalf("%d ms of frames held back at %v", held, f.pts)
+			}
+		}
+	}
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, blocks := readWebM(t, data)
+	if len(blocks) != written {
+		t.Errorf("%d blocks written, want %d", len(blocks), written)
+	}
+	var last int64
+	for i, block := range blocks {
+		if block.time < last {
+			t.Errorf("block %d at %d ms after one at %d ms", i, block.time, last)
+		}
+		last = block.time
+	}
+}
+
+// TestWebMRecording records a WHIP session to WebM and checks the file
+func TestWebMRecording(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	p.play(t, time.Second)
+	p.stop(t, base)
+
+	files, err := filepath.Glob(filepath.Join(config.OutputDir, "*", "*"))
+	if err != nil || len(files) != 1 || filepath.Ext(files[0]) != ".webm" {
+		t.Fatalf("recorded %v, want one WebM file: %v", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, blocks := readWebM(t, data)
+	want := []webmTestTrack{{1, "V_VP8", 640, 480}, {2, "A_OPUS", 0, 0}}
+	if len(tracks) != len(want) {
+		t.Fatalf("tracks = %+v, want %+v", tracks, want)
+	}
+	for i := range tracks {
+		if tracks[i] != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i, tracks[i], want[i])
+		}
+	}
+	for _, block := range blocks {
+		if block.track == 1 {
+			if !block.keyframe {
+				t.Error("the first video block isn't a keyframe")
+			}
+			break
+		}
+	}
+}
+
+// webmInfo returns the duration in the segment info of a WebM file and
+// whether the segment size matches the data that follows it
+func webmInfo(t *testing.T, data []byte) (duration float64, sized bool) {
+	t.Helper()
+	_, _, rest, _ := readEBMLElement(data)
+	_, segment, after, err := readEBMLElement(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unknown size leaves rest nil, like a size running to the end of the file
+	sized = after != nil && len(after) == 0
+	for len(segment) > 0 {
+		id, body, next, err := readEBMLElement(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment = next
+		if id != mkvIDInfo {
+			continue
+		}
+		for len(body) > 0 {
+			child, childBody, after, err := readEBMLElement(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = after
+			if child == mkvIDDuration {
+				return math.Float64frombits(binary.BigEndian.Uint64(childBody)), sized
+			}
+		}
+	}
+	t.Fatal("no duration in the segment info")
+	return 0, false
+}
+
+// TestWebMFinalize finalizes the tracks of a muxer before closing them and
+// checks the header duration matches the length of what was recorded
+func TestWebMFinalize(t *testing.T) {
+	mimeTypes := []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}
+	path := filepath.Join(t.TempDir(), "session.webm")
+	muxer := newWebMMuxer(path, len(mimeTypes))
+	var writers []mediaWriter
+	for _, mimeType := range mimeTypes {
+		writer, _, err := muxer.addTrack(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writers = append(writers, writer)
+	}
+	for _, f := range webmFrames(mimeTypes, 3*time.Second, 30) {
+		if err := writers[f.track].WriteFrame(f.frame, f.pts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, writer := range writers {
+		if err := writer.(finalizer).Finalize(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		duration, sized := webmInfo(t, data)
+		if i < len(writers)-1 {
+			// The file is only finalized with its last track
+			if sized || duration != 0 {
+				t.Fatalf("finalized with track %d still open: duration %v, sized %v", i+2, duration, sized)
+			}
+			continue
+		}
+		_, blocks := readWebM(t, data)
+		var length int64
+		for _, block := range blocks {
+			length = max(length, block.time)
+		}
+		if !sized {
+			t.Error("segment size not patched")
+		}
+		if duration != float64(length) || length < 2900 {
+			t.Errorf("duration %v ms, want the %d ms recorded", duration, length)
+		}
+	}
+
+	finalized, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closed, err := os.ReadFile(path); err != nil || !bytes.Equal(closed, finalized) {
+		t.Errorf("Close changed the finalized file: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// Handler for outgoing WHEP (WebRTC HTTP Egress Protocol) on /whep/{streamKey};
+// a bare /whep plays the default stream. Playback is stopped with a DELETE of
+// the /whep/{id} resource it creates.
+func whepHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.Error, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		whepDeleteHandler(w, r)
+		return
+	}
+	streamKey, ok := streamKeyFromPath(r.URL.Path, "/whep/")
+	if !ok {
+		http.Error(w, "Invalid stream key", http.StatusBadRequest)
+		return
+	}
+	if !requireStreamAuth(w, r, streamKey, rightPlay) {
+		return
+	}
+	if !acceptingSessions(w, http.Error) {
+		return
+	}
+
+	offerData, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	// Without a publisher, -test-source plays in its place
+	tracks := publishedTracks(streamKey)
+	var source *testSource
+	if len(tracks) == 0 {
+		if config.TestSource == "" {
+			http.Error(w, "No active publisher", http.StatusNotFound)
+			return
+		}
+		var err error
+		if source, err = loadTestSource(config.TestSource); err != nil {
+			slog.Error("Failed to load the test source", "path", config.TestSource, "error", err)
+			http.Error(w, "Failed to load the test source", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	peerConnection, _, err := newPeerConnection(nil)
+	if err != nil {
+		http.Error(w, "Failed to create PeerConnection", http.StatusInternalServerError)
+		return
+	}
+	viewer := &whepViewer{id: uuid.NewString(), streamKey: streamKey, peerConnection: peerConnection}
+	sourceCtx, stopSource := context.WithCancel(context.Background())
+	var sourceTrack *webrtc.TrackLocalStaticSample
+
+	// Start forwarding once the viewer is connected, and release it once it goes away
+	var (
+		subscribeOnce sync.Once
+		unsubscribeMu sync.Mutex
+		unsubscribers []func()
+		localTracks   []*webrtc.TrackLocalStaticRTP
+	)
+	unsubscribeAll := func() {
+		unsubscribeMu.Lock()
+		defer unsubscribeMu.Unlock()
+		for _, unsubscribe := range unsubscribers {
+			unsubscribe()
+		}
+		unsubscribers = nil
+	}
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			subscribeOnce.Do(func() {
+				unsubscribeMu.Lock()
+				defer unsubscribeMu.Unlock()
+				for i, track := range tracks {
+					unsubscribers = append(unsubscribers, track.subscribe(localTracks[i]))
+				}
+				if source != nil {
+					go source.play(sourceCtx, sourceTrack)
+				}
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected:
+			unsubscribeAll()
+			stopSource()
+			if err := peerConnection.Close(); err != nil {
+				slog.Warn("Failed to close WHEP PeerConnection", "error", err)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			viewers.remove(viewer.id)
+			unsubscribeAll()
+			stopSource()
+			slog.Info("WHEP session closed", "stream", streamKey, "id", viewer.id)
+		}
+	})
+
+	var senderTracks []webrtc.TrackLocal
+	for _, track := range tracks {
+		local, err := webrtc.NewTrackLocalStaticRTP(track.codec, track.id, track.streamID)
+		if err != nil {
+			peerConnection.Close()
+			http.Error(w, "Failed to create track", http.StatusInternalServerError)
+			return
+		}
+		localTracks = append(localTracks, local)
+		senderTracks = append(senderTracks, local)
+	}
+	if source != nil {
+		sourceTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test-source")
+		if err != nil {
+			peerConnection.Close()
+			http.Error(w, "Failed to create track", http.StatusInternalServerError)
+			return
+		}
+		senderTracks = append(senderTracks, sourceTrack)
+	}
+	for _, local := range senderTracks {
+		sender, err := peerConnection.AddTrack(local)
+		if err != nil {
+			peerConnection.Close()
+			http.Error(w, "Failed to add track", http.StatusInternalServerError)
+			return
+		}
+
+		// Drain incoming RTCP so interceptors keep working
+		go func() {
+			rtcpBuf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(rtcpBuf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Set remote description from the incoming SDP offer
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerData,
+	}
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		peerConnection.Close()
+		http.Error(w, "Failed to set remote description", http.StatusInternalServerError)
+		return
+	}
+
+	// Create an SDP answer and set it as the local description
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		peerConnection.Close()
+		http.Error(w, "Failed to create answer", http.StatusInternalServerError)
+		return
+	}
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		peerConnection.Close()
+		http.Error(w, "Failed to set local description", http.StatusInternalServerError)
+		return
+	}
+
+	// Wait until the connection is ready
+	<-webrtc.GatheringCompletePromise(peerConnection)
+
+	// Send the SDP answer back to the viewer, with the resource ending playback
+	viewers.add(viewer)
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", "/whep/"+viewer.id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(peerConnection.LocalDescription().SDP))
+
+	slog.Info("WHEP session established", "stream", streamKey, "id", viewer.id, "tracks", len(senderTracks), "test_source", source != nil)
+}
+
+// whepDeleteHandler stops the playback of the /whep/{id} resource, closing
+// the viewer's PeerConnection and with it the forwarding of its tracks
+func whepDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/whep/")
+	// A viewer's token must grant playing its stream
+	if viewer := viewers.get(id); viewer != nil {
+		if !requireStreamAuth(w, r, viewer.streamKey, rightPlay) {
+			return
+		}
+	} else if !requireResourceToken(w, r, rightPlay) {
+		return
+	}
+
+	viewer := viewers.remove(id)
+	if viewer == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := viewer.peerConnection.Close(); err != nil {
+		slog.Warn("Failed to close WHEP PeerConnection", "error", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	slog.Info("WHEP session terminated", "stream", viewer.streamKey, "id", viewer.id)
+}
+
+// whepViewer is a WHEP playback, subscribed to the tracks of streamKey
+type whepViewer struct {
+	id             string
+	streamKey      string
+	peerConnection *webrtc.PeerConnection
+}
+
+// viewerRegistry holds the WHEP viewers keyed by resource ID
+type viewerRegistry struct {
+	mu      sync.Mutex
+	viewers map[string]*whepViewer
+}
+
+var viewers = &viewerRegistry{viewers: map[string]*whepViewer{}}
+
+func (r *viewerRegistry) add(v *whepViewer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.viewers[v.id] = v
+}
+
+// remove deletes the viewer and returns it, or nil if it was already gone
+func (r *viewerRegistry) get(id string) *whepViewer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.viewers[id]
+}
+
+func (r *viewerRegistry) remove(id string) *whepViewer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := r.viewers[id]
+	delete(r.viewers, id)
+	return v
+}
+
+// count returns the number of viewers of streamKey
+func (r *viewerRegistry) count(streamKey string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, v := range r.viewers {
+		if v.streamKey == streamKey {
+			n++
+		}
+	}
+	return n
+}
+
+// total returns the number of viewers of every stream
+func (r *viewerRegistry) total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.viewers)
+}
+
+// closeAll removes every viewer and closes its PeerConnection
+func (r *viewerRegistry) closeAll() {
+	r.mu.Lock()
+	all := r.viewers
+	r.viewers = map[string]*whepViewer{}
+	r.mu.Unlock()
+	for _, v := range all {
+		if err := v.peerConnection.Close(); err != nil {
+			slog.Warn("Failed to close WHEP PeerConnection", "error", err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWHEPPlayback(t *testing.T) {
+	tests := []struct {
+		name       string
+		publish    []string
+		want       []string
+		wantStatus int
+	}{
+		{name: "video", publish: []string{webrtc.MimeTypeVP8}, want: []string{webrtc.MimeTypeVP8}, wantStatus: http.StatusCreated},
+		{name: "video and audio", publish: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, want: []string{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}, wantStatus: http.StatusCreated},
+		{name: "no publisher", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			if tt.publish != nil {
+				p := publish(t, base+"/whip", tt.publish...)
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					p.playUntil(ctx)
+				}()
+				t.Cleanup(func() {
+					cancel()
+					<-done
+				})
+				waitFor(t, "the tracks to be relayed", func() bool { return len(publishedTracks(defaultStreamKey)) == len(tt.publish) })
+			}
+
+			viewer := newTestPeerConnection(t)
+			for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+				if _, err := viewer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			received := make(chan string, 2)
+			viewer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+				if _, _, err := track.ReadRTP(); err == nil {
+					received <- track.Codec().MimeType
+				}
+			})
+
+			resp, body := postOffer(t, base+"/whep", viewer, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("POST /whep answered %d: %s, want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			got := map[string]bool{}
+			for range tt.want {
+				select {
+				case mimeType := <-received:
+					got[mimeType] = true
+				case <-time.After(testTimeout):
+					t.Fatalf("received RTP of %v, want %v", got, tt.want)
+				}
+			}
+			for _, mimeType := range tt.want {
+				if !got[mimeType] {
+					t.Errorf("no RTP of %s received", mimeType)
+				}
+			}
+		})
+	}
+}
+
+// writeTestIVF writes count frames of the sample VP8 media to an IVF file of
+// the given codec and returns its path
+func writeTestIVF(t *testing.T, fourcc string, count int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pattern.ivf")
+	writer, err := createIVFWriter(path, fourcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range count {
+		if err := writer.WriteFrame(sample(webrtc.MimeTypeVP8, i).Data, time.Duration(i)*time.Second/30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestWHEPTestSource plays a stream that has no publisher with -test-source
+// and checks the viewer receives the looped frames
+func TestWHEPTestSource(t *testing.T) {
+	base := startServer(t)
+	config.TestSource = writeTestIVF(t, "VP80", 10)
+
+	viewer := newTestPeerConnection(t)
+	if _, err := viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	// The 10 frames of the file loop, so more than 10 frames arrive
+	frames := make(chan struct{}, 100)
+	viewer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Codec().MimeType != webrtc.MimeTypeVP8 {
+			t.Errorf("received %s, want VP8", track.Codec().MimeType)
+			return
+		}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if packet.Marker {
+				select {
+				case frames <- struct{}{}:
+				default:
+				}
+			}
+		}
+	})
+
+	resp, body := postOffer(t, base+"/whep/nobody", viewer, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /whep/nobody answered %d: %s", resp.StatusCode, body)
+	}
+	for i := range 15 {
+		select {
+		case <-frames:
+		case <-time.After(testTimeout):
+			t.Fatalf("received %d frames of the test source, want 15", i)
+		}
+	}
+}
+
+func TestTestSourceConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    func(t *testing.T) string
+		wantErr string
+	}{
+		{name: "VP8", path: func(t *testing.T) string { return writeTestIVF(t, "VP80", 3) }},
+		{name: "not VP8", path: func(t *testing.T) string { return writeTestIVF(t, "VP90", 3) }, wantErr: "not VP8"},
+		{name: "no frames", path: func(t *testing.T) string { return writeTestIVF(t, "VP80", 0) }, wantErr: "no frames"},
+		{name: "missing", path: func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing.ivf") }, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseFlags(t, "-test-source", tt.path(t), "-output-dir", t.TempDir())
+			err := cfg.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// subscriberCount returns the viewers subscribed to the tracks of streamKey
+func subscriberCount(streamKey string) int {
+	n := 0
+	for _, track := range publishedTracks(streamKey) {
+		track.mu.Lock()
+		n += len(track.subscribers)
+		track.mu.Unlock()
+	}
+	return n
+}
+
+// TestWHEPDelete subscribes a viewer to a stream, deletes its resource and
+// checks the subscriber count falls back
+func TestWHEPDelete(t *testing.T) {
+	base := startServer(t)
+	p := publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.playUntil(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the track to be relayed", func() bool { return len(publishedTracks("cam")) == 1 })
+
+	viewer := newTestPeerConnection(t)
+	if _, err := viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := postOffer(t, base+"/whep/cam", viewer, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /whep/cam answered %d: %s", resp.StatusCode, body)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/whep/") || location == "/whep/cam" {
+		t.Fatalf("Location %q, want the /whep/{id} resource of the viewer", location)
+	}
+	if n := viewers.count("cam"); n != 1 {
+		t.Errorf("%d viewers of cam, want 1", n)
+	}
+	if info := sessions.list()[0].info(); info.Viewers != 1 {
+		t.Errorf("session lists %d viewers, want 1", info.Viewers)
+	}
+	waitFor(t, "the viewer to subscribe", func() bool { return subscriberCount("cam") == 1 })
+
+	for _, want := range []int{http.StatusOK, http.StatusNotFound} {
+		req, err := http.NewRequest(http.MethodDelete, base+location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted.Body.Close()
+		if deleted.StatusCode != want {
+			t.Errorf("DELETE %s answered %d, want %d", location, deleted.StatusCode, want)
+		}
+	}
+	if n := viewers.count("cam"); n != 0 {
+		t.Errorf("%d viewers of cam after DELETE, want 0", n)
+	}
+	if info := sessions.list()[0].info(); info.Viewers != 0 {
+		t.Errorf("session lists %d viewers after DELETE, want 0", info.Viewers)
+	}
+	waitFor(t, "the viewer to unsubscribe", func() bool { return subscriberCount("cam") == 0 })
+}
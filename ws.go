@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+// wsOfferTimeout bounds the wait for the offer once a signaling socket is open
+const wsOfferTimeout = 10 * time.Second
+
+// wsMessage is a JSON message of the WebSocket signaling: the client sends
+// an offer, answered with every server candidate, then may trickle its own
+// candidates, an empty one ending them. Either side sends close to end the
+// session, the server with the reason it failed to start.
+type wsMessage struct {
+	Type      string `json:"type"`
+	SDP       string `json:"sdp,omitempty"`
+	Candidate string `json:"candidate,omitempty"`
+	Session   string `json:"session,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Handler for publishes signaled over a WebSocket on /ws/{streamKey}, for
+// clients that can't do the WHIP exchange. The session lasts as long as
+// the socket, and is recorded in the ?format like a WHIP publish.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	streamKey, ok := streamKeyFromPath(r.URL.Path, "/ws/")
+	if !ok {
+		http.Error(w, "Invalid stream key", http.StatusBadRequest)
+		return
+	}
+	if !requireStreamAuth(w, r, streamKey, rightPublish) {
+		return
+	}
+	if !acceptingSessions(w, http.Error) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = config.RecordingFormat
+	}
+	server := websocket.Server{
+		Handshake: checkWSOrigin,
+		Handler:   func(conn *websocket.Conn) { serveWS(conn, streamKey, format) },
+	}
+	server.ServeHTTP(w, r)
+}
+
+// checkWSOrigin lets browsers open a socket from the -cors-origins only;
+// other clients send no Origin
+func checkWSOrigin(_ *websocket.Config, r *http.Request) error {
+	if r.Header.Get("Origin") == "" || newCORS().OriginAllowed(r) {
+		return nil
+	}
+	return errors.New("origin not allowed")
+}
+
+// serveWS runs the signaling of one publisher over conn, recording in format
+func serveWS(conn *websocket.Conn, streamKey, format string) {
+	// Messages are bounded like the offers posted to WHIP
+	conn.MaxPayloadBytes = maxOfferSize
+	var offer wsMessage
+	conn.SetReadDeadline(time.Now().Add(wsOfferTimeout))
+	if err := websocket.JSON.Receive(conn, &offer); err != nil {
+		if errors.Is(err, websocket.ErrFrameTooLarge) {
+			websocket.JSON.Send(conn, wsMessage{Type: "close", Reason: "Offer too large"})
+			return
+		}
+		slog.Debug("No offer on the WebSocket", "stream", streamKey, "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if offer.Type != "offer" {
+		websocket.JSON.Send(conn, wsMessage{Type: "close", Reason: "Expected an offer"})
+		return
+	}
+	if err := checkOffer(offer.SDP); err != nil {
+		websocket.JSON.Send(conn, wsMessage{Type: "close", Reason: err.Error()})
+		return
+	}
+	sess, err := startPublish(streamKey, offer.SDP, format)
+	if err != nil {
+		websocket.JSON.Send(conn, wsMessage{Type: "close", Reason: err.Error()})
+		return
+	}
+
+	<-webrtc.GatheringCompletePromise(sess.peerConnection)
+	answer := wsMessage{Type: "answer", SDP: publishAnswer(sess), Session: sess.id}
+	if err := websocket.JSON.Send(conn, answer); err != nil {
+		sess.log.Warn("Failed to send the answer", "error", err)
+	}
+	sess.log.Info("WebSocket session established")
+
+	// A session ending on its own closes the socket, ending the loop below
+	go func() {
+		<-sess.done
+		websocket.JSON.Send(conn, wsMessage{Type: "close"})
+		conn.Close()
+	}()
+
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil || msg.Type == "close" {
+			break
+		}
+		switch msg.Type {
+		case "candidate":
+			if err := sess.peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: msg.Candidate}); err != nil {
+				sess.log.Warn("Failed to add ICE candidate", "candidate", msg.Candidate, "error", err)
+			}
+		default:
+			sess.log.Warn("Unknown WebSocket message", "type", msg.Type)
+		}
+	}
+
+	if sessions.remove(sess.id) == nil {
+		return
+	}
+	if err := sess.Close(); err != nil {
+		sess.log.Warn("Failed to close PeerConnection", "error", err)
+	}
+	sess.log.Info("WebSocket session terminated")
+}
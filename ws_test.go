@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/websocket"
+)
+
+// dialWS opens a signaling socket to the server at base, closed after the test
+func dialWS(t *testing.T, base, path string) *websocket.Conn {
+	t.Helper()
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(base, "http")+path, "", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	return conn
+}
+
+// TestWebSocketPublish publishes a session signaled entirely over a
+// WebSocket, trickling the client candidates, and checks it is recorded and
+// ends with the socket's close message
+func TestWebSocketPublish(t *testing.T) {
+	base := startServer(t)
+	conn := dialWS(t, base, "/ws/cam")
+	p := newCodecPublisher(t, webrtc.MimeTypeVP8)
+	p.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		msg := wsMessage{Type: "candidate"}
+		if candidate != nil {
+			msg.Candidate = candidate.ToJSON().Candidate
+		}
+		websocket.JSON.Send(conn, msg)
+	})
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.JSON.Send(conn, wsMessage{Type: "offer", SDP: offer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+
+	var answer wsMessage
+	if err := websocket.JSON.Receive(conn, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Type != "answer" || answer.Session == "" {
+		t.Fatalf("got %+v, want an answer with its session", answer)
+	}
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	s := sessions.get(answer.Session)
+	if s == nil || s.streamKey != "cam" {
+		t.Fatalf("session %s not registered for stream cam", answer.Session)
+	}
+	waitFor(t, "the publisher to connect", func() bool { return p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected })
+	p.play(t, 500*time.Millisecond)
+
+	if err := websocket.JSON.Send(conn, wsMessage{Type: "close"}); err != nil {
+		t.Fatal(err)
+	}
+	var closed wsMessage
+	if err := websocket.JSON.Receive(conn, &closed); err != nil || closed.Type != "close" {
+		t.Fatalf("got %+v, %v, want a close message", closed, err)
+	}
+	if sessions.get(answer.Session) != nil {
+		t.Error("session still registered after close")
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, "recording.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, blocks := readWebM(t, data); len(blocks) == 0 {
+		t.Error("no frames recorded")
+	}
+}
+
+// TestWebSocketRejected checks failures to start a session are reported
+// in a close message
+func TestWebSocketRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		msg        wsMessage
+		busy       bool
+		wantReason string
+	}{
+		{name: "not an offer", path: "/ws", msg: wsMessage{Type: "candidate"}, wantReason: "Expected an offer"},
+		{name: "empty offer", path: "/ws", msg: wsMessage{Type: "offer"}, wantReason: "Empty offer"},
+		{name: "no media", path: "/ws", msg: wsMessage{Type: "offer", SDP: "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"}, wantReason: "no media section"},
+		{name: "oversized offer", path: "/ws", msg: wsMessage{Type: "offer", SDP: "v=0\r\n" + strings.Repeat("a=x\r\n", maxOfferSize/5)}, wantReason: "Offer too large"},
+		{name: "stream key in use", path: "/ws/cam", msg: wsMessage{Type: "offer"}, busy: true, wantReason: "active publisher"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startServer(t)
+			if tt.busy {
+				publish(t, base+"/whip/cam", webrtc.MimeTypeVP8)
+				p := newCodecPublisher(t, webrtc.MimeTypeVP8)
+				offer, err := p.pc.CreateOffer(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.msg.SDP = offer.SDP
+			}
+			conn := dialWS(t, base, tt.path)
+			if err := websocket.JSON.Send(conn, tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			var reply wsMessage
+			if err := websocket.JSON.Receive(conn, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Type != "close" || !strings.Contains(reply.Reason, tt.wantReason) {
+				t.Errorf("got %+v, want a close message for %q", reply, tt.wantReason)
+			}
+		})
+	}
+}